@@ -16,14 +16,18 @@ func main() {
 	port := flag.Int("port", 8080, "Port to listen on")
 	listenAddr := flag.String("listenAddr", "0.0.0.0", "Address to listen on")
 	debug := flag.Bool("debug", false, "Whether to produce more debugging output")
+	bulkBatchSize := flag.Int("bulkBatchSize", 1000, "Number of bulk operations to write per transaction")
+	maxContentLength := flag.Int64("maxContentLength", 100<<20, "Largest request body accepted, in bytes")
 	flag.Parse()
 
 	s := &server.Server{
 		Cfg: server.Config{
-			DbLocation: *dbLoc,
-			ListenAddr: *listenAddr,
-			Port:       *port,
-			Debug:      *debug,
+			DbLocation:       *dbLoc,
+			ListenAddr:       *listenAddr,
+			Port:             *port,
+			Debug:            *debug,
+			BulkBatchSize:    *bulkBatchSize,
+			MaxContentLength: *maxContentLength,
 		},
 	}
 	s.Init()
@@ -10,13 +10,13 @@ require (
 	github.com/alecthomas/assert/v2 v2.1.0
 	github.com/alecthomas/participle/v2 v2.0.0-alpha9
 	github.com/alecthomas/repr v0.1.0
+	github.com/huandu/go-sqlbuilder v1.17.0
+	github.com/jmoiron/sqlx v1.3.5
 )
 
 require (
 	github.com/felixge/httpsnoop v1.0.1 // indirect
-	github.com/huandu/go-sqlbuilder v1.17.0 // indirect
 	github.com/huandu/xstrings v1.3.2 // indirect
-	github.com/jmoiron/sqlx v1.3.5 // indirect
 )
 
 require (
@@ -2,6 +2,7 @@ package date
 
 import (
 	"encoding/json"
+	"fmt"
 	"strconv"
 	"time"
 )
@@ -10,88 +11,54 @@ import (
 // https://www.elastic.co/guide/en/elasticsearch/reference/7.17/mapping-date-format.html
 // https://github.com/elastic/elasticsearch/tree/master/server/src/main/java/org/elasticsearch/common/time
 
-type DateLike interface {
-	int64 | float64 | string
-}
-
-func epochMillisString(val string) (*string, error) {
-	m, err := strconv.ParseInt(val, 10, 64)
-	if err != nil {
-		panic("couldn't parse field value " + string(val) + " to format epochMillis")
-	}
-	return epochMillisInt(m)
-}
+// Dates are stored in sqlite as RFC3339 strings in UTC; date fields keep all three
+// digits of milliseconds, and date_nanos fields all nine of the fraction, so that
+// their stored values also sort as strings
+const (
+	millisLayout = "2006-01-02T15:04:05.000Z07:00"
+	nanosLayout  = "2006-01-02T15:04:05.000000000Z07:00"
+)
 
-func epochMillisFloat(val float64) (*string, error) {
-	i := int64(val)
-	s := time.UnixMilli(i).UTC().Format(time.RFC3339)
-	return &s, nil
+// Wrapper function that will handle the type assertions on interface{}, since
+// we'll usually not know what we received, and convert a date in the given format
+// to its stored form. A null stays null
+func DateFormat(fmt string, v interface{}) (*string, error) {
+	return storeDate(fmt, v, false)
 }
 
-func epochMillisInt(val int64) (*string, error) {
-	s := time.UnixMilli(val).UTC().Format(time.RFC3339)
-	return &s, nil
+// As DateFormat, for a date_nanos field
+func DateNanosFormat(fmt string, v interface{}) (*string, error) {
+	return storeDate(fmt, v, true)
 }
 
-func epochSecondString(val string) (*string, error) {
-	m, err := strconv.ParseInt(val, 10, 64)
-	if err != nil {
-		panic("couldn't parse field value " + val + " to format epochSecond")
+// The stored form of a date
+func StoredDate(t time.Time, nanos bool) string {
+	if nanos {
+		return t.UTC().Format(nanosLayout)
 	}
-	return epochSecondInt(m)
-}
-func epochSecondInt(val int64) (*string, error) {
-	s := time.Unix(val, 0).UTC().Format(time.RFC3339)
-	return &s, nil
+	return t.UTC().Format(millisLayout)
 }
 
-// Wrapper function to DateFormatGen that will handle the type assertions on interface{}
-// since we'll usually not know what we received; generics haven't been as helpful
-// as expected for this purpose, so this will basically be a series of switch statements
-func DateFormat(fmt string, v interface{}) (*string, error) {
+func storeDate(format string, v interface{}, nanos bool) (*string, error) {
+	var s string
 	switch d := v.(type) {
+	case nil:
+		return nil, nil
 	case int64:
-		return dateFormatInt(fmt, d)
+		s = strconv.FormatInt(d, 10)
 	case float64:
-		return dateFormatFloat(fmt, d)
-	case string:
-		return dateFormatString(fmt, d)
+		s = strconv.FormatFloat(d, 'f', -1, 64)
 	case json.Number:
-		i, err := d.Int64()
-		if err != nil {
-			return nil, err
-		}
-		return dateFormatInt(fmt, i)
+		s = d.String()
+	case string:
+		s = d
 	default:
-		return nil, nil
-	}
-
-}
-
-func dateFormatInt(fmt string, v int64) (*string, error) {
-	switch fmt {
-	case "epoch_millis":
-		return epochMillisInt(v)
-	case "epoch_second":
-		return epochSecondInt(v)
+		return nil, fmt.Errorf("failed to parse date field [%v], a date must be a string or a number", v)
 	}
-	return nil, nil
-}
-
-func dateFormatFloat(fmt string, v float64) (*string, error) {
-	switch fmt {
-	case "epoch_millis":
-		return epochMillisFloat(v)
-	}
-	return nil, nil
-}
-
-func dateFormatString(fmt string, v string) (*string, error) {
-	switch fmt {
-	case "epoch_millis":
-		return epochMillisString(v)
-	case "epoch_second":
-		return epochSecondString(v)
+	t, err := Parse(format, s, time.UTC, false)
+	if err != nil {
+		return nil, err
 	}
-	return nil, nil
+	stored := StoredDate(t, nanos)
+	return &stored, nil
 }
@@ -8,7 +8,7 @@ import (
 
 func TestEpochMillisDirect(t *testing.T) {
 	i := 1668173489840
-	targ := "2022-11-11T13:31:29Z"
+	targ := "2022-11-11T13:31:29.840Z"
 	d1, _ := DateFormat("epoch_millis", int64(i))
 	require.Equal(t, *d1, targ)
 
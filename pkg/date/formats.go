@@ -0,0 +1,648 @@
+package date
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/atomic77/gopensearch/pkg/lru"
+)
+
+// The built-in formats of ES, as the java.time patterns they are equivalent to.
+// Each also has a strict_ variant; without it, numeric fields may have fewer
+// digits than the pattern does, eg. 2022-1-5 for date
+// https://www.elastic.co/guide/en/elasticsearch/reference/7.17/mapping-date-format.html#built-in-date-formats
+var namedFormats = map[string]string{
+	"basic_date":                        "yyyyMMdd",
+	"basic_date_time":                   "yyyyMMdd'T'HHmmss.SSSXX",
+	"basic_date_time_no_millis":         "yyyyMMdd'T'HHmmssXX",
+	"basic_ordinal_date":                "yyyyDDD",
+	"basic_ordinal_date_time":           "yyyyDDD'T'HHmmss.SSSXX",
+	"basic_ordinal_date_time_no_millis": "yyyyDDD'T'HHmmssXX",
+	"basic_time":                        "HHmmss.SSSXX",
+	"basic_time_no_millis":              "HHmmssXX",
+	"basic_t_time":                      "'T'HHmmss.SSSXX",
+	"basic_t_time_no_millis":            "'T'HHmmssXX",
+	"basic_week_date":                   "YYYY'W'wwe",
+	"basic_week_date_time":              "YYYY'W'wwe'T'HHmmss.SSSXX",
+	"basic_week_date_time_no_millis":    "YYYY'W'wwe'T'HHmmssXX",
+	"date":                              "yyyy-MM-dd",
+	"date_hour":                         "yyyy-MM-dd'T'HH",
+	"date_hour_minute":                  "yyyy-MM-dd'T'HH:mm",
+	"date_hour_minute_second":           "yyyy-MM-dd'T'HH:mm:ss",
+	"date_hour_minute_second_fraction":  "yyyy-MM-dd'T'HH:mm:ss.SSS",
+	"date_hour_minute_second_millis":    "yyyy-MM-dd'T'HH:mm:ss.SSS",
+	"date_time":                         "yyyy-MM-dd'T'HH:mm:ss.SSSXXX",
+	"date_time_no_millis":               "yyyy-MM-dd'T'HH:mm:ssXXX",
+	"hour":                              "HH",
+	"hour_minute":                       "HH:mm",
+	"hour_minute_second":                "HH:mm:ss",
+	"hour_minute_second_fraction":       "HH:mm:ss.SSS",
+	"hour_minute_second_millis":         "HH:mm:ss.SSS",
+	"ordinal_date":                      "yyyy-DDD",
+	"ordinal_date_time":                 "yyyy-DDD'T'HH:mm:ss.SSSXXX",
+	"ordinal_date_time_no_millis":       "yyyy-DDD'T'HH:mm:ssXXX",
+	"time":                              "HH:mm:ss.SSSXXX",
+	"time_no_millis":                    "HH:mm:ssXXX",
+	"t_time":                            "'T'HH:mm:ss.SSSXXX",
+	"t_time_no_millis":                  "'T'HH:mm:ssXXX",
+	"week_date":                         "YYYY-'W'ww-e",
+	"week_date_time":                    "YYYY-'W'ww-e'T'HH:mm:ss.SSSXXX",
+	"week_date_time_no_millis":          "YYYY-'W'ww-e'T'HH:mm:ssXXX",
+	"weekyear":                          "YYYY",
+	"weekyear_week":                     "YYYY-'W'ww",
+	"weekyear_week_day":                 "YYYY-'W'ww-e",
+	"year":                              "yyyy",
+	"year_month":                        "yyyy-MM",
+	"year_month_day":                    "yyyy-MM-dd",
+}
+
+// How the ISO formats, which parse any precision, are printed
+const (
+	isoPrintPattern      = "yyyy-MM-dd'T'HH:mm:ss.SSSXXX"
+	isoNanosPrintPattern = "yyyy-MM-dd'T'HH:mm:ss.SSSSSSSSSXXX"
+)
+
+func isISOFormat(format string) bool {
+	switch format {
+	case "strict_date_optional_time", "date_optional_time", "strict_date_optional_time_nanos", "iso8601":
+		return true
+	}
+	return false
+}
+
+// A compiled date pattern
+type pattern struct {
+	tokens []token
+	// Built-in formats without the strict_ prefix accept fewer digits
+	lenient bool
+	// Built-in formats take a fraction of any length, custom patterns exactly the
+	// number of S's they have
+	named bool
+}
+
+// A run of one pattern letter, eg. yyyy, a literal, or an optional [section]
+type token struct {
+	letter   byte
+	count    int
+	literal  string
+	optional []token
+}
+
+// Patterns are cached by format, up to a limit, as formats are given by requests
+const maxCachedPatterns = 256
+
+var patterns = lru.New[string, *pattern](maxCachedPatterns)
+
+// The pattern for a built-in format name or a java.time style pattern such as
+// yyyy-MM-dd HH:mm:ss
+func lookupPattern(format string) (*pattern, error) {
+	return patterns.Get(format, func() (*pattern, error) {
+		return compileFormat(format)
+	})
+}
+
+func compileFormat(format string) (*pattern, error) {
+	p := &pattern{}
+	src := format
+	if named, ok := namedFormats[format]; ok {
+		src, p.lenient, p.named = named, true, true
+	} else if named, ok := namedFormats[strings.TrimPrefix(format, "strict_")]; ok {
+		src, p.named = named, true
+	}
+	tokens, rest, err := compilePattern(src, false)
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("unmatched ] in pattern [%s]", format)
+	}
+	p.tokens = tokens
+	return p, nil
+}
+
+// Compile a pattern up to its end, or the ] that closes an optional section,
+// returning what follows
+func compilePattern(s string, optional bool) ([]token, string, error) {
+	tokens := []token{}
+	for len(s) > 0 {
+		c := s[0]
+		switch {
+		case isLetter(c):
+			n := 1
+			for n < len(s) && s[n] == c {
+				n++
+			}
+			if !strings.ContainsRune("yuYMLdDHkhKmsSaEecwXxZzV", rune(c)) {
+				return nil, "", fmt.Errorf("unsupported pattern letter [%c]", c)
+			}
+			tokens = append(tokens, token{letter: c, count: n})
+			s = s[n:]
+		case c == '\'':
+			end := strings.IndexByte(s[1:], '\'')
+			if end < 0 {
+				return nil, "", fmt.Errorf("unterminated quote in pattern")
+			}
+			lit := s[1 : end+1]
+			if lit == "" {
+				lit = "'"
+			}
+			tokens = append(tokens, token{literal: lit})
+			s = s[end+2:]
+		case c == '[':
+			sub, rest, err := compilePattern(s[1:], true)
+			if err != nil {
+				return nil, "", err
+			}
+			tokens = append(tokens, token{letter: '[', optional: sub})
+			s = rest
+		case c == ']':
+			if !optional {
+				return nil, s, nil
+			}
+			return tokens, s[1:], nil
+		default:
+			tokens = append(tokens, token{literal: s[:1]})
+			s = s[1:]
+		}
+	}
+	if optional {
+		return nil, "", fmt.Errorf("unterminated [ in pattern")
+	}
+	return tokens, "", nil
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isNumericToken(t token) bool {
+	switch t.letter {
+	case 'y', 'u', 'Y', 'd', 'D', 'H', 'k', 'h', 'K', 'm', 's', 'S', 'w', 'e', 'c':
+		return true
+	case 'M', 'L':
+		return t.count <= 2
+	}
+	return false
+}
+
+// The fields of a date as they are parsed
+type parsed struct {
+	year, month, day, yearDay   int
+	hour, minute, second, nanos int
+	weekYear, week, weekday     int
+	pm                          bool
+	loc                         *time.Location
+	has                         map[byte]bool
+}
+
+func (p *pattern) parse(value string, loc *time.Location, roundUp bool) (time.Time, bool) {
+	f := &parsed{year: 1970, month: 1, day: 1, has: map[byte]bool{}}
+	pos, ok := p.parseTokens(p.tokens, value, 0, f)
+	if !ok || pos != len(value) {
+		return time.Time{}, false
+	}
+	return f.time(loc, roundUp)
+}
+
+func (p *pattern) parseTokens(tokens []token, s string, pos int, f *parsed) (int, bool) {
+	for i, t := range tokens {
+		if t.letter == 0 {
+			if !strings.HasPrefix(s[pos:], t.literal) {
+				return pos, false
+			}
+			pos += len(t.literal)
+			continue
+		}
+		if t.letter == '[' {
+			// An optional section either parses completely or is skipped
+			saved := *f
+			saved.has = make(map[byte]bool, len(f.has))
+			for k, v := range f.has {
+				saved.has[k] = v
+			}
+			if next, ok := p.parseTokens(t.optional, s, pos, f); ok {
+				pos = next
+			} else {
+				*f = saved
+			}
+			continue
+		}
+		adjacent := i+1 < len(tokens) && isNumericToken(tokens[i+1])
+		next, ok := p.parseField(t, s, pos, adjacent, f)
+		if !ok {
+			return pos, false
+		}
+		pos = next
+		f.has[t.letter] = true
+	}
+	return pos, true
+}
+
+// The range of digits a numeric field may have
+func (p *pattern) width(t token, adjacent bool) (int, int) {
+	switch t.letter {
+	case 'y', 'u', 'Y':
+		if t.count == 2 {
+			return 2, 2
+		}
+		least := t.count
+		if p.lenient {
+			least = 1
+		}
+		if adjacent {
+			return least, 4
+		}
+		return least, 9
+	case 'S':
+		if p.named {
+			return 1, 9
+		}
+		return t.count, t.count
+	}
+	most := t.count
+	if t.count == 1 {
+		most = 2
+		if t.letter == 'D' {
+			most = 3
+		}
+	}
+	if p.lenient || t.count == 1 {
+		return 1, most
+	}
+	return t.count, most
+}
+
+func (p *pattern) parseField(t token, s string, pos int, adjacent bool, f *parsed) (int, bool) {
+	rest := s[pos:]
+	switch t.letter {
+	case 'M', 'L':
+		if t.count >= 3 {
+			for m := time.January; m <= time.December; m++ {
+				if n := matchName(rest, m.String(), t.count); n > 0 {
+					f.month = int(m)
+					return pos + n, true
+				}
+			}
+			return pos, false
+		}
+	case 'E':
+		for d := time.Sunday; d <= time.Saturday; d++ {
+			if n := matchName(rest, d.String(), t.count); n > 0 {
+				f.weekday = isoWeekday(d)
+				return pos + n, true
+			}
+		}
+		return pos, false
+	case 'a':
+		switch {
+		case len(rest) >= 2 && strings.EqualFold(rest[:2], "AM"):
+			f.pm = false
+		case len(rest) >= 2 && strings.EqualFold(rest[:2], "PM"):
+			f.pm = true
+		default:
+			return pos, false
+		}
+		return pos + 2, true
+	case 'X', 'x', 'Z':
+		loc, n, ok := parseOffset(rest, t.letter != 'x')
+		if !ok {
+			return pos, false
+		}
+		f.loc = loc
+		return pos + n, true
+	case 'z', 'V':
+		n := 0
+		for n < len(rest) && (isLetter(rest[n]) || strings.IndexByte("/_+-:0123456789", rest[n]) >= 0) {
+			n++
+		}
+		loc, err := ParseTimeZone(rest[:n])
+		if n == 0 || err != nil {
+			if n >= 3 && (rest[:3] == "GMT" || rest[:3] == "UTC") {
+				if loc, err = ParseTimeZone(rest[3:n]); err == nil {
+					f.loc = loc
+					return pos + n, true
+				}
+			}
+			return pos, false
+		}
+		f.loc = loc
+		return pos + n, true
+	}
+
+	least, most := p.width(t, adjacent)
+	n := 0
+	for n < len(rest) && n < most && rest[n] >= '0' && rest[n] <= '9' {
+		n++
+	}
+	if n < least {
+		return pos, false
+	}
+	v, _ := strconv.Atoi(rest[:n])
+	switch t.letter {
+	case 'y', 'u':
+		if t.count == 2 {
+			v += 2000
+		}
+		f.year = v
+	case 'Y':
+		if t.count == 2 {
+			v += 2000
+		}
+		f.weekYear = v
+	case 'M', 'L':
+		f.month = v
+	case 'd':
+		f.day = v
+	case 'D':
+		f.yearDay = v
+	case 'H', 'k', 'h', 'K':
+		if t.letter == 'k' && v == 24 {
+			v = 0
+		}
+		if t.letter == 'h' && v == 12 {
+			v = 0
+		}
+		f.hour = v
+	case 'm':
+		f.minute = v
+	case 's':
+		f.second = v
+	case 'S':
+		f.nanos = v
+		for i := n; i < 9; i++ {
+			f.nanos *= 10
+		}
+	case 'w':
+		f.week = v
+	case 'e', 'c':
+		f.weekday = v
+	}
+	return pos + n, true
+}
+
+// Match a month or day name, in full for 4 or more pattern letters and by its
+// first three letters otherwise
+func matchName(s, name string, count int) int {
+	if count < 4 {
+		name = name[:3]
+	}
+	if len(s) >= len(name) && strings.EqualFold(s[:len(name)], name) {
+		return len(name)
+	}
+	return 0
+}
+
+// Monday is 1 and Sunday 7, as in ISO week dates
+func isoWeekday(d time.Weekday) int {
+	if d == time.Sunday {
+		return 7
+	}
+	return int(d)
+}
+
+// An offset as +01, +0100 or +01:00, or Z for UTC
+func parseOffset(s string, allowZ bool) (*time.Location, int, bool) {
+	if allowZ && strings.HasPrefix(s, "Z") {
+		return time.UTC, 1, true
+	}
+	if len(s) < 3 || (s[0] != '+' && s[0] != '-') {
+		return nil, 0, false
+	}
+	hours, err := strconv.Atoi(s[1:3])
+	if err != nil || hours > 18 {
+		return nil, 0, false
+	}
+	n, minutes := 3, 0
+	digits := s[3:]
+	if strings.HasPrefix(digits, ":") {
+		digits = digits[1:]
+		n++
+	}
+	if len(digits) >= 2 {
+		if m, err := strconv.Atoi(digits[:2]); err == nil && digits[0] != '+' && digits[0] != '-' {
+			minutes = m
+			n += 2
+		}
+	}
+	if n == 4 || minutes > 59 {
+		// A colon must be followed by minutes
+		return nil, 0, false
+	}
+	offset := hours*3600 + minutes*60
+	if s[0] == '-' {
+		offset = -offset
+	}
+	return time.FixedZone("", offset), n, true
+}
+
+// Resolve the parsed fields to a time, defaulting anything missing to the start of
+// 1970. Rounding up gives the last millisecond of the smallest field parsed
+func (f *parsed) time(loc *time.Location, roundUp bool) (time.Time, bool) {
+	if f.loc != nil {
+		loc = f.loc
+	}
+	if f.has['a'] {
+		if f.hour > 11 {
+			return time.Time{}, false
+		}
+		if f.pm {
+			f.hour += 12
+		}
+	}
+	if f.month < 1 || f.month > 12 || f.day < 1 || f.day > 31 || f.hour > 23 || f.minute > 59 || f.second > 59 {
+		return time.Time{}, false
+	}
+
+	var t time.Time
+	switch {
+	case f.has['Y'] || f.has['w']:
+		year := f.year
+		if f.has['Y'] {
+			year = f.weekYear
+		}
+		week, weekday := f.week, f.weekday
+		if !f.has['w'] {
+			week = 1
+		}
+		if !f.has['e'] && !f.has['c'] && !f.has['E'] {
+			weekday = 1
+		}
+		if week < 1 || week > 53 || weekday < 1 || weekday > 7 {
+			return time.Time{}, false
+		}
+		// Week 1 is the week with the year's first Thursday, and so always has the 4th
+		jan4 := time.Date(year, time.January, 4, f.hour, f.minute, f.second, f.nanos, loc)
+		monday := jan4.AddDate(0, 0, 1-isoWeekday(jan4.Weekday()))
+		t = monday.AddDate(0, 0, (week-1)*7+weekday-1)
+		if _, w := t.ISOWeek(); w != week {
+			return time.Time{}, false
+		}
+	case f.has['D']:
+		t = time.Date(f.year, time.January, f.yearDay, f.hour, f.minute, f.second, f.nanos, loc)
+		if f.yearDay < 1 || t.Year() != f.year {
+			return time.Time{}, false
+		}
+	default:
+		t = time.Date(f.year, time.Month(f.month), f.day, f.hour, f.minute, f.second, f.nanos, loc)
+		if t.Day() != f.day {
+			// eg. Feb 30th
+			return time.Time{}, false
+		}
+	}
+
+	if roundUp && !f.has['S'] {
+		switch {
+		case f.has['s']:
+			t = t.Add(time.Second)
+		case f.has['m']:
+			t = t.Add(time.Minute)
+		case f.has['H'] || f.has['k'] || f.has['h'] || f.has['K']:
+			t = t.Add(time.Hour)
+		case f.has['d'] || f.has['D'] || f.has['e'] || f.has['c'] || f.has['E']:
+			t = t.AddDate(0, 0, 1)
+		case f.has['w']:
+			t = t.AddDate(0, 0, 7)
+		case f.has['M'] || f.has['L']:
+			t = t.AddDate(0, 1, 0)
+		case f.has['y'] || f.has['u']:
+			t = t.AddDate(1, 0, 0)
+		case f.has['Y']:
+			_, weeks := time.Date(f.weekYear, time.December, 28, 0, 0, 0, 0, loc).ISOWeek()
+			t = t.AddDate(0, 0, weeks*7)
+		default:
+			return t, true
+		}
+		t = t.Add(-time.Millisecond)
+	}
+	return t, true
+}
+
+// Print a time with a pattern; optional sections are always printed
+func (p *pattern) format(t time.Time) string {
+	var sb strings.Builder
+	formatTokens(&sb, p.tokens, t)
+	return sb.String()
+}
+
+func formatTokens(sb *strings.Builder, tokens []token, t time.Time) {
+	pad := func(v, n int) {
+		s := strconv.Itoa(v)
+		for i := len(s); i < n; i++ {
+			sb.WriteByte('0')
+		}
+		sb.WriteString(s)
+	}
+	for _, tok := range tokens {
+		switch tok.letter {
+		case 0:
+			sb.WriteString(tok.literal)
+		case '[':
+			formatTokens(sb, tok.optional, t)
+		case 'y', 'u':
+			if tok.count == 2 {
+				pad(t.Year()%100, 2)
+			} else {
+				pad(t.Year(), tok.count)
+			}
+		case 'Y':
+			year, _ := t.ISOWeek()
+			if tok.count == 2 {
+				year %= 100
+			}
+			pad(year, tok.count)
+		case 'M', 'L':
+			switch {
+			case tok.count >= 4:
+				sb.WriteString(t.Month().String())
+			case tok.count == 3:
+				sb.WriteString(t.Month().String()[:3])
+			default:
+				pad(int(t.Month()), tok.count)
+			}
+		case 'd':
+			pad(t.Day(), tok.count)
+		case 'D':
+			pad(t.YearDay(), tok.count)
+		case 'H':
+			pad(t.Hour(), tok.count)
+		case 'k':
+			h := t.Hour()
+			if h == 0 {
+				h = 24
+			}
+			pad(h, tok.count)
+		case 'h':
+			h := t.Hour() % 12
+			if h == 0 {
+				h = 12
+			}
+			pad(h, tok.count)
+		case 'K':
+			pad(t.Hour()%12, tok.count)
+		case 'm':
+			pad(t.Minute(), tok.count)
+		case 's':
+			pad(t.Second(), tok.count)
+		case 'S':
+			frac := fmt.Sprintf("%09d", t.Nanosecond())
+			for len(frac) < tok.count {
+				frac += "0"
+			}
+			sb.WriteString(frac[:tok.count])
+		case 'a':
+			if t.Hour() < 12 {
+				sb.WriteString("AM")
+			} else {
+				sb.WriteString("PM")
+			}
+		case 'E':
+			name := t.Weekday().String()
+			if tok.count < 4 {
+				name = name[:3]
+			}
+			sb.WriteString(name)
+		case 'e', 'c':
+			pad(isoWeekday(t.Weekday()), tok.count)
+		case 'w':
+			_, week := t.ISOWeek()
+			pad(week, tok.count)
+		case 'X', 'x', 'Z':
+			sb.WriteString(formatOffset(t, tok))
+		case 'z':
+			sb.WriteString(t.Format("MST"))
+		case 'V':
+			sb.WriteString(t.Location().String())
+		}
+	}
+}
+
+// Offsets print as java.time does: X as Z for UTC and otherwise +01, +0100 or
+// +01:00 for one, two or three letters, x the same without the Z, and Z as +0100,
+// or +01:00 for five letters
+func formatOffset(t time.Time, tok token) string {
+	_, offset := t.Zone()
+	if offset == 0 && (tok.letter == 'X' || (tok.letter == 'Z' && tok.count == 5)) {
+		return "Z"
+	}
+	sign := '+'
+	if offset < 0 {
+		sign, offset = '-', -offset
+	}
+	hours, minutes := offset/3600, offset%3600/60
+	count := tok.count
+	if tok.letter == 'Z' {
+		count = 2
+		if tok.count == 5 {
+			count = 3
+		}
+	}
+	switch {
+	case count == 1 && minutes == 0:
+		return fmt.Sprintf("%c%02d", sign, hours)
+	case count <= 2:
+		return fmt.Sprintf("%c%02d%02d", sign, hours, minutes)
+	}
+	return fmt.Sprintf("%c%02d:%02d", sign, hours, minutes)
+}
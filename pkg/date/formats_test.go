@@ -0,0 +1,161 @@
+package date
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	require "github.com/alecthomas/assert/v2"
+)
+
+func TestNamedFormats(t *testing.T) {
+	tests := []struct {
+		format  string
+		value   string
+		roundUp bool
+		want    string
+	}{
+		{"basic_date", "20221111", false, "2022-11-11T00:00:00Z"},
+		{"basic_date_time", "20221111T133129.840+0100", false, "2022-11-11T12:31:29.84Z"},
+		{"basic_ordinal_date", "2022315", false, "2022-11-11T00:00:00Z"},
+		{"basic_week_date", "2022W455", false, "2022-11-11T00:00:00Z"},
+		{"date", "2022-1-5", false, "2022-01-05T00:00:00Z"},
+		{"date_time", "2022-11-11T13:31:29.840123Z", false, "2022-11-11T13:31:29.840123Z"},
+		{"date_time_no_millis", "2022-11-11T13:31:29-05:00", false, "2022-11-11T18:31:29Z"},
+		{"date_hour_minute", "2022-11-11T13:31", true, "2022-11-11T13:31:59.999Z"},
+		{"hour_minute", "13:31", false, "1970-01-01T13:31:00Z"},
+		{"ordinal_date", "2020-366", false, "2020-12-31T00:00:00Z"},
+		{"t_time", "T13:31:29.840Z", false, "1970-01-01T13:31:29.84Z"},
+		{"week_date", "2021-W52-7", false, "2022-01-02T00:00:00Z"},
+		{"weekyear_week", "2022-W01", true, "2022-01-09T23:59:59.999Z"},
+		{"year_month", "2022-11", true, "2022-11-30T23:59:59.999Z"},
+		{"strict_year_month_day", "2022-11-11", false, "2022-11-11T00:00:00Z"},
+		{"strict_date_optional_time_nanos", "2022-11-11T13:31:29.840123456Z", false, "2022-11-11T13:31:29.840123456Z"},
+	}
+	for _, test := range tests {
+		got, err := Parse(test.format, test.value, nil, test.roundUp)
+		require.NoError(t, err, test.format)
+		require.Equal(t, got.UTC().Format(time.RFC3339Nano), test.want, test.format)
+	}
+
+	for _, bad := range []struct{ format, value string }{
+		{"strict_date", "2022-1-5"},
+		{"date", "2022-02-30"},
+		{"ordinal_date", "2022-366"},
+		{"week_date", "2022-W53-1"},
+		{"date_time", "2022-11-11T13:31:29.840"},
+		{"basic_date", "2022-11-11"},
+	} {
+		_, err := Parse(bad.format, bad.value, nil, false)
+		require.Error(t, err, bad.format+" "+bad.value)
+	}
+}
+
+func TestPatterns(t *testing.T) {
+	paris := time.FixedZone("", 3600)
+	tests := []struct {
+		format string
+		value  string
+		want   string
+	}{
+		{"yyyy-MM-dd HH:mm:ss", "2022-11-11 13:31:29", "2022-11-11T12:31:29Z"},
+		{"yyyy/MM/dd||epoch_millis", "1668173489840", "2022-11-11T13:31:29.84Z"},
+		{"dd/MMM/yyyy:HH:mm:ss Z", "11/Nov/2022:13:31:29 -0500", "2022-11-11T18:31:29Z"},
+		{"EEE, d MMMM yy h:mm a", "Fri, 11 November 22 1:31 PM", "2022-11-11T12:31:00Z"},
+		{"yyyy-MM-dd'T'HH:mm:ss.SSSXXX", "2022-11-11T13:31:29.840Z", "2022-11-11T13:31:29.84Z"},
+		{"yyyy-MM-dd[ HH:mm]", "2022-11-11", "2022-11-10T23:00:00Z"},
+		{"yyyy-MM-dd[ HH:mm]", "2022-11-11 13:31", "2022-11-11T12:31:00Z"},
+		{"yyyyMMddHHmmss", "20221111133129", "2022-11-11T12:31:29Z"},
+		{"yyyy-MM-dd HH:mm:ss z", "2022-11-11 13:31:29 UTC", "2022-11-11T13:31:29Z"},
+	}
+	for _, test := range tests {
+		got, err := Parse(test.format, test.value, paris, false)
+		require.NoError(t, err, test.format)
+		require.Equal(t, got.UTC().Format(time.RFC3339Nano), test.want, test.format)
+	}
+
+	_, err := Parse("yyyy-MM-dd", "11/11/2022", nil, false)
+	require.Error(t, err)
+	_, err = Parse("yyyy-MM-dd HH:mm:ss.SSS", "2022-11-11 13:31:29.84", nil, false)
+	require.Error(t, err)
+	_, err = Parse("yyyy-MM-dd qq", "2022-11-11", nil, false)
+	require.Error(t, err)
+	_, err = Parse("yyyy-MM-dd[", "2022-11-11", nil, false)
+	require.Error(t, err)
+}
+
+func TestPatternCacheBound(t *testing.T) {
+	for i := 0; i < 2*maxCachedPatterns; i++ {
+		_, err := Parse(fmt.Sprintf("yyyy-MM-dd'#%d'", i), fmt.Sprintf("2022-11-11#%d", i), nil, false)
+		require.NoError(t, err)
+	}
+	require.Equal(t, patterns.Len(), maxCachedPatterns)
+}
+
+func TestFormat(t *testing.T) {
+	ts := time.Date(2022, 11, 11, 13, 31, 29, 840123456, time.UTC)
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{"", "2022-11-11T13:31:29.840Z"},
+		{"strict_date_optional_time_nanos", "2022-11-11T13:31:29.840123456Z"},
+		{"epoch_second||strict_date_optional_time", "1668173489.840123456"},
+		{"basic_date_time", "20221111T133129.840Z"},
+		{"week_date", "2022-W45-5"},
+		{"ordinal_date_time_no_millis", "2022-315T13:31:29Z"},
+		{"yyyy-MM-dd HH:mm:ss", "2022-11-11 13:31:29"},
+		{"dd/MMM/yyyy:hh:mm:ss a Z", "11/Nov/2022:01:31:29 PM +0000"},
+		{"EEEE d MMMM yy", "Friday 11 November 22"},
+	}
+	for _, test := range tests {
+		got, err := Format(test.format, ts)
+		require.NoError(t, err, test.format)
+		require.Equal(t, fmt.Sprint(got), test.want, test.format)
+	}
+
+	got, err := Format("epoch_millis", ts.Truncate(time.Millisecond))
+	require.NoError(t, err)
+	require.Equal(t, got, interface{}(int64(1668173489840)))
+	got, err = Format("epoch_millis", time.UnixMilli(-1).Add(-500*time.Microsecond))
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprint(got), "-1.5")
+
+	// Everything that prints can be parsed back
+	for name := range namedFormats {
+		for _, format := range []string{name, "strict_" + name} {
+			s, err := Format(format, ts)
+			require.NoError(t, err, format)
+			_, err = Parse(format, s.(string), nil, false)
+			require.NoError(t, err, format+" "+s.(string))
+		}
+	}
+}
+
+func TestStoredDates(t *testing.T) {
+	s, err := DateNanosFormat("strict_date_optional_time_nanos", "2022-11-11T13:31:29.84+01:00")
+	require.NoError(t, err)
+	require.Equal(t, *s, "2022-11-11T12:31:29.840000000Z")
+	s, err = DateFormat("", "2022-11-11T13:31:29.840123Z")
+	require.NoError(t, err)
+	require.Equal(t, *s, "2022-11-11T13:31:29.840Z")
+	s, err = DateFormat("yyyy", float64(2022))
+	require.NoError(t, err)
+	require.Equal(t, *s, "2022-01-01T00:00:00.000Z")
+	s, err = DateFormat("", nil)
+	require.NoError(t, err)
+	require.Equal(t, s, nil)
+
+	_, err = DateFormat("epoch_millis", "yesterday")
+	require.Error(t, err)
+	_, err = DateFormat("epoch_second", "")
+	require.Error(t, err)
+	_, err = DateFormat("", true)
+	require.Error(t, err)
+
+	v, err := AsDateFormat("date_hour_minute||epoch_millis", "2022-11-11T12:31:29.840000000Z")
+	require.NoError(t, err)
+	require.Equal(t, v, interface{}("2022-11-11T12:31"))
+	_, err = AsDateFormat("epoch_millis", "not a date")
+	require.Error(t, err)
+}
@@ -0,0 +1,135 @@
+package date
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Resolve a date math expression, either relative to now, eg. `now-1d/d`, or to a
+// date, eg. `2022-11-11||+1M/d`. Math and rounding happen in loc, and rounding up
+// (for gt and lte bounds) goes to the last millisecond of the unit rather than
+// the first, as ES does
+// https://www.elastic.co/guide/en/elasticsearch/reference/7.17/common-options.html#date-math
+func ParseMath(expr, format string, loc *time.Location, roundUp bool, now time.Time) (time.Time, error) {
+	if loc == nil {
+		loc = time.UTC
+	}
+	var (
+		t    time.Time
+		math string
+	)
+	if strings.HasPrefix(expr, "now") {
+		t, math = now, expr[len("now"):]
+	} else if i := strings.Index(expr, "||"); i >= 0 {
+		anchor, err := Parse(format, expr[:i], loc, false)
+		if err != nil {
+			return time.Time{}, err
+		}
+		t, math = anchor, expr[i+2:]
+	} else {
+		return Parse(format, expr, loc, roundUp)
+	}
+	t = t.In(loc)
+
+	for len(math) > 0 {
+		op := math[0]
+		math = math[1:]
+		n := 1
+		if op != '/' {
+			if op != '+' && op != '-' {
+				return time.Time{}, fmt.Errorf("operator not supported for date math [%s]", expr)
+			}
+			end := 0
+			for end < len(math) && math[end] >= '0' && math[end] <= '9' {
+				end++
+			}
+			if end > 0 {
+				n, _ = strconv.Atoi(math[:end])
+			}
+			math = math[end:]
+			if op == '-' {
+				n = -n
+			}
+		}
+		if len(math) == 0 {
+			return time.Time{}, fmt.Errorf("truncated date math [%s]", expr)
+		}
+		unit := math[0]
+		math = math[1:]
+		var err error
+		if op == '/' {
+			t, err = round(t, unit, roundUp)
+		} else {
+			t, err = add(t, unit, n)
+		}
+		if err != nil {
+			return time.Time{}, fmt.Errorf("%s in date math [%s]", err, expr)
+		}
+	}
+	return t, nil
+}
+
+func add(t time.Time, unit byte, n int) (time.Time, error) {
+	switch unit {
+	case 'y':
+		return addMonths(t, 12*n), nil
+	case 'M':
+		return addMonths(t, n), nil
+	case 'w':
+		return t.AddDate(0, 0, 7*n), nil
+	case 'd':
+		return t.AddDate(0, 0, n), nil
+	case 'h', 'H':
+		return t.Add(time.Duration(n) * time.Hour), nil
+	case 'm':
+		return t.Add(time.Duration(n) * time.Minute), nil
+	case 's':
+		return t.Add(time.Duration(n) * time.Second), nil
+	}
+	return time.Time{}, fmt.Errorf("unit [%c] not supported", unit)
+}
+
+// Unlike time.AddDate, months that are too short clamp to their last day rather
+// than overflowing into the next, eg. 2022-01-31 + 1M is 2022-02-28
+func addMonths(t time.Time, n int) time.Time {
+	y, mo, d := t.Date()
+	first := time.Date(y, mo+time.Month(n), 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	if last := first.AddDate(0, 1, -1).Day(); d > last {
+		d = last
+	}
+	return first.AddDate(0, 0, d-1)
+}
+
+// Round down to the start of a unit in the time's location, or up to the last
+// millisecond of it. Weeks start on a Monday
+func round(t time.Time, unit byte, roundUp bool) (time.Time, error) {
+	y, mo, d := t.Date()
+	loc := t.Location()
+	var start time.Time
+	switch unit {
+	case 'y':
+		start = time.Date(y, time.January, 1, 0, 0, 0, 0, loc)
+	case 'M':
+		start = time.Date(y, mo, 1, 0, 0, 0, 0, loc)
+	case 'w':
+		offset := (int(t.Weekday()) + 6) % 7
+		start = time.Date(y, mo, d-offset, 0, 0, 0, 0, loc)
+	case 'd':
+		start = time.Date(y, mo, d, 0, 0, 0, 0, loc)
+	case 'h', 'H':
+		start = time.Date(y, mo, d, t.Hour(), 0, 0, 0, loc)
+	case 'm':
+		start = time.Date(y, mo, d, t.Hour(), t.Minute(), 0, 0, loc)
+	case 's':
+		start = time.Date(y, mo, d, t.Hour(), t.Minute(), t.Second(), 0, loc)
+	default:
+		return time.Time{}, fmt.Errorf("unit [%c] not supported", unit)
+	}
+	if !roundUp {
+		return start, nil
+	}
+	end, _ := add(start, unit, 1)
+	return end.Add(-time.Millisecond), nil
+}
@@ -0,0 +1,87 @@
+package date
+
+import (
+	"testing"
+	"time"
+
+	require "github.com/alecthomas/assert/v2"
+)
+
+func TestParse(t *testing.T) {
+	paris := time.FixedZone("", 3600)
+	tests := []struct {
+		format  string
+		value   string
+		loc     *time.Location
+		roundUp bool
+		want    string
+	}{
+		{"", "2022-11-11", nil, false, "2022-11-11T00:00:00Z"},
+		{"", "2022-11-11", nil, true, "2022-11-11T23:59:59.999Z"},
+		{"", "2022-11", nil, true, "2022-11-30T23:59:59.999Z"},
+		{"", "2022", nil, false, "2022-01-01T00:00:00Z"},
+		{"", "2022-11-11T13:31:29.840Z", nil, true, "2022-11-11T13:31:29.84Z"},
+		{"", "2022-11-11T13:31:29", paris, false, "2022-11-11T12:31:29Z"},
+		{"", "2022-11-11T13:31:29+02:00", paris, false, "2022-11-11T11:31:29Z"},
+		{"", "2022-11-11T13:31:29-0130", nil, false, "2022-11-11T15:01:29Z"},
+		{"", "1668173489840", paris, false, "2022-11-11T13:31:29.84Z"},
+		{"epoch_second", "1668173489", nil, false, "2022-11-11T13:31:29Z"},
+		{"epoch_second", "1668173489.5", nil, false, "2022-11-11T13:31:29.5Z"},
+		{"epoch_millis||strict_date_optional_time", "2022-11-11", nil, false, "2022-11-11T00:00:00Z"},
+	}
+	for _, test := range tests {
+		got, err := Parse(test.format, test.value, test.loc, test.roundUp)
+		require.NoError(t, err, test.value)
+		require.Equal(t, got.UTC().Format(time.RFC3339Nano), test.want, test.value)
+	}
+	for _, value := range []string{"2022-13-01", "2022-02-30", "22-11-11", "2022-11-11T25:00", "yesterday", "1e9"} {
+		_, err := Parse("", value, nil, false)
+		require.Error(t, err, value)
+	}
+}
+
+func TestParseMath(t *testing.T) {
+	now := time.Date(2022, 11, 11, 13, 31, 29, 840e6, time.UTC)
+	tests := []struct {
+		expr    string
+		loc     string
+		roundUp bool
+		want    string
+	}{
+		{"now", "", false, "2022-11-11T13:31:29.84Z"},
+		{"now-1d", "", false, "2022-11-10T13:31:29.84Z"},
+		{"now/d", "", false, "2022-11-11T00:00:00Z"},
+		{"now/d", "", true, "2022-11-11T23:59:59.999Z"},
+		{"now-1h/h", "", false, "2022-11-11T12:00:00Z"},
+		{"now+1M-2d/M", "", false, "2022-12-01T00:00:00Z"},
+		{"now/w", "", false, "2022-11-07T00:00:00Z"},
+		{"now/y", "", true, "2022-12-31T23:59:59.999Z"},
+		{"now/d", "+01:00", false, "2022-11-10T23:00:00Z"},
+		{"2022-01-31||+1M/d", "", false, "2022-02-28T00:00:00Z"},
+		{"2022-11-11||/M", "", true, "2022-11-30T23:59:59.999Z"},
+		{"2022-11-11T10:00:00||-10m", "-05:00", false, "2022-11-11T14:50:00Z"},
+	}
+	for _, test := range tests {
+		loc, err := ParseTimeZone(test.loc)
+		require.NoError(t, err)
+		got, err := ParseMath(test.expr, "", loc, test.roundUp, now)
+		require.NoError(t, err, test.expr)
+		require.Equal(t, got.UTC().Format(time.RFC3339Nano), test.want, test.expr)
+	}
+	for _, expr := range []string{"now*1d", "now-1", "now/q", "2022-11-11||+1x", "nope||+1d"} {
+		_, err := ParseMath(expr, "", nil, false, now)
+		require.Error(t, err, expr)
+	}
+}
+
+func TestParseTimeZone(t *testing.T) {
+	loc, err := ParseTimeZone("+05:30")
+	require.NoError(t, err)
+	_, offset := time.Date(2022, 1, 1, 0, 0, 0, 0, loc).Zone()
+	require.Equal(t, offset, 5*3600+30*60)
+
+	_, err = ParseTimeZone("+5")
+	require.Error(t, err)
+	_, err = ParseTimeZone("Not/AZone")
+	require.Error(t, err)
+}
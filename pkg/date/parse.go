@@ -0,0 +1,226 @@
+package date
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The formats ES uses for date and date_nanos fields that don't have one of their own
+const (
+	DefaultFormat      = "strict_date_optional_time||epoch_millis"
+	DefaultNanosFormat = "strict_date_optional_time_nanos||epoch_millis"
+)
+
+// Parse a date in one of a number of formats separated by ||, as in a mapping or
+// the format of a range query. Dates without an offset are taken to be in loc.
+// Dates that are given only to some precision, eg. a day, are the first instant
+// of it, or the last when rounding up as the upper bound of a range does
+func Parse(format, value string, loc *time.Location, roundUp bool) (time.Time, error) {
+	if format == "" {
+		format = DefaultFormat
+	}
+	if loc == nil {
+		loc = time.UTC
+	}
+	for _, f := range strings.Split(format, "||") {
+		t, ok, err := parseFormat(strings.TrimSpace(f), value, loc, roundUp)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid format [%s]: %v", format, err)
+		}
+		if ok {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("failed to parse date field [%s] with format [%s]", value, format)
+}
+
+// Parse with one format, which is either a built-in one or a pattern such as
+// yyyy-MM-dd HH:mm:ss. Only an invalid pattern is an error
+func parseFormat(format, value string, loc *time.Location, roundUp bool) (time.Time, bool, error) {
+	switch {
+	case format == "epoch_millis":
+		t, ok := parseEpoch(value, time.Millisecond)
+		return t, ok, nil
+	case format == "epoch_second":
+		t, ok := parseEpoch(value, time.Second)
+		return t, ok, nil
+	case isISOFormat(format):
+		t, ok := parseISODate(value, loc, roundUp)
+		return t, ok, nil
+	}
+	p, err := lookupPattern(format)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	t, ok := p.parse(value, loc, roundUp)
+	return t, ok, nil
+}
+
+// Epoch timestamps can be negative or have a fraction, eg. 1668173489840.5 millis
+func parseEpoch(value string, unit time.Duration) (time.Time, bool) {
+	digits := strings.TrimPrefix(value, "-")
+	if digits == "" || strings.Trim(digits, "0123456789.") != "" {
+		return time.Time{}, false
+	}
+	if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if unit == time.Millisecond {
+			return time.UnixMilli(i).UTC(), true
+		}
+		return time.Unix(i, 0).UTC(), true
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	secs, frac := math.Modf(f * unit.Seconds())
+	return time.Unix(int64(secs), int64(frac*float64(time.Second))).UTC(), true
+}
+
+// ISO 8601 dates with an optional time and offset, to any precision from a year
+// down to nanoseconds: 2022, 2022-11, 2022-11-11, 2022-11-11T13:31,
+// 2022-11-11T13:31:29.840Z, 2022-11-11T13:31:29+01:00 and so on
+func parseISODate(value string, loc *time.Location, roundUp bool) (time.Time, bool) {
+	p := isoParser{s: value}
+	// Each field and the separator that precedes it; all but the year are optional
+	fields := []struct {
+		sep    string
+		digits int
+	}{{"", 4}, {"-", 2}, {"-", 2}, {"T", 2}, {":", 2}, {":", 2}}
+	vals := []int{0, 1, 1, 0, 0, 0}
+	n := 0
+	for i, f := range fields {
+		if i > 0 && !p.consume(f.sep) {
+			break
+		}
+		v, ok := p.number(f.digits)
+		if !ok {
+			return time.Time{}, false
+		}
+		vals[i] = v
+		n++
+	}
+	nanos, fracDigits := 0, 0
+	if n == len(fields) && (p.consume(".") || p.consume(",")) {
+		for ; p.pos < len(p.s) && p.s[p.pos] >= '0' && p.s[p.pos] <= '9'; p.pos++ {
+			if fracDigits < 9 {
+				nanos = nanos*10 + int(p.s[p.pos]-'0')
+				fracDigits++
+			}
+		}
+		if fracDigits == 0 {
+			return time.Time{}, false
+		}
+		for i := fracDigits; i < 9; i++ {
+			nanos *= 10
+		}
+	}
+	if n > 3 {
+		// An offset can only follow a time
+		if zone, ok := p.zone(); ok {
+			loc = zone
+		}
+	}
+	if p.pos != len(p.s) || vals[1] < 1 || vals[1] > 12 || vals[2] < 1 || vals[2] > 31 ||
+		vals[3] > 23 || vals[4] > 59 || vals[5] > 59 {
+		return time.Time{}, false
+	}
+	t := time.Date(vals[0], time.Month(vals[1]), vals[2], vals[3], vals[4], vals[5], nanos, loc)
+	if t.Day() != vals[2] {
+		// eg. 2022-02-30
+		return time.Time{}, false
+	}
+	if roundUp && fracDigits == 0 {
+		switch n {
+		case 1:
+			t = t.AddDate(1, 0, 0)
+		case 2:
+			t = t.AddDate(0, 1, 0)
+		case 3:
+			t = t.AddDate(0, 0, 1)
+		case 4:
+			t = t.Add(time.Hour)
+		case 5:
+			t = t.Add(time.Minute)
+		default:
+			t = t.Add(time.Second)
+		}
+		t = t.Add(-time.Millisecond)
+	}
+	return t, true
+}
+
+type isoParser struct {
+	s   string
+	pos int
+}
+
+func (p *isoParser) consume(sep string) bool {
+	if strings.HasPrefix(p.s[p.pos:], sep) {
+		p.pos += len(sep)
+		return true
+	}
+	return false
+}
+
+func (p *isoParser) number(digits int) (int, bool) {
+	if p.pos+digits > len(p.s) {
+		return 0, false
+	}
+	v, err := strconv.Atoi(p.s[p.pos : p.pos+digits])
+	if err != nil || p.s[p.pos] == '+' || p.s[p.pos] == '-' {
+		return 0, false
+	}
+	p.pos += digits
+	return v, true
+}
+
+// Z, or an offset as +01, +0100 or +01:00
+func (p *isoParser) zone() (*time.Location, bool) {
+	if p.consume("Z") {
+		return time.UTC, true
+	}
+	if p.pos >= len(p.s) || (p.s[p.pos] != '+' && p.s[p.pos] != '-') {
+		return nil, false
+	}
+	sign := 1
+	if p.s[p.pos] == '-' {
+		sign = -1
+	}
+	p.pos++
+	hours, ok := p.number(2)
+	if !ok {
+		return nil, false
+	}
+	p.consume(":")
+	minutes := 0
+	if p.pos < len(p.s) {
+		if minutes, ok = p.number(2); !ok {
+			return nil, false
+		}
+	}
+	return time.FixedZone("", sign*(hours*3600+minutes*60)), true
+}
+
+// The time_zone of a query, either an offset like +01:00 or a zone id such as
+// Europe/Paris
+func ParseTimeZone(tz string) (*time.Location, error) {
+	switch tz {
+	case "", "Z", "UTC", "utc":
+		return time.UTC, nil
+	}
+	if strings.HasPrefix(tz, "+") || strings.HasPrefix(tz, "-") {
+		p := isoParser{s: tz}
+		if loc, ok := p.zone(); ok && p.pos == len(tz) {
+			return loc, nil
+		}
+		return nil, fmt.Errorf("invalid time zone [%s]", tz)
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, fmt.Errorf("unknown time zone id [%s]", tz)
+	}
+	return loc, nil
+}
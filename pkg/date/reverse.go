@@ -1,25 +1,59 @@
 package date
 
 import (
+	"encoding/json"
+	"fmt"
+	"strings"
 	"time"
 )
 
 // Inverse functions for returning back to the desired format
 // from internal representation used in sqlite storage (RFC3339)
 func AsDateFormat(fmt, s string) (interface{}, error) {
-	switch fmt {
-	case "epoch_millis":
-		return asEpochMillis(s)
+	tm, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return nil, err
 	}
-	return nil, nil
+	return Format(fmt, tm.UTC())
 }
 
-func asEpochMillis(s string) (int64, error) {
-	tm, err := time.Parse(time.RFC3339, s)
+// Print a time in the first of a number of formats separated by ||. The epoch
+// formats are numbers, and everything else a string in the time's own zone
+func Format(format string, t time.Time) (interface{}, error) {
+	if format == "" {
+		format = DefaultFormat
+	}
+	format = strings.TrimSpace(strings.Split(format, "||")[0])
+	switch {
+	case format == "epoch_millis":
+		return asEpoch(t, time.Millisecond), nil
+	case format == "epoch_second":
+		return asEpoch(t, time.Second), nil
+	case format == "strict_date_optional_time_nanos":
+		format = isoNanosPrintPattern
+	case isISOFormat(format):
+		format = isoPrintPattern
+	}
+	p, err := lookupPattern(format)
 	if err != nil {
-		return -1, err
+		return nil, fmt.Errorf("invalid format [%s]: %v", format, err)
 	}
-	ms := tm.UnixMilli()
+	return p.format(t), nil
+}
 
-	return ms, nil
+// Whole units are an int64, anything finer a number with a fraction
+func asEpoch(t time.Time, unit time.Duration) interface{} {
+	whole, frac, width := t.Unix(), int64(t.Nanosecond()), 9
+	if unit == time.Millisecond {
+		whole, frac, width = t.UnixMilli(), frac%int64(time.Millisecond), 6
+	}
+	if frac == 0 {
+		return whole
+	}
+	sign := ""
+	if whole < 0 {
+		whole, frac, sign = -(whole + 1), int64(unit)-frac, "-"
+	}
+	digits := strings.TrimRight(fmt.Sprintf("%0*d", width, frac), "0")
+	return json.Number(fmt.Sprintf("%s%d.%s", sign, whole, digits))
 }
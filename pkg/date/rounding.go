@@ -0,0 +1,241 @@
+package date
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How a date histogram rounds dates down to the key of their bucket: either a
+// fixed interval such as 90m, or a calendar unit whose length varies, such as a
+// month. Buckets start at midnight, the first of the month and so on in the time
+// zone, shifted by the offset
+type Rounding struct {
+	fixed    time.Duration
+	calendar string
+	// Calendar years can be in multiples, eg. decades
+	years  int
+	offset time.Duration
+	loc    *time.Location
+}
+
+// Calendar intervals are a single unit, by name or as eg. 1M
+var calendarUnits = map[string]string{
+	"minute": "minute", "1m": "minute",
+	"hour": "hour", "1h": "hour",
+	"day": "day", "1d": "day",
+	"week": "week", "1w": "week",
+	"month": "month", "1M": "month",
+	"quarter": "quarter", "1q": "quarter",
+	"year": "year", "1y": "year",
+}
+
+// Units of fixed intervals and offsets, longest suffix first
+var durationUnits = []struct {
+	suffix string
+	unit   time.Duration
+}{
+	{"nanos", time.Nanosecond}, {"micros", time.Microsecond}, {"ms", time.Millisecond},
+	{"s", time.Second}, {"m", time.Minute}, {"h", time.Hour}, {"d", 24 * time.Hour},
+}
+
+// A rounding for a fixed interval, or a calendar one
+func NewRounding(interval string, calendar bool, offset time.Duration, loc *time.Location) (*Rounding, error) {
+	if loc == nil {
+		loc = time.UTC
+	}
+	r := &Rounding{offset: offset, loc: loc}
+	if calendar {
+		unit, ok := calendarUnits[interval]
+		if !ok {
+			return nil, fmt.Errorf("The supplied interval [%s] could not be parsed as a calendar interval.", interval)
+		}
+		r.calendar = unit
+		return r, nil
+	}
+	d, err := ParseDuration(interval)
+	if err != nil || d < time.Millisecond {
+		return nil, fmt.Errorf("failed to parse setting [date_histogram.fixedInterval] with value [%s] as a time value: unit is missing or unrecognized", interval)
+	}
+	r.fixed = d
+	return r, nil
+}
+
+// Whether an interval is one of the calendar units
+func IsCalendarInterval(interval string) bool {
+	_, ok := calendarUnits[interval]
+	return ok
+}
+
+// A time value such as 90m, 1h or -1d, as used for fixed intervals and offsets.
+// Unlike time.ParseDuration, days are a unit
+func ParseDuration(s string) (time.Duration, error) {
+	value := strings.TrimPrefix(strings.TrimPrefix(s, "+"), "-")
+	for _, u := range durationUnits {
+		if !strings.HasSuffix(value, u.suffix) {
+			continue
+		}
+		n, err := strconv.ParseInt(strings.TrimSuffix(value, u.suffix), 10, 64)
+		if err != nil || n < 0 {
+			break
+		}
+		d := time.Duration(n) * u.unit
+		if strings.HasPrefix(s, "-") {
+			d = -d
+		}
+		return d, nil
+	}
+	return 0, fmt.Errorf("failed to parse time value [%s]", s)
+}
+
+// The key of the bucket a time falls in
+func (r *Rounding) Round(t time.Time) time.Time {
+	t = t.Add(-r.offset).In(r.loc)
+	if r.fixed > 0 {
+		// Fixed intervals line up with the epoch in local time
+		_, zone := t.Zone()
+		local := t.UnixMilli() + int64(zone)*1000
+		iv := r.fixed.Milliseconds()
+		key := local - ((local%iv)+iv)%iv
+		return time.UnixMilli(key - int64(zone)*1000).Add(r.offset).In(r.loc)
+	}
+	y, m, d := t.Date()
+	var key time.Time
+	switch r.calendar {
+	case "minute":
+		key = t.Add(-time.Duration(t.Second())*time.Second - time.Duration(t.Nanosecond()))
+	case "hour":
+		// Not with time.Date, which can't tell the repeated hour apart when the clocks go back
+		key = t.Add(-time.Duration(t.Minute())*time.Minute - time.Duration(t.Second())*time.Second - time.Duration(t.Nanosecond()))
+	case "day":
+		key = time.Date(y, m, d, 0, 0, 0, 0, r.loc)
+	case "week":
+		key = time.Date(y, m, d+1-isoWeekday(t.Weekday()), 0, 0, 0, 0, r.loc)
+	case "month":
+		key = time.Date(y, m, 1, 0, 0, 0, 0, r.loc)
+	case "quarter":
+		key = time.Date(y, (m-1)/3*3+1, 1, 0, 0, 0, 0, r.loc)
+	default:
+		if r.years > 1 {
+			y -= ((y % r.years) + r.years) % r.years
+		}
+		key = time.Date(y, time.January, 1, 0, 0, 0, 0, r.loc)
+	}
+	return key.Add(r.offset)
+}
+
+// The key of the bucket after the one with the given key
+func (r *Rounding) Next(key time.Time) time.Time {
+	if r.fixed > 0 {
+		next := r.Round(key.Add(r.fixed))
+		if !next.After(key) {
+			// Where the clocks go back
+			next = key.Add(r.fixed)
+		}
+		return next
+	}
+	var next time.Time
+	t := key.Add(-r.offset).In(r.loc)
+	switch {
+	case r.calendar == "minute":
+		return key.Add(time.Minute)
+	case r.calendar == "hour":
+		return key.Add(time.Hour)
+	case r.calendar == "day":
+		next = t.AddDate(0, 0, 1)
+	case r.calendar == "week":
+		next = t.AddDate(0, 0, 7)
+	case r.calendar == "month":
+		next = t.AddDate(0, 1, 0)
+	case r.calendar == "quarter":
+		next = t.AddDate(0, 3, 0)
+	default:
+		years := r.years
+		if years == 0 {
+			years = 1
+		}
+		next = t.AddDate(years, 0, 0)
+	}
+	// Rounding again keeps to the start of days across daylight saving changes
+	return r.Round(next.Add(r.offset))
+}
+
+// The intervals auto_date_histogram chooses from, finest first, as multiples of
+// each unit. Single units other than seconds are calendar intervals
+var autoIntervals = []struct {
+	unit      string
+	name      string
+	multiples []int
+}{
+	{"s", "second", []int{1, 5, 10, 30}},
+	{"m", "minute", []int{1, 5, 10, 30}},
+	{"h", "hour", []int{1, 3, 12}},
+	{"d", "day", []int{1, 7}},
+	{"M", "month", []int{1, 3}},
+	{"y", "year", []int{1, 5, 10, 20, 50, 100}},
+}
+
+// The finest interval that covers the dates from first to last in no more than
+// target buckets, and its name, eg. 3h. Intervals start from the minimum, one
+// of second, minute, hour, day, month or year
+func AutoRounding(first, last time.Time, target int, minimum string, loc *time.Location) (*Rounding, string, error) {
+	if loc == nil {
+		loc = time.UTC
+	}
+	start := -1
+	for i, ai := range autoIntervals {
+		if minimum == "" || minimum == ai.name {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		return nil, "", fmt.Errorf("minimum_interval must be one of [second, minute, hour, day, month, year]")
+	}
+	var r *Rounding
+	var name string
+	for _, ai := range autoIntervals[start:] {
+		for _, n := range ai.multiples {
+			name = fmt.Sprintf("%d%s", n, ai.unit)
+			r = &Rounding{loc: loc}
+			switch {
+			case ai.unit == "y":
+				r.calendar, r.years = "year", n
+			case ai.unit == "M" && n == 3:
+				r.calendar = "quarter"
+			case IsCalendarInterval(name):
+				r.calendar = calendarUnits[name]
+			default:
+				r.fixed, _ = ParseDuration(name)
+			}
+			if r.fits(first, last, target) {
+				return r, name, nil
+			}
+		}
+	}
+	// Beyond centuries, there are more buckets than asked for
+	return r, name, nil
+}
+
+// Whether the dates from first to last are in no more than n buckets
+func (r *Rounding) fits(first, last time.Time, n int) bool {
+	key, end := r.Round(first), r.Round(last)
+	if r.calendar == "" && r.fixed > 0 {
+		// Fixed intervals are all the same length, so there's no need to step
+		// through them
+		d := end.Sub(key)
+		steps := d / r.fixed
+		if d%r.fixed != 0 {
+			steps++
+		}
+		return int64(steps) <= int64(n-1)
+	}
+	for i := 1; i < n; i++ {
+		if !key.Before(end) {
+			return true
+		}
+		key = r.Next(key)
+	}
+	return !key.Before(end)
+}
@@ -0,0 +1,116 @@
+package date
+
+import (
+	"testing"
+	"time"
+
+	require "github.com/alecthomas/assert/v2"
+)
+
+func TestRounding(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	require.NoError(t, err)
+	ts := time.Date(2022, 11, 11, 13, 31, 29, 840e6, time.UTC)
+	tests := []struct {
+		interval string
+		calendar bool
+		offset   time.Duration
+		loc      *time.Location
+		want     string
+	}{
+		{"15m", false, 0, time.UTC, "2022-11-11T13:30:00Z"},
+		{"90m", false, 0, time.UTC, "2022-11-11T13:30:00Z"},
+		{"1d", false, 0, paris, "2022-11-10T23:00:00Z"},
+		{"500ms", false, 0, time.UTC, "2022-11-11T13:31:29.5Z"},
+		{"1h", false, 10 * time.Minute, time.UTC, "2022-11-11T13:10:00Z"},
+		{"minute", true, 0, time.UTC, "2022-11-11T13:31:00Z"},
+		{"1h", true, 0, time.FixedZone("", 5*3600+1800), "2022-11-11T13:30:00Z"},
+		{"day", true, 0, paris, "2022-11-10T23:00:00Z"},
+		{"1w", true, 0, time.UTC, "2022-11-07T00:00:00Z"},
+		{"month", true, -6 * time.Hour, time.UTC, "2022-10-31T18:00:00Z"},
+		{"1q", true, 0, paris, "2022-09-30T22:00:00Z"},
+		{"year", true, 0, time.UTC, "2022-01-01T00:00:00Z"},
+	}
+	for _, test := range tests {
+		r, err := NewRounding(test.interval, test.calendar, test.offset, test.loc)
+		require.NoError(t, err, test.interval)
+		require.Equal(t, r.Round(ts).UTC().Format(time.RFC3339Nano), test.want, test.interval)
+	}
+
+	for _, bad := range []struct {
+		interval string
+		calendar bool
+	}{{"2d", true}, {"1M", false}, {"0s", false}, {"1.5h", false}, {"", false}} {
+		_, err := NewRounding(bad.interval, bad.calendar, 0, nil)
+		require.Error(t, err, bad.interval)
+	}
+}
+
+// Buckets keep to local midnight and don't repeat as the clocks change
+func TestRoundingNext(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	require.NoError(t, err)
+	day, _ := NewRounding("day", true, 0, paris)
+	key := day.Round(time.Date(2022, 10, 29, 12, 0, 0, 0, paris))
+	for _, want := range []string{"2022-10-30T00:00:00+02:00", "2022-10-31T00:00:00+01:00"} {
+		key = day.Next(key)
+		require.Equal(t, key.Format(time.RFC3339), want)
+	}
+
+	hour, _ := NewRounding("hour", true, 0, paris)
+	key = hour.Round(time.Date(2022, 10, 30, 0, 30, 0, 0, time.UTC))
+	require.Equal(t, key.Format(time.RFC3339), "2022-10-30T02:00:00+02:00")
+	for _, want := range []string{"2022-10-30T02:00:00+01:00", "2022-10-30T03:00:00+01:00"} {
+		key = hour.Next(key)
+		require.Equal(t, key.Format(time.RFC3339), want)
+	}
+
+	month, _ := NewRounding("month", true, 0, time.UTC)
+	require.Equal(t, month.Next(month.Round(time.Date(2022, 1, 31, 0, 0, 0, 0, time.UTC))).Format(time.RFC3339), "2022-02-01T00:00:00Z")
+}
+
+func TestAutoRounding(t *testing.T) {
+	first := time.Date(2022, 11, 11, 13, 31, 29, 0, time.UTC)
+	tests := []struct {
+		last    time.Time
+		target  int
+		minimum string
+		want    string
+	}{
+		{first, 10, "", "1s"},
+		{first.Add(30 * time.Second), 10, "", "5s"},
+		{first.Add(40 * time.Hour), 3, "", "1d"},
+		{first.Add(40 * time.Hour), 10, "", "12h"},
+		{first.Add(40 * time.Hour), 10, "day", "1d"},
+		{first.AddDate(0, 5, 0), 3, "", "3M"},
+		{first.AddDate(30, 0, 0), 4, "", "10y"},
+		{first.AddDate(30, 0, 0), 4, "year", "10y"},
+		// Nothing is coarser than centuries
+		{first.AddDate(1000, 0, 0), 2, "", "100y"},
+	}
+	for _, test := range tests {
+		r, interval, err := AutoRounding(first, test.last, test.target, test.minimum, nil)
+		require.NoError(t, err)
+		require.Equal(t, interval, test.want, test.last.String())
+		require.True(t, r != nil)
+	}
+
+	r, _, _ := AutoRounding(first, first.AddDate(0, 5, 0), 3, "", nil)
+	require.Equal(t, r.Round(first).Format(time.RFC3339), "2022-10-01T00:00:00Z")
+	r, _, _ = AutoRounding(first, first.AddDate(30, 0, 0), 4, "", nil)
+	require.Equal(t, r.Round(first).Format(time.RFC3339), "2020-01-01T00:00:00Z")
+
+	_, _, err := AutoRounding(first, first, 10, "week", nil)
+	require.Error(t, err)
+}
+
+func TestFixedRoundingFits(t *testing.T) {
+	r, err := NewRounding("1s", false, 0, time.UTC)
+	require.NoError(t, err)
+	first := time.Date(2022, 11, 11, 13, 31, 29, 0, time.UTC)
+	require.True(t, r.fits(first, first, 1))
+	require.True(t, r.fits(first, first.Add(9*time.Second), 10))
+	require.False(t, r.fits(first, first.Add(10*time.Second), 10))
+	// Far more buckets than could be stepped through
+	require.False(t, r.fits(first, first.AddDate(200, 0, 0), 10))
+}
@@ -1,12 +1,47 @@
 package dsl
 
 type Aggregate struct {
-	Terms         *AggTerms      `json:"terms"`
-	DateHistogram *DateHistogram `json:"date_histogram"`
-	// AutoDateHistogram *AutoDateHistogram `| "auto_date_histogram" ":" "{" @@ "}" ","?`
-	Aggs map[string]Aggregate `json:"aggregations"`
-	Avg  *AggField            `json:"avg"`
-	Max  *AggField            `json:"max"`
+	Terms                   *AggTerms                `json:"terms"`
+	DateHistogram           *DateHistogram           `json:"date_histogram"`
+	AutoDateHistogram       *AutoDateHistogram       `json:"auto_date_histogram"`
+	Histogram               *Histogram               `json:"histogram"`
+	Range                   *RangeAgg                `json:"range"`
+	DateRange               *RangeAgg                `json:"date_range"`
+	IpRange                 *RangeAgg                `json:"ip_range"`
+	Filter                  *Query                   `json:"filter"`
+	Filters                 *FiltersAgg              `json:"filters"`
+	Missing                 *MissingAgg              `json:"missing"`
+	Global                  *GlobalAgg               `json:"global"`
+	Composite               *Composite               `json:"composite"`
+	TopHits                 *TopHits                 `json:"top_hits"`
+	TopMetrics              *TopMetrics              `json:"top_metrics"`
+	SignificantTerms        *SignificantTerms        `json:"significant_terms"`
+	RareTerms               *RareTerms               `json:"rare_terms"`
+	Aggs                    map[string]Aggregate     `json:"aggregations"`
+	Avg                     *AggField                `json:"avg"`
+	Max                     *AggField                `json:"max"`
+	Min                     *AggField                `json:"min"`
+	Sum                     *AggField                `json:"sum"`
+	ValueCount              *AggField                `json:"value_count"`
+	Cardinality             *Cardinality             `json:"cardinality"`
+	Stats                   *AggField                `json:"stats"`
+	ExtendedStats           *ExtendedStats           `json:"extended_stats"`
+	WeightedAvg             *WeightedAvg             `json:"weighted_avg"`
+	Percentiles             *Percentiles             `json:"percentiles"`
+	PercentileRanks         *Percentiles             `json:"percentile_ranks"`
+	MedianAbsoluteDeviation *MedianAbsoluteDeviation `json:"median_absolute_deviation"`
+	Derivative              *Derivative              `json:"derivative"`
+	CumulativeSum           *PipelineField           `json:"cumulative_sum"`
+	MovingFn                *MovingFn                `json:"moving_fn"`
+	SerialDiff              *SerialDiff              `json:"serial_diff"`
+	AvgBucket               *PipelineField           `json:"avg_bucket"`
+	MaxBucket               *PipelineField           `json:"max_bucket"`
+	MinBucket               *PipelineField           `json:"min_bucket"`
+	SumBucket               *PipelineField           `json:"sum_bucket"`
+	StatsBucket             *PipelineField           `json:"stats_bucket"`
+	BucketScript            *BucketScript            `json:"bucket_script"`
+	BucketSelector          *BucketScript            `json:"bucket_selector"`
+	BucketSort              *BucketSort              `json:"bucket_sort"`
 }
 
 type AggregationCategory int
@@ -16,19 +51,75 @@ const (
 	MetricsMultiple
 	Bucket
 	Pipeline
+	// Of the top documents, which are shown rather than aggregated
+	Hits
 )
 
 type AggField struct {
-	Field   string `json:"field"`
-	Missing string `json:"missing"`
+	Field string `json:"field"`
+	// The value of documents that don't have one
+	Missing *StringOrNumber `json:"missing"`
+	// Of the value_as_string of date fields
+	Format string `json:"format"`
+}
+
+type Cardinality struct {
+	AggField
+	// Counts are exact up to this many distinct values, and approximate beyond
+	PrecisionThreshold *int `json:"precision_threshold"`
+}
+
+type ExtendedStats struct {
+	AggField
+	// The number of standard deviations of std_deviation_bounds, 2 by default
+	Sigma *float64 `json:"sigma"`
+}
+
+// A percentiles aggregation, or percentile_ranks, which has values rather than
+// percents
+type Percentiles struct {
+	AggField
+	Percents []float64 `json:"percents"`
+	Values   []float64 `json:"values"`
+	// Keyed by default
+	Keyed   *bool    `json:"keyed"`
+	TDigest *TDigest `json:"tdigest"`
+	// HDR histograms aren't supported, but are recognized so they can be refused
+	Hdr *struct {
+		NumberOfSignificantValueDigits int `json:"number_of_significant_value_digits"`
+	} `json:"hdr"`
+}
+
+type TDigest struct {
+	Compression *float64 `json:"compression"`
+}
+
+type MedianAbsoluteDeviation struct {
+	AggField
+	Compression *float64 `json:"compression"`
+}
+
+type WeightedAvg struct {
+	Value  AggField `json:"value"`
+	Weight AggField `json:"weight"`
+	Format string   `json:"format"`
 }
 
 type AggTerms struct {
 	Field string `json:"field"`
-	Size  int    `json:"size"`
-	// FIXME This should support multiple
-	// Order *Property `| "order" ":" "[" "{" @@ "}" "]" ","? )+`
-	// Term  *Term  `"{" ( "term" ":" "{" @@ "}"`
+	// The number of buckets, 10 by default
+	Size *int `json:"size"`
+	// Accepted for compatibility, as there is only ever the one shard
+	ShardSize *int `json:"shard_size"`
+	// By doc count by default
+	Order TermsOrder `json:"order"`
+	// Some clients send this as a string
+	MinDocCount *StringOrNumber `json:"min_doc_count"`
+	// The value of documents that don't have one
+	Missing *StringOrNumber `json:"missing"`
+	Include *IncludeExclude `json:"include"`
+	Exclude *IncludeExclude `json:"exclude"`
+	Format  string          `json:"format"`
 }
 
 type DateHistogram struct {
@@ -36,24 +127,246 @@ type DateHistogram struct {
 	Buckets          int    `json:"buckets"`
 	FixedInterval    string `json:"fixed_interval"`
 	CalendarInterval string `json:"calendar_interval"`
+	// The deprecated form of either, which older clients still send
+	Interval string `json:"interval"`
+	// eg. +6h, or a number of millis
+	Offset   *StringOrNumber `json:"offset"`
+	TimeZone string          `json:"time_zone"`
+	// Some clients send this as a string
+	MinDocCount    *StringOrNumber `json:"min_doc_count"`
+	ExtendedBounds *Bounds         `json:"extended_bounds"`
+	HardBounds     *Bounds         `json:"hard_bounds"`
+	Format         string          `json:"format"`
+}
+
+// The bounds of a histogram, as dates or epoch millis
+type Bounds struct {
+	Min *StringOrNumber `json:"min"`
+	Max *StringOrNumber `json:"max"`
 }
 
-/* TODO Implement
 type AutoDateHistogram struct {
-	Field           string `( "field" ":" @String ","?`
-	Buckets         int    `| "buckets" ":" @Number ","?`
-	MinimumInterval string `| "buckets" ":" @String ","? )+`
+	Field string `json:"field"`
+	// The number of buckets to aim for, 10 by default
+	Buckets         *int   `json:"buckets"`
+	Format          string `json:"format"`
+	TimeZone        string `json:"time_zone"`
+	MinimumInterval string `json:"minimum_interval"`
+}
+
+type Histogram struct {
+	Field          string          `json:"field"`
+	Interval       *float64        `json:"interval"`
+	Offset         float64         `json:"offset"`
+	MinDocCount    *StringOrNumber `json:"min_doc_count"`
+	ExtendedBounds *Bounds         `json:"extended_bounds"`
+	HardBounds     *Bounds         `json:"hard_bounds"`
+}
+
+// A range, date_range or ip_range aggregation. Format and time zone apply only to
+// dates
+type RangeAgg struct {
+	Field    string     `json:"field"`
+	Ranges   []AggRange `json:"ranges"`
+	Keyed    bool       `json:"keyed"`
+	Format   string     `json:"format"`
+	TimeZone string     `json:"time_zone"`
+}
+
+// From is inclusive and to exclusive. Ip ranges can instead be given as a CIDR
+// mask
+type AggRange struct {
+	Key  string          `json:"key"`
+	From *StringOrNumber `json:"from"`
+	To   *StringOrNumber `json:"to"`
+	Mask string          `json:"mask"`
+}
+
+// The terms of a field that are more frequent among the documents of a bucket, the
+// foreground, than among all of those in the indices, the background
+type SignificantTerms struct {
+	Field string `json:"field"`
+	// 10 by default
+	Size *int `json:"size"`
+	// 3 by default
+	MinDocCount *StringOrNumber `json:"min_doc_count"`
+	// Accepted for compatibility, as there is only ever the one shard
+	ShardSize        *int            `json:"shard_size"`
+	ShardMinDocCount *StringOrNumber `json:"shard_min_doc_count"`
+	// Of the background, instead of all of the documents
+	BackgroundFilter *Query          `json:"background_filter"`
+	Include          *IncludeExclude `json:"include"`
+	Exclude          *IncludeExclude `json:"exclude"`
+	// The heuristic terms are scored by, jlh by default
+	JLH               *struct{}              `json:"jlh"`
+	ChiSquare         *SignificanceHeuristic `json:"chi_square"`
+	MutualInformation *SignificanceHeuristic `json:"mutual_information"`
+	GND               *SignificanceHeuristic `json:"gnd"`
+}
+
+type SignificanceHeuristic struct {
+	// Also score terms that are less frequent in the foreground
+	IncludeNegatives bool `json:"include_negatives"`
+	// Whether the background includes the foreground, true by default
+	BackgroundIsSuperset *bool `json:"background_is_superset"`
+}
+
+// The terms of a field that only a few documents have
+type RareTerms struct {
+	Field string `json:"field"`
+	// 1 by default
+	MaxDocCount *int `json:"max_doc_count"`
+	// The value of documents that don't have one
+	Missing *StringOrNumber `json:"missing"`
+	Include *IncludeExclude `json:"include"`
+	Exclude *IncludeExclude `json:"exclude"`
+	// Of the filter ES approximates the terms with, accepted for compatibility
+	Precision *float64 `json:"precision"`
+}
+
+// The buckets of documents matching each of the filters, which are either named
+// or anonymous, and of those matching none of them
+type FiltersAgg struct {
+	Filters        map[string]Query `json:"-"`
+	Anonymous      []Query          `json:"-"`
+	OtherBucket    bool             `json:"other_bucket"`
+	OtherBucketKey string           `json:"other_bucket_key"`
+	Keyed          *bool            `json:"keyed"`
+}
+
+type MissingAgg struct {
+	Field string `json:"field"`
+}
+
+// All of the documents of the indices searched, whatever the query
+type GlobalAgg struct{}
+
+// The buckets of each combination of the values of its sources, in their order,
+// which can be paged through by the key of the last bucket of a page
+type Composite struct {
+	Sources CompositeSources `json:"sources"`
+	// 10 by default
+	Size  *int           `json:"size"`
+	After CompositeAfter `json:"after"`
+}
+
+// The key of the bucket to continue after, by the names of the sources. Numbers
+// are json.Numbers, so that integer keys are as precise as the ones returned
+type CompositeAfter map[string]interface{}
+
+// The sources of a composite aggregation, whose order is that of the keys
+type CompositeSources []CompositeSource
+
+// A terms, histogram or date_histogram source, named as in the key of buckets
+type CompositeSource struct {
+	Name          string
+	Terms         *CompositeValues `json:"terms"`
+	Histogram     *CompositeValues `json:"histogram"`
+	DateHistogram *CompositeValues `json:"date_histogram"`
+}
+
+// The options of a source, of which the intervals, offset and time zone are those
+// of histograms
+type CompositeValues struct {
+	Field string `json:"field"`
+	// asc by default
+	Order string `json:"order"`
+	// Documents without a value are in a bucket with a null key, rather than none
+	MissingBucket    bool            `json:"missing_bucket"`
+	Format           string          `json:"format"`
+	Interval         *StringOrNumber `json:"interval"`
+	FixedInterval    string          `json:"fixed_interval"`
+	CalendarInterval string          `json:"calendar_interval"`
+	Offset           *StringOrNumber `json:"offset"`
+	TimeZone         string          `json:"time_zone"`
+}
+
+// The top documents of a bucket, as hits are shown for a search
+type TopHits struct {
+	From int `json:"from"`
+	// 3 by default
+	Size   *int          `json:"size"`
+	Sort   SortFields    `json:"sort"`
+	Source *SourceFilter `json:"_source"`
+	// Compute scores even when sorting on a field
+	TrackScores bool `json:"track_scores"`
+}
+
+// The values of fields of the top documents by a sort
+type TopMetrics struct {
+	Metrics TopMetricsFields `json:"metrics"`
+	Sort    SortFields       `json:"sort"`
+	// 1 by default
+	Size *int `json:"size"`
+}
+
+// The metrics of a top_metrics, as a single field or a list of them
+type TopMetricsFields []AggField
+
+// What pipeline aggregations have in common: the path to the values they take
+// from other aggregations, eg. sales_per_month>sales, and what is done about
+// buckets without one
+type PipelineField struct {
+	BucketsPath string `json:"buckets_path"`
+	// skip by default, insert_zeros or keep_values
+	GapPolicy string `json:"gap_policy"`
+	Format    string `json:"format"`
+}
+
+type Derivative struct {
+	PipelineField
+	// Of the normalized_value, as the derivative per eg. 1s or day
+	Unit string `json:"unit"`
+}
+
+type MovingFn struct {
+	PipelineField
+	Window *int   `json:"window"`
+	Shift  int    `json:"shift"`
+	Script Script `json:"script"`
+}
+
+type SerialDiff struct {
+	PipelineField
+	// 1 by default, to difference each bucket with the one before
+	Lag *int `json:"lag"`
+}
+
+// A bucket_script or bucket_selector, whose script has the values of its paths
+// as params
+type BucketScript struct {
+	BucketsPath BucketsPath `json:"buckets_path"`
+	Script      Script      `json:"script"`
+	GapPolicy   string      `json:"gap_policy"`
+	Format      string      `json:"format"`
+}
+
+type BucketSort struct {
+	Sort      SortFields `json:"sort"`
+	From      int        `json:"from"`
+	Size      *int       `json:"size"`
+	GapPolicy string     `json:"gap_policy"`
 }
-*/
 
 func (a *Aggregate) GenAggregationCategory() AggregationCategory {
 	// There must be a better way to do this... ?
 
-	if a.Avg != nil ||
-		a.Max != nil {
+	if a.Avg != nil || a.Max != nil || a.Min != nil || a.Sum != nil || a.ValueCount != nil ||
+		a.Cardinality != nil || a.WeightedAvg != nil || a.MedianAbsoluteDeviation != nil {
 		return MetricsSingle
-	} else if a.Terms != nil {
+	} else if a.Stats != nil || a.ExtendedStats != nil || a.Percentiles != nil || a.PercentileRanks != nil {
+		return MetricsMultiple
+	} else if a.Terms != nil || a.DateHistogram != nil || a.AutoDateHistogram != nil ||
+		a.Histogram != nil || a.Range != nil || a.DateRange != nil || a.IpRange != nil ||
+		a.Filter != nil || a.Filters != nil || a.Missing != nil || a.Global != nil || a.Composite != nil ||
+		a.SignificantTerms != nil || a.RareTerms != nil {
 		return Bucket
+	} else if a.Derivative != nil || a.CumulativeSum != nil || a.MovingFn != nil || a.SerialDiff != nil ||
+		a.AvgBucket != nil || a.MaxBucket != nil || a.MinBucket != nil || a.SumBucket != nil ||
+		a.StatsBucket != nil || a.BucketScript != nil || a.BucketSelector != nil || a.BucketSort != nil {
+		return Pipeline
+	} else if a.TopHits != nil || a.TopMetrics != nil {
+		return Hits
 	}
 	return 0
 
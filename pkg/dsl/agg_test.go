@@ -42,11 +42,30 @@ func TestAggTermsWithLongName(t *testing.T) {
 		}
     `
 	err := json.Unmarshal([]byte(q), &dsl)
-	require.Equal(t, dsl.Aggs["distinct_services"].Terms, &AggTerms{Field: "serviceName", Size: 10000})
+	size := 10000
+	require.Equal(t, dsl.Aggs["distinct_services"].Terms, &AggTerms{Field: "serviceName", Size: &size})
 	require.NoError(t, err)
 	repr.Println(dsl)
 }
 
+func TestTermsOptions(t *testing.T) {
+	terms := func(q string) *AggTerms {
+		t.Helper()
+		agg := Aggregate{}
+		require.NoError(t, json.Unmarshal([]byte(q), &agg))
+		return agg.Terms
+	}
+	one, four := 1, 4
+	require.Equal(t, terms(`{"terms": {"field": "host", "order": {"_key": "asc"}, "include": "web-.*", "exclude": ["web-02"]}}`),
+		&AggTerms{Field: "host", Order: TermsOrder{{"_key", "asc"}},
+			Include: &IncludeExclude{Regexp: "web-.*"}, Exclude: &IncludeExclude{Values: []interface{}{"web-02"}}})
+	require.Equal(t, terms(`{"terms": {"field": "n", "order": [{"lat.avg": "desc"}, {"_count": "asc"}], "include": {"partition": 1, "num_partitions": 4}}}`),
+		&AggTerms{Field: "n", Order: TermsOrder{{"lat.avg", "desc"}, {"_count", "asc"}},
+			Include: &IncludeExclude{Partition: &one, NumPartitions: &four}})
+	require.Equal(t, terms(`{"terms": {"field": "n", "include": [1, 2.5]}}`).Include.Values,
+		[]interface{}{json.Number("1"), json.Number("2.5")})
+}
+
 func TestAvg(t *testing.T) {
 	dsl := &Dsl{}
 	q := `
@@ -133,3 +152,120 @@ func TestSubAggregate(t *testing.T) {
 	require.Equal(t, dsl.Aggs["aggOuter"].Terms.Field, "groupField")
 	require.Equal(t, dsl.Aggs["aggOuter"].Aggs["maxTime"].Max.Field, "Time")
 }
+
+func TestNestedSubAggregates(t *testing.T) {
+	agg := Aggregate{}
+	q := `{
+		"terms": {"field": "host"},
+		"aggs": {
+			"time": {
+				"date_histogram": {"field": "ts", "fixed_interval": "1h"},
+				"aggs": {"lat": {"avg": {"field": "lat"}}}
+			}
+		}
+	}`
+	require.NoError(t, json.Unmarshal([]byte(q), &agg))
+	require.Equal(t, agg.Aggs["time"].DateHistogram.Field, "ts")
+	require.Equal(t, agg.Aggs["time"].Aggs["lat"].Avg, &AggField{Field: "lat"})
+}
+
+func TestPipelineAggregates(t *testing.T) {
+	agg := func(q string) Aggregate {
+		t.Helper()
+		a := Aggregate{}
+		require.NoError(t, json.Unmarshal([]byte(q), &a))
+		require.Equal(t, a.GenAggregationCategory(), Pipeline)
+		return a
+	}
+	require.Equal(t, agg(`{"derivative": {"buckets_path": "sales", "unit": "1d"}}`).Derivative,
+		&Derivative{PipelineField: PipelineField{BucketsPath: "sales"}, Unit: "1d"})
+	require.Equal(t, agg(`{"bucket_script": {"buckets_path": "sales", "script": "params._value * 2"}}`).BucketScript,
+		&BucketScript{BucketsPath: BucketsPath{"_value": "sales"}, Script: Script{Source: "params._value * 2"}})
+	require.Equal(t, agg(`{"bucket_selector": {"buckets_path": {"n": "_count"}, "script": {"inline": "params.n > params.min", "params": {"min": 1}}}}`).BucketSelector,
+		&BucketScript{BucketsPath: BucketsPath{"n": "_count"}, Script: Script{Source: "params.n > params.min", Params: map[string]interface{}{"min": 1.0}}})
+	size := 3
+	require.Equal(t, agg(`{"bucket_sort": {"sort": ["_key", {"sales": "desc"}, {"n": {"order": "asc"}}], "size": 3}}`).BucketSort,
+		&BucketSort{Sort: SortFields{{"_key", ""}, {"sales", "desc"}, {"n", "asc"}}, Size: &size})
+}
+
+func TestFilterAggregates(t *testing.T) {
+	agg := func(q string) Aggregate {
+		t.Helper()
+		a := Aggregate{}
+		require.NoError(t, json.Unmarshal([]byte(q), &a))
+		require.Equal(t, a.GenAggregationCategory(), Bucket)
+		return a
+	}
+	require.True(t, agg(`{"filter": {"term": {"status": 500}}}`).Filter != nil)
+	require.Equal(t, agg(`{"missing": {"field": "took"}}`).Missing, &MissingAgg{Field: "took"})
+	require.Equal(t, agg(`{"global": {}}`).Global, &GlobalAgg{})
+
+	named := agg(`{"filters": {"other_bucket_key": "rest", "filters": {"errors": {"range": {"status": {"gte": 500}}}, "all": {"match_all": {}}}}}`).Filters
+	require.Equal(t, len(named.Filters), 2)
+	require.True(t, named.Filters["errors"].Range != nil)
+	require.Equal(t, named.Anonymous, nil)
+	require.Equal(t, named.OtherBucketKey, "rest")
+
+	anonymous := agg(`{"filters": {"other_bucket": true, "filters": [{"term": {"path": "/home"}}, {"term": {"path": "/search"}}]}}`).Filters
+	require.Equal(t, len(anonymous.Anonymous), 2)
+	require.Equal(t, anonymous.Filters, nil)
+	require.True(t, anonymous.OtherBucket)
+}
+
+func TestCompositeAggregate(t *testing.T) {
+	a := Aggregate{}
+	require.NoError(t, json.Unmarshal([]byte(`{"composite": {"size": 2, "after": {"service": "api", "day": 1667260800000},
+		"sources": [{"service": {"terms": {"field": "service", "missing_bucket": true}}},
+		{"day": {"date_histogram": {"field": "ts", "calendar_interval": "day", "order": "desc"}}}]}}`), &a))
+	require.Equal(t, a.GenAggregationCategory(), Bucket)
+	size := 2
+	require.Equal(t, a.Composite, &Composite{
+		Sources: CompositeSources{
+			{Name: "service", Terms: &CompositeValues{Field: "service", MissingBucket: true}},
+			{Name: "day", DateHistogram: &CompositeValues{Field: "ts", CalendarInterval: "day", Order: "desc"}},
+		},
+		Size:  &size,
+		After: CompositeAfter{"service": "api", "day": json.Number("1667260800000")},
+	})
+	require.Error(t, json.Unmarshal([]byte(`{"composite": {"sources": [{"a": {"terms": {}}, "b": {"terms": {}}}]}}`), &a))
+}
+
+func TestTopHitsAggregates(t *testing.T) {
+	agg := func(q string) Aggregate {
+		t.Helper()
+		a := Aggregate{}
+		require.NoError(t, json.Unmarshal([]byte(q), &a))
+		require.Equal(t, a.GenAggregationCategory(), Hits)
+		return a
+	}
+	size := 1
+	require.Equal(t, agg(`{"top_hits": {"size": 1, "sort": [{"ts": {"order": "desc"}}], "_source": {"includes": ["msg"], "excludes": ["user.*"]}}}`).TopHits,
+		&TopHits{Size: &size, Sort: SortFields{{"ts", "desc"}}, Source: &SourceFilter{Includes: []string{"msg"}, Excludes: []string{"user.*"}}})
+	require.Equal(t, agg(`{"top_hits": {"_source": false}}`).TopHits.Source, &SourceFilter{Disabled: true})
+	require.Equal(t, agg(`{"top_hits": {"_source": "msg"}}`).TopHits.Source, &SourceFilter{Includes: []string{"msg"}})
+	require.Equal(t, agg(`{"top_hits": {"_source": ["msg", "user"]}}`).TopHits.Source, &SourceFilter{Includes: []string{"msg", "user"}})
+	require.Equal(t, agg(`{"top_metrics": {"metrics": {"field": "status"}, "sort": {"ts": "desc"}}}`).TopMetrics,
+		&TopMetrics{Metrics: TopMetricsFields{{Field: "status"}}, Sort: SortFields{{"ts", "desc"}}})
+	require.Equal(t, agg(`{"top_metrics": {"metrics": [{"field": "a"}, {"field": "b"}], "sort": "ts"}}`).TopMetrics.Metrics,
+		TopMetricsFields{{Field: "a"}, {Field: "b"}})
+}
+
+func TestSignificantTermsAggregates(t *testing.T) {
+	agg := func(q string) Aggregate {
+		t.Helper()
+		a := Aggregate{}
+		require.NoError(t, json.Unmarshal([]byte(q), &a))
+		require.Equal(t, a.GenAggregationCategory(), Bucket)
+		return a
+	}
+	st := agg(`{"significant_terms": {"field": "service", "min_doc_count": 1, "background_filter": {"term": {"service": "db"}},
+		"chi_square": {"include_negatives": true, "background_is_superset": false}}}`).SignificantTerms
+	require.Equal(t, st.Field, "service")
+	require.Equal(t, st.MinDocCount.String(), "1")
+	require.True(t, st.BackgroundFilter != nil)
+	superset := false
+	require.Equal(t, st.ChiSquare, &SignificanceHeuristic{IncludeNegatives: true, BackgroundIsSuperset: &superset})
+	require.True(t, agg(`{"significant_terms": {"field": "service", "jlh": {}}}`).SignificantTerms.JLH != nil)
+	max := 2
+	require.Equal(t, agg(`{"rare_terms": {"field": "status", "max_doc_count": 2}}`).RareTerms, &RareTerms{Field: "status", MaxDocCount: &max})
+}
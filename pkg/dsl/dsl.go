@@ -16,6 +16,11 @@ type Dsl struct {
 	Aggs            map[string]Aggregate
 
 	Sort []map[string]Sort `json:"sort"`
+
+	// Hits scoring lower than this are excluded, from aggregations as well
+	MinScore *float64 `json:"min_score"`
+	// Compute scores even when sorting on a field
+	TrackScores bool `json:"track_scores"`
 }
 
 type Query struct {
@@ -30,17 +35,142 @@ type Query struct {
 	Range map[string]Range `json:"range"`
 
 	QueryString *QueryString `json:"query_string"`
+
+	RawMatchPhrase       map[string]interface{} `json:"match_phrase"`
+	MatchPhrase          map[string]MatchPhrase
+	RawMatchPhrasePrefix map[string]interface{} `json:"match_phrase_prefix"`
+	MatchPhrasePrefix    map[string]MatchPhrase
+	RawMatchBoolPrefix   map[string]interface{} `json:"match_bool_prefix"`
+	MatchBoolPrefix      map[string]Match
+
+	MultiMatch *MultiMatch `json:"multi_match"`
+
+	SimpleQueryString *SimpleQueryString `json:"simple_query_string"`
+
+	RawTerms    map[string]json.RawMessage `json:"terms"`
+	Terms       *Terms
+	RawPrefix   map[string]interface{} `json:"prefix"`
+	Prefix      map[string]Prefix
+	RawWildcard map[string]interface{} `json:"wildcard"`
+	Wildcard    map[string]Wildcard
+	RawRegexp   map[string]interface{} `json:"regexp"`
+	Regexp      map[string]Regexp
+	RawFuzzy    map[string]interface{} `json:"fuzzy"`
+	Fuzzy       map[string]Fuzzy
+	Exists      *Exists    `json:"exists"`
+	Ids         *Ids       `json:"ids"`
+	MatchAll    *MatchAll  `json:"match_all"`
+	MatchNone   *MatchNone `json:"match_none"`
 }
 
 type Term struct {
+	Value           StringOrNumber `json:"value"`
+	Boost           *float64       `json:"boost"`
+	CaseInsensitive bool           `json:"case_insensitive"`
+}
+
+// https://www.elastic.co/guide/en/elasticsearch/reference/7.17/query-dsl-terms-query.html
+// The field is given as a key alongside boost, with either a list of values or
+// a lookup of the values from a field of another document
+type Terms struct {
+	Field  string
+	Values []string
+	Lookup *TermsLookup
+	Boost  *float64
+}
+
+type TermsLookup struct {
+	Index   string `json:"index"`
+	Id      string `json:"id"`
+	Path    string `json:"path"`
+	Routing string `json:"routing"`
+}
+
+// https://www.elastic.co/guide/en/elasticsearch/reference/7.17/query-dsl-prefix-query.html
+type Prefix struct {
 	Value           string   `json:"value"`
-	Boost           *float64 `json:"fuzziness"`
-	CaseInsensitive bool     `json:"operator"`
+	Boost           *float64 `json:"boost"`
+	CaseInsensitive bool     `json:"case_insensitive"`
+	Rewrite         string   `json:"rewrite"`
+}
+
+// https://www.elastic.co/guide/en/elasticsearch/reference/7.17/query-dsl-regexp-query.html
+type Regexp struct {
+	Value                 string   `json:"value"`
+	Flags                 string   `json:"flags"`
+	CaseInsensitive       bool     `json:"case_insensitive"`
+	MaxDeterminizedStates *int     `json:"max_determinized_states"`
+	Rewrite               string   `json:"rewrite"`
+	Boost                 *float64 `json:"boost"`
+}
+
+// https://www.elastic.co/guide/en/elasticsearch/reference/7.17/query-dsl-fuzzy-query.html
+type Fuzzy struct {
+	Value          string         `json:"value"`
+	Fuzziness      StringOrNumber `json:"fuzziness"`
+	MaxExpansions  *int           `json:"max_expansions"`
+	PrefixLength   int            `json:"prefix_length"`
+	Transpositions *bool          `json:"transpositions"`
+	Rewrite        string         `json:"rewrite"`
+	Boost          *float64       `json:"boost"`
+}
+
+// https://www.elastic.co/guide/en/elasticsearch/reference/7.17/query-dsl-ids-query.html
+type Ids struct {
+	Values []string `json:"values"`
+	Boost  *float64 `json:"boost"`
+}
+
+// https://www.elastic.co/guide/en/elasticsearch/reference/7.17/query-dsl-match-all-query.html
+type MatchAll struct {
+	Boost *float64 `json:"boost"`
 }
+
+type MatchNone struct{}
+
+// https://www.elastic.co/guide/en/elasticsearch/reference/7.17/query-dsl-match-query.html#match-field-params
 type Match struct {
-	Query     string `json:"query"`
-	Fuzziness string `json:"fuzziness"`
-	Operator  string `json:"operator"`
+	Query               string         `json:"query"`
+	Analyzer            string         `json:"analyzer"`
+	Fuzziness           StringOrNumber `json:"fuzziness"`
+	PrefixLength        int            `json:"prefix_length"`
+	MaxExpansions       *int           `json:"max_expansions"`
+	FuzzyTranspositions *bool          `json:"fuzzy_transpositions"`
+	Operator            string         `json:"operator"`
+	MinimumShouldMatch  StringOrNumber `json:"minimum_should_match"`
+	ZeroTermsQuery      string         `json:"zero_terms_query"`
+	Lenient             bool           `json:"lenient"`
+	Boost               *float64       `json:"boost"`
+}
+
+// Used for both match_phrase and match_phrase_prefix
+// https://www.elastic.co/guide/en/elasticsearch/reference/7.17/query-dsl-match-query-phrase.html
+type MatchPhrase struct {
+	Query          string   `json:"query"`
+	Analyzer       string   `json:"analyzer"`
+	Slop           int      `json:"slop"`
+	MaxExpansions  *int     `json:"max_expansions"`
+	ZeroTermsQuery string   `json:"zero_terms_query"`
+	Boost          *float64 `json:"boost"`
+}
+
+// https://www.elastic.co/guide/en/elasticsearch/reference/7.17/query-dsl-multi-match-query.html
+type MultiMatch struct {
+	Query               string         `json:"query"`
+	Fields              []string       `json:"fields"`
+	Type                string         `json:"type"`
+	TieBreaker          *float64       `json:"tie_breaker"`
+	Analyzer            string         `json:"analyzer"`
+	Fuzziness           StringOrNumber `json:"fuzziness"`
+	PrefixLength        int            `json:"prefix_length"`
+	MaxExpansions       *int           `json:"max_expansions"`
+	FuzzyTranspositions *bool          `json:"fuzzy_transpositions"`
+	Operator            string         `json:"operator"`
+	MinimumShouldMatch  StringOrNumber `json:"minimum_should_match"`
+	Slop                int            `json:"slop"`
+	ZeroTermsQuery      string         `json:"zero_terms_query"`
+	Lenient             bool           `json:"lenient"`
+	Boost               *float64       `json:"boost"`
 }
 
 type Bool struct {
@@ -49,28 +179,37 @@ type Bool struct {
 	Must      []Query
 	RawShould json.RawMessage `json:"should"`
 	Should    []Query
-	// Filter is similar to must, but not relevant to scoring, which we don't really use for
-	// the moment anyway so it's basically the same.
-	Filter []Query `json:"filter"`
+	// Filter is similar to must, but not relevant to scoring
+	RawFilter  json.RawMessage `json:"filter"`
+	Filter     []Query
+	RawMustNot json.RawMessage `json:"must_not"`
+	MustNot    []Query
+
+	MinimumShouldMatch StringOrNumber `json:"minimum_should_match"`
+	Boost              *float64       `json:"boost"`
 }
 
 type Range struct {
-	Gt *json.Number `json:"gt"`
-	// TODO Post-process to copy from -> gt since they're equivalent
-	// from == gt
-	// to == lt
-	From   *json.Number `json:"from"`
-	Gte    *json.Number `json:"gte"`
-	Lt     *json.Number `json:"lt"`
-	To     *json.Number `json:"to"`
-	Lte    *json.Number `json:"lte"`
-	Format *string      `json:"format"`
-	// These have been deprecated since version 0.9 (!) but some clients
-	// in the wild still depend on them.
+	Gt  *StringOrNumber `json:"gt"`
+	Gte *StringOrNumber `json:"gte"`
+	Lt  *StringOrNumber `json:"lt"`
+	Lte *StringOrNumber `json:"lte"`
+	// The older form of the bounds, inclusive unless include_lower/include_upper
+	// say otherwise. These have been deprecated since version 0.9 (!) but some
+	// clients in the wild still depend on them.
 	// https://github.com/elastic/elasticsearch/issues/48538
-	IncludeLower bool   `json:"include_lower"`
-	IncludeUpper bool   `json:"include_upper"`
-	Boost        string `json:"boost"`
+	From         *StringOrNumber `json:"from"`
+	To           *StringOrNumber `json:"to"`
+	IncludeLower *bool           `json:"include_lower"`
+	IncludeUpper *bool           `json:"include_upper"`
+	Format       *string         `json:"format"`
+	// Applies to date bounds that don't have an offset of their own, and to the
+	// rounding of date math
+	TimeZone string `json:"time_zone"`
+	// How the query range matches the values of range fields: intersects (the
+	// default), contains or within
+	Relation string   `json:"relation"`
+	Boost    *float64 `json:"boost"`
 }
 
 // https://www.elastic.co/guide/en/elasticsearch/reference/current/sort-search-results.html
@@ -81,7 +220,52 @@ type Sort struct {
 
 // https://www.elastic.co/guide/en/elasticsearch/reference/7.17/query-dsl-query-string-query.htmlj
 type QueryString struct {
-	Query           string `json:"query"`
-	AnalyzeWildcard bool   `json:"analyze_wildcard"`
-	DefaultField    string `json:"default_field"`
+	Query                string         `json:"query"`
+	DefaultField         string         `json:"default_field"`
+	Fields               []string       `json:"fields"`
+	DefaultOperator      string         `json:"default_operator"`
+	Analyzer             string         `json:"analyzer"`
+	QuoteAnalyzer        string         `json:"quote_analyzer"`
+	AllowLeadingWildcard *bool          `json:"allow_leading_wildcard"`
+	AnalyzeWildcard      bool           `json:"analyze_wildcard"`
+	Fuzziness            StringOrNumber `json:"fuzziness"`
+	FuzzyMaxExpansions   *int           `json:"fuzzy_max_expansions"`
+	FuzzyPrefixLength    int            `json:"fuzzy_prefix_length"`
+	FuzzyTranspositions  *bool          `json:"fuzzy_transpositions"`
+	Lenient              bool           `json:"lenient"`
+	MinimumShouldMatch   StringOrNumber `json:"minimum_should_match"`
+	PhraseSlop           int            `json:"phrase_slop"`
+	TieBreaker           *float64       `json:"tie_breaker"`
+	Boost                *float64       `json:"boost"`
+}
+
+// https://www.elastic.co/guide/en/elasticsearch/reference/7.17/query-dsl-simple-query-string-query.html
+type SimpleQueryString struct {
+	Query               string         `json:"query"`
+	Fields              []string       `json:"fields"`
+	DefaultOperator     string         `json:"default_operator"`
+	Analyzer            string         `json:"analyzer"`
+	Flags               string         `json:"flags"`
+	FuzzyMaxExpansions  *int           `json:"fuzzy_max_expansions"`
+	FuzzyPrefixLength   int            `json:"fuzzy_prefix_length"`
+	FuzzyTranspositions *bool          `json:"fuzzy_transpositions"`
+	Lenient             bool           `json:"lenient"`
+	MinimumShouldMatch  StringOrNumber `json:"minimum_should_match"`
+	Boost               *float64       `json:"boost"`
+}
+
+// https://www.elastic.co/guide/en/elasticsearch/reference/7.17/query-dsl-wildcard-query.html
+type Wildcard struct {
+	Value string `json:"value"`
+	// An alias of value
+	Wildcard        string   `json:"wildcard"`
+	Boost           *float64 `json:"boost"`
+	CaseInsensitive bool     `json:"case_insensitive"`
+	Rewrite         string   `json:"rewrite"`
+}
+
+// https://www.elastic.co/guide/en/elasticsearch/reference/7.17/query-dsl-exists-query.html
+type Exists struct {
+	Field string   `json:"field"`
+	Boost *float64 `json:"boost"`
 }
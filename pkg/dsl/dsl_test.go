@@ -256,3 +256,105 @@ func TestRangeWithBooleanParams(t *testing.T) {
 	require.NoError(t, err)
 	repr.Println(dsl)
 }
+
+func TestBoolMustAndShould(t *testing.T) {
+	dsl := &Dsl{}
+	q := `
+	{
+		"query":{"bool":{
+			"must":{"match":{"foo":"bar"}},
+			"should":[{"match":{"oof":{"query":"rab","boost":2}}}],
+			"boost":1.5
+		}},
+		"min_score":0.5
+	}`
+
+	err := json.Unmarshal([]byte(q), &dsl)
+	require.NoError(t, err)
+	require.Equal(t, len(dsl.Query.Bool.Must), 1)
+	require.Equal(t, len(dsl.Query.Bool.Should), 1)
+	require.Equal(t, *dsl.Query.Bool.Should[0].Match["oof"].Boost, 2.0)
+	require.Equal(t, *dsl.Query.Bool.Boost, 1.5)
+	require.Equal(t, *dsl.MinScore, 0.5)
+}
+
+func TestPhraseAndMultiMatch(t *testing.T) {
+	dsl := &Dsl{}
+	q := `
+	{
+		"query":{"bool":{
+			"must":[
+				{"match_phrase":{"foo":"bar baz"}},
+				{"match_phrase_prefix":{"foo":{"query":"bar ba","slop":1}}},
+				{"multi_match":{"query":"bar","fields":["foo^2","oof"],"type":"most_fields"}}
+			]
+		}}
+	}`
+
+	err := json.Unmarshal([]byte(q), &dsl)
+	require.NoError(t, err)
+	must := dsl.Query.Bool.Must
+	require.Equal(t, must[0].MatchPhrase["foo"].Query, "bar baz")
+	require.Equal(t, must[1].MatchPhrasePrefix["foo"].Slop, 1)
+	require.Equal(t, must[2].MultiMatch.Fields, []string{"foo^2", "oof"})
+	require.Equal(t, must[2].MultiMatch.Type, "most_fields")
+}
+
+func TestBoolAllClauses(t *testing.T) {
+	dsl := &Dsl{}
+	q := `
+	{
+		"query":{"bool":{
+			"filter":{"term":{"foo":"bar"}},
+			"must_not":[{"term":{"oof":"rab"}},{"bool":{"should":{"match":{"baz":"qux"}}}}],
+			"minimum_should_match":"75%"
+		}}
+	}`
+
+	err := json.Unmarshal([]byte(q), &dsl)
+	require.NoError(t, err)
+	require.Equal(t, dsl.Query.Bool.Filter[0].Term["foo"].Value, "bar")
+	require.Equal(t, len(dsl.Query.Bool.MustNot), 2)
+	require.Equal(t, dsl.Query.Bool.MustNot[1].Bool.Should[0].Match["baz"].Query, "qux")
+	require.Equal(t, dsl.Query.Bool.MinimumShouldMatch, StringOrNumber("75%"))
+}
+
+func TestTermLevelQueries(t *testing.T) {
+	dsl := &Dsl{}
+	q := `
+	{
+		"query":{"bool":{
+			"filter":[
+				{"terms":{"user.id":["kimchy", 42], "boost": 2}},
+				{"terms":{"color":{"index":"my-index","id":"2","path":"color"}}},
+				{"term":{"status":{"value":500}}},
+				{"prefix":{"host":"web"}},
+				{"wildcard":{"host":{"wildcard":"*.prod","case_insensitive":true}}},
+				{"regexp":{"host":{"value":"web-[0-9]+","flags":"ALL"}}},
+				{"fuzzy":{"user":{"value":"ki","fuzziness":1}}},
+				{"ids":{"values":["1","2"]}},
+				{"match_all":{"boost":1.2}},
+				{"match_none":{}}
+			]
+		}}
+	}`
+
+	err := json.Unmarshal([]byte(q), &dsl)
+	require.NoError(t, err)
+	f := dsl.Query.Bool.Filter
+	require.Equal(t, f[0].Terms.Field, "user.id")
+	require.Equal(t, f[0].Terms.Values, []string{"kimchy", "42"})
+	require.Equal(t, *f[0].Terms.Boost, 2.0)
+	require.Equal(t, f[1].Terms.Lookup.Path, "color")
+	require.Equal(t, f[2].Term["status"].Value, "500")
+	require.Equal(t, f[3].Prefix["host"].Value, "web")
+	require.Equal(t, f[4].Wildcard["host"].Wildcard, "*.prod")
+	require.Equal(t, f[5].Regexp["host"].Flags, "ALL")
+	require.Equal(t, f[6].Fuzzy["user"].Fuzziness, "1")
+	require.Equal(t, f[7].Ids.Values, []string{"1", "2"})
+	require.Equal(t, *f[8].MatchAll.Boost, 1.2)
+	require.True(t, f[9].MatchNone != nil)
+
+	err = json.Unmarshal([]byte(`{"query":{"terms":{"a":["x"],"b":["y"]}}}`), &dsl)
+	require.Error(t, err)
+}
@@ -3,7 +3,38 @@ package dsl
 // Custom json handling methods to deal with all the wacky ways ES allows users
 // to submit queries
 
-import "encoding/json"
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// Some parameters, eg. fuzziness and minimum_should_match, can be given as
+// either a string or a number. Term values can be booleans as well
+type StringOrNumber string
+
+func (sn *StringOrNumber) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*sn = StringOrNumber(s)
+		return nil
+	}
+	var bl bool
+	if err := json.Unmarshal(b, &bl); err == nil {
+		*sn = StringOrNumber(shortFormValue(bl))
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(b, &n); err != nil {
+		return err
+	}
+	*sn = StringOrNumber(n.String())
+	return nil
+}
+
+func (sn StringOrNumber) String() string {
+	return string(sn)
+}
 
 func (jq *Query) UnmarshalJSON(b []byte) error {
 	// ES accepts a shorthand version of the match structure, so use this custom unmarshaller
@@ -18,6 +49,45 @@ func (jq *Query) UnmarshalJSON(b []byte) error {
 
 	jq.Bool = base.Bool
 	jq.Range = base.Range
+	jq.QueryString = base.QueryString
+	jq.MultiMatch = base.MultiMatch
+	jq.SimpleQueryString = base.SimpleQueryString
+	jq.Exists = base.Exists
+	jq.Ids = base.Ids
+	jq.MatchAll = base.MatchAll
+	jq.MatchNone = base.MatchNone
+
+	if err := expandShortForm(base.RawMatchPhrase, "query", &jq.MatchPhrase); err != nil {
+		return err
+	}
+	if err := expandShortForm(base.RawMatchPhrasePrefix, "query", &jq.MatchPhrasePrefix); err != nil {
+		return err
+	}
+	if err := expandShortForm(base.RawMatchBoolPrefix, "query", &jq.MatchBoolPrefix); err != nil {
+		return err
+	}
+	if err := expandShortForm(base.RawTerm, "value", &jq.Term); err != nil {
+		return err
+	}
+	if err := expandShortForm(base.RawPrefix, "value", &jq.Prefix); err != nil {
+		return err
+	}
+	if err := expandShortForm(base.RawWildcard, "value", &jq.Wildcard); err != nil {
+		return err
+	}
+	if err := expandShortForm(base.RawRegexp, "value", &jq.Regexp); err != nil {
+		return err
+	}
+	if err := expandShortForm(base.RawFuzzy, "value", &jq.Fuzzy); err != nil {
+		return err
+	}
+	if len(base.RawTerms) > 0 {
+		terms, err := unmarshalTerms(base.RawTerms)
+		if err != nil {
+			return err
+		}
+		jq.Terms = terms
+	}
 
 	if len(base.RawMatch) > 0 {
 
@@ -27,6 +97,9 @@ func (jq *Query) UnmarshalJSON(b []byte) error {
 			if v, ok := rawVal.(string); ok {
 				jm := Match{Query: v}
 				jq.Match[k] = jm
+			} else if _, ok := rawVal.(map[string]interface{}); !ok {
+				// Numbers and booleans can be matched in the short form too
+				jq.Match[k] = Match{Query: shortFormValue(rawVal)}
 			} else {
 				// I can't find any better way to re-parse this map[string]interface{}
 				// back to our struct than to redo the serialization from JSON.
@@ -43,29 +116,77 @@ func (jq *Query) UnmarshalJSON(b []byte) error {
 		}
 	}
 
-	if len(base.RawTerm) > 0 {
-
-		jq.Term = make(map[string]Term, len(base.RawTerm))
+	return nil
+}
 
-		for k, rawVal := range base.RawTerm {
-			if v, ok := rawVal.(string); ok {
-				jm := Term{Value: v}
-				jq.Term[k] = jm
-			} else {
-				s, err := json.Marshal(rawVal)
-				if err != nil {
-					return err
-				}
-				jm := Term{}
-				if err = json.Unmarshal([]byte(s), &jm); err != nil {
-					return err
+// The terms query has the field as a key next to its other parameters, eg.
+// {"terms": {"user.id": ["kimchy", "elkbee"], "boost": 1.0}}
+func unmarshalTerms(raw map[string]json.RawMessage) (*Terms, error) {
+	terms := &Terms{}
+	for k, v := range raw {
+		if k == "boost" {
+			if err := json.Unmarshal(v, &terms.Boost); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if terms.Field != "" {
+			return nil, fmt.Errorf("[terms] query does not support multiple fields")
+		}
+		terms.Field = k
+		values := make([]interface{}, 0)
+		if err := json.Unmarshal(v, &values); err == nil {
+			terms.Values = make([]string, 0, len(values))
+			for _, val := range values {
+				if s, ok := val.(string); ok {
+					terms.Values = append(terms.Values, s)
+				} else {
+					terms.Values = append(terms.Values, shortFormValue(val))
 				}
-				jq.Term[k] = jm
 			}
+			continue
+		}
+		terms.Lookup = &TermsLookup{}
+		if err := json.Unmarshal(v, terms.Lookup); err != nil {
+			return nil, err
 		}
 	}
+	if terms.Field == "" {
+		return nil, fmt.Errorf("[terms] query requires a field")
+	}
+	return terms, nil
+}
 
-	return nil
+// Field level queries can be given in a short form with just the value, eg.
+// {"match_phrase": {"foo": "bar baz"}}. Expand any of those to the full form,
+// with the value under key, and decode the lot into target
+func expandShortForm(raw map[string]interface{}, key string, target interface{}) error {
+	if len(raw) == 0 {
+		return nil
+	}
+	full := make(map[string]interface{}, len(raw))
+	for k, rawVal := range raw {
+		switch v := rawVal.(type) {
+		case map[string]interface{}:
+			full[k] = v
+		case string:
+			full[k] = map[string]interface{}{key: v}
+		default:
+			full[k] = map[string]interface{}{key: shortFormValue(v)}
+		}
+	}
+	b, err := json.Marshal(full)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, target)
+}
+
+// Scalar values are re-encoded, rather than formatted, so that large integers
+// don't end up in exponent form
+func shortFormValue(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
 }
 
 func (jd *Dsl) UnmarshalJSON(b []byte) error {
@@ -78,6 +199,8 @@ func (jd *Dsl) UnmarshalJSON(b []byte) error {
 	jd.Query = base.Query
 	jd.Size = base.Size
 	jd.Sort = base.Sort
+	jd.MinScore = base.MinScore
+	jd.TrackScores = base.TrackScores
 	if len(base.RawAggregations) > 0 {
 		jd.Aggs = base.RawAggregations
 	} else if len(base.RawAggs) > 0 {
@@ -87,6 +210,23 @@ func (jd *Dsl) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+// Sub-aggregations can be under either "aggregations" or "aggs"
+func (a *Aggregate) UnmarshalJSON(b []byte) error {
+	type Aggregate_ Aggregate
+	var base struct {
+		Aggregate_
+		RawAggs map[string]Aggregate `json:"aggs"`
+	}
+	if err := json.Unmarshal(b, &base); err != nil {
+		return err
+	}
+	*a = Aggregate(base.Aggregate_)
+	if len(a.Aggs) == 0 && len(base.RawAggs) > 0 {
+		a.Aggs = base.RawAggs
+	}
+	return nil
+}
+
 func (bl *Bool) UnmarshalJSON(b []byte) error {
 	type Bool_ Bool
 	var base Bool_
@@ -95,44 +235,281 @@ func (bl *Bool) UnmarshalJSON(b []byte) error {
 	if err = json.Unmarshal(b, &base); err != nil {
 		return err
 	}
-	// Let's hope we don't discover any dual cases for Filter
-	bl.Filter = base.Filter
+	bl.MinimumShouldMatch = base.MinimumShouldMatch
+	bl.Boost = base.Boost
 
+	// Each of the clauses can be provided with a single object or an array
+	if bl.Must, err = unmarshalClauses(base.RawMust); err != nil {
+		return err
+	}
+	if bl.Should, err = unmarshalClauses(base.RawShould); err != nil {
+		return err
+	}
+	if bl.Filter, err = unmarshalClauses(base.RawFilter); err != nil {
+		return err
+	}
+	bl.MustNot, err = unmarshalClauses(base.RawMustNot)
+	return err
+}
+
+func unmarshalClauses(raw json.RawMessage) ([]Query, error) {
+	if raw == nil {
+		return nil, nil
+	}
 	m1 := Query{}
+	if err := json.Unmarshal(raw, &m1); err == nil {
+		return []Query{m1}, nil
+	}
 	m2 := make([]Query, 0)
+	err := json.Unmarshal(raw, &m2)
+	return m2, err
+}
+
+// The criteria buckets are ordered by, eg. {"_count": "desc"}, which can be given
+// as a single object or a list of them to break ties
+type TermsOrder []OrderCriterion
+
+type OrderCriterion struct {
+	// _count, _key or the path of a sub-aggregation, eg. stats.avg
+	Key       string
+	Direction string
+}
 
-	if base.RawMust != nil {
-		// Must can be provided with a single object or an array
-		err = json.Unmarshal(base.RawMust, &m1)
-		if err == nil {
-			bl.Must = append(bl.Must, m1)
-			return nil
+func (to *TermsOrder) UnmarshalJSON(b []byte) error {
+	raws := make([]json.RawMessage, 0)
+	if err := json.Unmarshal(b, &raws); err != nil {
+		raws = []json.RawMessage{b}
+	}
+	order := make(TermsOrder, 0, len(raws))
+	for _, raw := range raws {
+		// Objects are decoded by token so that their keys stay in order
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+			return fmt.Errorf("order must be an object or an array of objects")
 		}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			var dir string
+			if err := dec.Decode(&dir); err != nil {
+				return err
+			}
+			order = append(order, OrderCriterion{Key: key.(string), Direction: dir})
+		}
+	}
+	*to = order
+	return nil
+}
+
+// The terms to include in or exclude from a terms aggregation: a regular
+// expression, a list of exact values, or for include, one partition of the terms
+type IncludeExclude struct {
+	Regexp string
+	Values []interface{}
+	// Partitioned, the terms are split by their hash into NumPartitions groups
+	Partition     *int `json:"partition"`
+	NumPartitions *int `json:"num_partitions"`
+}
+
+func (ie *IncludeExclude) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &ie.Regexp); err == nil {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&ie.Values); err == nil {
+		return nil
+	}
+	type IncludeExclude_ IncludeExclude
+	var base IncludeExclude_
+	if err := json.Unmarshal(b, &base); err != nil {
+		return err
+	}
+	ie.Partition, ie.NumPartitions = base.Partition, base.NumPartitions
+	return nil
+}
+
+// The paths of a bucket_script or bucket_selector by the names of their params. A
+// single path is named _value
+type BucketsPath map[string]string
 
-		err = json.Unmarshal(base.RawMust, &m2)
-		if err == nil {
-			bl.Must = m2
-			return nil
+func (bp *BucketsPath) UnmarshalJSON(b []byte) error {
+	var path string
+	if err := json.Unmarshal(b, &path); err == nil {
+		*bp = BucketsPath{"_value": path}
+		return nil
+	}
+	paths := make(map[string]string)
+	if err := json.Unmarshal(b, &paths); err != nil {
+		return err
+	}
+	*bp = paths
+	return nil
+}
+
+// A script as its source alone, or an object with the source and its params
+type Script struct {
+	Source string                 `json:"source"`
+	Lang   string                 `json:"lang"`
+	Params map[string]interface{} `json:"params"`
+}
+
+func (sc *Script) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &sc.Source); err == nil {
+		return nil
+	}
+	type Script_ Script
+	var base struct {
+		Script_
+		// The deprecated name of source
+		Inline string `json:"inline"`
+	}
+	if err := json.Unmarshal(b, &base); err != nil {
+		return err
+	}
+	*sc = Script(base.Script_)
+	if sc.Source == "" {
+		sc.Source = base.Inline
+	}
+	return nil
+}
+
+// The fields of a sort, each of which can be just its name, or by its name either
+// the order or an object with it, eg. [{"total": {"order": "desc"}}]
+type SortFields []OrderCriterion
+
+func (sf *SortFields) UnmarshalJSON(b []byte) error {
+	raws := make([]json.RawMessage, 0)
+	if err := json.Unmarshal(b, &raws); err != nil {
+		raws = []json.RawMessage{b}
+	}
+	fields := make(SortFields, 0, len(raws))
+	for _, raw := range raws {
+		var name string
+		if err := json.Unmarshal(raw, &name); err == nil {
+			fields = append(fields, OrderCriterion{Key: name})
+			continue
 		}
+		sorts := make(map[string]json.RawMessage)
+		if err := json.Unmarshal(raw, &sorts); err != nil {
+			return err
+		}
+		for name, v := range sorts {
+			c := OrderCriterion{Key: name}
+			if err := json.Unmarshal(v, &c.Direction); err != nil {
+				var s Sort
+				if err := json.Unmarshal(v, &s); err != nil {
+					return err
+				}
+				c.Direction = s.Order
+			}
+			fields = append(fields, c)
+		}
+	}
+	*sf = fields
+	return nil
+}
+
+// Filters are an object by their names, or an array of anonymous ones
+func (fa *FiltersAgg) UnmarshalJSON(b []byte) error {
+	type FiltersAgg_ FiltersAgg
+	var base struct {
+		FiltersAgg_
+		RawFilters json.RawMessage `json:"filters"`
+	}
+	if err := json.Unmarshal(b, &base); err != nil {
+		return err
 	}
-	// TODO This approach to handling these variable types needs to be
-	// generalized somehow
-	// Should can also be provided with a single object or an array
-	if base.RawShould != nil {
-		m1 = Query{}
-		m2 = make([]Query, 0)
-		err = json.Unmarshal(base.RawShould, &m1)
-		if err == nil {
-			bl.Should = append(bl.Should, m1)
-			return nil
+	*fa = FiltersAgg(base.FiltersAgg_)
+	if bytes.HasPrefix(bytes.TrimSpace(base.RawFilters), []byte("[")) {
+		return json.Unmarshal(base.RawFilters, &fa.Anonymous)
+	}
+	if len(base.RawFilters) == 0 {
+		return nil
+	}
+	return json.Unmarshal(base.RawFilters, &fa.Filters)
+}
+
+// Sources are an array of objects with the one source each, keyed by its name
+func (cs *CompositeSources) UnmarshalJSON(b []byte) error {
+	raws := make([]map[string]CompositeSource, 0)
+	if err := json.Unmarshal(b, &raws); err != nil {
+		return err
+	}
+	sources := make(CompositeSources, 0, len(raws))
+	for _, raw := range raws {
+		if len(raw) != 1 {
+			return fmt.Errorf("each of the composite sources must have exactly one name")
+		}
+		for name, source := range raw {
+			source.Name = name
+			sources = append(sources, source)
 		}
+	}
+	*cs = sources
+	return nil
+}
+
+func (ca *CompositeAfter) UnmarshalJSON(b []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	after := make(map[string]interface{})
+	if err := dec.Decode(&after); err != nil {
+		return err
+	}
+	*ca = after
+	return nil
+}
 
-		err = json.Unmarshal(base.RawShould, &m2)
-		if err == nil {
-			bl.Should = m2
-			return nil
+func (tf *TopMetricsFields) UnmarshalJSON(b []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("[")) {
+		fields := make([]AggField, 0)
+		if err := json.Unmarshal(b, &fields); err != nil {
+			return err
 		}
+		*tf = fields
+		return nil
+	}
+	var field AggField
+	if err := json.Unmarshal(b, &field); err != nil {
+		return err
 	}
+	*tf = TopMetricsFields{field}
+	return nil
+}
 
-	return err
+// Which fields of the _source of hits are shown: none if it is disabled, or those
+// matching any of the includes if there are some, less those matching excludes.
+// It can be given as a boolean, a pattern, a list of them, or an object with both
+type SourceFilter struct {
+	Disabled bool     `json:"-"`
+	Includes []string `json:"includes"`
+	Excludes []string `json:"excludes"`
+}
+
+func (sf *SourceFilter) UnmarshalJSON(b []byte) error {
+	var enabled bool
+	if err := json.Unmarshal(b, &enabled); err == nil {
+		*sf = SourceFilter{Disabled: !enabled}
+		return nil
+	}
+	var pattern string
+	if err := json.Unmarshal(b, &pattern); err == nil {
+		*sf = SourceFilter{Includes: []string{pattern}}
+		return nil
+	}
+	patterns := make([]string, 0)
+	if err := json.Unmarshal(b, &patterns); err == nil {
+		*sf = SourceFilter{Includes: patterns}
+		return nil
+	}
+	type SourceFilter_ SourceFilter
+	var f SourceFilter_
+	if err := json.Unmarshal(b, &f); err != nil {
+		return err
+	}
+	*sf = SourceFilter(f)
+	return nil
 }
@@ -0,0 +1,792 @@
+package dsl
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/participle/v2"
+	"github.com/alecthomas/participle/v2/lexer"
+)
+
+/*
+
+The Lucene query syntax used by query_string, parsed into the same Query types as
+the rest of the DSL so that it compiles to sql the same way:
+
+	service:frontend AND status:[400 TO 599] -debug
+
+https://www.elastic.co/guide/en/elasticsearch/reference/7.17/query-dsl-query-string-query.html#query-string-syntax
+
+Like Lucene's classic query parser, a query is a flat list of clauses, each of
+which can be required (+), prohibited (-) or optional. AND and OR don't have a
+precedence of their own; they change whether the clauses either side of them
+are required, so `a OR b AND c` requires b and c, with a only adding to the score.
+
+*/
+
+var luceneLexer = lexer.MustSimple([]lexer.SimpleRule{
+	{Name: "Whitespace", Pattern: `\s+`},
+	{Name: "Phrase", Pattern: `"(?:\\.|[^"\\])*"`},
+	{Name: "Fuzzy", Pattern: `~[0-9]*(?:\.[0-9]+)?`},
+	{Name: "Boost", Pattern: `\^[0-9]+(?:\.[0-9]+)?`},
+	{Name: "Compare", Pattern: `[<>]=?`},
+	{Name: "Operator", Pattern: `&&|\|\||[-+!():\[\]{}]`},
+	// Terms can't start with an operator, but can contain - and +, eg. dates
+	{Name: "Term", Pattern: `(?:\\.|[^\s"~^<>&|+\-!():\[\]{}\\])(?:\\.|[^\s"~^!():\[\]{}\\])*`},
+})
+
+type luceneQuery struct {
+	Clauses []*luceneClause `parser:"@@*"`
+}
+
+type luceneClause struct {
+	Conjunction string         `parser:"@(\"AND\" | \"OR\" | \"&&\" | \"||\")?"`
+	Modifier    string         `parser:"@(\"+\" | \"-\" | \"NOT\" | \"!\")?"`
+	Field       string         `parser:"(@Term \":\")?"`
+	Group       *luceneQuery   `parser:"( \"(\" @@ \")\""`
+	Range       *luceneRange   `parser:"| @@"`
+	Compare     *luceneCompare `parser:"| @@"`
+	Phrase      *string        `parser:"| @Phrase"`
+	Term        *string        `parser:"| @Term )"`
+	Fuzzy       *string        `parser:"@Fuzzy?"`
+	Boost       *string        `parser:"@Boost?"`
+}
+
+// Ranges can mix inclusive [] and exclusive {} bounds, with * for an open bound
+type luceneRange struct {
+	Open  string `parser:"@(\"[\" | \"{\")"`
+	From  string `parser:"@(Phrase | \"-\"? Term)"`
+	To    string `parser:"\"TO\" @(Phrase | \"-\"? Term)"`
+	Close string `parser:"@(\"]\" | \"}\")"`
+}
+
+// The one sided form of a range, eg. `status:>=400`
+type luceneCompare struct {
+	Op    string `parser:"@Compare"`
+	Value string `parser:"@(Phrase | \"-\"? Term)"`
+}
+
+// Groups can only be nested so deep, as with ES' max_nested_depth, which also
+// keeps the recursive parsers from exhausting the stack
+const maxNestedDepth = 20
+
+// The depth of the deepest group of a query, outside of phrases and escapes
+func groupDepth(q string) int {
+	depth, deepest := 0, 0
+	phrase := false
+	for i := 0; i < len(q); i++ {
+		switch c := q[i]; {
+		case c == '\\':
+			i++
+		case c == '"':
+			phrase = !phrase
+		case phrase:
+		case c == '(':
+			if depth++; depth > deepest {
+				deepest = depth
+			}
+		case c == ')' && depth > 0:
+			depth--
+		}
+	}
+	return deepest
+}
+
+// Query strings compile to bool queries nested as deeply as their groups and
+// changes of operator, and sqlite can only parse the sql of so many levels of them.
+// This is as deep as the sql of the deepest clauses, should clauses of fuzzy
+// matches against several fields, still parses
+const maxBoolDepth = 5
+
+// The number of bool queries nested in each other at the deepest point of q
+func boolDepth(q *Query) int {
+	if q.Bool == nil {
+		return 0
+	}
+	deepest := 0
+	for _, clauses := range [][]Query{q.Bool.Must, q.Bool.Filter, q.Bool.Should, q.Bool.MustNot} {
+		for i := range clauses {
+			if d := boolDepth(&clauses[i]); d > deepest {
+				deepest = d
+			}
+		}
+	}
+	return deepest + 1
+}
+
+func checkBoolDepth(q *Query) error {
+	if d := boolDepth(q); d > maxBoolDepth {
+		return fmt.Errorf("the query nests [%d] bool queries, more than the maximum depth of [%d]", d, maxBoolDepth)
+	}
+	return nil
+}
+
+var luceneParser = participle.MustBuild(&luceneQuery{},
+	participle.Lexer(luceneLexer),
+	participle.Elide("Whitespace"),
+	participle.UseLookahead(2),
+)
+
+// How a clause takes part in the boolean query it belongs to
+type occur int
+
+const (
+	occurShould occur = iota
+	occurMust
+	occurMustNot
+)
+
+// Options shared by query_string and simple_query_string for turning their terms
+// into queries against the default fields
+type termOptions struct {
+	fields               []string
+	and                  bool
+	analyzer             string
+	quoteAnalyzer        string
+	allowLeadingWildcard bool
+	fuzziness            string
+	maxExpansions        *int
+	prefixLength         int
+	transpositions       *bool
+	lenient              bool
+	phraseSlop           int
+	tieBreaker           *float64
+}
+
+// Parse the query into the equivalent DSL query
+func (qs *QueryString) Parse() (*Query, error) {
+	opts := termOptions{
+		fields:               defaultFields(qs.Fields, qs.DefaultField),
+		and:                  strings.EqualFold(qs.DefaultOperator, "and"),
+		analyzer:             qs.Analyzer,
+		quoteAnalyzer:        qs.QuoteAnalyzer,
+		allowLeadingWildcard: qs.AllowLeadingWildcard == nil || *qs.AllowLeadingWildcard,
+		fuzziness:            string(qs.Fuzziness),
+		maxExpansions:        qs.FuzzyMaxExpansions,
+		prefixLength:         qs.FuzzyPrefixLength,
+		transpositions:       qs.FuzzyTranspositions,
+		lenient:              qs.Lenient,
+		phraseSlop:           qs.PhraseSlop,
+		tieBreaker:           qs.TieBreaker,
+	}
+	if opts.fuzziness == "" {
+		opts.fuzziness = "AUTO"
+	}
+	if opts.quoteAnalyzer == "" {
+		opts.quoteAnalyzer = opts.analyzer
+	}
+
+	// A bare * is common enough to skip the parser for
+	if q := strings.TrimSpace(qs.Query); q == "" || q == "*" {
+		return &Query{MatchAll: &MatchAll{Boost: qs.Boost}}, nil
+	}
+	if groupDepth(qs.Query) > maxNestedDepth {
+		return nil, fmt.Errorf("groups are nested more than the maximum depth of [%d]", maxNestedDepth)
+	}
+	lq := &luceneQuery{}
+	if err := luceneParser.ParseString("", qs.Query, lq); err != nil {
+		return nil, err
+	}
+	q, err := opts.compileQuery(lq, opts.fields)
+	if err != nil {
+		return nil, err
+	}
+	if qs.MinimumShouldMatch != "" && q.Bool != nil {
+		q.Bool.MinimumShouldMatch = qs.MinimumShouldMatch
+	}
+	bq := boosted(q, qs.Boost)
+	if err := checkBoolDepth(bq); err != nil {
+		return nil, err
+	}
+	return bq, nil
+}
+
+// Fields listed with `fields` take precedence over default_field, and without
+// either every field is searched
+func defaultFields(fields []string, defaultField string) []string {
+	if len(fields) > 0 {
+		return fields
+	}
+	if defaultField != "" {
+		return []string{defaultField}
+	}
+	return []string{"*"}
+}
+
+// Wrap a query so that its score is multiplied by boost
+func boosted(q Query, boost *float64) *Query {
+	if boost == nil {
+		return &q
+	}
+	return &Query{Bool: &Bool{Must: []Query{q}, Boost: boost}}
+}
+
+func (o *termOptions) compileQuery(lq *luceneQuery, fields []string) (Query, error) {
+	queries := make([]Query, 0, len(lq.Clauses))
+	occurs := make([]occur, 0, len(lq.Clauses))
+	for i, c := range lq.Clauses {
+		and := c.Conjunction == "AND" || c.Conjunction == "&&"
+		or := c.Conjunction == "OR" || c.Conjunction == "||"
+
+		// A conjunction changes the clause before it as well, as in Lucene's
+		// QueryParserBase.addClause
+		if i > 0 && occurs[i-1] != occurMustNot {
+			if and {
+				occurs[i-1] = occurMust
+			} else if o.and && or {
+				occurs[i-1] = occurShould
+			}
+		}
+		prohibited := c.Modifier == "-" || c.Modifier == "NOT" || c.Modifier == "!"
+		required := c.Modifier == "+"
+		if o.and {
+			required = !prohibited && !or
+		} else if and && !prohibited {
+			required = true
+		}
+
+		q, err := o.compileClause(c, fields)
+		if err != nil {
+			return Query{}, err
+		}
+		queries = append(queries, q)
+		switch {
+		case prohibited:
+			occurs = append(occurs, occurMustNot)
+		case required:
+			occurs = append(occurs, occurMust)
+		default:
+			occurs = append(occurs, occurShould)
+		}
+	}
+
+	if len(queries) == 1 && occurs[0] != occurMustNot {
+		return queries[0], nil
+	}
+	b := &Bool{}
+	for i, q := range queries {
+		switch occurs[i] {
+		case occurMust:
+			b.Must = append(b.Must, q)
+		case occurMustNot:
+			b.MustNot = append(b.MustNot, q)
+		default:
+			b.Should = append(b.Should, q)
+		}
+	}
+	return Query{Bool: b}, nil
+}
+
+func (o *termOptions) compileClause(c *luceneClause, fields []string) (Query, error) {
+	if c.Field != "" {
+		fields = []string{unescapeTerm(c.Field)}
+	}
+	var boost *float64
+	if c.Boost != nil {
+		b, err := strconv.ParseFloat(strings.TrimPrefix(*c.Boost, "^"), 64)
+		if err != nil {
+			return Query{}, err
+		}
+		boost = &b
+	}
+
+	switch {
+	case c.Group != nil:
+		q, err := o.compileQuery(c.Group, fields)
+		if err != nil {
+			return Query{}, err
+		}
+		return *boosted(q, boost), nil
+
+	case c.Range != nil:
+		rng := Range{Boost: boost}
+		if from := rangeBound(c.Range.From); from != nil {
+			if c.Range.Open == "[" {
+				rng.Gte = from
+			} else {
+				rng.Gt = from
+			}
+		}
+		if to := rangeBound(c.Range.To); to != nil {
+			if c.Range.Close == "]" {
+				rng.Lte = to
+			} else {
+				rng.Lt = to
+			}
+		}
+		return o.rangeQuery(fields, rng)
+
+	case c.Compare != nil:
+		rng := Range{Boost: boost}
+		bound := rangeBound(c.Compare.Value)
+		switch c.Compare.Op {
+		case ">":
+			rng.Gt = bound
+		case ">=":
+			rng.Gte = bound
+		case "<":
+			rng.Lt = bound
+		case "<=":
+			rng.Lte = bound
+		}
+		return o.rangeQuery(fields, rng)
+
+	case c.Phrase != nil:
+		slop := o.phraseSlop
+		if c.Fuzzy != nil && len(*c.Fuzzy) > 1 {
+			s, err := strconv.ParseFloat((*c.Fuzzy)[1:], 64)
+			if err != nil {
+				return Query{}, err
+			}
+			slop = int(s)
+		}
+		return o.phraseQuery(fields, unquotePhrase(*c.Phrase), slop, boost), nil
+	}
+
+	term := *c.Term
+	if len(fields) == 1 && fields[0] == "_exists_" {
+		return Query{Exists: &Exists{Field: unescapeTerm(term), Boost: boost}}, nil
+	}
+	if term == "*" {
+		// field:* matches documents with any value for field, and *:* everything
+		if fields[0] == "*" {
+			return Query{MatchAll: &MatchAll{Boost: boost}}, nil
+		}
+		return o.perField(fields, func(field string, fieldBoost *float64) Query {
+			return Query{Exists: &Exists{Field: field, Boost: fieldBoost}}
+		}, boost), nil
+	}
+	if hasWildcard(term) {
+		if !o.allowLeadingWildcard && (term[0] == '*' || term[0] == '?') {
+			return Query{}, fmt.Errorf("leading wildcard is not allowed: %s", term)
+		}
+		return o.wildcardQuery(fields, term, boost), nil
+	}
+	fuzziness := ""
+	if c.Fuzzy != nil {
+		fuzziness = strings.TrimPrefix(*c.Fuzzy, "~")
+		if fuzziness == "" {
+			fuzziness = o.fuzziness
+		}
+	}
+	return o.matchQuery(fields, unescapeTerm(term), fuzziness, boost), nil
+}
+
+// A term is analyzed and matched against each of the fields, combined as
+// multi_match does
+func (o *termOptions) matchQuery(fields []string, text string, fuzziness string, boost *float64) Query {
+	operator := "or"
+	if o.and {
+		operator = "and"
+	}
+	if len(fields) == 1 && !strings.Contains(fields[0], "^") {
+		return Query{Match: map[string]Match{fields[0]: {
+			Query:               text,
+			Analyzer:            o.analyzer,
+			Fuzziness:           StringOrNumber(fuzziness),
+			PrefixLength:        o.prefixLength,
+			MaxExpansions:       o.maxExpansions,
+			FuzzyTranspositions: o.transpositions,
+			Operator:            operator,
+			Lenient:             o.lenient,
+			Boost:               boost,
+		}}}
+	}
+	return Query{MultiMatch: &MultiMatch{
+		Query:               text,
+		Fields:              fields,
+		TieBreaker:          o.tieBreaker,
+		Analyzer:            o.analyzer,
+		Fuzziness:           StringOrNumber(fuzziness),
+		PrefixLength:        o.prefixLength,
+		MaxExpansions:       o.maxExpansions,
+		FuzzyTranspositions: o.transpositions,
+		Operator:            operator,
+		Lenient:             o.lenient,
+		Boost:               boost,
+	}}
+}
+
+func (o *termOptions) phraseQuery(fields []string, text string, slop int, boost *float64) Query {
+	if len(fields) == 1 && !strings.Contains(fields[0], "^") {
+		return Query{MatchPhrase: map[string]MatchPhrase{fields[0]: {
+			Query:    text,
+			Analyzer: o.quoteAnalyzer,
+			Slop:     slop,
+			Boost:    boost,
+		}}}
+	}
+	return Query{MultiMatch: &MultiMatch{
+		Query:      text,
+		Fields:     fields,
+		Type:       "phrase",
+		TieBreaker: o.tieBreaker,
+		Analyzer:   o.quoteAnalyzer,
+		Slop:       slop,
+		Lenient:    o.lenient,
+		Boost:      boost,
+	}}
+}
+
+// Wildcards are matched against the terms of a field as well as its whole value,
+// and like Lucene's, they ignore case since the terms have been lowercased
+func (o *termOptions) wildcardQuery(fields []string, pattern string, boost *float64) Query {
+	return o.perField(fields, func(field string, fieldBoost *float64) Query {
+		return Query{Wildcard: map[string]Wildcard{field: {Value: pattern, Boost: fieldBoost, CaseInsensitive: true}}}
+	}, boost)
+}
+
+func (o *termOptions) rangeQuery(fields []string, rng Range) (Query, error) {
+	for _, f := range fields {
+		if f == "*" {
+			return Query{}, fmt.Errorf("a field is required for range queries")
+		}
+	}
+	boost := rng.Boost
+	return o.perField(fields, func(field string, fieldBoost *float64) Query {
+		r := rng
+		r.Boost = fieldBoost
+		return Query{Range: map[string]Range{field: r}}
+	}, boost), nil
+}
+
+// Build a query for each of the fields, which may have boosts of their own, eg.
+// `title^3`, and match any of them
+func (o *termOptions) perField(fields []string, build func(field string, boost *float64) Query, boost *float64) Query {
+	queries := make([]Query, 0, len(fields))
+	for _, f := range fields {
+		field, fieldBoost := splitFieldBoost(f)
+		if boost != nil {
+			b := *boost
+			if fieldBoost != nil {
+				b *= *fieldBoost
+			}
+			fieldBoost = &b
+		}
+		queries = append(queries, build(field, fieldBoost))
+	}
+	if len(queries) == 1 {
+		return queries[0]
+	}
+	return Query{Bool: &Bool{Should: queries}}
+}
+
+func splitFieldBoost(f string) (string, *float64) {
+	if i := strings.LastIndex(f, "^"); i >= 0 {
+		if b, err := strconv.ParseFloat(f[i+1:], 64); err == nil {
+			return f[:i], &b
+		}
+	}
+	return f, nil
+}
+
+func rangeBound(s string) *StringOrNumber {
+	if s == "*" {
+		return nil
+	}
+	if strings.HasPrefix(s, `"`) {
+		s = unquotePhrase(s)
+	} else {
+		s = unescapeTerm(s)
+	}
+	n := StringOrNumber(s)
+	return &n
+}
+
+// Whether a term has any * or ? that haven't been escaped
+func hasWildcard(term string) bool {
+	for i := 0; i < len(term); i++ {
+		switch term[i] {
+		case '\\':
+			i++
+		case '*', '?':
+			return true
+		}
+	}
+	return false
+}
+
+func unescapeTerm(term string) string {
+	if !strings.Contains(term, `\`) {
+		return term
+	}
+	var sb strings.Builder
+	for i := 0; i < len(term); i++ {
+		if term[i] == '\\' && i+1 < len(term) {
+			i++
+		}
+		sb.WriteByte(term[i])
+	}
+	return sb.String()
+}
+
+func unquotePhrase(phrase string) string {
+	return unescapeTerm(strings.TrimSuffix(strings.TrimPrefix(phrase, `"`), `"`))
+}
+
+/*
+
+simple_query_string has a smaller syntax that never fails to parse: anything that
+isn't an operator is just text to be analyzed. As in Lucene's SimpleQueryParser,
+the operators combine what has been parsed so far with the next term, left to
+right, so `a + b | c` is `(a AND b) OR c`
+
+	+ AND, | OR, - NOT, "" phrase, * prefix, ( ) grouping, ~N fuzziness or slop
+
+https://www.elastic.co/guide/en/elasticsearch/reference/7.17/query-dsl-simple-query-string-query.html#simple-query-string-syntax
+
+*/
+
+// The operators enabled by flags, eg. `OR|AND|PREFIX`
+type simpleFlags map[string]bool
+
+var allSimpleFlags = []string{"AND", "OR", "NOT", "PREFIX", "PHRASE", "PRECEDENCE", "ESCAPE", "WHITESPACE", "FUZZY", "NEAR", "SLOP"}
+
+func parseSimpleFlags(spec string) simpleFlags {
+	flags := make(simpleFlags)
+	if spec == "" {
+		spec = "ALL"
+	}
+	for _, f := range strings.Split(strings.ToUpper(spec), "|") {
+		switch f = strings.TrimSpace(f); f {
+		case "ALL":
+			for _, a := range allSimpleFlags {
+				flags[a] = true
+			}
+		case "NONE":
+		default:
+			flags[f] = true
+		}
+	}
+	return flags
+}
+
+type simpleParser struct {
+	text  []rune
+	pos   int
+	depth int
+	// Groups nested past the maximum depth, which are parsed as part of the
+	// group they are in
+	flattened int
+	flags     simpleFlags
+	opts      termOptions
+}
+
+// Parse the query into the equivalent DSL query
+func (sq *SimpleQueryString) Parse() (*Query, error) {
+	p := &simpleParser{
+		text:  []rune(sq.Query),
+		flags: parseSimpleFlags(sq.Flags),
+		opts: termOptions{
+			fields:         defaultFields(sq.Fields, ""),
+			and:            strings.EqualFold(sq.DefaultOperator, "and"),
+			analyzer:       sq.Analyzer,
+			quoteAnalyzer:  sq.Analyzer,
+			maxExpansions:  sq.FuzzyMaxExpansions,
+			prefixLength:   sq.FuzzyPrefixLength,
+			transpositions: sq.FuzzyTranspositions,
+			lenient:        sq.Lenient,
+		},
+	}
+	q := p.parseGroup()
+	if q == nil {
+		// Nothing but operators, so nothing to match
+		return &Query{MatchNone: &MatchNone{}}, nil
+	}
+	if sq.MinimumShouldMatch != "" && q.Bool != nil {
+		q.Bool.MinimumShouldMatch = sq.MinimumShouldMatch
+	}
+	bq := boosted(*q, sq.Boost)
+	if err := checkBoolDepth(bq); err != nil {
+		return nil, err
+	}
+	return bq, nil
+}
+
+func (p *simpleParser) enabled(r rune) bool {
+	switch r {
+	case '+':
+		return p.flags["AND"]
+	case '|':
+		return p.flags["OR"]
+	case '-':
+		return p.flags["NOT"]
+	case '"':
+		return p.flags["PHRASE"]
+	case '(', ')':
+		return p.flags["PRECEDENCE"]
+	case '\\':
+		return p.flags["ESCAPE"]
+	}
+	return p.flags["WHITESPACE"] && isSpace(r)
+}
+
+func isSpace(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\n' || r == '\r'
+}
+
+// Parse up to the end of the text or of the current group
+func (p *simpleParser) parseGroup() *Query {
+	var (
+		top       *Query
+		current   occur
+		hasOp     bool
+		previous  occur
+		hasPrev   bool
+		negations int
+	)
+	add := func(branch *Query) {
+		if branch == nil {
+			return
+		}
+		if negations%2 == 1 {
+			branch = &Query{Bool: &Bool{MustNot: []Query{*branch}}}
+		}
+		negations = 0
+		if !hasOp {
+			current = occurShould
+			if p.opts.and {
+				current = occurMust
+			}
+		}
+		if top == nil {
+			top = branch
+		} else {
+			if !hasPrev || previous != current {
+				top = &Query{Bool: occurBool(current, *top)}
+			}
+			if current == occurMust {
+				top.Bool.Must = append(top.Bool.Must, *branch)
+			} else {
+				top.Bool.Should = append(top.Bool.Should, *branch)
+			}
+			previous, hasPrev = current, true
+		}
+		hasOp = false
+	}
+
+	for p.pos < len(p.text) {
+		r := p.text[p.pos]
+		switch {
+		case isSpace(r) && p.enabled(r):
+			p.pos++
+		case r == '(' && p.enabled(r):
+			p.pos++
+			if p.depth >= maxNestedDepth {
+				p.flattened++
+				continue
+			}
+			p.depth++
+			add(p.parseGroup())
+		case r == ')' && p.enabled(r):
+			p.pos++
+			if p.flattened > 0 {
+				p.flattened--
+				continue
+			}
+			// An unbalanced ) is ignored
+			if p.depth > 0 {
+				p.depth--
+				return top
+			}
+		case r == '+' && p.enabled(r):
+			p.pos++
+			current, hasOp = occurMust, true
+		case r == '|' && p.enabled(r):
+			p.pos++
+			current, hasOp = occurShould, true
+		case r == '-' && p.enabled(r):
+			p.pos++
+			negations++
+		case r == '"' && p.enabled(r):
+			add(p.parsePhrase())
+		default:
+			add(p.parseTerm())
+		}
+	}
+	return top
+}
+
+func occurBool(o occur, q Query) *Bool {
+	if o == occurMust {
+		return &Bool{Must: []Query{q}}
+	}
+	return &Bool{Should: []Query{q}}
+}
+
+func (p *simpleParser) parsePhrase() *Query {
+	p.pos++
+	var sb strings.Builder
+	for p.pos < len(p.text) && p.text[p.pos] != '"' {
+		if p.text[p.pos] == '\\' && p.enabled('\\') && p.pos+1 < len(p.text) {
+			p.pos++
+		}
+		sb.WriteRune(p.text[p.pos])
+		p.pos++
+	}
+	p.pos++
+	slop, ok := p.parseTilde(p.flags["NEAR"] || p.flags["SLOP"])
+	if !ok {
+		slop = 0
+	}
+	q := p.opts.phraseQuery(p.opts.fields, sb.String(), slop, nil)
+	return &q
+}
+
+func (p *simpleParser) parseTerm() *Query {
+	var sb strings.Builder
+	for p.pos < len(p.text) {
+		r := p.text[p.pos]
+		if r == '\\' && p.enabled(r) && p.pos+1 < len(p.text) {
+			p.pos++
+			sb.WriteRune(p.text[p.pos])
+			p.pos++
+			continue
+		}
+		// A - within a term is just part of it, eg. a date
+		if r != '-' && r != '\\' && p.enabled(r) || r == '~' && p.flags["FUZZY"] {
+			break
+		}
+		sb.WriteRune(r)
+		p.pos++
+	}
+	term := sb.String()
+	if term == "" {
+		// A ~ without a term to apply to
+		p.pos++
+		return nil
+	}
+	if p.flags["PREFIX"] && strings.HasSuffix(term, "*") && strings.Trim(term, "*") != "" {
+		prefix := strings.TrimRight(term, "*")
+		q := p.opts.perField(p.opts.fields, func(field string, boost *float64) Query {
+			return Query{Prefix: map[string]Prefix{field: {Value: prefix, Boost: boost, CaseInsensitive: true}}}
+		}, nil)
+		return &q
+	}
+	edits, ok := p.parseTilde(p.flags["FUZZY"])
+	fuzziness := ""
+	if ok {
+		fuzziness = strconv.Itoa(edits)
+	}
+	q := p.opts.matchQuery(p.opts.fields, term, fuzziness, nil)
+	return &q
+}
+
+// Consume a ~N suffix, which defaults to 2 edits for fuzziness, or a slop of 0
+// for phrases
+func (p *simpleParser) parseTilde(enabled bool) (int, bool) {
+	if !enabled || p.pos >= len(p.text) || p.text[p.pos] != '~' {
+		return 0, false
+	}
+	p.pos++
+	start := p.pos
+	for p.pos < len(p.text) && p.text[p.pos] >= '0' && p.text[p.pos] <= '9' {
+		p.pos++
+	}
+	if p.pos == start {
+		return 2, true
+	}
+	n, _ := strconv.Atoi(string(p.text[start:p.pos]))
+	return n, true
+}
@@ -0,0 +1,102 @@
+package dsl
+
+import (
+	"strings"
+	"testing"
+
+	require "github.com/alecthomas/assert/v2"
+)
+
+func TestQueryStringParse(t *testing.T) {
+	qs := &QueryString{Query: `service:frontend AND status:[400 TO 599} -debug`}
+	q, err := qs.Parse()
+	require.NoError(t, err)
+	require.Equal(t, len(q.Bool.Must), 2)
+	require.Equal(t, q.Bool.Must[0].Match["service"].Query, "frontend")
+	require.Equal(t, q.Bool.Must[1].Range["status"].Gte.String(), "400")
+	require.Equal(t, q.Bool.Must[1].Range["status"].Lt.String(), "599")
+	require.Equal(t, q.Bool.MustNot[0].Match["*"].Query, "debug")
+
+	// AND only makes its neighbours required
+	qs = &QueryString{Query: `a OR b AND c`}
+	q, err = qs.Parse()
+	require.NoError(t, err)
+	require.Equal(t, len(q.Bool.Should), 1)
+	require.Equal(t, len(q.Bool.Must), 2)
+
+	qs = &QueryString{Query: `title:(quick brown)^2 "lazy dog"~3 _exists_:user wild*card`, Fields: []string{"body", "title^2"}}
+	q, err = qs.Parse()
+	require.NoError(t, err)
+	require.Equal(t, *q.Bool.Should[0].Bool.Boost, 2.0)
+	require.Equal(t, q.Bool.Should[0].Bool.Must[0].Bool.Should[1].Match["title"].Query, "brown")
+	require.Equal(t, q.Bool.Should[1].MultiMatch.Type, "phrase")
+	require.Equal(t, q.Bool.Should[1].MultiMatch.Slop, 3)
+	require.Equal(t, q.Bool.Should[2].Exists.Field, "user")
+	require.Equal(t, *q.Bool.Should[3].Bool.Should[1].Wildcard["title"].Boost, 2.0)
+
+	// Groups can't be nested without limit, but parentheses in phrases don't count
+	qs = &QueryString{Query: strings.Repeat("(", 21) + "a" + strings.Repeat(")", 21)}
+	_, err = qs.Parse()
+	require.Error(t, err)
+	qs = &QueryString{Query: strings.Repeat("(", 20) + `"((" \(` + strings.Repeat(")", 20)}
+	_, err = qs.Parse()
+	require.NoError(t, err)
+
+	// Nor can the bool queries they compile to, whether nested by groups or by
+	// boosts of them
+	qs = &QueryString{Query: `(a OR (b OR (c OR (d OR (e OR f)))))`}
+	q, err = qs.Parse()
+	require.NoError(t, err)
+	require.Equal(t, boolDepth(q), maxBoolDepth)
+	for _, deep := range []string{`(a OR (b OR (c OR (d OR (e OR (f OR g))))))`, `(a OR (b OR (c OR (d OR (e OR f)))))^2`} {
+		qs = &QueryString{Query: deep}
+		_, err = qs.Parse()
+		require.Error(t, err, deep)
+	}
+
+	for _, bad := range []string{`a AND`, `(a`, `status:[1 TO`, `foo:`} {
+		qs = &QueryString{Query: bad}
+		_, err = qs.Parse()
+		require.Error(t, err, bad)
+	}
+}
+
+func TestSimpleQueryStringParse(t *testing.T) {
+	parse := func(sq *SimpleQueryString) *Query {
+		t.Helper()
+		q, err := sq.Parse()
+		require.NoError(t, err)
+		return q
+	}
+	// Operators apply left to right
+	q := parse(&SimpleQueryString{Query: `a + b | c`})
+	require.Equal(t, len(q.Bool.Should), 2)
+	require.Equal(t, len(q.Bool.Should[0].Bool.Must), 2)
+	require.Equal(t, q.Bool.Should[1].Match["*"].Query, "c")
+
+	q = parse(&SimpleQueryString{Query: `"big fox"~2 qui* fox~1 -dog`, DefaultOperator: "and"})
+	require.Equal(t, q.Bool.Must[0].MatchPhrase["*"].Slop, 2)
+	require.Equal(t, q.Bool.Must[1].Prefix["*"].Value, "qui")
+	require.Equal(t, q.Bool.Must[2].Match["*"].Fuzziness, StringOrNumber("1"))
+	require.Equal(t, q.Bool.Must[3].Bool.MustNot[0].Match["*"].Query, "dog")
+
+	// Anything goes, and disabled operators are just text
+	q = parse(&SimpleQueryString{Query: `a) ("b`})
+	require.Equal(t, q.Bool.Should[1].MatchPhrase["*"].Query, "b")
+	q = parse(&SimpleQueryString{Query: `a|b`, Flags: "AND|PHRASE"})
+	require.Equal(t, q.Match["*"].Query, "a|b")
+
+	// Each change of operator nests what came before it in another bool query
+	q = parse(&SimpleQueryString{Query: `a +b |c +d |e`})
+	require.Equal(t, boolDepth(q), 4)
+	q = parse(&SimpleQueryString{Query: `a +b |c +d |e +f`})
+	require.Equal(t, boolDepth(q), maxBoolDepth)
+	_, err := (&SimpleQueryString{Query: `a +b |c +d |e +f |g`}).Parse()
+	require.Error(t, err)
+
+	// Groups nested past the maximum depth are flattened into their parent
+	q = parse(&SimpleQueryString{Query: strings.Repeat("(", 100000) + "a b" + strings.Repeat(")", 100000) + " c"})
+	require.Equal(t, len(q.Bool.Should), 2)
+	require.Equal(t, q.Bool.Should[0].Bool.Should[1].Match["*"].Query, "b")
+	require.Equal(t, q.Bool.Should[1].Match["*"].Query, "c")
+}
@@ -0,0 +1,55 @@
+// Caches of the values most recently used, for those made from what requests
+// give, which would otherwise be kept without limit
+package lru
+
+import (
+	"container/list"
+	"sync"
+)
+
+type Cache[K comparable, V any] struct {
+	mu      sync.Mutex
+	size    int
+	entries map[K]*list.Element
+	// Most recently used first
+	order *list.List
+}
+
+type entry[K comparable, V any] struct {
+	key   K
+	value V
+}
+
+// A cache of up to size values
+func New[K comparable, V any](size int) *Cache[K, V] {
+	return &Cache[K, V]{size: size, entries: make(map[K]*list.Element), order: list.New()}
+}
+
+// The value cached under the key, or the one made for it, which is cached unless
+// making it failed
+func (c *Cache[K, V]) Get(key K, make func() (V, error)) (V, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.order.MoveToFront(e)
+		return e.Value.(*entry[K, V]).value, nil
+	}
+	v, err := make()
+	if err != nil {
+		return v, err
+	}
+	c.entries[key] = c.order.PushFront(&entry[K, V]{key, v})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*entry[K, V]).key)
+	}
+	return v, nil
+}
+
+// The number of values cached
+func (c *Cache[K, V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
@@ -0,0 +1,40 @@
+package lru
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+
+	require "github.com/alecthomas/assert/v2"
+)
+
+func TestCache(t *testing.T) {
+	c := New[string, int](2)
+	made := 0
+	get := func(key string) int {
+		t.Helper()
+		v, err := c.Get(key, func() (int, error) {
+			made++
+			return strconv.Atoi(key)
+		})
+		require.NoError(t, err)
+		return v
+	}
+	require.Equal(t, get("1"), 1)
+	require.Equal(t, get("2"), 2)
+	require.Equal(t, get("1"), 1)
+	require.Equal(t, made, 2)
+
+	// The least recently used value makes way for a new one
+	require.Equal(t, get("3"), 3)
+	require.Equal(t, c.Len(), 2)
+	require.Equal(t, get("1"), 1)
+	require.Equal(t, made, 3)
+	require.Equal(t, get("2"), 2)
+	require.Equal(t, made, 4)
+
+	// Failures aren't cached
+	_, err := c.Get("x", func() (int, error) { return 0, errors.New("no") })
+	require.Error(t, err)
+	require.Equal(t, c.Len(), 2)
+}
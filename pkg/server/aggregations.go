@@ -0,0 +1,130 @@
+package server
+
+import (
+	"log"
+
+	"github.com/atomic77/gopensearch/pkg/dsl"
+)
+
+/*
+
+Aggregations nest to any depth. Metric sub-aggregations are embedded in the
+select of their bucket aggregation, where they aggregate over the rows of each
+group. Bucket sub-aggregations can't be, as they group the documents of each
+bucket in turn, so they run as queries of their own once the buckets of their
+parent are known: one for each parent bucket, over the documents in the bucket of
+each of its ancestors. Pipeline sub-aggregations are applied last, once the
+buckets and all of their sub-aggregations are known
+
+*/
+
+// What aggregations are run over: the indices being searched, their mappings, and
+// the query documents have to match
+type aggSource struct {
+	indices  []string
+	mappings map[string]*TemplateMapping
+	q        *dsl.Dsl
+}
+
+// The sql predicate of the documents in the bucket of a parent aggregation, which
+// is generated with the builder of the sub-aggregation's query
+type docFilter func(dbq *dbSubQuery) (string, error)
+
+// A bucket aggregation whose buckets can have bucket sub-aggregations
+type bucketsAggregation interface {
+	Aggregation
+	buckets() []Bucket
+	// Of pipelines that select or sort them
+	setBuckets(buckets []Bucket)
+	// The predicate of the documents in one of the buckets
+	bucketFilter(dbq *dbSubQuery, b *Bucket) (string, error)
+}
+
+// The query of an aggregation, over the documents in the buckets that filters
+// select for a sub-aggregation
+func genAggregationPlan(label string, agg *dsl.Aggregate, src *aggSource, filters []docFilter) (*dbSubQuery, error) {
+	aggQ := makeDbSubQuery()
+	aggQ.label = &label
+	aggQ.source = src
+	aggQ.filters = filters
+	aggQ.mapping = aggregationMapping(src.indices, src.mappings)
+	if err := aggQ.genAggregateSelectExprs(agg); err != nil {
+		return nil, err
+	}
+
+	aggQ.genSelectExpression()
+	// Of all documents for a global aggregation
+	if err := aggQ.genDocSource(aggQ.source.indices, aggQ.source.mappings, aggQ.source.q); err != nil {
+		return nil, err
+	}
+	aggQ.genAggGroupBy()
+	aggQ.genAggOrder()
+	return &aggQ, nil
+}
+
+// Run the query of an aggregation, and then those of its bucket sub-aggregations
+// for each of its buckets, and its pipelines. The buckets of every aggregation of
+// the search are counted, and there can't be more than maxBuckets of them
+func (s *Server) runAggregation(dbq *dbSubQuery, bucketCount *int) (Aggregation, error) {
+	sql, args := dbq.sb.Build()
+	if s.Cfg.Debug {
+		log.Println(sql, args)
+	}
+	rows, err := s.db.Queryx(sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	err = dbq.aggregation.SerializeResultset(rows, dbq)
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	parent, ok := dbq.aggregation.(bucketsAggregation)
+	if !ok {
+		return dbq.aggregation, nil
+	}
+
+	buckets := parent.buckets()
+	*bucketCount += len(buckets)
+	if *bucketCount > maxBuckets {
+		return nil, tooManyBucketsError()
+	}
+	for i := range buckets {
+		b := &buckets[i]
+		// Buckets added for gaps have none of the rows their metrics come from
+		for _, v := range dbq.fnAliases {
+			if m, ok := v.(*metric); ok && b.subaggregates[m.label] == nil {
+				if b.subaggregates[m.label], err = m.result(nil); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if len(dbq.subBuckets) == 0 {
+			continue
+		}
+		filters := make([]docFilter, len(dbq.filters), len(dbq.filters)+1)
+		copy(filters, dbq.filters)
+		if b.DocCount == 0 {
+			// Nothing to aggregate, which sqlite can tell without a scan
+			filters = append(filters, func(*dbSubQuery) (string, error) { return "0", nil })
+		} else {
+			filters = append(filters, func(child *dbSubQuery) (string, error) {
+				return parent.bucketFilter(child, b)
+			})
+		}
+		for label, sub := range dbq.subBuckets {
+			sub := sub
+			subQ, err := genAggregationPlan(label, &sub, dbq.source, filters)
+			if err != nil {
+				return nil, err
+			}
+			if b.subaggregates[label], err = s.runAggregation(subQ, bucketCount); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := applyPipelines(dbq.pipelines, parent); err != nil {
+		return nil, err
+	}
+	return dbq.aggregation, nil
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	require "github.com/alecthomas/assert/v2"
+)
+
+func TestNestedAggregations(t *testing.T) {
+	bulkRequest(t, "/nestedaggs/_bulk", `
+{"index": {}}
+{"host": "web-01", "ts": "2022-11-11T00:10:00Z", "lat": 10, "status": 200}
+{"index": {}}
+{"host": "web-01", "ts": "2022-11-11T01:10:00Z", "lat": 20, "status": 500}
+{"index": {}}
+{"host": "web-01", "ts": "2022-11-11T01:20:00Z", "lat": 30, "status": 200}
+{"index": {}}
+{"host": "web-02", "ts": "2022-11-11T00:30:00Z", "lat": 40, "status": 200}
+{"index": {}}
+{"host": "db-01", "lat": 5}
+`)
+	nested := func(aggs string) string {
+		t.Helper()
+		return aggregationResult(t, "nestedaggs", aggs)
+	}
+
+	// Grouped by host, then time, then status
+	require.Equal(t, nested(`{"a": {"terms": {"field": "host"}, "aggs": {
+		"time": {"date_histogram": {"field": "ts", "fixed_interval": "1h", "format": "HH:mm"}, "aggs": {
+			"status": {"terms": {"field": "status"}, "aggs": {"lat": {"avg": {"field": "lat"}}}}}}}}}`),
+		`{"doc_count_error_upper_bound":0,"sum_other_doc_count":0,"buckets":[`+
+			`{"key":"web-01","doc_count":3,"time":{"buckets":[`+
+			`{"key_as_string":"00:00","key":1668124800000,"doc_count":1,"status":{"doc_count_error_upper_bound":0,"sum_other_doc_count":0,"buckets":[{"key":200,"doc_count":1,"lat":{"value":10}}]}},`+
+			`{"key_as_string":"01:00","key":1668128400000,"doc_count":2,"status":{"doc_count_error_upper_bound":0,"sum_other_doc_count":0,"buckets":[{"key":200,"doc_count":1,"lat":{"value":30}},{"key":500,"doc_count":1,"lat":{"value":20}}]}}]}},`+
+			`{"key":"db-01","doc_count":1,"time":{"buckets":[]}},`+
+			`{"key":"web-02","doc_count":1,"time":{"buckets":[`+
+			`{"key_as_string":"00:00","key":1668124800000,"doc_count":1,"status":{"doc_count_error_upper_bound":0,"sum_other_doc_count":0,"buckets":[{"key":200,"doc_count":1,"lat":{"value":40}}]}}]}}]}`)
+
+	// Empty buckets have empty sub-aggregations
+	require.Equal(t, nested(`{"a": {"histogram": {"field": "lat", "interval": 20, "extended_bounds": {"min": 0, "max": 60}}, "aggregations": {
+		"hosts": {"terms": {"field": "host"}}, "lat": {"max": {"field": "lat"}}}}}`),
+		`{"buckets":[`+
+			`{"key":0,"doc_count":2,"hosts":{"doc_count_error_upper_bound":0,"sum_other_doc_count":0,"buckets":[{"key":"db-01","doc_count":1},{"key":"web-01","doc_count":1}]},"lat":{"value":10}},`+
+			`{"key":20,"doc_count":2,"hosts":{"doc_count_error_upper_bound":0,"sum_other_doc_count":0,"buckets":[{"key":"web-01","doc_count":2}]},"lat":{"value":30}},`+
+			`{"key":40,"doc_count":1,"hosts":{"doc_count_error_upper_bound":0,"sum_other_doc_count":0,"buckets":[{"key":"web-02","doc_count":1}]},"lat":{"value":40}},`+
+			`{"key":60,"doc_count":0,"hosts":{"doc_count_error_upper_bound":0,"sum_other_doc_count":0,"buckets":[]},"lat":{"value":null}}]}`)
+	require.Equal(t, nested(`{"a": {"range": {"field": "lat", "ranges": [{"to": 10}, {"from": 10, "to": 25}, {"from": 100}]}, "aggs": {
+		"hosts": {"terms": {"field": "host"}}}}}`),
+		`{"buckets":[`+
+			`{"key":"*-10.0","to":10,"doc_count":1,"hosts":{"doc_count_error_upper_bound":0,"sum_other_doc_count":0,"buckets":[{"key":"db-01","doc_count":1}]}},`+
+			`{"key":"10.0-25.0","from":10,"to":25,"doc_count":2,"hosts":{"doc_count_error_upper_bound":0,"sum_other_doc_count":0,"buckets":[{"key":"web-01","doc_count":2}]}},`+
+			`{"key":"100.0-*","from":100,"doc_count":0,"hosts":{"doc_count_error_upper_bound":0,"sum_other_doc_count":0,"buckets":[]}}]}`)
+
+	// The documents of each auto_date_histogram bucket are those up to the next
+	require.Equal(t, nested(`{"a": {"auto_date_histogram": {"field": "ts", "buckets": 2, "format": "HH:mm"}, "aggs": {
+		"hosts": {"terms": {"field": "host"}}}}}`),
+		`{"buckets":[`+
+			`{"key_as_string":"00:00","key":1668124800000,"doc_count":2,"hosts":{"doc_count_error_upper_bound":0,"sum_other_doc_count":0,"buckets":[{"key":"web-01","doc_count":1},{"key":"web-02","doc_count":1}]}},`+
+			`{"key_as_string":"01:00","key":1668128400000,"doc_count":2,"hosts":{"doc_count_error_upper_bound":0,"sum_other_doc_count":0,"buckets":[{"key":"web-01","doc_count":2}]}}],"interval":"1h"}`)
+
+	// Sub-aggregations are planned even when there are no buckets to run them for
+	for _, aggs := range []string{
+		`{"a": {"terms": {"field": "nothing"}, "aggs": {"b": {"date_histogram": {"field": "ts"}}}}}`,
+		`{"a": {"avg": {"field": "lat"}, "aggs": {"b": {"max": {"field": "lat"}}}}}`,
+	} {
+		rec := doRequest(http.MethodPost, "/nestedaggs/_search", `{"size": 0, "aggs": `+aggs+`}`)
+		require.Equal(t, rec.Code, http.StatusBadRequest, aggs)
+	}
+}
+
+func TestTooManyBuckets(t *testing.T) {
+	bulkRequest(t, "/manybuckets/_bulk", `
+{"index": {}}
+{"price": 0}
+{"index": {}}
+{"price": 40}
+`)
+	wide := `{"histogram": {"field": "price", "interval": 0.001, "extended_bounds": {"min": 0, "max": 40}}}`
+	rec := doRequest(http.MethodPost, "/manybuckets/_search", `{"size": 0, "aggs": {"a": `+wide+`}}`)
+	require.Equal(t, rec.Code, http.StatusOK)
+
+	// The buckets of all aggregations count towards the limit, as do those of
+	// sub-aggregations for every parent bucket
+	for _, aggs := range []string{
+		`{"a": ` + wide + `, "b": ` + wide + `}`,
+		`{"a": {"histogram": {"field": "price", "interval": 10}, "aggs": {"b": {"histogram": {"field": "price", "interval": 0.001, "extended_bounds": {"min": 0, "max": 20}}}}}}`,
+	} {
+		rec := doRequest(http.MethodPost, "/manybuckets/_search", `{"size": 0, "aggs": `+aggs+`}`)
+		require.Equal(t, rec.Code, http.StatusBadRequest, aggs)
+		require.Contains(t, rec.Body.String(), "Trying to create too many buckets")
+	}
+}
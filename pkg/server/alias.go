@@ -0,0 +1,445 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/huandu/go-sqlbuilder"
+	"github.com/jmoiron/sqlx"
+)
+
+// Aliases are kept in memory as alias -> index -> properties, and persisted
+// to the __aliases table in the same way as templates
+type AliasProperties struct {
+	IsWriteIndex *bool `json:"is_write_index,omitempty"`
+}
+
+type aliasMap map[string]map[string]AliasProperties
+
+// https://www.elastic.co/guide/en/elasticsearch/reference/7.17/indices-aliases.html
+type UpdateAliasesRequest struct {
+	Actions []AliasAction `json:"actions"`
+}
+
+type AliasAction struct {
+	Add    *AliasActionSpec `json:"add"`
+	Remove *AliasActionSpec `json:"remove"`
+}
+
+type AliasActionSpec struct {
+	Index        string   `json:"index"`
+	Indices      []string `json:"indices"`
+	Alias        string   `json:"alias"`
+	Aliases      []string `json:"aliases"`
+	IsWriteIndex *bool    `json:"is_write_index"`
+}
+
+type AliasesResponse map[string]IndexAliases
+
+type IndexAliases struct {
+	Aliases map[string]AliasProperties `json:"aliases"`
+}
+
+type AcknowledgedResponse struct {
+	Acknowledged bool `json:"acknowledged"`
+}
+
+func (am aliasMap) clone() aliasMap {
+	c := make(aliasMap, len(am))
+	for alias, idxs := range am {
+		c[alias] = make(map[string]AliasProperties, len(idxs))
+		for idx, props := range idxs {
+			c[alias][idx] = props
+		}
+	}
+	return c
+}
+
+func (am aliasMap) add(alias, index string, props AliasProperties) {
+	if _, ok := am[alias]; !ok {
+		am[alias] = make(map[string]AliasProperties)
+	}
+	am[alias][index] = props
+}
+
+func (am aliasMap) remove(alias, index string) bool {
+	idxs, ok := am[alias]
+	if !ok {
+		return false
+	}
+	if _, ok := idxs[index]; !ok {
+		return false
+	}
+	delete(idxs, index)
+	if len(idxs) == 0 {
+		delete(am, alias)
+	}
+	return true
+}
+
+// An alias can point at any number of indices for reads, but at most one
+// of them can be flagged as the write index
+func (am aliasMap) validate() error {
+	for alias, idxs := range am {
+		writeIndices := 0
+		for _, props := range idxs {
+			if props.IsWriteIndex != nil && *props.IsWriteIndex {
+				writeIndices++
+			}
+		}
+		if writeIndices > 1 {
+			return fmt.Errorf("alias [%s] has more than one write index", alias)
+		}
+	}
+	return nil
+}
+
+func (am aliasMap) names() []string {
+	names := make([]string, 0, len(am))
+	for alias := range am {
+		names = append(names, alias)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// The current aliases, which are never modified once published, so they can be
+// read without holding the lock
+func (s *Server) aliases() aliasMap {
+	s.aliasMu.RLock()
+	defer s.aliasMu.RUnlock()
+	return s.Aliases
+}
+
+// Return the single index that writes against the given name should go to. If
+// the name isn't an alias, it is assumed to be an index (which may be created
+// implicitly by the caller)
+func (s *Server) resolveWriteIndex(name string) (string, error) {
+	idxs, ok := s.aliases()[name]
+	if !ok {
+		return name, nil
+	}
+	if len(idxs) == 1 {
+		for idx, props := range idxs {
+			if props.IsWriteIndex == nil || *props.IsWriteIndex {
+				return idx, nil
+			}
+		}
+	}
+	for idx, props := range idxs {
+		if props.IsWriteIndex != nil && *props.IsWriteIndex {
+			return idx, nil
+		}
+	}
+	return "", fmt.Errorf(
+		"no write index is defined for alias [%s]. The write index may be explicitly "+
+			"disabled using is_write_index=false or the alias points to multiple indices "+
+			"without one being designated as a write index", name)
+}
+
+// Return the single index that reads of a document by the given name go to.
+// Unlike writes, an alias may resolve to its only index whether or not it's
+// the write index
+func (s *Server) resolveReadIndex(name string) (string, error) {
+	idxs, ok := s.aliases()[name]
+	if !ok {
+		return name, nil
+	}
+	if len(idxs) == 1 {
+		for idx := range idxs {
+			return idx, nil
+		}
+	}
+	names := make([]string, 0, len(idxs))
+	for idx := range idxs {
+		names = append(names, idx)
+	}
+	sort.Strings(names)
+	return "", &AmbiguousAliasError{Alias: name, Indices: names}
+}
+
+// Apply a set of alias actions atomically; either they all succeed or nothing changes
+func (s *Server) updateAliases(actions []AliasAction) error {
+	s.aliasMu.Lock()
+	defer s.aliasMu.Unlock()
+	idxMap, err := s.ListTables()
+	if err != nil {
+		return err
+	}
+	updated, err := s.Aliases.apply(actions, idxMap)
+	if err != nil {
+		return err
+	}
+	return s.setAliases(updated)
+}
+
+// The aliases after a set of actions against the given indices, or an error if
+// any of them is invalid
+func (am aliasMap) apply(actions []AliasAction, idxMap map[string]interface{}) (aliasMap, error) {
+	updated := am.clone()
+
+	for _, action := range actions {
+		spec := action.Add
+		if spec == nil {
+			spec = action.Remove
+		}
+		if spec == nil {
+			return nil, errors.New("unsupported alias action; only add and remove are implemented")
+		}
+
+		indexExprs := spec.Indices
+		if spec.Index != "" {
+			indexExprs = append(indexExprs, spec.Index)
+		}
+		aliases := spec.Aliases
+		if spec.Alias != "" {
+			aliases = append(aliases, spec.Alias)
+		}
+		if len(indexExprs) == 0 || len(aliases) == 0 {
+			return nil, errors.New("alias action requires both an index and an alias")
+		}
+
+		indices := make([]string, 0)
+		for _, expr := range indexExprs {
+			for _, name := range splitIndexExpression(expr) {
+				if strings.Contains(name, "*") {
+					for tab := range idxMap {
+						if indexPatternMatch(name, tab) {
+							indices = append(indices, tab)
+						}
+					}
+				} else if _, ok := idxMap[name]; ok {
+					indices = append(indices, name)
+				} else {
+					return nil, &IndexNotFoundError{Index: name}
+				}
+			}
+		}
+
+		for _, alias := range aliases {
+			if _, ok := idxMap[alias]; ok {
+				return nil, fmt.Errorf("an index exists with the same name as the alias [%s]", alias)
+			}
+			for _, idx := range indices {
+				if action.Add != nil {
+					updated.add(alias, idx, AliasProperties{IsWriteIndex: spec.IsWriteIndex})
+				} else if !updated.remove(alias, idx) {
+					return nil, &AliasNotFoundError{Alias: alias}
+				}
+			}
+		}
+	}
+
+	if err := updated.validate(); err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// Persist and publish the aliases; the caller holds the lock
+func (s *Server) setAliases(am aliasMap) error {
+	if err := saveAliasMetadata(s.db, am); err != nil {
+		return err
+	}
+	s.Aliases = am
+	return nil
+}
+
+func (s *Server) UpdateAliasesHandler(w http.ResponseWriter, r *http.Request) {
+	// POST /_aliases
+	buf, _ := io.ReadAll(r.Body)
+	req := UpdateAliasesRequest{}
+	if err := json.Unmarshal(buf, &req); err != nil {
+		handleErrorResponse(w, errors.New("unable to parse json "+err.Error()))
+		return
+	}
+	if err := s.updateAliases(req.Actions); err != nil {
+		handleAliasErrorResponse(w, err)
+		return
+	}
+	writeAcknowledged(w)
+}
+
+func (s *Server) PutAliasHandler(w http.ResponseWriter, r *http.Request) {
+	// PUT /<index>/_alias/<name>, with an optional body for the alias properties
+	vars := mux.Vars(r)
+	spec := AliasActionSpec{}
+	buf, _ := io.ReadAll(r.Body)
+	if len(strings.TrimSpace(string(buf))) > 0 {
+		if err := json.Unmarshal(buf, &spec); err != nil {
+			handleErrorResponse(w, errors.New("unable to parse json "+err.Error()))
+			return
+		}
+	}
+	spec.Index = vars["index"]
+	spec.Alias = vars["name"]
+	if err := s.updateAliases([]AliasAction{{Add: &spec}}); err != nil {
+		handleAliasErrorResponse(w, err)
+		return
+	}
+	writeAcknowledged(w)
+}
+
+func (s *Server) DeleteAliasHandler(w http.ResponseWriter, r *http.Request) {
+	// DELETE /<index>/_alias/<name>; both may be comma-separated lists or patterns
+	vars := mux.Vars(r)
+	actions := make([]AliasAction, 0)
+	aliases := s.aliases()
+	for _, name := range splitIndexExpression(vars["name"]) {
+		matched := false
+		for _, alias := range aliases.names() {
+			if !indexPatternMatch(name, alias) {
+				continue
+			}
+			for idx := range aliases[alias] {
+				if aliasIndexMatches(vars["index"], idx) {
+					matched = true
+					actions = append(actions, AliasAction{
+						Remove: &AliasActionSpec{Index: idx, Alias: alias},
+					})
+				}
+			}
+		}
+		if !matched {
+			handleAliasErrorResponse(w, &AliasNotFoundError{Alias: name})
+			return
+		}
+	}
+	if err := s.updateAliases(actions); err != nil {
+		handleAliasErrorResponse(w, err)
+		return
+	}
+	writeAcknowledged(w)
+}
+
+func (s *Server) GetAliasHandler(w http.ResponseWriter, r *http.Request) {
+	// GET /_alias, /_alias/<name>, /<index>/_alias and /<index>/_alias/<name>
+	vars := mux.Vars(r)
+	nameExpr, filterNames := vars["name"]
+
+	resp := make(AliasesResponse)
+	found := false
+	aliases := s.aliases()
+	for _, alias := range aliases.names() {
+		if filterNames && !aliasNameMatches(nameExpr, alias) {
+			continue
+		}
+		for idx, props := range aliases[alias] {
+			if !aliasIndexMatches(vars["index"], idx) {
+				continue
+			}
+			if _, ok := resp[idx]; !ok {
+				resp[idx] = IndexAliases{Aliases: make(map[string]AliasProperties)}
+			}
+			resp[idx].Aliases[alias] = props
+			found = true
+		}
+	}
+
+	if filterNames && !found {
+		handleAliasErrorResponse(w, &AliasNotFoundError{Alias: nameExpr})
+		return
+	}
+	j, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
+func aliasNameMatches(expr, alias string) bool {
+	for _, name := range splitIndexExpression(expr) {
+		if indexPatternMatch(name, alias) {
+			return true
+		}
+	}
+	return false
+}
+
+func aliasIndexMatches(expr, index string) bool {
+	if expr == "" {
+		return true
+	}
+	return aliasNameMatches(expr, index)
+}
+
+func writeAcknowledged(w http.ResponseWriter) {
+	j, _ := json.Marshal(AcknowledgedResponse{Acknowledged: true})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
+func handleAliasErrorResponse(w http.ResponseWriter, err error) {
+	var (
+		nf  *IndexNotFoundError
+		anf *AliasNotFoundError
+	)
+	switch {
+	case errors.As(err, &nf), errors.As(err, &anf):
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	fmt.Fprint(w, err.Error())
+}
+
+func (s *Server) loadAliasMetadata() {
+	aliases := make(aliasMap)
+	sb := sqlbuilder.NewSelectBuilder()
+	sb.Select("alias", "index_name", "body").From("__aliases")
+
+	rows, err := s.db.Queryx(sb.String())
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var alias, index, body string
+		rows.Scan(&alias, &index, &body)
+		props := AliasProperties{}
+		if err := json.Unmarshal([]byte(body), &props); err != nil {
+			panic(err)
+		}
+		aliases.add(alias, index, props)
+	}
+	s.aliasMu.Lock()
+	s.Aliases = aliases
+	s.aliasMu.Unlock()
+
+	if s.Cfg.Debug {
+		log.Printf("Loaded %d aliases from local datastore\n", len(aliases))
+	}
+}
+
+func saveAliasMetadata(db *sqlx.DB, am aliasMap) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM __aliases;"); err != nil {
+		tx.Rollback()
+		return err
+	}
+	qry := `INSERT INTO __aliases (alias, index_name, body) VALUES (?, ?, json(?))`
+
+	for alias, idxs := range am {
+		for idx, props := range idxs {
+			b, err := json.Marshal(props)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+			if _, err = tx.Exec(qry, alias, idx, string(b)); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
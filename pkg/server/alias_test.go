@@ -0,0 +1,150 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	require "github.com/alecthomas/assert/v2"
+)
+
+func doRequest(method, path, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	s.Router.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAliasReadWrite(t *testing.T) {
+	rec := doRequest(http.MethodPut, "/logs-000001", "")
+	require.Equal(t, rec.Code, http.StatusOK)
+	rec = doRequest(http.MethodPut, "/logs-000002", "")
+	require.Equal(t, rec.Code, http.StatusOK)
+
+	rec = doRequest(http.MethodPost, "/_aliases", `
+	{
+		"actions": [
+			{ "add": { "index": "logs-*", "alias": "logs-read" } },
+			{ "add": { "index": "logs-000001", "alias": "logs-write", "is_write_index": false } },
+			{ "add": { "index": "logs-000002", "alias": "logs-write", "is_write_index": true } }
+		]
+	}`)
+	require.Equal(t, rec.Code, http.StatusOK, rec.Body.String())
+
+	rec = doRequest(http.MethodPost, "/logs-000001/_create", `{"msg": "old"}`)
+	require.Equal(t, rec.Code, http.StatusCreated)
+	rec = doRequest(http.MethodPost, "/logs-write/_create", `{"msg": "new"}`)
+	require.Equal(t, rec.Code, http.StatusCreated)
+
+	rec = doRequest(http.MethodPost, "/logs-000002/_search", `{"query": {"term": {"msg": "new"}}}`)
+	d := getResponse(t, rec.Result())
+	require.Equal(t, len(d.Hits.Hits), 1)
+
+	// Documents can be read through an alias of a single index, write index or
+	// not, but not through one of several
+	rec = doRequest(http.MethodPost, "/_aliases", `{"actions": [{"add": {"index": "logs-000002", "alias": "logs-last", "is_write_index": false}}]}`)
+	require.Equal(t, rec.Code, http.StatusOK)
+	rec = doRequest(http.MethodGet, "/logs-last/_doc/"+d.Hits.Hits[0].Id, "")
+	require.Equal(t, rec.Code, http.StatusOK, rec.Body.String())
+	rec = doRequest(http.MethodHead, "/logs-last/_source/"+d.Hits.Hits[0].Id, "")
+	require.Equal(t, rec.Code, http.StatusOK)
+	rec = doRequest(http.MethodGet, "/logs-read/_doc/"+d.Hits.Hits[0].Id, "")
+	require.Equal(t, rec.Code, http.StatusBadRequest)
+
+	rec = doRequest(http.MethodPost, "/logs-read/_search", `{}`)
+	d = getResponse(t, rec.Result())
+	require.Equal(t, len(d.Hits.Hits), 2)
+
+	// Patterns expand through aliases too
+	rec = doRequest(http.MethodPost, "/logs-re*/_search", `{}`)
+	d = getResponse(t, rec.Result())
+	require.Equal(t, len(d.Hits.Hits), 2)
+
+	// A read alias over several indices can't be written to
+	rec = doRequest(http.MethodPost, "/logs-read/_create", `{"msg": "nowhere"}`)
+	require.Equal(t, rec.Code, http.StatusBadRequest)
+
+	rec = doRequest(http.MethodPost, "/_bulk", `{"index": {"_index": "logs-write"}}
+{"msg": "bulk"}
+`)
+	require.Equal(t, rec.Code, http.StatusOK)
+	rec = doRequest(http.MethodPost, "/logs-000002/_search", `{}`)
+	d = getResponse(t, rec.Result())
+	require.Equal(t, len(d.Hits.Hits), 2)
+}
+
+func TestAliasMultipleWriteIndices(t *testing.T) {
+	rec := doRequest(http.MethodPut, "/dup-000001", "")
+	require.Equal(t, rec.Code, http.StatusOK)
+	rec = doRequest(http.MethodPut, "/dup-000002", "")
+	require.Equal(t, rec.Code, http.StatusOK)
+
+	rec = doRequest(http.MethodPost, "/_aliases", `
+	{
+		"actions": [
+			{ "add": { "index": "dup-000001", "alias": "dup-write", "is_write_index": true } },
+			{ "add": { "index": "dup-000002", "alias": "dup-write", "is_write_index": true } }
+		]
+	}`)
+	require.Equal(t, rec.Code, http.StatusBadRequest)
+
+	// Nothing should have been applied
+	rec = doRequest(http.MethodGet, "/_alias/dup-write", "")
+	require.Equal(t, rec.Code, http.StatusNotFound)
+}
+
+func TestAliasPutGetDelete(t *testing.T) {
+	rec := doRequest(http.MethodPut, "/crud-000001", `{"aliases": {"crud-create": {}}}`)
+	require.Equal(t, rec.Code, http.StatusOK)
+	rec = doRequest(http.MethodPut, "/crud-000001/_alias/crud-alias", "")
+	require.Equal(t, rec.Code, http.StatusOK)
+
+	rec = doRequest(http.MethodGet, "/crud-000001/_alias", "")
+	require.Equal(t, rec.Code, http.StatusOK)
+	resp := AliasesResponse{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	require.Equal(t, len(resp["crud-000001"].Aliases), 2)
+
+	rec = doRequest(http.MethodGet, "/_alias/crud-*", "")
+	require.Equal(t, rec.Code, http.StatusOK)
+
+	// An index isn't created if its aliases are invalid
+	rec = doRequest(http.MethodPut, "/crud-000002", `{"aliases": {"crud-000001": {}}}`)
+	require.Equal(t, rec.Code, http.StatusBadRequest)
+	idxMap, err := s.ListTables()
+	require.NoError(t, err)
+	_, ok := idxMap["crud-000002"]
+	require.False(t, ok)
+
+	rec = doRequest(http.MethodDelete, "/crud-000001/_alias/crud-alias", "")
+	require.Equal(t, rec.Code, http.StatusOK)
+	rec = doRequest(http.MethodDelete, "/crud-000001/_alias/crud-alias", "")
+	require.Equal(t, rec.Code, http.StatusNotFound)
+
+	rec = doRequest(http.MethodPost, "/crud-alias/_search", `{}`)
+	require.Equal(t, rec.Code, http.StatusNotFound)
+	rec = doRequest(http.MethodPost, "/crud-create/_search", `{}`)
+	require.Equal(t, rec.Code, http.StatusOK)
+
+	// Aliases survive a reload from the datastore
+	s.loadAliasMetadata()
+	_, ok = s.Aliases["crud-create"]["crud-000001"]
+	require.True(t, ok)
+	_, ok = s.Aliases["crud-alias"]
+	require.False(t, ok)
+}
+
+func TestAliasMapping(t *testing.T) {
+	rec := doRequest(http.MethodPost, "/_aliases", `
+	{ "actions": [ { "add": { "index": "jaeger-span-2022-11-11", "alias": "jaeger-span-read" } } ] }`)
+	require.Equal(t, rec.Code, http.StatusOK)
+
+	rec = doRequest(http.MethodGet, "/jaeger-span-read/_mapping", "")
+	require.Equal(t, rec.Code, http.StatusOK)
+	mappings := make(map[string]TemplateMapping)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &mappings))
+	_, ok := mappings["jaeger-span-2022-11-11"]
+	require.True(t, ok)
+}
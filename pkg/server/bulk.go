@@ -0,0 +1,275 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+/*
+
+Bulk requests can be one of four types :
+- index
+- create
+- update
+- delete
+
+https://www.elastic.co/guide/en/elasticsearch/reference/master/docs-bulk.html
+
+The response is somewhat complex and is used by the python bulk helper client:
+https://www.elastic.co/guide/en/elasticsearch/reference/master/docs-bulk.html#docs-bulk-api-example
+
+Each action is processed independently; a failure of one item is reported in its
+response item and flagged with `errors: true` rather than failing the whole request.
+
+*/
+
+type BulkActionMeta struct {
+	Index string `json:"_index"`
+	Id    string `json:"_id"`
+}
+
+// Body of an update action
+type UpdateRequest struct {
+	Doc         map[string]interface{} `json:"doc"`
+	DocAsUpsert bool                   `json:"doc_as_upsert"`
+	Upsert      map[string]interface{} `json:"upsert"`
+	Script      json.RawMessage        `json:"script"`
+}
+
+type bulkRequestError struct {
+	status  int
+	errType string
+	err     error
+}
+
+func (s *Server) BulkHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	defaultIndex := vars["index"]
+
+	start := time.Now()
+
+	// Documents are written in batched transactions as the body is streamed in.
+	// Each batch is read before its transaction begins, so that a slow client
+	// doesn't hold up other writers
+	dw, err := s.newDocWriter(s.Cfg.BulkBatchSize)
+	if err != nil {
+		handleErrorResponse(w, err)
+		return
+	}
+	defer dw.rollback()
+
+	bulkResp := BulkResponse{
+		Items: make([]map[string]BulkResponseItem, 0),
+	}
+
+	batch := make([]bulkOp, 0, dw.batchSize)
+	rdr := bufio.NewReader(r.Body)
+	for {
+		line, err := readBulkLine(rdr)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "failure trying to parse "+err.Error())
+			return
+		}
+
+		var actionLine map[string]BulkActionMeta
+		if err = json.Unmarshal(line, &actionLine); err != nil || len(actionLine) != 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "malformed action/metadata line: %s", string(line))
+			return
+		}
+
+		for action, meta := range actionLine {
+			var body []byte
+			if action != "delete" {
+				body, err = readBulkLine(rdr)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					fmt.Fprintf(w, "missing source for %s action", action)
+					return
+				}
+			}
+			if meta.Index == "" {
+				meta.Index = defaultIndex
+			}
+			batch = append(batch, bulkOp{action: action, meta: meta, body: body})
+		}
+		if len(batch) >= dw.batchSize {
+			s.applyBulkBatch(dw, batch, &bulkResp)
+			batch = batch[:0]
+		}
+	}
+	s.applyBulkBatch(dw, batch, &bulkResp)
+	bulkResp.Took = int(time.Since(start).Milliseconds())
+
+	j, _ := json.Marshal(bulkResp)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
+type bulkOp struct {
+	action string
+	meta   BulkActionMeta
+	body   []byte
+}
+
+// Apply a batch of operations in a single transaction. Their items are only
+// reported once it has been committed, and as failed if it couldn't be
+func (s *Server) applyBulkBatch(dw *docWriter, batch []bulkOp, resp *BulkResponse) {
+	if len(batch) == 0 {
+		return
+	}
+	items := make([]BulkResponseItem, len(batch))
+	for i, op := range batch {
+		items[i] = s.bulkItem(dw, op.action, op.meta, op.body)
+	}
+	if err := dw.flush(); err != nil {
+		failBulkItems(items, err)
+	}
+	for i, item := range items {
+		if item.Error != nil {
+			resp.Errors = true
+		}
+		resp.Items = append(resp.Items, map[string]BulkResponseItem{batch[i].action: item})
+	}
+}
+
+// Items whose writes were lost along with the rest of their batch
+func failBulkItems(items []BulkResponseItem, err error) {
+	for i, item := range items {
+		if item.Error != nil {
+			continue
+		}
+		items[i] = BulkResponseItem{
+			Index:  item.Index,
+			Id:     item.Id,
+			Type:   item.Type,
+			Status: http.StatusInternalServerError,
+			Error:  &BulkItemError{Type: "exception", Reason: "failed to commit batch: " + err.Error(), Index: item.Index},
+		}
+	}
+}
+
+// Skip any blank lines, and return the next line of an ndjson body
+func readBulkLine(rdr *bufio.Reader) ([]byte, error) {
+	for {
+		line, err := rdr.ReadBytes('\n')
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 {
+			return line, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (s *Server) bulkItem(dw *docWriter, action string, meta BulkActionMeta, body []byte) BulkResponseItem {
+	item := BulkResponseItem{
+		Index: meta.Index,
+		Id:    meta.Id,
+		Type:  "_doc",
+	}
+
+	res, err := s.applyBulkAction(dw, action, &meta, body)
+	item.Index = meta.Index
+	if err != nil {
+		status, errType := bulkErrorStatus(err)
+		item.Status = status
+		item.Error = &BulkItemError{Type: errType, Reason: err.Error(), Index: meta.Index}
+		return item
+	}
+
+	item.Id = res.Id
+	item.Version = res.Version
+	item.Result = res.Result
+	item.SeqNo = &res.SeqNo
+	item.PrimaryTerm = 1
+	shards := MakeShardsInfo()
+	item.Shards = &shards
+	switch res.Result {
+	case "created":
+		item.Status = http.StatusCreated
+	case "not_found":
+		item.Status = http.StatusNotFound
+	default:
+		item.Status = http.StatusOK
+	}
+	return item
+}
+
+func (s *Server) applyBulkAction(dw *docWriter, action string, meta *BulkActionMeta, body []byte) (*IndexResult, error) {
+	if meta.Index == "" {
+		return nil, &bulkRequestError{http.StatusBadRequest, "action_request_validation_exception", errors.New("index is missing")}
+	}
+	index, err := s.resolveWriteIndex(meta.Index)
+	if err != nil {
+		return nil, &bulkRequestError{http.StatusBadRequest, "illegal_argument_exception", err}
+	}
+	meta.Index = index
+
+	if (action == "update" || action == "delete") && meta.Id == "" {
+		return nil, &bulkRequestError{http.StatusBadRequest, "action_request_validation_exception", errors.New("id is missing")}
+	}
+
+	switch action {
+	case "index", "create":
+		return dw.index(string(body), index, meta.Id, action == "create")
+
+	case "update":
+		upd := UpdateRequest{}
+		if err = json.Unmarshal(body, &upd); err != nil {
+			return nil, &bulkRequestError{http.StatusBadRequest, "illegal_argument_exception", err}
+		}
+		if upd.Script != nil {
+			return nil, &bulkRequestError{http.StatusBadRequest, "action_request_validation_exception", errors.New("scripted updates are not supported")}
+		}
+		if upd.Doc == nil && upd.Upsert == nil {
+			return nil, &bulkRequestError{http.StatusBadRequest, "action_request_validation_exception", errors.New("script or doc is missing")}
+		}
+		return dw.update(index, meta.Id, upd.Doc, upd.Upsert, upd.DocAsUpsert)
+
+	case "delete":
+		return dw.delete(index, meta.Id)
+	}
+	return nil, &bulkRequestError{http.StatusBadRequest, "illegal_argument_exception", fmt.Errorf("unsupported bulk action [%s]", action)}
+}
+
+func (e *bulkRequestError) Error() string {
+	return e.err.Error()
+}
+
+// Map errors to the status and exception type ES would report for them
+func bulkErrorStatus(err error) (int, string) {
+	var (
+		br *bulkRequestError
+		vc *VersionConflictError
+		dm *DocumentMissingError
+		in *InvalidIndexNameError
+		mp *MapperParsingError
+	)
+	switch {
+	case errors.As(err, &vc):
+		return http.StatusConflict, "version_conflict_engine_exception"
+	case errors.As(err, &dm):
+		return http.StatusNotFound, "document_missing_exception"
+	case errors.As(err, &in):
+		return http.StatusBadRequest, "invalid_index_name_exception"
+	case errors.As(err, &mp):
+		return http.StatusBadRequest, "mapper_parsing_exception"
+	case errors.As(err, &br):
+		return br.status, br.errType
+	}
+	return http.StatusInternalServerError, "exception"
+}
@@ -0,0 +1,257 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	require "github.com/alecthomas/assert/v2"
+)
+
+func bulkRequest(t *testing.T, path, body string) BulkResponse {
+	rec := doRequest(http.MethodPost, path, body)
+	require.Equal(t, rec.Code, http.StatusOK, rec.Body.String())
+	resp := BulkResponse{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	return resp
+}
+
+func TestBulkActions(t *testing.T) {
+	resp := bulkRequest(t, "/bulk-actions/_bulk", `
+{"index": {"_id": "1"}}
+{"name": "one", "nested": {"a": 1, "b": 2}}
+{"create": {"_id": "2"}}
+{"name": "two"}
+{"create": {}}
+{"name": "generated"}
+{"update": {"_id": "1"}}
+{"doc": {"nested": {"b": 3}, "extra": true}}
+{"update": {"_id": "1"}}
+{"doc": {"extra": true}}
+{"delete": {"_id": "2"}}
+{"delete": {"_id": "2"}}
+`)
+	require.False(t, resp.Errors)
+	require.Equal(t, len(resp.Items), 7)
+
+	expect := []struct {
+		action string
+		status int
+		result string
+	}{
+		{"index", 201, "created"},
+		{"create", 201, "created"},
+		{"create", 201, "created"},
+		{"update", 200, "updated"},
+		{"update", 200, "noop"},
+		{"delete", 200, "deleted"},
+		{"delete", 404, "not_found"},
+	}
+	for i, e := range expect {
+		item, ok := resp.Items[i][e.action]
+		require.True(t, ok, e.action)
+		require.Equal(t, item.Status, e.status, e.action)
+		require.Equal(t, item.Result, e.result, e.action)
+		require.Equal(t, item.Index, "bulk-actions")
+	}
+	require.Equal(t, resp.Items[0]["index"].Id, "1")
+	require.Equal(t, len(resp.Items[2]["create"].Id), 20)
+	require.Equal(t, resp.Items[3]["update"].Version, 2)
+
+	rec := doRequest(http.MethodGet, "/bulk-actions/_source/1", "")
+	require.Equal(t, rec.Body.String(), `{"extra":true,"name":"one","nested":{"a":1,"b":3}}`)
+}
+
+func TestBulkUpserts(t *testing.T) {
+	resp := bulkRequest(t, "/_bulk", `
+{"update": {"_index": "bulk-upserts", "_id": "a"}}
+{"doc": {"n": 1}, "doc_as_upsert": true}
+{"update": {"_index": "bulk-upserts", "_id": "b"}}
+{"doc": {"n": 2}, "upsert": {"n": 0}}
+{"update": {"_index": "bulk-upserts", "_id": "b"}}
+{"doc": {"n": 2}, "upsert": {"n": 0}}
+`)
+	require.False(t, resp.Errors)
+	require.Equal(t, resp.Items[0]["update"].Result, "created")
+	require.Equal(t, resp.Items[1]["update"].Result, "created")
+	require.Equal(t, resp.Items[2]["update"].Result, "updated")
+
+	rec := doRequest(http.MethodGet, "/bulk-upserts/_source/a", "")
+	require.Equal(t, rec.Body.String(), `{"n":1}`)
+	rec = doRequest(http.MethodGet, "/bulk-upserts/_source/b", "")
+	require.Equal(t, rec.Body.String(), `{"n":2}`)
+}
+
+func TestBulkItemErrors(t *testing.T) {
+	resp := bulkRequest(t, "/bulk-errors/_bulk", `
+{"create": {"_id": "1"}}
+{"n": 1}
+{"create": {"_id": "1"}}
+{"n": 2}
+{"update": {"_id": "missing"}}
+{"doc": {"n": 3}}
+{"index": {"_id": "bad"}}
+{"n": 
+{"update": {}}
+{"doc": {"n": 4}}
+{"index": {"_id": "2"}}
+{"n": 5}
+`)
+	require.True(t, resp.Errors)
+	require.Equal(t, len(resp.Items), 6)
+
+	require.Equal(t, resp.Items[0]["create"].Status, 201)
+	require.Zero(t, resp.Items[0]["create"].Error)
+
+	require.Equal(t, resp.Items[1]["create"].Status, 409)
+	require.Equal(t, resp.Items[1]["create"].Error.Type, "version_conflict_engine_exception")
+
+	require.Equal(t, resp.Items[2]["update"].Status, 404)
+	require.Equal(t, resp.Items[2]["update"].Error.Type, "document_missing_exception")
+
+	require.Equal(t, resp.Items[3]["index"].Status, 400)
+	require.Equal(t, resp.Items[3]["index"].Error.Type, "mapper_parsing_exception")
+
+	require.Equal(t, resp.Items[4]["update"].Status, 400)
+
+	// Items after failures are still processed
+	require.Equal(t, resp.Items[5]["index"].Status, 201)
+}
+
+func TestBulkBatches(t *testing.T) {
+	// Batches smaller than the request should still commit everything, and a
+	// failing item shouldn't affect the rest of its batch
+	prev := s.Cfg.BulkBatchSize
+	s.Cfg.BulkBatchSize = 2
+	defer func() { s.Cfg.BulkBatchSize = prev }()
+
+	resp := bulkRequest(t, "/bulk-batches/_bulk", `
+{"index": {"_id": "1"}}
+{"n": 1}
+{"create": {"_id": "1"}}
+{"n": 2}
+{"index": {"_id": "2"}}
+{"n": 3}
+{"index": {"_id": "3"}}
+{"n": 4}
+{"index": {"_id": "4"}}
+{"n": 5}
+`)
+	require.True(t, resp.Errors)
+	rec := doRequest(http.MethodPost, "/bulk-batches/_search", `{}`)
+	d := getResponse(t, rec.Result())
+	require.Equal(t, len(d.Hits.Hits), 4)
+	rec = doRequest(http.MethodGet, "/bulk-batches/_source/1", "")
+	require.Equal(t, rec.Body.String(), `{"n":1}`)
+}
+
+func TestConcurrentBulkWriters(t *testing.T) {
+	// Writers to a database file wait their turn rather than failing
+	fs := &Server{Cfg: Config{DbLocation: filepath.Join(t.TempDir(), "writers.db")}}
+	fs.Init()
+	defer fs.db.Close()
+
+	const writers, requests = 8, 20
+	errs := make(chan error, writers*requests)
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for r := 0; r < requests; r++ {
+				body := fmt.Sprintf("{\"index\": {}}\n{\"writer\": %d, \"request\": %d}\n", w, r)
+				rec := httptest.NewRecorder()
+				fs.Router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/concurrent-writers/_bulk", strings.NewReader(body)))
+				resp := BulkResponse{}
+				if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.Errors {
+					errs <- fmt.Errorf("writer %d request %d: %s", w, r, rec.Body.String())
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	rec := httptest.NewRecorder()
+	fs.Router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/concurrent-writers/_search", strings.NewReader(`{"size": 1000}`)))
+	d := getResponse(t, rec.Result())
+	require.Equal(t, len(d.Hits.Hits), writers*requests)
+}
+
+func TestFailBulkItems(t *testing.T) {
+	// Once a batch fails to commit, none of its writes can be reported as done
+	items := []BulkResponseItem{
+		{Index: "a", Id: "1", Type: "_doc", Result: "created", Status: http.StatusCreated},
+		{Index: "a", Id: "2", Type: "_doc", Status: http.StatusConflict, Error: &BulkItemError{Type: "version_conflict_engine_exception"}},
+	}
+	failBulkItems(items, errors.New("database is locked"))
+	require.Equal(t, items[0], BulkResponseItem{Index: "a", Id: "1", Type: "_doc", Status: http.StatusInternalServerError,
+		Error: &BulkItemError{Type: "exception", Reason: "failed to commit batch: database is locked", Index: "a"}})
+	require.Equal(t, items[1].Status, http.StatusConflict)
+}
+
+// Build a bulk body from the fixtures, repeated enough times to be worth measuring.
+// Index names and ids are stripped so that every document is a fresh insert into
+// whichever index the request is sent to
+func benchmarkBulkBody(b *testing.B, repeat int) string {
+	files, err := filepath.Glob("./testdata/*.ndjson")
+	require.NoError(b, err)
+
+	var fixture strings.Builder
+	for _, f := range files {
+		raw, err := os.ReadFile(f)
+		require.NoError(b, err)
+		for i, line := range strings.Split(strings.TrimSpace(string(raw)), "\n") {
+			if i%2 == 0 {
+				line = `{"index": {}}`
+			}
+			fixture.WriteString(line + "\n")
+		}
+	}
+	return strings.Repeat(fixture.String(), repeat)
+}
+
+func benchmarkBulk(b *testing.B, batchSize int) {
+	body := benchmarkBulkBody(b, 250)
+	prev := s.Cfg.BulkBatchSize
+	s.Cfg.BulkBatchSize = batchSize
+	defer func() { s.Cfg.BulkBatchSize = prev }()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Named so the span template applies
+		path := fmt.Sprintf("/bench-jaeger-span-%d-%d/_bulk", batchSize, i)
+		rec := doRequest(http.MethodPost, path, body)
+		if rec.Code != http.StatusOK {
+			b.Fatal(rec.Body.String())
+		}
+	}
+}
+
+func BenchmarkBulkUnbatched(b *testing.B) {
+	benchmarkBulk(b, 1)
+}
+
+func BenchmarkBulkBatched100(b *testing.B) {
+	benchmarkBulk(b, 100)
+}
+
+func BenchmarkBulkBatchedDefault(b *testing.B) {
+	benchmarkBulk(b, defaultBulkBatchSize)
+}
+
+func BenchmarkFindMatchingTemplate(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		s.findMatchingTemplate("jaeger-span-2022-11-11")
+	}
+}
@@ -0,0 +1,457 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/atomic77/gopensearch/pkg/date"
+	"github.com/atomic77/gopensearch/pkg/dsl"
+	"github.com/huandu/go-sqlbuilder"
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+
+Composite aggregations group documents by the keys of all of their sources at
+once, and order the buckets by them, so that every combination can be paged
+through with the after_key of each page, which the next one starts after. Terms
+sources join each document to its values as terms aggregations do, and histogram
+sources key it by its bucket
+
+https://www.elastic.co/guide/en/elasticsearch/reference/7.17/search-aggregations-bucket-composite-aggregation.html
+
+*/
+
+type CompositeAggregation struct {
+	AfterKey  compositeKey `json:"after_key,omitempty"`
+	Buckets   []Bucket     `json:"buckets"`
+	composite *compositeAgg
+}
+
+func (m CompositeAggregation) GetAggregateCategory() dsl.AggregationCategory {
+	return dsl.Bucket
+}
+
+// The key of a composite bucket, shown by the names of the sources in their order
+type compositeKey []compositeValue
+
+type compositeValue struct {
+	name  string
+	value interface{}
+	// As the sql has it, for the filters of sub-aggregations
+	raw interface{}
+}
+
+func (k compositeKey) MarshalJSON() ([]byte, error) {
+	buf := bytes.NewBufferString("{")
+	for i, v := range k {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, err := json.Marshal(v.name)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(v.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// A composite aggregation as planned
+type compositeAgg struct {
+	sources []*compositeSource
+	size    int
+	// The key the buckets start after, as the sql has it, if any
+	after      []interface{}
+	countAlias string
+}
+
+type compositeSource struct {
+	name          string
+	field         string
+	desc          bool
+	missingBucket bool
+	// A terms source has each of the values of the field as keys, while the
+	// histograms have the one
+	hist     *HistogramAggregation
+	dateHist *dateHistogram
+	// Date keys are epoch millis, shown in the format for terms and for date
+	// histograms that have one
+	format    string
+	loc       *time.Location
+	formatted bool
+	boolean   bool
+	alias     string
+}
+
+func newComposite(c *dsl.Composite, label string, mapping *TemplateMapping) (*compositeAgg, error) {
+	if len(c.Sources) == 0 {
+		return nil, &QueryError{Reason: "Composite [sources] cannot be null or empty"}
+	}
+	ca := &compositeAgg{size: 10}
+	if c.Size != nil {
+		if ca.size = *c.Size; ca.size <= 0 {
+			return nil, &QueryError{Reason: fmt.Sprintf("[size] must be greater than 0. Found [%d] in [%s]", ca.size, label)}
+		}
+	}
+	seen := make(map[string]bool)
+	for _, s := range c.Sources {
+		if seen[s.Name] {
+			return nil, &QueryError{Reason: fmt.Sprintf("Composite source names must be unique, found duplicates: [%s]", s.Name)}
+		}
+		seen[s.Name] = true
+		src, err := newCompositeSource(s, mapping)
+		if err != nil {
+			return nil, err
+		}
+		ca.sources = append(ca.sources, src)
+	}
+
+	if c.After == nil {
+		return ca, nil
+	}
+	if len(c.After) != len(ca.sources) {
+		return nil, &QueryError{Reason: fmt.Sprintf("[after] has %d value(s) but [sources] has %d", len(c.After), len(ca.sources))}
+	}
+	for _, src := range ca.sources {
+		v, ok := c.After[src.name]
+		if !ok {
+			return nil, &QueryError{Reason: fmt.Sprintf("Missing value for [after.%s]", src.name)}
+		}
+		raw, err := src.afterValue(v)
+		if err != nil {
+			return nil, err
+		}
+		ca.after = append(ca.after, raw)
+	}
+	return ca, nil
+}
+
+func newCompositeSource(s dsl.CompositeSource, mapping *TemplateMapping) (*compositeSource, error) {
+	var v *dsl.CompositeValues
+	n := 0
+	for _, kind := range []*dsl.CompositeValues{s.Terms, s.Histogram, s.DateHistogram} {
+		if kind != nil {
+			v = kind
+			n++
+		}
+	}
+	if n != 1 {
+		return nil, &QueryError{Reason: fmt.Sprintf("Composite source [%s] must be one of terms, histogram or date_histogram", s.Name)}
+	}
+	src := &compositeSource{name: s.Name, field: cleanseKeyField(v.Field), missingBucket: v.MissingBucket}
+	if src.field == "" {
+		return nil, &QueryError{Reason: fmt.Sprintf("Required one of fields [field, script], but none were specified in [%s]", s.Name)}
+	}
+	switch strings.ToLower(v.Order) {
+	case "", "asc":
+	case "desc":
+		src.desc = true
+	default:
+		return nil, &QueryError{Reason: fmt.Sprintf("Unknown order direction [%s]", v.Order)}
+	}
+	prop, _ := mapping.fieldType(src.field)
+
+	var err error
+	switch {
+	case s.Histogram != nil:
+		h := &dsl.Histogram{Field: v.Field}
+		if v.Interval != nil {
+			iv, err := strconv.ParseFloat(v.Interval.String(), 64)
+			if err != nil {
+				return nil, &QueryError{Reason: fmt.Sprintf("[interval] failed to parse [%s] as a number", v.Interval.String())}
+			}
+			h.Interval = &iv
+		}
+		if v.Offset != nil {
+			if h.Offset, err = strconv.ParseFloat(v.Offset.String(), 64); err != nil {
+				return nil, &QueryError{Reason: fmt.Sprintf("[offset] failed to parse [%s] as a number", v.Offset.String())}
+			}
+		}
+		if _, err := newHistogram(h); err != nil {
+			return nil, err
+		}
+		src.hist = &HistogramAggregation{agg: h}
+	case s.DateHistogram != nil:
+		h := &dsl.DateHistogram{Field: v.Field, FixedInterval: v.FixedInterval, CalendarInterval: v.CalendarInterval,
+			Offset: v.Offset, TimeZone: v.TimeZone, Format: v.Format}
+		if v.Interval != nil {
+			h.Interval = v.Interval.String()
+		}
+		if src.dateHist, err = newDateHistogram(h, prop); err != nil {
+			return nil, err
+		}
+		src.format, src.loc, src.formatted = src.dateHist.format, src.dateHist.loc, v.Format != ""
+	default:
+		switch prop.Type {
+		case "date", "date_nanos":
+			if src.format, err = aggDateFormat(v.Format, prop); err != nil {
+				return nil, err
+			}
+			src.loc, src.formatted = time.UTC, true
+		case "boolean":
+			src.boolean = true
+		}
+	}
+	return src, nil
+}
+
+// The value of the after key for a source as the sql has it: dates are epoch
+// millis, booleans 1 or 0, and integral numbers int64s, which are compared
+// exactly with the integers stored
+func (src *compositeSource) afterValue(v interface{}) (interface{}, error) {
+	if v == nil {
+		if !src.missingBucket {
+			return nil, &QueryError{Reason: fmt.Sprintf("Invalid value for [after.%s], null is only allowed with [missing_bucket]", src.name)}
+		}
+		return nil, nil
+	}
+	if n, ok := v.(json.Number); ok {
+		if i, err := n.Int64(); err == nil {
+			v = i
+		} else if f, err := n.Float64(); err == nil {
+			v = f
+		} else {
+			return nil, &QueryError{Reason: fmt.Sprintf("Invalid value for [after.%s]: %v", src.name, err)}
+		}
+	}
+	switch {
+	case src.format != "":
+		s := fmt.Sprint(v)
+		if f, ok := v.(float64); ok {
+			s = strconv.FormatInt(int64(f), 10)
+		}
+		t, err := date.ParseMath(s, src.format+"||epoch_millis", src.loc, false, time.Now())
+		if err != nil {
+			return nil, &QueryError{Reason: fmt.Sprintf("Invalid value for [after.%s]: %v", src.name, err)}
+		}
+		return t.UnixMilli(), nil
+	case src.boolean:
+		if b, ok := v.(bool); ok {
+			if b {
+				return int64(1), nil
+			}
+			return int64(0), nil
+		}
+	}
+	switch v.(type) {
+	case string, int64, float64, bool:
+		return v, nil
+	}
+	return nil, &QueryError{Reason: fmt.Sprintf("Invalid value for [after.%s], expected a value but got [%v]", src.name, v)}
+}
+
+// The sql of the key of a document for a source, for which a terms source joins
+// it to each of its values, or to none if it has none and there's a missing bucket
+func (src *compositeSource) keyExpr(dbq *dbSubQuery) (string, error) {
+	switch {
+	case src.hist != nil:
+		return src.hist.keyExpr(dbq)
+	case src.dateHist != nil:
+		millis, err := dbq.dateMillis(src.field)
+		if err != nil {
+			return "", err
+		}
+		return src.dateHist.keyExpr(dbq, millis), nil
+	}
+	values, err := dbq.metricValue(&dsl.AggField{Field: src.field})
+	if err != nil {
+		return "", err
+	}
+	each := "terms_" + src.alias
+	value := each + ".value"
+	var option sqlbuilder.JoinOption
+	if src.missingBucket {
+		option = sqlbuilder.LeftJoin
+	}
+	dbq.sb.JoinWithOption(option, fmt.Sprintf("json_each(%s) AS %s", values, each),
+		fmt.Sprintf(`%s.type NOT IN ('null', 'object', 'array')`, each),
+		fmt.Sprintf(`NOT EXISTS (SELECT 1 FROM json_each(%s) AS seen WHERE seen.key < %s.key AND seen.value IS %s)`,
+			values, each, value),
+	)
+	if src.format != "" {
+		return epochMillis(value, each+".type"), nil
+	}
+	return value, nil
+}
+
+// The documents with a key for a source, as the filter of a bucket
+func (src *compositeSource) keyFilter(dbq *dbSubQuery, raw interface{}) (string, error) {
+	if src.hist != nil || src.dateHist != nil {
+		key, err := src.keyExpr(dbq)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s IS %s", key, dbq.sb.Var(raw)), nil
+	}
+	values, err := dbq.metricValue(&dsl.AggField{Field: src.field})
+	if err != nil {
+		return "", err
+	}
+	if raw == nil {
+		return fmt.Sprintf("NOT EXISTS (SELECT 1 FROM json_each(%s) AS term WHERE term.type NOT IN ('null', 'object', 'array'))", values), nil
+	}
+	value := "term.value"
+	if src.format != "" {
+		value = epochMillis(value, "term.type")
+	}
+	return fmt.Sprintf("EXISTS (SELECT 1 FROM json_each(%s) AS term WHERE %s IS %s)",
+		values, value, dbq.sb.Var(raw)), nil
+}
+
+// Keys are shown as ES does for the type of their field
+func (src *compositeSource) keyValue(raw interface{}) interface{} {
+	if raw == nil {
+		return nil
+	}
+	switch {
+	case src.format != "":
+		ms, _ := termsKeyNumber(raw)
+		if !src.formatted {
+			return int64(ms)
+		}
+		s, _ := date.Format(src.format, time.UnixMilli(int64(ms)).In(src.loc))
+		return fmt.Sprint(s)
+	case src.boolean:
+		if n, ok := raw.(int64); ok {
+			return n != 0
+		}
+	}
+	return raw
+}
+
+func (dbq *dbSubQuery) genCompositeSelectExprs(agg *dsl.Aggregate, grpIdx, fnIdx string) error {
+	ca, err := newComposite(agg.Composite, *dbq.label, dbq.mapping)
+	if err != nil {
+		return err
+	}
+	ca.countAlias = fnIdx
+	for i, src := range ca.sources {
+		src.alias = fmt.Sprintf("%s_%d", grpIdx, i)
+		key, err := src.keyExpr(dbq)
+		if err != nil {
+			return err
+		}
+		if !src.missingBucket {
+			dbq.sb.Where(key + " IS NOT NULL")
+		}
+		dbq.groupAliases[src.alias] = agg.Composite
+		dbq.selectExprs = append(dbq.selectExprs, dbq.sb.As(" "+key, src.alias))
+	}
+	dbq.fnAliases[fnIdx] = agg.Composite
+	dbq.selectExprs = append(dbq.selectExprs, dbq.sb.As("COUNT(*)", fnIdx))
+	dbq.aggregation = &CompositeAggregation{composite: ca}
+	return nil
+}
+
+// The buckets after the after key, up to the size, in the order of the sources,
+// where missing keys come first in ascending order and last in descending, as
+// sqlite has nulls. The key of each bucket is distinct, which makes the order of
+// the pages deterministic
+func (dbq *dbSubQuery) genCompositeOrder(ca *compositeAgg) {
+	outer := sqlbuilder.SQLite.NewSelectBuilder()
+	outer.Select("*").From(outer.BuilderAs(dbq.sb, "buckets"))
+	if ca.after != nil {
+		// Either the first keys are the same and the next comes after, or ...
+		alts := make([]string, 0, len(ca.sources))
+		for i, src := range ca.sources {
+			conds := make([]string, 0, i+1)
+			for j := 0; j < i; j++ {
+				conds = append(conds, fmt.Sprintf("%s IS %s", ca.sources[j].alias, outer.Var(ca.after[j])))
+			}
+			after := ca.after[i]
+			switch {
+			case after == nil && src.desc:
+				continue
+			case after == nil:
+				conds = append(conds, src.alias+" IS NOT NULL")
+			case src.desc:
+				conds = append(conds, fmt.Sprintf("(%s < %s OR %s IS NULL)", src.alias, outer.Var(after), src.alias))
+			default:
+				conds = append(conds, fmt.Sprintf("%s > %s", src.alias, outer.Var(after)))
+			}
+			alts = append(alts, "("+strings.Join(conds, " AND ")+")")
+		}
+		if len(alts) == 0 {
+			alts = append(alts, "0")
+		}
+		outer.Where(strings.Join(alts, " OR "))
+	}
+	for _, src := range ca.sources {
+		if src.desc {
+			outer.OrderBy(src.alias + " DESC")
+		} else {
+			outer.OrderBy(src.alias + " ASC")
+		}
+	}
+	outer.Limit(ca.size)
+	dbq.sb = outer
+}
+
+func (m *CompositeAggregation) SerializeResultset(rows *sqlx.Rows, dbq *dbSubQuery) error {
+	ca := m.composite
+	m.Buckets = make([]Bucket, 0)
+	for rows.Next() {
+		dest := make(map[string]interface{})
+		if err := rows.MapScan(dest); err != nil {
+			return err
+		}
+		b, err := scanBucket(dest, dbq)
+		if err != nil {
+			return err
+		}
+		key := make(compositeKey, len(ca.sources))
+		for i, src := range ca.sources {
+			raw := dest[src.alias]
+			key[i] = compositeValue{name: src.name, value: src.keyValue(raw), raw: raw}
+		}
+		b.Key = key
+		m.Buckets = append(m.Buckets, b)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	m.setAfterKey()
+	return nil
+}
+
+// The after key is that of the last bucket, which the next page starts after
+func (m *CompositeAggregation) setAfterKey() {
+	m.AfterKey = nil
+	if len(m.Buckets) > 0 {
+		m.AfterKey = m.Buckets[len(m.Buckets)-1].Key.(compositeKey)
+	}
+}
+
+func (m *CompositeAggregation) buckets() []Bucket {
+	return m.Buckets
+}
+
+func (m *CompositeAggregation) setBuckets(buckets []Bucket) {
+	m.Buckets = buckets
+}
+
+// The documents of a bucket are those with each of its keys
+func (m *CompositeAggregation) bucketFilter(dbq *dbSubQuery, b *Bucket) (string, error) {
+	key := b.Key.(compositeKey)
+	preds := make([]string, len(key))
+	for i, src := range m.composite.sources {
+		pred, err := src.keyFilter(dbq, key[i].raw)
+		if err != nil {
+			return "", err
+		}
+		preds[i] = pred
+	}
+	return strings.Join(preds, " AND "), nil
+}
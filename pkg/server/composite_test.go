@@ -0,0 +1,100 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	require "github.com/alecthomas/assert/v2"
+)
+
+func TestCompositeAggregation(t *testing.T) {
+	bulkRequest(t, "/compositeaggs/_bulk", `
+{"index": {}}
+{"service": "api", "op": "get", "ts": "2022-11-01T10:00:00Z", "took": 10}
+{"index": {}}
+{"service": "api", "op": "put", "ts": "2022-11-01T12:00:00Z", "took": 20}
+{"index": {}}
+{"service": "api", "op": "get", "ts": "2022-11-02T10:00:00Z", "took": 30}
+{"index": {}}
+{"service": "web", "op": "get", "ts": "2022-11-02T11:00:00Z", "took": 40}
+{"index": {}}
+{"service": "web", "ts": "2022-11-03T10:00:00Z", "took": 55}
+`)
+	composite := func(options string) string {
+		t.Helper()
+		return aggregationResult(t, "compositeaggs", `{"a": {"composite": {`+options+`}, "aggs": {"took": {"avg": {"field": "took"}}}}}`)
+	}
+	sources := `"sources": [{"service": {"terms": {"field": "service"}}}, {"op": {"terms": {"field": "op"}}}]`
+
+	// Paging through every combination
+	require.Equal(t, composite(sources+`, "size": 2`),
+		`{"after_key":{"service":"api","op":"put"},"buckets":[`+
+			`{"key":{"service":"api","op":"get"},"doc_count":2,"took":{"value":20}},`+
+			`{"key":{"service":"api","op":"put"},"doc_count":1,"took":{"value":20}}]}`)
+	require.Equal(t, composite(sources+`, "size": 2, "after": {"service": "api", "op": "put"}`),
+		`{"after_key":{"service":"web","op":"get"},"buckets":[`+
+			`{"key":{"service":"web","op":"get"},"doc_count":1,"took":{"value":40}}]}`)
+	require.Equal(t, composite(sources+`, "size": 2, "after": {"service": "web", "op": "get"}`),
+		`{"buckets":[]}`)
+
+	// Missing keys come first in ascending order, and last in descending
+	require.Equal(t, composite(`"sources": [{"service": {"terms": {"field": "service", "order": "desc"}}},
+		{"op": {"terms": {"field": "op", "missing_bucket": true}}}]`),
+		`{"after_key":{"service":"api","op":"put"},"buckets":[`+
+			`{"key":{"service":"web","op":null},"doc_count":1,"took":{"value":55}},`+
+			`{"key":{"service":"web","op":"get"},"doc_count":1,"took":{"value":40}},`+
+			`{"key":{"service":"api","op":"get"},"doc_count":2,"took":{"value":20}},`+
+			`{"key":{"service":"api","op":"put"},"doc_count":1,"took":{"value":20}}]}`)
+	require.Equal(t, composite(`"sources": [{"service": {"terms": {"field": "service"}}},
+		{"op": {"terms": {"field": "op", "missing_bucket": true, "order": "desc"}}}], "after": {"service": "api", "op": null}`),
+		`{"after_key":{"service":"web","op":null},"buckets":[`+
+			`{"key":{"service":"web","op":"get"},"doc_count":1,"took":{"value":40}},`+
+			`{"key":{"service":"web","op":null},"doc_count":1,"took":{"value":55}}]}`)
+
+	// Date keys are epoch millis unless there's a format, which the after key is in
+	require.Equal(t, composite(`"sources": [{"day": {"date_histogram": {"field": "ts", "calendar_interval": "day"}}},
+		{"took": {"histogram": {"field": "took", "interval": 50}}}], "size": 2`),
+		`{"after_key":{"day":1667347200000,"took":0},"buckets":[`+
+			`{"key":{"day":1667260800000,"took":0},"doc_count":2,"took":{"value":15}},`+
+			`{"key":{"day":1667347200000,"took":0},"doc_count":2,"took":{"value":35}}]}`)
+	require.Equal(t, composite(`"sources": [{"day": {"date_histogram": {"field": "ts", "calendar_interval": "day", "format": "yyyy-MM-dd"}}},
+		{"took": {"histogram": {"field": "took", "interval": 50}}}], "after": {"day": "2022-11-02", "took": 0}`),
+		`{"after_key":{"day":"2022-11-03","took":50},"buckets":[`+
+			`{"key":{"day":"2022-11-03","took":50},"doc_count":1,"took":{"value":55}}]}`)
+
+	// Bucket sub-aggregations are over the documents with each of the keys
+	require.Equal(t, aggregationResult(t, "compositeaggs", `{"a": {"composite": {"sources": [{"service": {"terms": {"field": "service"}}}]},
+		"aggs": {"days": {"date_histogram": {"field": "ts", "calendar_interval": "day", "format": "MM-dd"}}}}}`),
+		`{"after_key":{"service":"web"},"buckets":[`+
+			`{"key":{"service":"api"},"doc_count":3,"days":{"buckets":[`+
+			`{"key_as_string":"11-01","key":1667260800000,"doc_count":2},{"key_as_string":"11-02","key":1667347200000,"doc_count":1}]}},`+
+			`{"key":{"service":"web"},"doc_count":2,"days":{"buckets":[`+
+			`{"key_as_string":"11-02","key":1667347200000,"doc_count":1},{"key_as_string":"11-03","key":1667433600000,"doc_count":1}]}}]}`)
+
+	// Integer keys beyond the precision of floats page exactly
+	bulkRequest(t, "/compositeaggs/_bulk", `
+{"index": {}}
+{"account": 9007199254740993}
+{"index": {}}
+{"account": 9007199254740994}
+{"index": {}}
+{"account": 9007199254740995}
+`)
+	require.Equal(t, aggregationResult(t, "compositeaggs", `{"a": {"composite": {"sources": [{"account": {"terms": {"field": "account"}}}],
+		"after": {"account": 9007199254740993}}}}`),
+		`{"after_key":{"account":9007199254740995},"buckets":[`+
+			`{"key":{"account":9007199254740994},"doc_count":1},{"key":{"account":9007199254740995},"doc_count":1}]}`)
+
+	for _, aggs := range []string{
+		`{"a": {"composite": {"sources": []}}}`,
+		`{"a": {"composite": {"sources": [{"s": {"terms": {"field": "service"}}}, {"s": {"terms": {"field": "op"}}}]}}}`,
+		`{"a": {"composite": {"sources": [{"s": {"terms": {"field": "service", "order": "up"}}}]}}}`,
+		`{"a": {"composite": {"sources": [{"s": {"terms": {"field": "service"}}}], "after": {"t": "api"}}}}`,
+		`{"a": {"composite": {"sources": [{"s": {"terms": {"field": "service"}}}], "after": {"s": null}}}}`,
+		`{"a": {"composite": {"sources": [{"s": {"histogram": {"field": "took"}}}]}}}`,
+		`{"a": {"terms": {"field": "service"}, "aggs": {"c": {"composite": {"sources": [{"s": {"terms": {"field": "op"}}}]}}}}}`,
+	} {
+		rec := doRequest(http.MethodPost, "/compositeaggs/_search", `{"size": 0, "aggs": `+aggs+`}`)
+		require.Equal(t, rec.Code, http.StatusBadRequest, aggs)
+	}
+}
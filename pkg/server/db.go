@@ -1,9 +1,13 @@
 package server
 
 import (
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log"
+	"sort"
+	"strings"
 
 	"github.com/atomic77/gopensearch/pkg/date"
 	"github.com/atomic77/gopensearch/pkg/dsl"
@@ -11,74 +15,228 @@ import (
 	"github.com/jmoiron/sqlx"
 )
 
-func (s *Server) IndexDocument(doc string, index string) error {
+type docIdRow struct {
+	Rowid   int64 `db:"doc_rowid"`
+	Version int   `db:"version"`
+}
 
-	// Insert into fts5 index; rowid will be created automatically
-	sql := fmt.Sprintf(` INSERT INTO '%s' (content) VALUES (json(?)) `, index)
+// fts5 tables can't have a real index on the _id column, so alongside each one
+// we keep a regular table mapping document ids to fts5 rowids. ES index names
+// can't start with an underscore, so this can't collide with a user's index
+func docIdTable(index string) string {
+	return "__docids_" + index
+}
 
-	tm := s.findMatchingTemplate(index)
+// fts5vocab table over an index, listing the distinct terms in it. Used to
+// expand fuzzy queries into the terms they could match
+func vocabTable(index string) string {
+	return "__vocab_" + index
+}
 
-	var err error
-	d := &doc
-	if tm != nil {
-		d, err = templateMapDoc(doc, tm)
-		if err != nil {
-			return err
-		}
+// ES auto-generated ids are 20 character url-safe base64 strings
+func generateDocId() string {
+	b := make([]byte, 15)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Quote a table name for use in sql. Index names are validated before their
+// tables are created, but are quoted regardless as they come from requests
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// The restrictions ES places on index names, which also keep them clear of the
+// tables used internally
+// https://www.elastic.co/guide/en/elasticsearch/reference/7.17/indices-create-index.html#indices-create-api-path-params
+func validateIndexName(index string) error {
+	invalid := func(reason string) error {
+		return &InvalidIndexNameError{Index: index, Reason: reason}
 	}
+	switch {
+	case index == "":
+		return invalid("must not be empty")
+	case index == "." || index == "..":
+		return invalid("must not be '.' or '..'")
+	case strings.ToLower(index) != index:
+		return invalid("must be lowercase")
+	case strings.ContainsAny(index, `\/*?"<>| ,#:`):
+		return invalid(`must not contain the following characters [ , ", *, \, <, |, ,, >, /, ?, #, :]`)
+	case strings.ContainsRune(index, 0):
+		return invalid("must not contain a null character")
+	case strings.HasPrefix(index, "-") || strings.HasPrefix(index, "_") || strings.HasPrefix(index, "+"):
+		return invalid("must not start with '_', '-', or '+'")
+	case len(index) > 255:
+		return invalid("index name is too long")
+	}
+	return nil
+}
 
-	// How to index specific json columns in sqlite:
-	// https://dgl.cx/2020/06/sqlite-json-support
-	// https://www.sqlite.org/gencol.html  <- as of 3.31
-	// Need to figure out best way to provide mapping between indexing features of ES and how we'd add
-	// columns on the fly to ensure fast performance without bloating the size of the resulting file
+func (s *Server) CreateTable(index string) error {
+	return createTable(s.db, index)
+}
 
-	stmt, err := s.db.Prepare(sql)
+func createTable(db sqlx.Execer, index string) error {
+	if err := validateIndexName(index); err != nil {
+		return err
+	}
+	// Mimic the creation of an elasticsearch index with an FTS5 virtual table
+	sql := fmt.Sprintf(
+		`CREATE VIRTUAL TABLE IF NOT EXISTS %s USING fts5(content, _id UNINDEXED);`,
+		quoteIdent(index),
+	)
+	_, err := db.Exec(sql)
 	if err != nil {
 		return err
 	}
-	defer stmt.Close()
+	if err = createDocIdTable(db, index); err != nil {
+		return err
+	}
+	return createVocabTable(db, index)
+}
 
-	_, err2 := stmt.Exec(*d)
-	return err2
+func createDocIdTable(db sqlx.Execer, index string) error {
+	sql := fmt.Sprintf(
+		`CREATE TABLE IF NOT EXISTS %s (_id TEXT PRIMARY KEY, doc_rowid INTEGER NOT NULL, version INTEGER NOT NULL);`,
+		quoteIdent(docIdTable(index)),
+	)
+	_, err := db.Exec(sql)
+	return err
 }
 
-func (s *Server) CreateTable(index string) error {
-	// Mimic the creation of an elasticsearch index with an FTS5 virtual table
+func createVocabTable(db sqlx.Execer, index string) error {
 	sql := fmt.Sprintf(
-		`CREATE VIRTUAL TABLE IF NOT EXISTS "%s" USING fts5(content);`,
-		index,
+		`CREATE VIRTUAL TABLE IF NOT EXISTS %s USING fts5vocab(%s, 'row');`,
+		quoteIdent(vocabTable(index)), quoteIdent(index),
 	)
-	_, err := s.db.Exec(sql, index)
+	_, err := db.Exec(sql)
 	return err
 }
 
-func (s *Server) SearchItem(index string, q *dsl.Dsl) ([]Document, map[string]Aggregation, error) {
+// Indices created before documents had ids are fts5 tables with only a content
+// column. Rebuild them with an _id column, using the old rowid as the id
+func (s *Server) migrateTables() error {
+	idxMap, err := s.ListTables()
+	if err != nil {
+		return err
+	}
+	for index := range idxMap {
+		cols := make([]struct {
+			Name string `db:"name"`
+		}, 0)
+		err = s.db.Select(&cols, `SELECT name FROM pragma_table_info(?)`, index)
+		if err != nil {
+			return err
+		}
+		hasId := false
+		for _, c := range cols {
+			if c.Name == "_id" {
+				hasId = true
+			}
+		}
+		// Vocab tables came later still, but can simply be added
+		if err = createVocabTable(s.db, index); err != nil {
+			return err
+		}
+		if hasId {
+			continue
+		}
+
+		log.Printf("Migrating index %s to support document ids\n", index)
+		tx, err := s.db.Beginx()
+		if err != nil {
+			return err
+		}
+		old := "__migrate_" + index
+		stmts := []string{
+			fmt.Sprintf(`ALTER TABLE %s RENAME TO %s`, quoteIdent(index), quoteIdent(old)),
+			fmt.Sprintf(`CREATE VIRTUAL TABLE %s USING fts5(content, _id UNINDEXED)`, quoteIdent(index)),
+			fmt.Sprintf(`INSERT INTO %s (rowid, content, _id) SELECT rowid, content, CAST(rowid AS TEXT) FROM %s`, quoteIdent(index), quoteIdent(old)),
+			fmt.Sprintf(`DROP TABLE %s`, quoteIdent(old)),
+		}
+		for _, stmt := range stmts {
+			if _, err = tx.Exec(stmt); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		if err = createDocIdTable(tx, index); err != nil {
+			tx.Rollback()
+			return err
+		}
+		_, err = tx.Exec(fmt.Sprintf(
+			`INSERT INTO %s (_id, doc_rowid, version) SELECT _id, rowid, 1 FROM %s`,
+			quoteIdent(docIdTable(index)), quoteIdent(index),
+		))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) SearchItem(indices []string, q *dsl.Dsl) ([]Document, map[string]Aggregation, error) {
 	var (
 		aggs map[string]Aggregation
 		docs []Document
 	)
 	aggs = make(map[string]Aggregation, 0)
-	subQueries, err := GenPlan(index, q)
+	mappings := make(map[string]*TemplateMapping, len(indices))
+	for _, index := range indices {
+		mappings[index] = s.findMatchingTemplate(index)
+	}
+	pipelines, err := newPipelines(nil, q.Aggs)
 	if err != nil {
-		panic(err)
+		return nil, nil, err
+	}
+	if lookups := lookupIndices(q); len(lookups) > 0 {
+		idxMap, err := s.ListTables()
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, index := range lookups {
+			if _, ok := idxMap[index]; !ok {
+				return nil, nil, &IndexNotFoundError{Index: index}
+			}
+		}
+	}
+	subQueries, err := GenPlan(indices, mappings, q)
+	if err != nil {
+		return nil, nil, err
 	}
 
+	bucketCount := 0
 	for _, subq := range subQueries {
-		log.Println(subq.sb.String())
-		rows, err := s.db.Queryx(subq.sb.String())
+		subq := subq
+		if subq.isAggregation() {
+			if aggs[*subq.label], err = s.runAggregation(&subq, &bucketCount); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		sql, args := subq.sb.Build()
+		if s.Cfg.Debug {
+			log.Println(sql, args)
+		}
+		rows, err := s.db.Queryx(sql, args...)
 		if err != nil {
 			return nil, nil, err
 		}
-		defer rows.Close()
-		if subq.isAggregation() {
-			subq.aggregation.SerializeResultset(rows, &subq)
-			aggs[*subq.label] = subq.aggregation
-
-		} else {
-			docs = s.execHitsSubquery(index, subq)
+		docs, err = s.scanHits(rows)
+		rows.Close()
+		if err != nil {
+			return nil, nil, err
 		}
 	}
+	if err := applyTopLevelPipelines(pipelines, aggs); err != nil {
+		return nil, nil, err
+	}
 	return docs, aggs, nil
 }
 
@@ -87,7 +245,10 @@ func (s *Server) ListTables() (map[string]interface{}, error) {
 	sb.Select("tbl_name").
 		From("sqlite_schema").
 		// Haven't figured out a better way to list out all of the FTS5-indices
-		Where(sb.Like("sql", "CREATE VIRTUAL TABLE%%fts5%"))
+		Where(
+			sb.Like("sql", "CREATE VIRTUAL TABLE%%fts5%"),
+			sb.NotLike("sql", "%%fts5vocab%"),
+		)
 
 	sql, args := sb.Build()
 	rows, err := s.db.Queryx(sql, args...)
@@ -107,96 +268,159 @@ func (s *Server) ListTables() (map[string]interface{}, error) {
 	return indices, nil
 }
 
-func (m *BucketAggregation) SerializeResultset(rows *sqlx.Rows, dbq *dbSubQuery) {
-	for rows.Next() {
-		b := makeBucket()
-		dest := make(map[string]interface{})
-		err := rows.MapScan(dest)
-		if err != nil {
-			panic(err)
-		}
-		// FIXME Assume the first group element is the key we want
-		for k := range dbq.groupAliases {
-			switch d := dest[k].(type) {
-			case string:
-				b.Key = d
-			case int64:
-				b.Key = fmt.Sprintf("%d", d)
-			default:
-				b.Key = ""
-			}
-			break
-		}
-
-		for k, v := range dbq.fnAliases {
-			switch d := v.(type) {
-			case *dsl.AggTerms:
-			case *dsl.DateHistogram:
-				b.DocCount = dest[k].(int64)
-			case *dsl.AggField:
-				// TODO Extract this struct literal out
-				var destVal string
-				if val, ok := dest[k].(string); ok {
-					destVal = val
-				} else if val, ok := dest[k].(int64); ok {
-					destVal = fmt.Sprintf("%d", val)
+// Resolve index expressions as they are found in the url or an msearch header, eg.
+// `idx1,idx2`, `jaeger-span-*`, `_all`, an alias or an empty expression for all
+// indices, into the sorted list of tables to search. As with ES, wildcards that don't
+// match anything are not an error, but concrete names that don't exist are
+// unless ignoreUnavailable is set
+func (s *Server) ResolveIndices(exprs []string, ignoreUnavailable bool) ([]string, error) {
+	idxMap, err := s.ListTables()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0)
+	for _, expr := range exprs {
+		names = append(names, splitIndexExpression(expr)...)
+	}
+	if len(names) == 0 {
+		names = append(names, "_all")
+	}
+
+	aliases := s.aliases()
+	matched := make(map[string]bool)
+	for _, name := range names {
+		exclude := false
+		if strings.HasPrefix(name, "-") && len(matched) > 0 {
+			// Only treated as an exclusion if something came before it
+			exclude = true
+			name = name[1:]
+		}
+
+		if name == "_all" || strings.Contains(name, "*") {
+			for tab := range idxMap {
+				if indexPatternMatch(name, tab) {
+					matched[tab] = !exclude
 				}
-				b.subaggregates[d.Field] = struct {
-					Value         string `json:"value,omitempty"`
-					ValueAsString string `json:"value_as_string,omitempty"`
-				}{
-					Value:         destVal,
-					ValueAsString: "not_yet_implemented",
+			}
+			// Patterns also expand to the indices behind any matching aliases
+			if name != "_all" {
+				for alias, idxs := range aliases {
+					if indexPatternMatch(name, alias) {
+						for idx := range idxs {
+							matched[idx] = !exclude
+						}
+					}
 				}
 			}
+			continue
+		}
+
+		if _, ok := idxMap[name]; ok {
+			matched[name] = !exclude
+		} else if idxs, ok := aliases[name]; ok {
+			for idx := range idxs {
+				matched[idx] = !exclude
+			}
+		} else if !exclude && !ignoreUnavailable {
+			return nil, &IndexNotFoundError{Index: name}
 		}
-		m.Buckets = append(m.Buckets, b)
 	}
-}
 
-func (m *MetricMultipleAggregation) SerializeResultset(rows *sqlx.Rows, dbq *dbSubQuery) {
-	// TODO IMPLEMENT ME as with Bucket aggregation
+	indices := make([]string, 0, len(matched))
+	for tab, ok := range matched {
+		if ok {
+			indices = append(indices, tab)
+		}
+	}
+	sort.Strings(indices)
+	return indices, nil
 }
 
-func (m *MetricSingleAggregation) SerializeResultset(rows *sqlx.Rows, dbq *dbSubQuery) {
-	for rows.Next() {
-		err := rows.Scan(&m.Value)
-		if err != nil {
-			panic(err)
+func splitIndexExpression(expr string) []string {
+	names := make([]string, 0)
+	for _, name := range strings.Split(expr, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			names = append(names, name)
 		}
 	}
+	return names
 }
 
-func (s *Server) execHitsSubquery(index string, q dbSubQuery) []Document {
-
-	docs := make([]Document, 0)
-	if s.Cfg.Debug {
-		log.Println(q.sb.String())
+// ES index patterns only support `*` as a wildcard, so there's no need to go via
+// regexp like we do for templates
+func indexPatternMatch(pattern, name string) bool {
+	if pattern == "_all" || pattern == "*" {
+		return true
 	}
-	rows, err := s.db.Query(q.sb.String())
-	if err != nil {
-		panic(err)
+	parts := strings.Split(pattern, "*")
+	if !strings.HasPrefix(name, parts[0]) {
+		return false
 	}
-	defer rows.Close()
+	name = name[len(parts[0]):]
+	last := len(parts) - 1
+	for i := 1; i < last; i++ {
+		pos := strings.Index(name, parts[i])
+		if pos < 0 {
+			return false
+		}
+		name = name[pos+len(parts[i]):]
+	}
+	if last == 0 {
+		return name == ""
+	}
+	return strings.HasSuffix(name, parts[last])
+}
+
+// The doc count and sub-aggregations of a bucket from its row
+func scanBucket(dest map[string]interface{}, dbq *dbSubQuery) (Bucket, error) {
+	b := makeBucket()
+	for k, v := range dbq.fnAliases {
+		switch d := v.(type) {
+		case *dsl.AggTerms, *dsl.DateHistogram, *dsl.AutoDateHistogram, *dsl.Histogram, *dsl.RangeAgg,
+			*dsl.Query, *dsl.FiltersAgg, *dsl.MissingAgg, *dsl.GlobalAgg, *dsl.Composite:
+			b.DocCount = dest[k].(int64)
+		case *metric:
+			r, err := d.result(dest[k])
+			if err != nil {
+				return b, err
+			}
+			b.subaggregates[d.label] = r
+		}
+	}
+	return b, nil
+}
 
-	tm := s.findMatchingTemplate(index)
+func (s *Server) scanHits(rows *sqlx.Rows) ([]Document, error) {
+
+	docs := make([]Document, 0)
+	// Hits can come from any of the indices that were searched, each of which
+	// may have its own template mapping
+	templates := make(map[string]*TemplateMapping)
 
 	for rows.Next() {
 		doc := Document{}
-		var s string
-		err2 := rows.Scan(&doc.Id, &s)
-		if err2 != nil {
-			return nil
+		var src string
+		err := rows.Scan(&doc.Index, &doc.Id, &src, &doc.Score)
+		if err != nil {
+			return nil, err
 		}
 
-		newDoc, err := unMarshalDoc(s, tm)
+		tm, ok := templates[doc.Index]
+		if !ok {
+			tm = s.findMatchingTemplate(doc.Index)
+			templates[doc.Index] = tm
+		}
+
+		newDoc, err := unMarshalDoc(src, tm)
 		if err != nil {
-			return nil
+			return nil, err
 		}
 		doc.Content = newDoc
 		docs = append(docs, doc)
 	}
-	return docs
+	return docs, rows.Err()
 }
 
 // Unmarshal raw string from sqlite and transform representation to
@@ -214,12 +438,23 @@ func unMarshalDoc(sdata string, tm *TemplateMapping) (map[string]interface{}, er
 	}
 
 	for fld, prop := range tm.Fields {
-		if dat, ok := docMap[fld]; ok {
-			convDate, err := date.AsDateFormat(prop.Format, dat.(string))
-			if err != nil {
-				return nil, err
+		if prop.Type != "date" && prop.Type != "date_nanos" {
+			continue
+		}
+		err = mapDocField(docMap, fld, func(v interface{}) (interface{}, error) {
+			stored, ok := v.(string)
+			if !ok {
+				// Not something we stored, eg. from before the template existed
+				return v, nil
 			}
-			docMap[fld] = convDate
+			format := prop.Format
+			if format == "" && prop.Type == "date_nanos" {
+				format = date.DefaultNanosFormat
+			}
+			return date.AsDateFormat(format, stored)
+		})
+		if err != nil {
+			return nil, err
 		}
 	}
 	return docMap, nil
@@ -234,12 +469,24 @@ func templateMapDoc(sdata string, tm *TemplateMapping) (*string, error) {
 		return nil, err
 	}
 	for fld, prop := range tm.Fields {
-		if dat, ok := docMap[fld]; ok {
-			convDate, err := date.DateFormat(prop.Format, dat)
+		if prop.Type != "date" && prop.Type != "date_nanos" {
+			continue
+		}
+		err = mapDocField(docMap, fld, func(v interface{}) (interface{}, error) {
+			if v == nil {
+				return nil, nil
+			}
+			stored, err := date.DateFormat(prop.Format, v)
+			if prop.Type == "date_nanos" {
+				stored, err = date.DateNanosFormat(prop.Format, v)
+			}
 			if err != nil {
-				return nil, err
+				return nil, &MapperParsingError{Field: fld, Type: prop.Type, Err: err}
 			}
-			docMap[fld] = convDate
+			return *stored, nil
+		})
+		if err != nil {
+			return nil, err
 		}
 	}
 	// Re-marshal the json nwo that we've t it
@@ -251,3 +498,43 @@ func templateMapDoc(sdata string, tm *TemplateMapping) (*string, error) {
 
 	return &doc, nil
 }
+
+// Replace the values of a field of a document, which may be an array of them.
+// Mappings name the fields of objects by their dotted paths, which are looked for
+// both as keys and through the objects the path goes through
+func mapDocField(doc map[string]interface{}, field string, fn func(interface{}) (interface{}, error)) error {
+	if v, ok := doc[field]; ok {
+		if arr, ok := v.([]interface{}); ok {
+			for i := range arr {
+				mv, err := fn(arr[i])
+				if err != nil {
+					return err
+				}
+				arr[i] = mv
+			}
+			return nil
+		}
+		mv, err := fn(v)
+		if err != nil {
+			return err
+		}
+		doc[field] = mv
+		return nil
+	}
+	for i := strings.Index(field, "."); i >= 0; i = nextDot(field, i) {
+		if obj, ok := doc[field[:i]].(map[string]interface{}); ok {
+			if err := mapDocField(obj, field[i+1:], fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func nextDot(s string, i int) int {
+	j := strings.Index(s[i+1:], ".")
+	if j < 0 {
+		return -1
+	}
+	return i + 1 + j
+}
@@ -0,0 +1,208 @@
+// Apis operating on a single document by its id
+// https://www.elastic.co/guide/en/elasticsearch/reference/7.17/docs.html
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+func (s *Server) IndexDocumentHandler(w http.ResponseWriter, r *http.Request) {
+	// PUT|POST /<index>/_doc/<id>, or POST /<index>/_doc for a generated id
+	s.indexDocument(w, r, r.URL.Query().Get("op_type") == "create")
+}
+
+func (s *Server) CreateDocumentHandler(w http.ResponseWriter, r *http.Request) {
+	// PUT|POST /<index>/_create/<id>; fails if the document already exists
+	s.indexDocument(w, r, true)
+}
+
+func (s *Server) indexDocument(w http.ResponseWriter, r *http.Request, onlyCreate bool) {
+	vars := mux.Vars(r)
+	index, err := s.resolveWriteIndex(vars["index"])
+	if err != nil {
+		handleAliasErrorResponse(w, err)
+		return
+	}
+
+	// Check if we need to implicitly create this index
+	idxMap, err := s.ListTables()
+	if err != nil {
+		handleErrorResponse(w, err)
+		return
+	}
+
+	if _, ok := idxMap[index]; !ok {
+		err = s.CreateTable(index)
+		if err != nil {
+			handleDocumentErrorResponse(w, err)
+			return
+		}
+	}
+
+	b, _ := io.ReadAll(r.Body)
+	res, err := s.IndexDocument(string(b), index, vars["id"], onlyCreate)
+	if err != nil {
+		handleDocumentErrorResponse(w, err)
+		return
+	}
+	resp := IndexDocumentResponse{
+		Index:       index,
+		Type:        "_doc",
+		Id:          res.Id,
+		Version:     res.Version,
+		Result:      res.Result,
+		Shards:      MakeShardsInfo(),
+		SeqNo:       res.SeqNo,
+		PrimaryTerm: 1,
+	}
+	status := http.StatusOK
+	if res.Result == "created" {
+		status = http.StatusCreated
+	}
+	writeJson(w, status, resp)
+}
+
+func (s *Server) GetDocumentHandler(w http.ResponseWriter, r *http.Request) {
+	// GET|HEAD /<index>/_doc/<id>
+	doc, index, err := s.getDocumentForRequest(r)
+	if err != nil {
+		handleDocumentErrorResponse(w, err)
+		return
+	}
+
+	resp := GetDocumentResponse{
+		Index: index,
+		Type:  "_doc",
+		Id:    mux.Vars(r)["id"],
+	}
+	status := http.StatusNotFound
+	if doc != nil {
+		status = http.StatusOK
+		resp.Found = true
+		resp.Version = doc.Version
+		resp.SeqNo = &doc.SeqNo
+		resp.PrimaryTerm = 1
+		resp.Source = doc.Content
+	}
+
+	if r.Method == http.MethodHead {
+		w.WriteHeader(status)
+		return
+	}
+	writeJson(w, status, resp)
+}
+
+func (s *Server) GetSourceHandler(w http.ResponseWriter, r *http.Request) {
+	// GET|HEAD /<index>/_source/<id>
+	doc, _, err := s.getDocumentForRequest(r)
+	if err != nil {
+		handleDocumentErrorResponse(w, err)
+		return
+	}
+	if doc == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	writeJson(w, http.StatusOK, doc.Content)
+}
+
+func (s *Server) getDocumentForRequest(r *http.Request) (*StoredDocument, string, error) {
+	vars := mux.Vars(r)
+	index, err := s.resolveReadIndex(vars["index"])
+	if err != nil {
+		return nil, "", err
+	}
+	idxMap, err := s.ListTables()
+	if err != nil {
+		return nil, "", err
+	}
+	if _, ok := idxMap[index]; !ok {
+		return nil, "", &IndexNotFoundError{Index: index}
+	}
+	doc, err := s.GetDocument(index, vars["id"])
+	return doc, index, err
+}
+
+func (s *Server) DeleteDocumentHandler(w http.ResponseWriter, r *http.Request) {
+	// DELETE /<index>/_doc/<id>
+	vars := mux.Vars(r)
+	index, err := s.resolveWriteIndex(vars["index"])
+	if err != nil {
+		handleAliasErrorResponse(w, err)
+		return
+	}
+	idxMap, err := s.ListTables()
+	if err != nil {
+		handleErrorResponse(w, err)
+		return
+	}
+	if _, ok := idxMap[index]; !ok {
+		handleDocumentErrorResponse(w, &IndexNotFoundError{Index: index})
+		return
+	}
+
+	res, err := s.DeleteDocument(index, vars["id"])
+	if err != nil {
+		handleDocumentErrorResponse(w, err)
+		return
+	}
+	resp := IndexDocumentResponse{
+		Index:       index,
+		Type:        "_doc",
+		Id:          res.Id,
+		Version:     res.Version,
+		Result:      res.Result,
+		Shards:      MakeShardsInfo(),
+		SeqNo:       res.SeqNo,
+		PrimaryTerm: 1,
+	}
+	status := http.StatusOK
+	if res.Result == "not_found" {
+		status = http.StatusNotFound
+	}
+	writeJson(w, status, resp)
+}
+
+func handleDocumentErrorResponse(w http.ResponseWriter, err error) {
+	var (
+		nf *IndexNotFoundError
+		vc *VersionConflictError
+		in *InvalidIndexNameError
+		mp *MapperParsingError
+		aa *AmbiguousAliasError
+	)
+	switch {
+	case errors.As(err, &nf):
+		eresp := &GenericErrorResponse{
+			Reason:       err.Error(),
+			Index:        nf.Index,
+			ResourceId:   nf.Index,
+			ResourceType: "index_expression",
+		}
+		writeJson(w, http.StatusNotFound, eresp)
+	case errors.As(err, &vc):
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(err.Error()))
+	case errors.As(err, &in), errors.As(err, &mp), errors.As(err, &aa):
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+	default:
+		handleErrorResponse(w, err)
+	}
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	j, _ := json.Marshal(v)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(j)
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	require "github.com/alecthomas/assert/v2"
+)
+
+func TestDocumentCrud(t *testing.T) {
+	rec := doRequest(http.MethodPut, "/docs-crud/_doc/doc-1", `{"title": "first"}`)
+	require.Equal(t, rec.Code, http.StatusCreated, rec.Body.String())
+	resp := IndexDocumentResponse{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	require.Equal(t, resp.Id, "doc-1")
+	require.Equal(t, resp.Result, "created")
+	require.Equal(t, resp.Version, 1)
+
+	rec = doRequest(http.MethodHead, "/docs-crud/_doc/doc-1", "")
+	require.Equal(t, rec.Code, http.StatusOK)
+	require.Equal(t, rec.Body.Len(), 0)
+
+	// Overwrite
+	rec = doRequest(http.MethodPut, "/docs-crud/_doc/doc-1", `{"title": "second"}`)
+	require.Equal(t, rec.Code, http.StatusOK)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	require.Equal(t, resp.Result, "updated")
+	require.Equal(t, resp.Version, 2)
+
+	rec = doRequest(http.MethodGet, "/docs-crud/_doc/doc-1", "")
+	require.Equal(t, rec.Code, http.StatusOK)
+	get := GetDocumentResponse{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &get))
+	require.True(t, get.Found)
+	require.Equal(t, get.Version, 2)
+	require.Equal(t, get.Source["title"], "second")
+
+	rec = doRequest(http.MethodGet, "/docs-crud/_source/doc-1", "")
+	require.Equal(t, rec.Code, http.StatusOK)
+	require.Equal(t, rec.Body.String(), `{"title":"second"}`)
+
+	// Only one copy of the document should be searchable
+	rec = doRequest(http.MethodPost, "/docs-crud/_search", `{}`)
+	d := getResponse(t, rec.Result())
+	require.Equal(t, len(d.Hits.Hits), 1)
+	require.Equal(t, d.Hits.Hits[0].Id, "doc-1")
+
+	rec = doRequest(http.MethodDelete, "/docs-crud/_doc/doc-1", "")
+	require.Equal(t, rec.Code, http.StatusOK)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	require.Equal(t, resp.Result, "deleted")
+
+	rec = doRequest(http.MethodDelete, "/docs-crud/_doc/doc-1", "")
+	require.Equal(t, rec.Code, http.StatusNotFound)
+	rec = doRequest(http.MethodGet, "/docs-crud/_doc/doc-1", "")
+	require.Equal(t, rec.Code, http.StatusNotFound)
+	rec = doRequest(http.MethodHead, "/docs-crud/_doc/doc-1", "")
+	require.Equal(t, rec.Code, http.StatusNotFound)
+	rec = doRequest(http.MethodGet, "/docs-crud/_source/doc-1", "")
+	require.Equal(t, rec.Code, http.StatusNotFound)
+
+	rec = doRequest(http.MethodGet, "/docs-nonexistent/_doc/doc-1", "")
+	require.Equal(t, rec.Code, http.StatusNotFound)
+}
+
+func TestDocumentCreate(t *testing.T) {
+	rec := doRequest(http.MethodPut, "/docs-create/_create/only-once", `{"n": 1}`)
+	require.Equal(t, rec.Code, http.StatusCreated)
+	rec = doRequest(http.MethodPut, "/docs-create/_create/only-once", `{"n": 2}`)
+	require.Equal(t, rec.Code, http.StatusConflict)
+	rec = doRequest(http.MethodPut, "/docs-create/_doc/only-once?op_type=create", `{"n": 3}`)
+	require.Equal(t, rec.Code, http.StatusConflict)
+
+	rec = doRequest(http.MethodGet, "/docs-create/_source/only-once", "")
+	require.Equal(t, rec.Body.String(), `{"n":1}`)
+}
+
+func TestDocumentGeneratedId(t *testing.T) {
+	rec := doRequest(http.MethodPost, "/docs-autoid/_doc", `{"n": 1}`)
+	require.Equal(t, rec.Code, http.StatusCreated)
+	resp := IndexDocumentResponse{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	require.Equal(t, len(resp.Id), 20)
+
+	rec = doRequest(http.MethodGet, "/docs-autoid/_doc/"+resp.Id, "")
+	require.Equal(t, rec.Code, http.StatusOK)
+}
+
+func TestBulkDocumentId(t *testing.T) {
+	// The service fixture is loaded with an explicit _id
+	rec := doRequest(http.MethodGet, "/jaeger-service-2022-11-11/_doc/c9e22197086c9894", "")
+	require.Equal(t, rec.Code, http.StatusOK)
+
+	rec = doRequest(http.MethodPost, "/jaeger-service-2022-11-11/_search", `{}`)
+	d := getResponse(t, rec.Result())
+	require.Equal(t, d.Hits.Hits[0].Id, "c9e22197086c9894")
+}
+
+func TestMigrateLegacyTable(t *testing.T) {
+	_, err := s.db.Exec(`CREATE VIRTUAL TABLE "legacy-idx" USING fts5(content)`)
+	require.NoError(t, err)
+	_, err = s.db.Exec(`INSERT INTO "legacy-idx" (content) VALUES (json('{"a": 1}'))`)
+	require.NoError(t, err)
+
+	require.NoError(t, s.migrateTables())
+
+	rec := doRequest(http.MethodGet, "/legacy-idx/_doc/1", "")
+	require.Equal(t, rec.Code, http.StatusOK)
+	rec = doRequest(http.MethodPut, "/legacy-idx/_doc/2", `{"a": 2}`)
+	require.Equal(t, rec.Code, http.StatusCreated)
+}
+
+func TestDateMappings(t *testing.T) {
+	rec := doRequest(http.MethodPut, "/_template/dates", `{
+		"index_patterns": "dates-*",
+		"mappings": {
+			"properties": {
+				"logged": {"type": "date", "format": "yyyy-MM-dd HH:mm:ss||epoch_millis"},
+				"seen": {"type": "date"},
+				"precise": {"type": "date_nanos"},
+				"event": {"properties": {"day": {"type": "date", "format": "basic_date"}}}
+			}
+		}
+	}`)
+	require.Equal(t, rec.Code, http.StatusOK, rec.Body.String())
+
+	resp := bulkRequest(t, "/dates-000001/_bulk", `
+{"index": {"_id": "1"}}
+{"logged": "2022-11-11 13:31:29", "seen": [1668173489840, null], "precise": "2022-11-11T13:31:29.840123456Z", "event": {"day": "20221111"}}
+{"index": {"_id": "2"}}
+{"logged": 1668173489840, "precise": "2022-11-11T13:31:29.840123457Z"}
+{"index": {"_id": "bad"}}
+{"logged": "11/11/2022"}
+`)
+	require.True(t, resp.Errors)
+	require.Equal(t, resp.Items[2]["index"].Status, http.StatusBadRequest)
+	require.Equal(t, resp.Items[2]["index"].Error.Type, "mapper_parsing_exception")
+
+	// Dates come back in the first of their formats
+	rec = doRequest(http.MethodGet, "/dates-000001/_source/1", "")
+	require.Equal(t, rec.Code, http.StatusOK)
+	require.Equal(t, rec.Body.String(), `{"event":{"day":"20221111"},"logged":"2022-11-11 13:31:29","precise":"2022-11-11T13:31:29.840123456Z","seen":["2022-11-11T13:31:29.840Z",null]}`)
+	rec = doRequest(http.MethodGet, "/dates-000001/_source/2", "")
+	require.Equal(t, rec.Body.String(), `{"logged":"2022-11-11 13:31:29","precise":"2022-11-11T13:31:29.840123457Z"}`)
+
+	rec = doRequest(http.MethodPut, "/dates-000001/_doc/3", `{"logged": "yesterday"}`)
+	require.Equal(t, rec.Code, http.StatusBadRequest)
+
+	for _, test := range []struct {
+		query string
+		hits  int
+	}{
+		{`{"range": {"precise": {"gt": "2022-11-11T13:31:29.840123456Z"}}}`, 1},
+		{`{"range": {"precise": {"lte": "2022-11-11T13:31:29.840123457Z"}}}`, 2},
+		{`{"range": {"logged": {"gte": "2022-11-11 13:00:00", "lt": "2022-11-11 14:00:00"}}}`, 2},
+		{`{"range": {"logged": {"gte": "2022-11-11T09:00", "format": "yyyy-MM-dd'T'HH:mm"}}}`, 2},
+		{`{"range": {"logged": {"gte": "2022-11-11T09:00", "format": "yyyy-MM-dd'T'HH:mm", "time_zone": "America/New_York"}}}`, 0},
+		{`{"range": {"event.day": {"gte": "20221111", "lte": "20221111"}}}`, 1},
+	} {
+		rec = doRequest(http.MethodPost, "/dates-000001/_search", `{"query": `+test.query+`}`)
+		d := getResponse(t, rec.Result())
+		require.Equal(t, len(d.Hits.Hits), test.hits, test.query)
+	}
+
+	// Stored dates sort in time order, whatever the fraction of a second
+	bulkRequest(t, "/dates-000002/_bulk", `
+{"index": {"_id": "a"}}
+{"seen": "2022-11-11T13:31:29.840Z"}
+{"index": {"_id": "b"}}
+{"seen": "2022-11-11T13:31:29Z"}
+{"index": {"_id": "c"}}
+{"seen": "2022-11-11T13:31:29.9Z"}
+`)
+	rec = doRequest(http.MethodPost, "/dates-000002/_search", `{"sort": [{"seen": {"order": "asc"}}]}`)
+	d := getResponse(t, rec.Result())
+	ids := make([]string, 0, len(d.Hits.Hits))
+	for _, hit := range d.Hits.Hits {
+		ids = append(ids, hit.Id)
+	}
+	require.Equal(t, ids, []string{"b", "a", "c"})
+}
+
+func TestNonObjectSources(t *testing.T) {
+	for _, source := range []string{`[1,2,3]`, `"str"`, `42`, `null`, `{"a": `} {
+		rec := doRequest(http.MethodPut, "/docs-sources/_doc/1", source)
+		require.Equal(t, rec.Code, http.StatusBadRequest, source)
+	}
+	resp := bulkRequest(t, "/docs-sources/_bulk", `
+{"index": {"_id": "1"}}
+[1,2,3]
+{"create": {"_id": "2"}}
+"str"
+{"index": {"_id": "3"}}
+{"a": 1}
+`)
+	require.True(t, resp.Errors)
+	require.Equal(t, resp.Items[0]["index"].Status, http.StatusBadRequest)
+	require.Equal(t, resp.Items[0]["index"].Error.Type, "mapper_parsing_exception")
+	require.Equal(t, resp.Items[1]["create"].Status, http.StatusBadRequest)
+	require.Equal(t, resp.Items[1]["create"].Error.Type, "mapper_parsing_exception")
+	require.Equal(t, resp.Items[2]["index"].Status, http.StatusCreated)
+
+	// Nothing was stored that searches and gets would fail on
+	rec := doRequest(http.MethodPost, "/docs-sources/_search", `{}`)
+	d := getResponse(t, rec.Result())
+	require.Equal(t, len(d.Hits.Hits), 1)
+	require.Equal(t, d.Hits.Hits[0].Id, "3")
+	rec = doRequest(http.MethodGet, "/docs-sources/_doc/1", "")
+	require.Equal(t, rec.Code, http.StatusNotFound)
+}
@@ -3,6 +3,7 @@ package server
 import (
 	"fmt"
 	"net/http"
+	"strings"
 )
 
 type GenericErrorResponse struct {
@@ -18,3 +19,85 @@ func handleErrorResponse(w http.ResponseWriter, err error) {
 	w.WriteHeader(http.StatusInternalServerError)
 	fmt.Fprint(w, err.Error())
 }
+
+type IndexNotFoundError struct {
+	Index string
+}
+
+func (e *IndexNotFoundError) Error() string {
+	return fmt.Sprintf("no such index [%s]", e.Index)
+}
+
+type InvalidIndexNameError struct {
+	Index  string
+	Reason string
+}
+
+func (e *InvalidIndexNameError) Error() string {
+	return fmt.Sprintf("Invalid index name [%s], %s", e.Index, e.Reason)
+}
+
+type AliasNotFoundError struct {
+	Alias string
+}
+
+func (e *AliasNotFoundError) Error() string {
+	return fmt.Sprintf("aliases [%s] missing", e.Alias)
+}
+
+// A single document op against an alias of several indices
+type AmbiguousAliasError struct {
+	Alias   string
+	Indices []string
+}
+
+func (e *AmbiguousAliasError) Error() string {
+	return fmt.Sprintf("alias [%s] has more than one index associated with it [%s], can't execute a single index op",
+		e.Alias, strings.Join(e.Indices, ", "))
+}
+
+type VersionConflictError struct {
+	Index string
+	Id    string
+}
+
+func (e *VersionConflictError) Error() string {
+	return fmt.Sprintf("[%s]: version conflict, document already exists", e.Id)
+}
+
+type DocumentMissingError struct {
+	Index string
+	Id    string
+}
+
+func (e *DocumentMissingError) Error() string {
+	return fmt.Sprintf("[_doc][%s]: document missing", e.Id)
+}
+
+// A document field that can't be indexed as its mapping says, eg. a date in the
+// wrong format
+type MapperParsingError struct {
+	Field string
+	Type  string
+	Err   error
+}
+
+func (e *MapperParsingError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("failed to parse: %v", e.Err)
+	}
+	return fmt.Sprintf("failed to parse field [%s] of type [%s]: %v", e.Field, e.Type, e.Err)
+}
+
+func (e *MapperParsingError) Unwrap() error {
+	return e.Err
+}
+
+// A search request that can't be run as given, which ES would reject with a 400
+type QueryError struct {
+	Reason string
+}
+
+func (e *QueryError) Error() string {
+	return e.Reason
+}
@@ -0,0 +1,333 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/atomic77/gopensearch/pkg/dsl"
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+
+Aggregations whose buckets are the documents matching queries: filter and filters,
+missing for those without a value for a field, and global for all of those in the
+indices being searched, whatever the query of the search
+
+https://www.elastic.co/guide/en/elasticsearch/reference/7.17/search-aggregations-bucket-filter-aggregation.html
+https://www.elastic.co/guide/en/elasticsearch/reference/7.17/search-aggregations-bucket-filters-aggregation.html
+https://www.elastic.co/guide/en/elasticsearch/reference/7.17/search-aggregations-bucket-missing-aggregation.html
+https://www.elastic.co/guide/en/elasticsearch/reference/7.17/search-aggregations-bucket-global-aggregation.html
+
+*/
+
+// A filter, missing or global aggregation, whose one bucket is shown as the
+// aggregation itself
+type SingleBucketAggregation struct {
+	bucket []Bucket
+	filter docFilter
+}
+
+func (m SingleBucketAggregation) GetAggregateCategory() dsl.AggregationCategory {
+	return dsl.Bucket
+}
+
+type FiltersAggregation struct {
+	Buckets []Bucket
+	filters []namedFilter
+	// The key of the bucket of documents matching none of the filters, if any
+	otherKey  string
+	keyed     bool
+	anonymous bool
+	keyAlias  string
+}
+
+func (m FiltersAggregation) GetAggregateCategory() dsl.AggregationCategory {
+	return dsl.Bucket
+}
+
+type namedFilter struct {
+	key   string
+	query *dsl.Query
+}
+
+// The predicate of the documents of the doc source that match a query. Queries
+// are compiled against each of the indices, as the query of the search is, and
+// documents are matched back by their index and rowid
+func (dbq *dbSubQuery) queryFilter(q *dsl.Query) (string, error) {
+	cases := make([]string, 0, len(dbq.source.indices))
+	for _, index := range dbq.source.indices {
+		branch := makeDbSubQuery()
+		branch.index = index
+		branch.mapping = dbq.source.mappings[index]
+		clause, err := branch.genQueryClause(q)
+		if err != nil {
+			return "", err
+		}
+		branch.sb.Select("rowid").
+			From(fmt.Sprintf(`%s AS %s`, tableName(index), branchAlias)).
+			Where(clause.pred)
+		cases = append(cases, fmt.Sprintf("WHEN %s THEN _rowid IN (%s)", dbq.sb.Var(index), dbq.sb.Var(branch.sb)))
+	}
+	if len(cases) == 0 {
+		return "0", nil
+	}
+	return fmt.Sprintf("(CASE _index %s ELSE 0 END)", strings.Join(cases, " ")), nil
+}
+
+func (dbq *dbSubQuery) genSingleBucketSelectExprs(agg *dsl.Aggregate, fnIdx string) error {
+	m := &SingleBucketAggregation{}
+	switch {
+	case agg.Filter != nil:
+		q := agg.Filter
+		m.filter = func(dbq *dbSubQuery) (string, error) {
+			return dbq.queryFilter(q)
+		}
+		dbq.fnAliases[fnIdx] = agg.Filter
+	case agg.Missing != nil:
+		field := cleanseKeyField(agg.Missing.Field)
+		if field == "" {
+			return &QueryError{Reason: "Required one of fields [field, script], but none were specified."}
+		}
+		m.filter = func(dbq *dbSubQuery) (string, error) {
+			exists, err := dbq.handleExists(&dsl.Exists{Field: field})
+			if err != nil {
+				return "", err
+			}
+			return "NOT " + exists.pred, nil
+		}
+		dbq.fnAliases[fnIdx] = agg.Missing
+	default:
+		// The documents of the global bucket, and of its sub-aggregations, are
+		// all of those of the indices
+		src := *dbq.source
+		src.q = &dsl.Dsl{}
+		dbq.source = &src
+		m.filter = func(*dbSubQuery) (string, error) {
+			return "1", nil
+		}
+		dbq.fnAliases[fnIdx] = agg.Global
+	}
+	pred, err := m.filter(dbq)
+	if err != nil {
+		return err
+	}
+	dbq.sb.Where(pred)
+	dbq.selectExprs = append(dbq.selectExprs, dbq.sb.As("COUNT(*)", fnIdx))
+	dbq.aggregation = m
+	return nil
+}
+
+func (m *SingleBucketAggregation) SerializeResultset(rows *sqlx.Rows, dbq *dbSubQuery) error {
+	b := makeBucket()
+	for rows.Next() {
+		dest := make(map[string]interface{})
+		if err := rows.MapScan(dest); err != nil {
+			return err
+		}
+		var err error
+		if b, err = scanBucket(dest, dbq); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	m.bucket = []Bucket{b}
+	return nil
+}
+
+func (m *SingleBucketAggregation) buckets() []Bucket {
+	return m.bucket
+}
+
+func (m *SingleBucketAggregation) setBuckets(buckets []Bucket) {
+	m.bucket = buckets
+}
+
+func (m *SingleBucketAggregation) bucketFilter(dbq *dbSubQuery, b *Bucket) (string, error) {
+	return m.filter(dbq)
+}
+
+func (m *SingleBucketAggregation) MarshalJSON() ([]byte, error) {
+	return marshalFilterBucket("", &m.bucket[0])
+}
+
+// The buckets of documents can overlap, so each is joined with the filters it
+// matches, by their index
+func (dbq *dbSubQuery) genFiltersSelectExprs(fa *dsl.FiltersAgg, grpIdx, fnIdx string) error {
+	m := &FiltersAggregation{keyAlias: grpIdx, anonymous: fa.Anonymous != nil}
+	m.keyed = !m.anonymous && (fa.Keyed == nil || *fa.Keyed)
+	if m.anonymous {
+		for i := range fa.Anonymous {
+			m.filters = append(m.filters, namedFilter{key: strconv.Itoa(i), query: &fa.Anonymous[i]})
+		}
+	} else {
+		// As ES sorts them
+		keys := make([]string, 0, len(fa.Filters))
+		for key := range fa.Filters {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			q := fa.Filters[key]
+			m.filters = append(m.filters, namedFilter{key: key, query: &q})
+		}
+	}
+	if len(m.filters) == 0 {
+		return &QueryError{Reason: "[filters] cannot be empty."}
+	}
+	if fa.OtherBucket || fa.OtherBucketKey != "" {
+		m.otherKey = fa.OtherBucketKey
+		if m.otherKey == "" {
+			m.otherKey = "_other_"
+		}
+	}
+
+	each := "filters_" + grpIdx
+	values := make([]string, 0, len(m.filters)+1)
+	cases := make([]string, 0, len(m.filters)+1)
+	for i := 0; i < m.size(); i++ {
+		pred, err := m.filterPred(dbq, i)
+		if err != nil {
+			return err
+		}
+		values = append(values, fmt.Sprintf("(%d)", i))
+		cases = append(cases, fmt.Sprintf("WHEN %d THEN %s", i, pred))
+	}
+	dbq.sb.Join(fmt.Sprintf("(VALUES %s) AS %s", strings.Join(values, ", "), each),
+		fmt.Sprintf("CASE %s.column1 %s END", each, strings.Join(cases, " ")))
+
+	dbq.groupAliases[grpIdx] = fa
+	dbq.fnAliases[fnIdx] = fa
+	dbq.selectExprs = append(dbq.selectExprs,
+		dbq.sb.As(" "+each+".column1", grpIdx),
+		dbq.sb.As("COUNT(*)", fnIdx),
+	)
+	dbq.aggregation = m
+	return nil
+}
+
+// The number of buckets, with the other bucket
+func (m *FiltersAggregation) size() int {
+	if m.otherKey != "" {
+		return len(m.filters) + 1
+	}
+	return len(m.filters)
+}
+
+func (m *FiltersAggregation) key(i int) string {
+	if i < len(m.filters) {
+		return m.filters[i].key
+	}
+	return m.otherKey
+}
+
+// The predicate of the documents in the i-th bucket, of which the other is last
+func (m *FiltersAggregation) filterPred(dbq *dbSubQuery, i int) (string, error) {
+	if i < len(m.filters) {
+		return dbq.queryFilter(m.filters[i].query)
+	}
+	preds := make([]string, len(m.filters))
+	for j := range m.filters {
+		pred, err := dbq.queryFilter(m.filters[j].query)
+		if err != nil {
+			return "", err
+		}
+		preds[j] = pred
+	}
+	return "NOT (" + strings.Join(preds, " OR ") + ")", nil
+}
+
+// Every filter has its bucket, even without documents
+func (m *FiltersAggregation) SerializeResultset(rows *sqlx.Rows, dbq *dbSubQuery) error {
+	m.Buckets = make([]Bucket, m.size())
+	for i := range m.Buckets {
+		m.Buckets[i] = makeBucket()
+		m.Buckets[i].Key = m.key(i)
+	}
+	for rows.Next() {
+		dest := make(map[string]interface{})
+		if err := rows.MapScan(dest); err != nil {
+			return err
+		}
+		b, err := scanBucket(dest, dbq)
+		if err != nil {
+			return err
+		}
+		i, _ := dest[m.keyAlias].(int64)
+		if i < 0 || int(i) >= len(m.Buckets) {
+			return fmt.Errorf("filter [%v] out of range", dest[m.keyAlias])
+		}
+		b.Key = m.Buckets[i].Key
+		m.Buckets[i] = b
+	}
+	return rows.Err()
+}
+
+func (m *FiltersAggregation) buckets() []Bucket {
+	return m.Buckets
+}
+
+func (m *FiltersAggregation) setBuckets(buckets []Bucket) {
+	m.Buckets = buckets
+}
+
+func (m *FiltersAggregation) bucketFilter(dbq *dbSubQuery, b *Bucket) (string, error) {
+	for i := 0; i < m.size(); i++ {
+		if m.key(i) == b.Key {
+			return m.filterPred(dbq, i)
+		}
+	}
+	return "", fmt.Errorf("bucket [%v] is not one of the filters", b.Key)
+}
+
+// Named filters are keyed by default, and anonymous ones have no key at all
+func (m *FiltersAggregation) MarshalJSON() ([]byte, error) {
+	open, close := "[", "]"
+	if m.keyed {
+		open, close = "{", "}"
+	}
+	buf := bytes.NewBufferString(`{"buckets":` + open)
+	for i := range m.Buckets {
+		b := &m.Buckets[i]
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := b.Key.(string)
+		if m.keyed {
+			k, err := json.Marshal(key)
+			if err != nil {
+				return nil, err
+			}
+			buf.Write(k)
+			buf.WriteByte(':')
+			key = ""
+		} else if m.anonymous {
+			key = ""
+		}
+		j, err := marshalFilterBucket(key, b)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(j)
+	}
+	buf.WriteString(close + "}")
+	return buf.Bytes(), nil
+}
+
+// A bucket with just its doc count and sub-aggregations, and its key if it has one
+func marshalFilterBucket(key string, b *Bucket) ([]byte, error) {
+	j, err := json.Marshal(struct {
+		Key      string `json:"key,omitempty"`
+		DocCount int64  `json:"doc_count"`
+	}{key, b.DocCount})
+	if err != nil {
+		return nil, err
+	}
+	return appendSubaggregates(j, b.subaggregates)
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	require "github.com/alecthomas/assert/v2"
+)
+
+func TestFilterAggregations(t *testing.T) {
+	bulkRequest(t, "/filteraggs/_bulk", `
+{"index": {}}
+{"status": 200, "path": "/home", "took": 10}
+{"index": {}}
+{"status": 200, "path": "/search", "took": 30}
+{"index": {}}
+{"status": 404, "path": "/login"}
+{"index": {}}
+{"status": 500, "path": "/search", "took": 90}
+{"index": {}}
+{"status": 503, "path": "/home", "took": 50}
+`)
+	require.Equal(t, aggregationResult(t, "filteraggs", `{"a": {"filter": {"range": {"status": {"gte": 500}}},
+		"aggs": {"took": {"avg": {"field": "took"}}}}}`),
+		`{"doc_count":2,"took":{"value":70}}`)
+	require.Equal(t, aggregationResult(t, "filteraggs", `{"a": {"filter": {"term": {"path": "/nowhere"}},
+		"aggs": {"took": {"max": {"field": "took"}}}}}`),
+		`{"doc_count":0,"took":{"value":null}}`)
+	require.Equal(t, aggregationResult(t, "filteraggs", `{"a": {"missing": {"field": "took"}}}`),
+		`{"doc_count":1}`)
+
+	// Buckets can overlap, and the other bucket has the documents in none of them
+	require.Equal(t, aggregationResult(t, "filteraggs", `{"a": {"filters": {"other_bucket_key": "rest", "filters": {
+		"errors": {"range": {"status": {"gte": 500}}},
+		"all": {"match_all": {}},
+		"search": {"term": {"path": "/search"}}}}}}`),
+		`{"buckets":{"all":{"doc_count":5},"errors":{"doc_count":2},"search":{"doc_count":2},"rest":{"doc_count":0}}}`)
+	require.Equal(t, aggregationResult(t, "filteraggs", `{"a": {"filters": {"other_bucket": true, "filters": [
+		{"term": {"path": "/home"}}, {"term": {"path": "/search"}}]}}}`),
+		`{"buckets":[{"doc_count":2},{"doc_count":2},{"doc_count":1}]}`)
+	require.Equal(t, aggregationResult(t, "filteraggs", `{"a": {"filters": {"keyed": false, "filters": {
+		"ok": {"range": {"status": {"lt": 400}}}}}, "aggs": {"took": {"sum": {"field": "took"}}}}}`),
+		`{"buckets":[{"key":"ok","doc_count":2,"took":{"value":40}}]}`)
+
+	// Error rates, from the buckets of the filters and those nested in them
+	require.Equal(t, aggregationResult(t, "filteraggs", `{"a": {"filters": {"filters": {
+		"errors": {"range": {"status": {"gte": 500}}}, "all": {"match_all": {}}}},
+		"aggs": {"paths": {"terms": {"field": "path", "order": {"_key": "asc"}}}}}}`),
+		`{"buckets":{`+
+			`"all":{"doc_count":5,"paths":{"doc_count_error_upper_bound":0,"sum_other_doc_count":0,"buckets":[`+
+			`{"key":"/home","doc_count":2},{"key":"/login","doc_count":1},{"key":"/search","doc_count":2}]}},`+
+			`"errors":{"doc_count":2,"paths":{"doc_count_error_upper_bound":0,"sum_other_doc_count":0,"buckets":[`+
+			`{"key":"/home","doc_count":1},{"key":"/search","doc_count":1}]}}}}`)
+	require.Equal(t, aggregationResult(t, "filteraggs", `{"a": {"terms": {"field": "path", "order": {"_key": "asc"}}, "aggs": {
+		"errors": {"filter": {"range": {"status": {"gte": 500}}}},
+		"rate": {"bucket_script": {"buckets_path": {"e": "errors", "n": "_count"}, "script": "params.e / params.n"}}}}}`),
+		`{"doc_count_error_upper_bound":0,"sum_other_doc_count":0,"buckets":[`+
+			`{"key":"/home","doc_count":2,"errors":{"doc_count":1},"rate":{"value":0.5}},`+
+			`{"key":"/login","doc_count":1,"errors":{"doc_count":0},"rate":{"value":0}},`+
+			`{"key":"/search","doc_count":2,"errors":{"doc_count":1},"rate":{"value":0.5}}]}`)
+
+	// The global bucket ignores the query of the search
+	rec := doRequest(http.MethodPost, "/filteraggs/_search", `{"size": 0, "query": {"term": {"path": "/home"}}, "aggs": {
+		"home": {"avg": {"field": "took"}},
+		"all": {"global": {}, "aggs": {"took": {"avg": {"field": "took"}}}}}}`)
+	require.Equal(t, rec.Code, http.StatusOK, rec.Body.String())
+	var resp struct {
+		Aggregations map[string]json.RawMessage `json:"aggregations"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	require.Equal(t, string(resp.Aggregations["home"]), `{"value":30}`)
+	require.Equal(t, string(resp.Aggregations["all"]), `{"doc_count":5,"took":{"value":45}}`)
+
+	for _, aggs := range []string{
+		`{"a": {"filters": {"filters": {}}}}`,
+		`{"a": {"missing": {}}}`,
+		`{"a": {"terms": {"field": "path"}, "aggs": {"g": {"global": {}}}}}`,
+		`{"a": {"filter": {"match_all": {}}, "aggs": {"b": {"bucket_script": {"buckets_path": {"n": "_count"}, "script": "params.n"}}}}}`,
+	} {
+		rec := doRequest(http.MethodPost, "/filteraggs/_search", `{"size": 0, "aggs": `+aggs+`}`)
+		require.Equal(t, rec.Code, http.StatusBadRequest, aggs)
+	}
+}
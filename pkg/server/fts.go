@@ -0,0 +1,479 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/atomic77/gopensearch/pkg/lru"
+	"github.com/jmoiron/sqlx"
+	"github.com/mattn/go-sqlite3"
+)
+
+/*
+
+Full text queries run through the FTS5 index over the whole document, which gives
+us bm25() for scoring. Since a document is stored as a single json column, FTS5
+can't tell which field a token came from, so the candidates it finds are checked
+against the field being queried with the fts_match() function registered below.
+
+The FTS5 index is built with the default unicode61 tokenizer, ie. lower-cased runs
+of letters and numbers, which is what the standard analyzer does here too. Other
+analyzers are applied when checking the field, so the FTS5 query only needs to
+find a superset of the documents they would match.
+
+*/
+
+const sqliteDriver = "sqlite3_gopensearch"
+
+func init() {
+	sql.Register(sqliteDriver, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			if err := conn.RegisterFunc("fts_match", ftsMatch, true); err != nil {
+				return err
+			}
+			if err := conn.RegisterFunc("fts_phrase", ftsPhrase, true); err != nil {
+				return err
+			}
+			if err := conn.RegisterFunc("fts_wildcard", ftsWildcard, true); err != nil {
+				return err
+			}
+			if err := conn.RegisterFunc("fts_regexp", ftsRegexp, true); err != nil {
+				return err
+			}
+			if err := conn.RegisterFunc("ip_key", ipKey, true); err != nil {
+				return err
+			}
+			if err := conn.RegisterFunc("date_bucket", dateBucket, true); err != nil {
+				return err
+			}
+			if err := conn.RegisterFunc("auto_date_bucket", autoDateBucket, true); err != nil {
+				return err
+			}
+			if err := conn.RegisterFunc("histogram_key", histogramKey, true); err != nil {
+				return err
+			}
+			if err := conn.RegisterFunc("terms_match", termsMatch, true); err != nil {
+				return err
+			}
+			if err := conn.RegisterFunc("terms_partition", termsPartition, true); err != nil {
+				return err
+			}
+			if err := conn.RegisterAggregator("metric_stats", newStatsAggregator, true); err != nil {
+				return err
+			}
+			if err := conn.RegisterAggregator("metric_weighted_avg", newWeightedAvgAggregator, true); err != nil {
+				return err
+			}
+			if err := conn.RegisterAggregator("metric_cardinality", newCardinalityAggregator, true); err != nil {
+				return err
+			}
+			if err := conn.RegisterAggregator("metric_digest", newDigestAggregator, true); err != nil {
+				return err
+			}
+			return conn.RegisterFunc("fts_fuzzy", ftsFuzzy, true)
+		},
+	})
+	sqlx.BindDriver(sqliteDriver, sqlx.QUESTION)
+}
+
+func ftsTokens(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// Tokenize text with one of the built-in ES analyzers
+func analyze(analyzer string, text string) ([]string, error) {
+	switch analyzer {
+	case "", "standard", "simple":
+		return ftsTokens(text), nil
+	case "whitespace":
+		return strings.Fields(text), nil
+	case "keyword":
+		return []string{text}, nil
+	}
+	return nil, fmt.Errorf("analyzer [%s] has not been configured in mappings", analyzer)
+}
+
+func distinctTokens(tokens []string) []string {
+	seen := make(map[string]bool, len(tokens))
+	res := make([]string, 0, len(tokens))
+	for _, tok := range tokens {
+		if !seen[tok] {
+			seen[tok] = true
+			res = append(res, tok)
+		}
+	}
+	return res
+}
+
+func ftsQuote(tok string) string {
+	return `"` + strings.ReplaceAll(tok, `"`, `""`) + `"`
+}
+
+// The number of edits allowed for a term by a fuzziness of 0, 1, 2, AUTO or
+// AUTO:[low],[high]
+// https://www.elastic.co/guide/en/elasticsearch/reference/7.17/common-options.html#fuzziness
+func maxEdits(fuzziness string, term string) (int, error) {
+	switch {
+	case fuzziness == "":
+		return 0, nil
+	case strings.HasPrefix(fuzziness, "AUTO"):
+		low, high := 3, 6
+		if bounds := strings.TrimPrefix(fuzziness, "AUTO"); bounds != "" {
+			parts := strings.Split(strings.TrimPrefix(bounds, ":"), ",")
+			if !strings.HasPrefix(bounds, ":") || len(parts) != 2 {
+				return 0, fmt.Errorf("failed to parse [fuzziness] value [%s]", fuzziness)
+			}
+			var err1, err2 error
+			low, err1 = strconv.Atoi(parts[0])
+			high, err2 = strconv.Atoi(parts[1])
+			if err1 != nil || err2 != nil || low > high {
+				return 0, fmt.Errorf("failed to parse [fuzziness] value [%s]", fuzziness)
+			}
+		}
+		n := len([]rune(term))
+		if n < low {
+			return 0, nil
+		} else if n < high {
+			return 1, nil
+		}
+		return 2, nil
+	}
+	edits, err := strconv.ParseFloat(fuzziness, 64)
+	if err != nil || edits < 0 {
+		return 0, fmt.Errorf("failed to parse [fuzziness] value [%s]", fuzziness)
+	}
+	// As with ES, no more than 2 edits are ever allowed
+	if edits > 2 {
+		edits = 2
+	}
+	return int(edits), nil
+}
+
+// Levenshtein distance between two strings, optionally counting a transposition
+// of adjacent characters as a single edit (the optimal string alignment distance)
+func editDistance(a string, b string, transpositions bool) int {
+	ra, rb := []rune(a), []rune(b)
+	// Three rows are enough to look back for transpositions
+	prev2 := make([]int, len(rb)+1)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			d := prev[j-1] + cost
+			if prev[j]+1 < d {
+				d = prev[j] + 1
+			}
+			if cur[j-1]+1 < d {
+				d = cur[j-1] + 1
+			}
+			if transpositions && i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] && prev2[j-2]+1 < d {
+				d = prev2[j-2] + 1
+			}
+			cur[j] = d
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(rb)]
+}
+
+// Whether term is within the fuzziness allowed for token. The first prefixLength
+// characters have to match exactly
+func fuzzyMatch(term string, token string, fuzziness string, prefixLength int, transpositions bool) bool {
+	if term == token {
+		return true
+	}
+	edits, err := maxEdits(fuzziness, token)
+	if err != nil || edits == 0 {
+		return false
+	}
+	rt, rk := []rune(term), []rune(token)
+	if prefixLength > 0 {
+		if len(rt) < prefixLength || len(rk) < prefixLength || string(rt[:prefixLength]) != string(rk[:prefixLength]) {
+			return false
+		}
+	}
+	if diff := len(rt) - len(rk); diff > edits || -diff > edits {
+		return false
+	}
+	return editDistance(term, token, transpositions) <= edits
+}
+
+// fts_fuzzy(term, token, fuzziness, prefix_length, transpositions) is used to find
+// the terms in an index's vocabulary that a fuzzy token could match
+func ftsFuzzy(term string, token string, fuzziness string, prefixLength int, transpositions bool) bool {
+	return fuzzyMatch(term, token, fuzziness, prefixLength, transpositions)
+}
+
+// fts_match(value, query, analyzer, fuzziness, prefix_length, transpositions, last_prefix)
+// returns how many of the distinct tokens of the query are found in value, which
+// is json as returned by the -> operator for a field, or the content of a whole
+// document. With last_prefix set the last token of the query matches as a prefix,
+// as for match_bool_prefix
+func ftsMatch(value interface{}, query string, analyzer string, fuzziness string, prefixLength int, transpositions bool, lastPrefix bool) int {
+	fieldTokens := make(map[string]bool)
+	for _, text := range fieldValues(decodeFieldValue(value)) {
+		// The analyzer was already validated when the query was planned
+		tokens, _ := analyze(analyzer, text)
+		for _, tok := range tokens {
+			fieldTokens[tok] = true
+		}
+	}
+	queryTokens, _ := analyze(analyzer, query)
+	last := ""
+	if lastPrefix && len(queryTokens) > 0 {
+		last = queryTokens[len(queryTokens)-1]
+	}
+
+	matched := 0
+	for _, tok := range distinctTokens(queryTokens) {
+		if fieldTokens[tok] {
+			matched++
+			continue
+		}
+		for term := range fieldTokens {
+			if tok == last && strings.HasPrefix(term, tok) ||
+				tok != last && fuzzyMatch(term, tok, fuzziness, prefixLength, transpositions) {
+				matched++
+				break
+			}
+		}
+	}
+	return matched
+}
+
+// fts_phrase(value, query, analyzer, slop, prefix) is true if the tokens of the
+// query are found in order in any one of the values of a field, allowing for slop
+// moves. With prefix set the last token matches as a prefix, as for
+// match_phrase_prefix
+func ftsPhrase(value interface{}, query string, analyzer string, slop int, prefix bool) bool {
+	phrase, _ := analyze(analyzer, query)
+	if len(phrase) == 0 {
+		return false
+	}
+	for _, text := range fieldValues(decodeFieldValue(value)) {
+		tokens, _ := analyze(analyzer, text)
+		if phraseMatch(tokens, phrase, slop, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// fts_wildcard(value, pattern, case_insensitive) is true if any of the values of a
+// field, or any of the terms within them, matches a pattern of * and ? wildcards
+func ftsWildcard(value interface{}, pattern string, caseInsensitive bool) bool {
+	if caseInsensitive {
+		pattern = strings.ToLower(pattern)
+	}
+	for _, text := range fieldValues(decodeFieldValue(value)) {
+		candidates := append([]string{text}, ftsTokens(text)...)
+		for _, c := range candidates {
+			if caseInsensitive {
+				c = strings.ToLower(c)
+			}
+			if wildcardMatch([]rune(pattern), []rune(c)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Escape any characters of s that wildcardMatch would treat as special
+func escapeWildcards(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`).Replace(s)
+}
+
+// Compiled regular expressions are cached by pattern, up to a limit, as the same
+// ones are used for every row of a query
+const maxCachedRegexps = 256
+
+var regexps = lru.New[string, *regexp.Regexp](maxCachedRegexps)
+
+func compileRegexp(pattern string, caseInsensitive bool) (*regexp.Regexp, error) {
+	if caseInsensitive {
+		pattern = "(?i)" + pattern
+	}
+	return regexps.Get(pattern, func() (*regexp.Regexp, error) {
+		return regexp.Compile(`^(?:` + pattern + `)$`)
+	})
+}
+
+// fts_regexp(value, pattern, case_insensitive) is true if any of the values of a
+// field, or any of the terms within them, matches the whole of a regular expression
+func ftsRegexp(value interface{}, pattern string, caseInsensitive bool) bool {
+	// The pattern was already validated when the query was planned
+	re, err := compileRegexp(pattern, caseInsensitive)
+	if err != nil {
+		return false
+	}
+	for _, text := range fieldValues(decodeFieldValue(value)) {
+		if re.MatchString(text) {
+			return true
+		}
+		for _, tok := range ftsTokens(text) {
+			if re.MatchString(tok) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ip_key(value) is a key for an ip address that sorts in address order, with ipv4
+// addresses in their ipv4-mapped ipv6 form as ES compares them. It is null for
+// anything that isn't an address
+func ipKey(value string) []byte {
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil
+	}
+	return ip.To16()
+}
+
+// Match s against a pattern where * matches any run of characters and ? any one
+// of them, unless escaped with a backslash
+func wildcardMatch(pattern []rune, s []rune) bool {
+	p, i := 0, 0
+	// Where to resume from after the last *, should what follows it fail to match
+	star, resume := -1, 0
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && pattern[p] == '*':
+			star, resume = p, i
+			p++
+		case p < len(pattern) && pattern[p] == '?':
+			p++
+			i++
+		case p+1 < len(pattern) && pattern[p] == '\\' && pattern[p+1] == s[i]:
+			p += 2
+			i++
+		case p < len(pattern) && pattern[p] != '\\' && pattern[p] == s[i]:
+			p++
+			i++
+		case star >= 0:
+			resume++
+			p, i = star+1, resume
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+func phraseMatch(tokens []string, phrase []string, slop int, prefix bool) bool {
+	// Positions of each term of the phrase in the field, relative to the position
+	// of the term within the phrase. The exact phrase has the same offset for every
+	// term, and like Lucene's sloppy phrases, slop is how far apart they can be
+	offsets := make([][]int, len(phrase))
+	for i, term := range phrase {
+		isPrefix := prefix && i == len(phrase)-1
+		for pos, tok := range tokens {
+			if tok == term || isPrefix && strings.HasPrefix(tok, term) {
+				offsets[i] = append(offsets[i], pos-i)
+			}
+		}
+		if len(offsets[i]) == 0 {
+			return false
+		}
+	}
+
+	// Find the smallest spread of offsets taking one from each term, by moving past
+	// the lowest one each time
+	idx := make([]int, len(phrase))
+	for {
+		lowest := 0
+		lo, hi := offsets[0][idx[0]], offsets[0][idx[0]]
+		for i := range offsets {
+			o := offsets[i][idx[i]]
+			if o < lo {
+				lo, lowest = o, i
+			}
+			if o > hi {
+				hi = o
+			}
+		}
+		if hi-lo <= slop {
+			return true
+		}
+		idx[lowest]++
+		if idx[lowest] == len(offsets[lowest]) {
+			return false
+		}
+	}
+}
+
+func decodeFieldValue(value interface{}) interface{} {
+	var raw string
+	switch v := value.(type) {
+	case string:
+		raw = v
+	case []byte:
+		raw = string(v)
+	case nil:
+		return nil
+	default:
+		return v
+	}
+	// The driver passes a missing value (sql NULL) through as an empty string,
+	// which is never valid json
+	if raw == "" {
+		return nil
+	}
+	var decoded interface{}
+	if err := json.Unmarshal([]byte(raw), &decoded); err != nil {
+		return raw
+	}
+	return decoded
+}
+
+// Flatten a json value into the text of each of the scalar values within it, as
+// each element of an array (or field of an object) is analyzed separately
+func fieldValues(v interface{}) []string {
+	switch val := v.(type) {
+	case nil:
+		return nil
+	case string:
+		return []string{val}
+	case float64:
+		return []string{strconv.FormatFloat(val, 'f', -1, 64)}
+	case []interface{}:
+		res := make([]string, 0, len(val))
+		for _, e := range val {
+			res = append(res, fieldValues(e)...)
+		}
+		return res
+	case map[string]interface{}:
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		res := make([]string, 0, len(val))
+		for _, k := range keys {
+			res = append(res, fieldValues(val[k])...)
+		}
+		return res
+	}
+	return []string{fmt.Sprint(v)}
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+
+	require "github.com/alecthomas/assert/v2"
+)
+
+func TestEditDistance(t *testing.T) {
+	require.Equal(t, editDistance("quick", "quick", true), 0)
+	require.Equal(t, editDistance("quick", "quikc", true), 1)
+	require.Equal(t, editDistance("quick", "quikc", false), 2)
+	require.Equal(t, editDistance("fox", "fax", true), 1)
+	require.Equal(t, editDistance("", "abc", true), 3)
+	require.Equal(t, editDistance("kitten", "sitting", false), 3)
+}
+
+func TestMaxEdits(t *testing.T) {
+	tests := []struct {
+		fuzziness string
+		term      string
+		edits     int
+	}{
+		{"AUTO", "ab", 0},
+		{"AUTO", "abc", 1},
+		{"AUTO", "abcdef", 2},
+		{"AUTO:4,7", "abc", 0},
+		{"AUTO:4,7", "abcdef", 1},
+		{"1", "ab", 1},
+		{"5", "abcdefgh", 2},
+	}
+	for _, test := range tests {
+		edits, err := maxEdits(test.fuzziness, test.term)
+		require.NoError(t, err)
+		require.Equal(t, edits, test.edits, test.fuzziness+" "+test.term)
+	}
+	_, err := maxEdits("AUTO:4", "abc")
+	require.Error(t, err)
+}
+
+func TestFtsMatch(t *testing.T) {
+	require.Equal(t, ftsMatch(`"HTTP GET /"`, "get post", "", "", 0, true, false), 1)
+	require.Equal(t, ftsMatch(`["Red Fox", "animal"]`, "red animal", "", "", 0, true, false), 2)
+	require.Equal(t, ftsMatch(`269`, "269", "", "", 0, true, false), 1)
+	require.Equal(t, ftsMatch(`{"a": "one", "b": {"c": "two"}}`, "two", "", "", 0, true, false), 1)
+	require.Equal(t, ftsMatch(`"Red Fox"`, "red fox", "keyword", "", 0, true, false), 0)
+	require.Equal(t, ftsMatch(nil, "red", "", "", 0, true, false), 0)
+}
+
+func TestPhraseMatch(t *testing.T) {
+	tokens := []string{"the", "quick", "brown", "fox"}
+	require.True(t, phraseMatch(tokens, []string{"quick", "brown"}, 0, false))
+	require.False(t, phraseMatch(tokens, []string{"quick", "fox"}, 0, false))
+	require.True(t, phraseMatch(tokens, []string{"quick", "fox"}, 1, false))
+	require.False(t, phraseMatch(tokens, []string{"brown", "quick"}, 1, false))
+	require.True(t, phraseMatch(tokens, []string{"brown", "quick"}, 2, false))
+	require.True(t, phraseMatch(tokens, []string{"quick", "bro"}, 0, true))
+	require.False(t, phraseMatch(tokens, []string{"qui", "brown"}, 0, true))
+}
+
+func TestWildcardMatch(t *testing.T) {
+	require.True(t, wildcardMatch([]rune("fro*"), []rune("frontend")))
+	require.True(t, wildcardMatch([]rune("*end"), []rune("frontend")))
+	require.True(t, wildcardMatch([]rune("f?o*n*d"), []rune("frontend")))
+	require.False(t, wildcardMatch([]rune("f?ont"), []rune("frontend")))
+	require.True(t, wildcardMatch([]rune(`what\?`), []rune("what?")))
+	require.False(t, wildcardMatch([]rune(`what\?`), []rune("whats")))
+	require.True(t, ftsWildcard(`["Backend", "Worker"]`, "back*", true))
+	require.True(t, ftsWildcard(`["Backend", "Worker"]`, "Back*", false))
+	require.False(t, ftsWildcard(`["Backend", "Worker"]`, "BACK*", false))
+}
+
+func TestFtsRegexp(t *testing.T) {
+	require.True(t, ftsRegexp(`"web-01.prod"`, `web-\d+\.prod`, false))
+	require.False(t, ftsRegexp(`"web-01.prod"`, `web-0`, false))
+	require.True(t, ftsRegexp(`"Quick brown fox"`, `qu.ck`, false))
+	require.True(t, ftsRegexp(`["Web"]`, `web`, true))
+	require.False(t, ftsRegexp(`"web"`, `web(`, false))
+}
+
+func TestRegexpCacheBound(t *testing.T) {
+	for i := 0; i < 2*maxCachedRegexps; i++ {
+		require.True(t, ftsRegexp(`"web"`, fmt.Sprintf(`web|x{%d}`, i), false))
+	}
+	require.Equal(t, regexps.Len(), maxCachedRegexps)
+}
@@ -0,0 +1,613 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/atomic77/gopensearch/pkg/date"
+	"github.com/atomic77/gopensearch/pkg/dsl"
+	"github.com/atomic77/gopensearch/pkg/lru"
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+
+Histograms are grouped in sql by the key of the bucket each value falls in. For
+dates the date_bucket function computes it, as calendar intervals in a time zone
+are more than sqlite's date functions can manage. Empty buckets, bounds and
+formatting of the keys are then handled as the results are read
+
+https://www.elastic.co/guide/en/elasticsearch/reference/7.17/search-aggregations-bucket-datehistogram-aggregation.html
+https://www.elastic.co/guide/en/elasticsearch/reference/7.17/search-aggregations-bucket-histogram-aggregation.html
+https://www.elastic.co/guide/en/elasticsearch/reference/7.17/search-aggregations-bucket-autodatehistogram-aggregation.html
+
+*/
+
+// As with the search.max_buckets setting of ES
+const maxBuckets = 65536
+
+func tooManyBucketsError() error {
+	return &QueryError{Reason: fmt.Sprintf("Trying to create too many buckets. Must be less than or equal to: [%d]. This limit can be set by changing the [search.max_buckets] cluster level setting.", maxBuckets)}
+}
+
+type DateHistogramAggregation struct {
+	Buckets []Bucket `json:"buckets"`
+	hist    *dateHistogram
+	field   string
+}
+
+func (m DateHistogramAggregation) GetAggregateCategory() dsl.AggregationCategory {
+	return dsl.Bucket
+}
+
+type HistogramAggregation struct {
+	Buckets []Bucket `json:"buckets"`
+	fill    *histogramFill
+	agg     *dsl.Histogram
+}
+
+func (m HistogramAggregation) GetAggregateCategory() dsl.AggregationCategory {
+	return dsl.Bucket
+}
+
+type AutoDateHistogramAggregation struct {
+	Buckets  []Bucket `json:"buckets"`
+	Interval string   `json:"interval"`
+	hist     *autoDateHistogram
+	field    string
+	// The key of the bucket after one, once the interval has been chosen
+	next func(float64) float64
+}
+
+func (m AutoDateHistogramAggregation) GetAggregateCategory() dsl.AggregationCategory {
+	return dsl.Bucket
+}
+
+// What the histograms have in common: buckets outside of the hard bounds are
+// dropped, and either those with too few documents or, with a min_doc_count of 0,
+// empty ones are added for the gaps and out to the extended bounds. Keys are
+// numbers, which for dates are epoch millis
+type histogramFill struct {
+	minDocCount              int64
+	extendedMin, extendedMax *float64
+	hardMin, hardMax         *float64
+	// The key of the bucket a value is in, and the key of the bucket after one
+	round, next func(float64) float64
+}
+
+func (hf *histogramFill) parseMinDocCount(v *dsl.StringOrNumber) error {
+	if v == nil {
+		return nil
+	}
+	n, err := strconv.ParseInt(v.String(), 10, 64)
+	if err != nil || n < 0 {
+		return &QueryError{Reason: "[minDocCount] must be greater than or equal to 0."}
+	}
+	hf.minDocCount = n
+	return nil
+}
+
+// The buckets found, whose keys are float64s, in order
+func (hf *histogramFill) fill(found []Bucket) ([]Bucket, error) {
+	key := func(b Bucket) float64 { return b.Key.(float64) }
+	sort.Slice(found, func(i, j int) bool { return key(found[i]) < key(found[j]) })
+	inBounds := func(k float64) bool {
+		return (hf.hardMin == nil || k >= *hf.hardMin) && (hf.hardMax == nil || k <= *hf.hardMax)
+	}
+	buckets := make([]Bucket, 0, len(found))
+	for _, b := range found {
+		if inBounds(key(b)) && b.DocCount >= hf.minDocCount {
+			buckets = append(buckets, b)
+		}
+	}
+	if hf.minDocCount > 0 {
+		return buckets, nil
+	}
+
+	var first, last *float64
+	if len(buckets) > 0 {
+		f, l := key(buckets[0]), key(buckets[len(buckets)-1])
+		first, last = &f, &l
+	}
+	if hf.extendedMin != nil {
+		if lower := hf.round(*hf.extendedMin); first == nil || lower < *first {
+			first = &lower
+		}
+	}
+	if hf.extendedMax != nil {
+		if upper := hf.round(*hf.extendedMax); last == nil || upper > *last {
+			last = &upper
+		}
+	}
+	if first == nil || last == nil {
+		return buckets, nil
+	}
+	// Nothing is added outside of the hard bounds, so they aren't walked either
+	if hf.hardMin != nil {
+		lower := hf.round(*hf.hardMin)
+		if lower < *hf.hardMin {
+			lower = hf.next(lower)
+		}
+		if lower > *first {
+			first = &lower
+		}
+	}
+	if hf.hardMax != nil {
+		if upper := hf.round(*hf.hardMax); upper < *last {
+			last = &upper
+		}
+	}
+
+	filled := make([]Bucket, 0, len(buckets))
+	next := 0
+	// Every step is counted, as keys so large that the interval is lost in their
+	// precision don't advance at all
+	for k, steps := *first, 0; k <= *last; k, steps = hf.next(k), steps+1 {
+		if steps >= maxBuckets || len(filled) >= maxBuckets {
+			return nil, tooManyBucketsError()
+		}
+		for next < len(buckets) && key(buckets[next]) < k {
+			filled = append(filled, buckets[next])
+			next++
+		}
+		if next < len(buckets) && key(buckets[next]) == k {
+			filled = append(filled, buckets[next])
+			next++
+		} else if inBounds(k) {
+			b := makeBucket()
+			b.Key = k
+			filled = append(filled, b)
+		}
+	}
+	return append(filled, buckets[next:]...), nil
+}
+
+// Read the buckets of a histogram, whose keys are the first group
+func scanHistogramBuckets(rows *sqlx.Rows, dbq *dbSubQuery) ([]Bucket, error) {
+	found := make([]Bucket, 0)
+	for rows.Next() {
+		dest := make(map[string]interface{})
+		if err := rows.MapScan(dest); err != nil {
+			return nil, err
+		}
+		for k := range dbq.groupAliases {
+			// Documents without a value for the field aren't in any bucket
+			var key float64
+			switch d := dest[k].(type) {
+			case int64:
+				key = float64(d)
+			case float64:
+				key = d
+			default:
+				continue
+			}
+			b, err := scanBucket(dest, dbq)
+			if err != nil {
+				return nil, err
+			}
+			b.Key = key
+			found = append(found, b)
+		}
+	}
+	return found, rows.Err()
+}
+
+// The settings of a date_histogram, resolved against the mapping of its field
+type dateHistogram struct {
+	histogramFill
+	interval string
+	calendar bool
+	offset   time.Duration
+	timeZone string
+	rounding *date.Rounding
+	loc      *time.Location
+	format   string
+}
+
+func newDateHistogram(h *dsl.DateHistogram, prop Property) (*dateHistogram, error) {
+	dh := &dateHistogram{timeZone: h.TimeZone}
+	switch {
+	case h.Interval != "" && (h.FixedInterval != "" || h.CalendarInterval != ""):
+		return nil, &QueryError{Reason: "Cannot use [interval] with [fixed_interval] or [calendar_interval] configuration options."}
+	case h.FixedInterval != "" && h.CalendarInterval != "":
+		return nil, &QueryError{Reason: "Cannot use [fixed_interval] with [calendar_interval] configuration option."}
+	case h.FixedInterval != "":
+		dh.interval = h.FixedInterval
+	case h.CalendarInterval != "":
+		dh.interval, dh.calendar = h.CalendarInterval, true
+	case h.Interval != "":
+		dh.interval, dh.calendar = h.Interval, date.IsCalendarInterval(h.Interval)
+	default:
+		return nil, &QueryError{Reason: "Invalid interval specified, must be non-null and non-empty"}
+	}
+
+	var err error
+	if h.Offset != nil {
+		if ms, err := strconv.ParseInt(h.Offset.String(), 10, 64); err == nil {
+			dh.offset = time.Duration(ms) * time.Millisecond
+		} else if dh.offset, err = date.ParseDuration(h.Offset.String()); err != nil {
+			return nil, &QueryError{Reason: fmt.Sprintf("failed to parse offset [%s]", h.Offset.String())}
+		}
+	}
+	if dh.loc, err = date.ParseTimeZone(h.TimeZone); err != nil {
+		return nil, &QueryError{Reason: err.Error()}
+	}
+	if dh.rounding, err = date.NewRounding(dh.interval, dh.calendar, dh.offset, dh.loc); err != nil {
+		return nil, &QueryError{Reason: err.Error()}
+	}
+	dh.round, dh.next = millisRounding(dh.rounding)
+
+	if dh.format, err = aggDateFormat(h.Format, prop); err != nil {
+		return nil, err
+	}
+	if err = dh.parseMinDocCount(h.MinDocCount); err != nil {
+		return nil, err
+	}
+	if h.ExtendedBounds != nil {
+		if dh.extendedMin, dh.extendedMax, err = dateBounds("extended_bounds", h.ExtendedBounds, dh.format, dh.loc); err != nil {
+			return nil, err
+		}
+	}
+	if h.HardBounds != nil {
+		if dh.hardMin, dh.hardMax, err = dateBounds("hard_bounds", h.HardBounds, dh.format, dh.loc); err != nil {
+			return nil, err
+		}
+	}
+	return dh, nil
+}
+
+// Histogram keys for dates are epoch millis
+func millisRounding(r *date.Rounding) (round, next func(float64) float64) {
+	round = func(k float64) float64 { return float64(r.Round(time.UnixMilli(int64(k))).UnixMilli()) }
+	next = func(k float64) float64 { return float64(r.Next(time.UnixMilli(int64(k))).UnixMilli()) }
+	return round, next
+}
+
+// The format of the keys of a date aggregation: its own, the mapping's, or the
+// default one for dates
+func aggDateFormat(format string, prop Property) (string, error) {
+	if format == "" {
+		format = prop.Format
+	}
+	if format == "" {
+		format = date.DefaultFormat
+	}
+	if _, err := date.Format(format, time.Unix(0, 0)); err != nil {
+		return "", &QueryError{Reason: err.Error()}
+	}
+	return format, nil
+}
+
+// Bounds are dates in the aggregation's format, date math or epoch millis
+func dateBounds(name string, b *dsl.Bounds, format string, loc *time.Location) (lower, upper *float64, err error) {
+	parse := func(v *dsl.StringOrNumber) (*float64, error) {
+		if v == nil {
+			return nil, nil
+		}
+		t, err := date.ParseMath(v.String(), format+"||epoch_millis", loc, false, time.Now())
+		if err != nil {
+			return nil, &QueryError{Reason: fmt.Sprintf("[%s] %v", name, err)}
+		}
+		ms := float64(t.UnixMilli())
+		return &ms, nil
+	}
+	if lower, err = parse(b.Min); err != nil {
+		return nil, nil, err
+	}
+	if upper, err = parse(b.Max); err != nil {
+		return nil, nil, err
+	}
+	return lower, upper, checkBounds(name, lower, upper)
+}
+
+func checkBounds(name string, lower, upper *float64) error {
+	if lower != nil && upper != nil && *lower > *upper {
+		return &QueryError{Reason: fmt.Sprintf("[%s.min][%v] cannot be greater than [%s.max][%v]", name, *lower, name, *upper)}
+	}
+	return nil
+}
+
+// The sql for the key of the bucket of an epoch millis value
+func (dh *dateHistogram) keyExpr(dbq *dbSubQuery, millis string) string {
+	return fmt.Sprintf(`CASE WHEN %s IS NOT NULL THEN date_bucket(CAST(%s AS INTEGER), %s, %s, %s, %s) END`,
+		millis, millis, dbq.sb.Var(dh.interval), dbq.sb.Var(dh.calendar),
+		dbq.sb.Var(dh.offset.Milliseconds()), dbq.sb.Var(dh.timeZone))
+}
+
+// Roundings are cached for the sql functions that apply them to every row, up to
+// a limit, as those of auto_date_histograms are for a range of dates that changes
+// with almost every query
+const maxCachedRoundings = 256
+
+type cachedRounding struct {
+	rounding *date.Rounding
+	interval string
+}
+
+var roundings = lru.New[string, cachedRounding](maxCachedRoundings)
+
+// The rounding cached under the key, or the one made for it
+func getRounding(key string, make func() (*date.Rounding, string, error)) (*date.Rounding, string, error) {
+	cr, err := roundings.Get(key, func() (cachedRounding, error) {
+		r, interval, err := make()
+		return cachedRounding{r, interval}, err
+	})
+	return cr.rounding, cr.interval, err
+}
+
+// The key of the date histogram bucket of an epoch millis value; the arguments
+// are those of the histogram, which were validated as its sql was generated
+func dateBucket(millis int64, interval string, calendar bool, offset int64, timeZone string) (int64, error) {
+	cacheKey := fmt.Sprintf("%s|%t|%d|%s", interval, calendar, offset, timeZone)
+	r, _, err := getRounding(cacheKey, func() (*date.Rounding, string, error) {
+		loc, err := date.ParseTimeZone(timeZone)
+		if err != nil {
+			return nil, "", err
+		}
+		r, err := date.NewRounding(interval, calendar, time.Duration(offset)*time.Millisecond, loc)
+		return r, interval, err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return r.Round(time.UnixMilli(millis)).UnixMilli(), nil
+}
+
+func (m *DateHistogramAggregation) SerializeResultset(rows *sqlx.Rows, dbq *dbSubQuery) error {
+	found, err := scanHistogramBuckets(rows, dbq)
+	if err != nil {
+		return err
+	}
+	if m.Buckets, err = m.hist.fill(found); err != nil {
+		return err
+	}
+	setDateKeys(m.Buckets, m.hist.format, m.hist.loc)
+	return nil
+}
+
+func (m *DateHistogramAggregation) buckets() []Bucket {
+	return m.Buckets
+}
+
+func (m *DateHistogramAggregation) setBuckets(buckets []Bucket) {
+	m.Buckets = buckets
+}
+
+func (m *DateHistogramAggregation) bucketFilter(dbq *dbSubQuery, b *Bucket) (string, error) {
+	millis, err := dbq.dateMillis(m.field)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s = %s", m.hist.keyExpr(dbq, millis), dbq.sb.Var(b.Key)), nil
+}
+
+// Date keys are epoch millis, and key_as_string is in the format and time zone
+// of the aggregation
+func setDateKeys(buckets []Bucket, format string, loc *time.Location) {
+	for i := range buckets {
+		ms := int64(buckets[i].Key.(float64))
+		k, _ := date.Format(format, time.UnixMilli(ms).In(loc))
+		buckets[i].Key = ms
+		buckets[i].KeyAsString = fmt.Sprint(k)
+	}
+}
+
+// Numeric histograms
+func newHistogram(h *dsl.Histogram) (*histogramFill, error) {
+	if h.Interval == nil || *h.Interval <= 0 {
+		return nil, &QueryError{Reason: "[interval] must be >0 for histogram aggregation"}
+	}
+	iv, offset := *h.Interval, h.Offset
+	hf := &histogramFill{
+		round: func(v float64) float64 { return histogramKey(v, iv, offset) },
+		// By the index of the bucket, so that keys don't drift as they're added up
+		next: func(k float64) float64 { return (math.Round((k-offset)/iv)+1)*iv + offset },
+	}
+	if err := hf.parseMinDocCount(h.MinDocCount); err != nil {
+		return nil, err
+	}
+	var err error
+	if h.ExtendedBounds != nil {
+		if hf.extendedMin, hf.extendedMax, err = numericBounds("extended_bounds", h.ExtendedBounds); err != nil {
+			return nil, err
+		}
+	}
+	if h.HardBounds != nil {
+		if hf.hardMin, hf.hardMax, err = numericBounds("hard_bounds", h.HardBounds); err != nil {
+			return nil, err
+		}
+	}
+	return hf, nil
+}
+
+func numericBounds(name string, b *dsl.Bounds) (lower, upper *float64, err error) {
+	parse := func(v *dsl.StringOrNumber) (*float64, error) {
+		if v == nil {
+			return nil, nil
+		}
+		f, err := strconv.ParseFloat(v.String(), 64)
+		if err != nil {
+			return nil, &QueryError{Reason: fmt.Sprintf("[%s] failed to parse [%s] as a number", name, v.String())}
+		}
+		return &f, nil
+	}
+	if lower, err = parse(b.Min); err != nil {
+		return nil, nil, err
+	}
+	if upper, err = parse(b.Max); err != nil {
+		return nil, nil, err
+	}
+	return lower, upper, checkBounds(name, lower, upper)
+}
+
+// The key of the histogram bucket of a value, registered as histogram_key
+func histogramKey(value, interval, offset float64) float64 {
+	return math.Floor((value-offset)/interval)*interval + offset
+}
+
+// The sql for the key of the bucket of a numeric value
+func (m *HistogramAggregation) keyExpr(dbq *dbSubQuery) (string, error) {
+	value, err := dbq.fieldExpr(cleanseKeyField(m.agg.Field), `JSON_EXTRACT(content, %s)`)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(`CASE WHEN typeof(%s) IN ('integer', 'real') THEN histogram_key(CAST(%s AS REAL), %s, %s) END`,
+		value, value, dbq.sb.Var(*m.agg.Interval), dbq.sb.Var(m.agg.Offset)), nil
+}
+
+func (m *HistogramAggregation) buckets() []Bucket {
+	return m.Buckets
+}
+
+func (m *HistogramAggregation) setBuckets(buckets []Bucket) {
+	m.Buckets = buckets
+}
+
+func (m *HistogramAggregation) bucketFilter(dbq *dbSubQuery, b *Bucket) (string, error) {
+	key, err := m.keyExpr(dbq)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s = %s", key, dbq.sb.Var(b.Key)), nil
+}
+
+func (m *HistogramAggregation) SerializeResultset(rows *sqlx.Rows, dbq *dbSubQuery) error {
+	found, err := scanHistogramBuckets(rows, dbq)
+	if err != nil {
+		return err
+	}
+	m.Buckets, err = m.fill.fill(found)
+	return err
+}
+
+// An auto_date_histogram chooses its interval once the range of dates it covers
+// is known, which the sql has as the auto_min and auto_max of each row
+type autoDateHistogram struct {
+	target   int
+	minimum  string
+	timeZone string
+	loc      *time.Location
+	format   string
+}
+
+// Far more than a chart could show, but few enough that trying each interval for
+// how many buckets it makes is quick
+const maxAutoBuckets = 10000
+
+func newAutoDateHistogram(h *dsl.AutoDateHistogram, prop Property) (*autoDateHistogram, error) {
+	ah := &autoDateHistogram{target: 10, minimum: h.MinimumInterval, timeZone: h.TimeZone}
+	if h.Buckets != nil {
+		ah.target = *h.Buckets
+	}
+	if ah.target <= 0 {
+		return nil, &QueryError{Reason: "[buckets] must be greater than 0"}
+	}
+	if ah.target > maxAutoBuckets {
+		return nil, &QueryError{Reason: fmt.Sprintf("[buckets] must be less than or equal to [%d]", maxAutoBuckets)}
+	}
+	var err error
+	if ah.loc, err = date.ParseTimeZone(h.TimeZone); err != nil {
+		return nil, &QueryError{Reason: err.Error()}
+	}
+	if _, _, err = date.AutoRounding(time.Time{}, time.Time{}, ah.target, ah.minimum, ah.loc); err != nil {
+		return nil, &QueryError{Reason: err.Error()}
+	}
+	if ah.format, err = aggDateFormat(h.Format, prop); err != nil {
+		return nil, err
+	}
+	return ah, nil
+}
+
+func (ah *autoDateHistogram) keyExpr(dbq *dbSubQuery, millis string) string {
+	return fmt.Sprintf(`CASE WHEN %s IS NOT NULL THEN auto_date_bucket(CAST(%s AS INTEGER), auto_min, auto_max, %s, %s, %s) END`,
+		millis, millis, dbq.sb.Var(ah.target), dbq.sb.Var(ah.minimum), dbq.sb.Var(ah.timeZone))
+}
+
+// The key of the auto_date_histogram bucket of an epoch millis value, with the
+// interval chosen for the dates from first to last
+func autoDateBucket(millis, first, last int64, target int, minimum, timeZone string) (int64, error) {
+	r, _, err := autoRounding(first, last, target, minimum, timeZone)
+	if err != nil {
+		return 0, err
+	}
+	return r.Round(time.UnixMilli(millis)).UnixMilli(), nil
+}
+
+func autoRounding(first, last int64, target int, minimum, timeZone string) (*date.Rounding, string, error) {
+	cacheKey := fmt.Sprintf("auto|%d|%d|%d|%s|%s", first, last, target, minimum, timeZone)
+	return getRounding(cacheKey, func() (*date.Rounding, string, error) {
+		loc, err := date.ParseTimeZone(timeZone)
+		if err != nil {
+			return nil, "", err
+		}
+		return date.AutoRounding(time.UnixMilli(first), time.UnixMilli(last), target, minimum, loc)
+	})
+}
+
+func (m *AutoDateHistogramAggregation) SerializeResultset(rows *sqlx.Rows, dbq *dbSubQuery) error {
+	found := make([]Bucket, 0)
+	var first, last int64
+	for rows.Next() {
+		dest := make(map[string]interface{})
+		if err := rows.MapScan(dest); err != nil {
+			return err
+		}
+		if lo, ok := dest["auto_first"].(int64); ok {
+			first, last = lo, dest["auto_last"].(int64)
+		}
+		for k := range dbq.groupAliases {
+			if key, ok := dest[k].(int64); ok {
+				b, err := scanBucket(dest, dbq)
+				if err != nil {
+					return err
+				}
+				b.Key = float64(key)
+				found = append(found, b)
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	m.Buckets = found
+	if len(found) == 0 {
+		return nil
+	}
+
+	r, interval, err := autoRounding(first, last, m.hist.target, m.hist.minimum, m.hist.timeZone)
+	if err != nil {
+		return err
+	}
+	m.Interval = interval
+	hf := histogramFill{}
+	hf.round, hf.next = millisRounding(r)
+	m.next = hf.next
+	if m.Buckets, err = hf.fill(found); err != nil {
+		return err
+	}
+	setDateKeys(m.Buckets, m.hist.format, m.hist.loc)
+	return nil
+}
+
+func (m *AutoDateHistogramAggregation) buckets() []Bucket {
+	return m.Buckets
+}
+
+func (m *AutoDateHistogramAggregation) setBuckets(buckets []Bucket) {
+	m.Buckets = buckets
+}
+
+// The documents of a bucket are those from its key up to that of the next one,
+// as the interval is chosen for the documents of the parent bucket as a whole
+func (m *AutoDateHistogramAggregation) bucketFilter(dbq *dbSubQuery, b *Bucket) (string, error) {
+	millis, err := dbq.dateMillis(m.field)
+	if err != nil {
+		return "", err
+	}
+	key := b.Key.(int64)
+	return fmt.Sprintf("%s >= %s AND %s < %s", millis, dbq.sb.Var(key),
+		millis, dbq.sb.Var(int64(m.next(float64(key))))), nil
+}
@@ -0,0 +1,261 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	require "github.com/alecthomas/assert/v2"
+)
+
+type histogramBucket struct {
+	Key         int64  `json:"key"`
+	KeyAsString string `json:"key_as_string"`
+	DocCount    int64  `json:"doc_count"`
+}
+
+func histogramBuckets(t *testing.T, index, agg string) []histogramBucket {
+	t.Helper()
+	rec := doRequest(http.MethodPost, "/"+index+"/_search", `{"size": 0, "aggs": {"h": {"date_histogram": `+agg+`}}}`)
+	require.Equal(t, rec.Code, http.StatusOK, rec.Body.String())
+	resp := struct {
+		Aggregations map[string]struct {
+			Buckets []histogramBucket `json:"buckets"`
+		} `json:"aggregations"`
+	}{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	return resp.Aggregations["h"].Buckets
+}
+
+func millis(s string) int64 {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		panic(err)
+	}
+	return t.UnixMilli()
+}
+
+func TestDateHistogramBuckets(t *testing.T) {
+	rec := doRequest(http.MethodPut, "/_template/hist", `{
+		"index_patterns": "hist-*",
+		"mappings": {"properties": {"ts": {"type": "date"}}}
+	}`)
+	require.Equal(t, rec.Code, http.StatusOK, rec.Body.String())
+	bulkRequest(t, "/hist-000001/_bulk", `
+{"index": {}}
+{"ts": "2022-11-11T13:31:29Z", "when": 1668173489000}
+{"index": {}}
+{"ts": "2022-11-11T13:45:00Z", "when": 1668174300000}
+{"index": {}}
+{"ts": "2022-11-11T16:10:00Z", "when": 1668183000000}
+{"index": {}}
+{"ts": "2022-11-30T23:30:00Z"}
+{"index": {}}
+{"ts": "2022-12-25T08:00:00+01:00"}
+{"index": {}}
+{"other": 1}
+`)
+
+	buckets := histogramBuckets(t, "hist-000001", `{"field": "ts", "fixed_interval": "1h", "min_doc_count": 1}`)
+	require.Equal(t, buckets, []histogramBucket{
+		{millis("2022-11-11T13:00:00Z"), "2022-11-11T13:00:00.000Z", 2},
+		{millis("2022-11-11T16:00:00Z"), "2022-11-11T16:00:00.000Z", 1},
+		{millis("2022-11-30T23:00:00Z"), "2022-11-30T23:00:00.000Z", 1},
+		{millis("2022-12-25T07:00:00Z"), "2022-12-25T07:00:00.000Z", 1},
+	})
+
+	// Empty buckets fill the gaps by default
+	buckets = histogramBuckets(t, "hist-000001", `{"field": "when", "fixed_interval": "1h"}`)
+	require.Equal(t, len(buckets), 4)
+	require.Equal(t, buckets[1], histogramBucket{millis("2022-11-11T14:00:00Z"), "2022-11-11T14:00:00.000Z", 0})
+
+	buckets = histogramBuckets(t, "hist-000001", `{"field": "ts", "calendar_interval": "month"}`)
+	require.Equal(t, buckets, []histogramBucket{
+		{millis("2022-11-01T00:00:00Z"), "2022-11-01T00:00:00.000Z", 4},
+		{millis("2022-12-01T00:00:00Z"), "2022-12-01T00:00:00.000Z", 1},
+	})
+
+	// Months start at midnight in the time zone, and keys print in it
+	buckets = histogramBuckets(t, "hist-000001", `{"field": "ts", "calendar_interval": "1M", "time_zone": "Europe/Paris"}`)
+	require.Equal(t, buckets, []histogramBucket{
+		{millis("2022-10-31T23:00:00Z"), "2022-11-01T00:00:00.000+01:00", 3},
+		{millis("2022-11-30T23:00:00Z"), "2022-12-01T00:00:00.000+01:00", 2},
+	})
+
+	buckets = histogramBuckets(t, "hist-000001", `{"field": "ts", "calendar_interval": "quarter", "format": "yyyy-MM-dd"}`)
+	require.Equal(t, buckets, []histogramBucket{{millis("2022-10-01T00:00:00Z"), "2022-10-01", 5}})
+
+	buckets = histogramBuckets(t, "hist-000001", `{"field": "ts", "calendar_interval": "week", "min_doc_count": "1"}`)
+	require.Equal(t, buckets[0], histogramBucket{millis("2022-11-07T00:00:00Z"), "2022-11-07T00:00:00.000Z", 3})
+
+	buckets = histogramBuckets(t, "hist-000001", `{"field": "ts", "calendar_interval": "day", "offset": "+14h", "min_doc_count": 1}`)
+	require.Equal(t, buckets[0], histogramBucket{millis("2022-11-10T14:00:00Z"), "2022-11-10T14:00:00.000Z", 2})
+	require.Equal(t, buckets[1], histogramBucket{millis("2022-11-11T14:00:00Z"), "2022-11-11T14:00:00.000Z", 1})
+
+	// The deprecated interval is a calendar one when it can be
+	buckets = histogramBuckets(t, "hist-000001", `{"field": "ts", "interval": "1y"}`)
+	require.Equal(t, buckets, []histogramBucket{{millis("2022-01-01T00:00:00Z"), "2022-01-01T00:00:00.000Z", 5}})
+	buckets = histogramBuckets(t, "hist-000001", `{"field": "ts", "interval": "90m", "min_doc_count": 1}`)
+	require.Equal(t, buckets[0].Key, millis("2022-11-11T13:30:00Z"))
+
+	buckets = histogramBuckets(t, "hist-000001", fmt.Sprintf(
+		`{"field": "ts", "fixed_interval": "1d", "extended_bounds": {"min": %d, "max": "2023-01-01"}}`, millis("2022-11-09T10:00:00Z")))
+	require.Equal(t, len(buckets), 54)
+	require.Equal(t, buckets[0], histogramBucket{millis("2022-11-09T00:00:00Z"), "2022-11-09T00:00:00.000Z", 0})
+	require.Equal(t, buckets[53].Key, millis("2023-01-01T00:00:00Z"))
+
+	buckets = histogramBuckets(t, "hist-000001", `{"field": "ts", "calendar_interval": "day", "hard_bounds": {"min": "2022-11-12", "max": "2022-11-30"}}`)
+	require.Equal(t, len(buckets), 1)
+	require.Equal(t, buckets[0].Key, millis("2022-11-30T00:00:00Z"))
+	buckets = histogramBuckets(t, "hist-000001", `{"field": "ts", "fixed_interval": "1ms", "min_doc_count": 0,
+		"extended_bounds": {"min": "2000-01-01", "max": "2100-01-01"}, "hard_bounds": {"min": "2022-11-30", "max": "2022-11-30T00:00:00.002Z"}}`)
+	require.Equal(t, len(buckets), 3)
+	require.Equal(t, buckets[2].Key, millis("2022-11-30T00:00:00.002Z"))
+
+	// As Grafana sends them
+	buckets = histogramBuckets(t, "hist-000001", fmt.Sprintf(
+		`{"field": "ts", "fixed_interval": "30m", "min_doc_count": "0", "extended_bounds": {"min": %d, "max": %d}, "format": "epoch_millis"}`,
+		millis("2022-11-11T12:00:00Z"), millis("2022-11-11T14:00:00Z")))
+	require.Equal(t, int64(len(buckets)), (millis("2022-12-25T07:00:00Z")-millis("2022-11-11T12:00:00Z"))/millis("1970-01-01T00:30:00Z")+1)
+	require.Equal(t, buckets[3], histogramBucket{millis("2022-11-11T13:30:00Z"), fmt.Sprint(millis("2022-11-11T13:30:00Z")), 2})
+
+	for _, agg := range []string{
+		`{"field": "ts"}`,
+		`{"field": "ts", "fixed_interval": "1h", "calendar_interval": "1h"}`,
+		`{"field": "ts", "interval": "1h", "calendar_interval": "1h"}`,
+		`{"field": "ts", "calendar_interval": "2d"}`,
+		`{"field": "ts", "fixed_interval": "1M"}`,
+		`{"field": "ts", "fixed_interval": "1h", "time_zone": "Mars/Olympus"}`,
+		`{"field": "ts", "fixed_interval": "1h", "offset": "soon"}`,
+		`{"field": "ts", "fixed_interval": "1h", "min_doc_count": -1}`,
+		`{"field": "ts", "fixed_interval": "1h", "format": "yyyy-qq"}`,
+		`{"field": "ts", "fixed_interval": "1h", "extended_bounds": {"min": "2023-01-01", "max": "2022-01-01"}}`,
+		`{"field": "ts", "fixed_interval": "1ms", "extended_bounds": {"min": 0, "max": "now"}}`,
+	} {
+		rec := doRequest(http.MethodPost, "/hist-000001/_search", `{"size": 0, "aggs": {"h": {"date_histogram": `+agg+`}}}`)
+		require.Equal(t, rec.Code, http.StatusBadRequest, agg)
+	}
+}
+
+// The json of the aggregation named a in a search with the given aggregations
+func aggregationResult(t *testing.T, index, aggs string) string {
+	t.Helper()
+	rec := doRequest(http.MethodPost, "/"+index+"/_search", `{"size": 0, "aggs": `+aggs+`}`)
+	require.Equal(t, rec.Code, http.StatusOK, rec.Body.String())
+	resp := struct {
+		Aggregations map[string]json.RawMessage `json:"aggregations"`
+	}{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	return string(resp.Aggregations["a"])
+}
+
+func TestHistogramBuckets(t *testing.T) {
+	bulkRequest(t, "/numhist/_bulk", `
+{"index": {}}
+{"price": 5, "n": 1}
+{"index": {}}
+{"price": 15, "n": 2}
+{"index": {}}
+{"price": 17.5, "n": 3}
+{"index": {}}
+{"price": 42}
+{"index": {}}
+{"price": "cheap"}
+{"index": {}}
+{"other": 1}
+`)
+	require.Equal(t, aggregationResult(t, "numhist", `{"a": {"histogram": {"field": "price", "interval": 10}}}`),
+		`{"buckets":[{"key":0,"doc_count":1},{"key":10,"doc_count":2},{"key":20,"doc_count":0},{"key":30,"doc_count":0},{"key":40,"doc_count":1}]}`)
+	require.Equal(t, aggregationResult(t, "numhist", `{"a": {"histogram": {"field": "price", "interval": 10, "offset": 5, "min_doc_count": 1}}}`),
+		`{"buckets":[{"key":5,"doc_count":1},{"key":15,"doc_count":2},{"key":35,"doc_count":1}]}`)
+	require.Equal(t, aggregationResult(t, "numhist", `{"a": {"histogram": {"field": "price", "interval": 2.5, "min_doc_count": 1}}}`),
+		`{"buckets":[{"key":5,"doc_count":1},{"key":15,"doc_count":1},{"key":17.5,"doc_count":1},{"key":40,"doc_count":1}]}`)
+	require.Equal(t, aggregationResult(t, "numhist", `{"a": {"histogram": {"field": "price", "interval": 20, "extended_bounds": {"min": -20, "max": 60}}}}`),
+		`{"buckets":[{"key":-20,"doc_count":0},{"key":0,"doc_count":3},{"key":20,"doc_count":0},{"key":40,"doc_count":1},{"key":60,"doc_count":0}]}`)
+	require.Equal(t, aggregationResult(t, "numhist", `{"a": {"histogram": {"field": "price", "interval": 10, "hard_bounds": {"min": 10, "max": 30}}}}`),
+		`{"buckets":[{"key":10,"doc_count":2}]}`)
+	// Only what's within the hard bounds of the extended bounds is filled
+	require.Equal(t, aggregationResult(t, "numhist", `{"a": {"histogram": {"field": "price", "interval": 1, "min_doc_count": 0,
+		"extended_bounds": {"min": 0, "max": 1e11}, "hard_bounds": {"min": 12.5, "max": 15}}}}`),
+		`{"buckets":[{"key":13,"doc_count":0},{"key":14,"doc_count":0},{"key":15,"doc_count":1}]}`)
+	require.Equal(t, aggregationResult(t, "numhist", `{"a": {"histogram": {"field": "price", "interval": 10, "min_doc_count": 1}, "aggregations": {"m": {"max": {"field": "n"}}}}}`),
+		`{"buckets":[{"key":0,"doc_count":1,"m":{"value":1}},{"key":10,"doc_count":2,"m":{"value":3}},{"key":40,"doc_count":1,"m":{"value":null}}]}`)
+
+	for _, agg := range []string{
+		`{"field": "price"}`,
+		`{"field": "price", "interval": 0}`,
+		`{"field": "price", "interval": 10, "min_doc_count": -1}`,
+		`{"field": "price", "interval": 10, "extended_bounds": {"min": 10, "max": 0}}`,
+		`{"field": "price", "interval": 10, "hard_bounds": {"min": "low"}}`,
+		`{"field": "price", "interval": 1, "extended_bounds": {"min": 0, "max": 1e11}}`,
+		`{"field": "price", "interval": 1, "extended_bounds": {"min": 1e17, "max": 1.1e17}}`,
+	} {
+		rec := doRequest(http.MethodPost, "/numhist/_search", `{"size": 0, "aggs": {"a": {"histogram": `+agg+`}}}`)
+		require.Equal(t, rec.Code, http.StatusBadRequest, agg)
+	}
+}
+
+func TestAutoDateHistogram(t *testing.T) {
+	bulkRequest(t, "/autohist/_bulk", `
+{"index": {}}
+{"ts": "2022-11-11T13:31:29Z"}
+{"index": {}}
+{"ts": "2022-11-11T18:45:00Z"}
+{"index": {}}
+{"ts": "2022-11-13T01:10:00Z"}
+{"index": {}}
+{"other": 1}
+`)
+	result := struct {
+		Buckets  []histogramBucket `json:"buckets"`
+		Interval string            `json:"interval"`
+	}{}
+	auto := func(agg string) {
+		t.Helper()
+		require.NoError(t, json.Unmarshal([]byte(aggregationResult(t, "autohist", `{"a": {"auto_date_histogram": `+agg+`}}`)), &result))
+	}
+
+	auto(`{"field": "ts", "buckets": 3}`)
+	require.Equal(t, result.Interval, "1d")
+	require.Equal(t, result.Buckets, []histogramBucket{
+		{millis("2022-11-11T00:00:00Z"), "2022-11-11T00:00:00.000Z", 2},
+		{millis("2022-11-12T00:00:00Z"), "2022-11-12T00:00:00.000Z", 0},
+		{millis("2022-11-13T00:00:00Z"), "2022-11-13T00:00:00.000Z", 1},
+	})
+
+	auto(`{"field": "ts"}`)
+	require.Equal(t, result.Interval, "12h")
+	require.Equal(t, len(result.Buckets), 4)
+
+	auto(`{"field": "ts", "buckets": 2, "format": "yyyy-MM-dd"}`)
+	require.Equal(t, result.Interval, "7d")
+	require.Equal(t, result.Buckets, []histogramBucket{{millis("2022-11-10T00:00:00Z"), "2022-11-10", 3}})
+
+	auto(`{"field": "ts", "minimum_interval": "month"}`)
+	require.Equal(t, result.Interval, "1M")
+	require.Equal(t, result.Buckets, []histogramBucket{{millis("2022-11-01T00:00:00Z"), "2022-11-01T00:00:00.000Z", 3}})
+
+	auto(`{"field": "nothing"}`)
+	require.Equal(t, len(result.Buckets), 0)
+
+	for _, agg := range []string{
+		`{"field": "ts", "buckets": 0}`,
+		`{"field": "ts", "buckets": 10001}`,
+		`{"field": "ts", "minimum_interval": "fortnight"}`,
+		`{"field": "ts", "time_zone": "Mars/Olympus"}`,
+	} {
+		rec := doRequest(http.MethodPost, "/autohist/_search", `{"size": 0, "aggs": {"a": {"auto_date_histogram": `+agg+`}}}`)
+		require.Equal(t, rec.Code, http.StatusBadRequest, agg)
+	}
+}
+
+func TestRoundingCacheBound(t *testing.T) {
+	first := time.Date(2022, 11, 11, 0, 0, 0, 0, time.UTC).UnixMilli()
+	for i := 0; i < 2*maxCachedRoundings; i++ {
+		_, _, err := autoRounding(first+int64(i), first+int64(i)+int64(time.Hour/time.Millisecond), 10, "", "")
+		require.NoError(t, err)
+	}
+	require.Equal(t, roundings.Len(), maxCachedRoundings)
+}
@@ -0,0 +1,738 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/atomic77/gopensearch/pkg/date"
+	"github.com/atomic77/gopensearch/pkg/dsl"
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+
+Metric aggregations are computed by aggregate functions registered with sqlite,
+which are handed the json of a field's value in each document so that arrays
+count each of their values. They return their state as json, which is then shaped
+into the response of each kind of metric. The same sql then works both for an
+aggregation of its own and as a sub-aggregation embedded in the select of a bucket
+
+https://www.elastic.co/guide/en/elasticsearch/reference/7.17/search-aggregations-metrics.html
+
+*/
+
+// What the values of a field are taken to be: numbers, which for dates are epoch
+// millis, or anything at all when only counting them
+const (
+	metricNumbers = "number"
+	metricDates   = "date"
+	metricAny     = "any"
+)
+
+// A metric aggregation as planned: which one it is, the label of its results, and
+// how they are shown
+type metric struct {
+	label  string
+	typ    string
+	format string
+	sigma  float64
+	// The percents of percentiles, or values of percentile_ranks
+	percents    []float64
+	keyed       bool
+	compression float64
+}
+
+// The state of the aggregate functions, as json
+type metricState struct {
+	Count        int64    `json:"count"`
+	Min          *float64 `json:"min,omitempty"`
+	Max          *float64 `json:"max,omitempty"`
+	Sum          float64  `json:"sum"`
+	SumOfSquares float64  `json:"sum_of_squares"`
+	Weight       float64  `json:"weight"`
+	Cardinality  int64    `json:"cardinality"`
+	// Of a t-digest of the values
+	Centroids []centroid `json:"centroids,omitempty"`
+}
+
+// The select expression of a metric aggregation, if the aggregation is one
+func (dbq *dbSubQuery) genMetricSelectExpr(agg *dsl.Aggregate, fnIdx string) error {
+	var (
+		field  *dsl.AggField
+		typ    string
+		values = metricNumbers
+	)
+	switch {
+	case agg.Avg != nil:
+		field, typ = agg.Avg, "avg"
+	case agg.Max != nil:
+		field, typ = agg.Max, "max"
+	case agg.Min != nil:
+		field, typ = agg.Min, "min"
+	case agg.Sum != nil:
+		field, typ = agg.Sum, "sum"
+	case agg.Stats != nil:
+		field, typ = agg.Stats, "stats"
+	case agg.ExtendedStats != nil:
+		field, typ = &agg.ExtendedStats.AggField, "extended_stats"
+	case agg.ValueCount != nil:
+		field, typ, values = agg.ValueCount, "value_count", metricAny
+	case agg.Cardinality != nil:
+		field, typ, values = &agg.Cardinality.AggField, "cardinality", metricAny
+	case agg.WeightedAvg != nil:
+		field, typ = &agg.WeightedAvg.Value, "weighted_avg"
+	case agg.Percentiles != nil:
+		field, typ = &agg.Percentiles.AggField, "percentiles"
+	case agg.PercentileRanks != nil:
+		field, typ = &agg.PercentileRanks.AggField, "percentile_ranks"
+	case agg.MedianAbsoluteDeviation != nil:
+		field, typ = &agg.MedianAbsoluteDeviation.AggField, "median_absolute_deviation"
+	default:
+		return nil
+	}
+
+	m := &metric{label: *dbq.label, typ: typ, sigma: 2, compression: defaultCompression}
+	name := cleanseKeyField(field.Field)
+	if prop, _ := dbq.mapping.fieldType(name); values == metricNumbers && (prop.Type == "date" || prop.Type == "date_nanos") {
+		format := field.Format
+		if agg.WeightedAvg != nil {
+			format = agg.WeightedAvg.Format
+		}
+		var err error
+		if m.format, err = aggDateFormat(format, prop); err != nil {
+			return err
+		}
+		values = metricDates
+	}
+	value, err := dbq.metricValue(field)
+	if err != nil {
+		return err
+	}
+
+	var expr string
+	switch {
+	case agg.Cardinality != nil:
+		threshold := defaultPrecisionThreshold
+		if agg.Cardinality.PrecisionThreshold != nil {
+			threshold = *agg.Cardinality.PrecisionThreshold
+		}
+		if threshold < 0 {
+			return &QueryError{Reason: fmt.Sprintf("[precisionThreshold] must be greater than or equal to 0. Found [%d] in [%s]", threshold, m.label)}
+		}
+		expr = fmt.Sprintf(`metric_cardinality(%s, %s)`, value, dbq.sb.Var(threshold))
+	case agg.WeightedAvg != nil:
+		weight, err := dbq.metricValue(&agg.WeightedAvg.Weight)
+		if err != nil {
+			return err
+		}
+		expr = fmt.Sprintf(`metric_weighted_avg(%s, %s, %s)`, value, weight, dbq.sb.Var(values))
+	case agg.Percentiles != nil || agg.PercentileRanks != nil || agg.MedianAbsoluteDeviation != nil:
+		if err := m.digestOptions(agg); err != nil {
+			return err
+		}
+		expr = fmt.Sprintf(`metric_digest(%s, %s, %s)`, value, dbq.sb.Var(values), dbq.sb.Var(m.compression))
+	default:
+		if agg.ExtendedStats != nil && agg.ExtendedStats.Sigma != nil {
+			if m.sigma = *agg.ExtendedStats.Sigma; m.sigma < 0 {
+				return &QueryError{Reason: fmt.Sprintf("[sigma] must be greater than or equal to 0. Found [%v] in [%s]", m.sigma, m.label)}
+			}
+		}
+		expr = fmt.Sprintf(`metric_stats(%s, %s)`, value, dbq.sb.Var(values))
+	}
+
+	dbq.fnAliases[fnIdx] = m
+	dbq.selectExprs = append(dbq.selectExprs, dbq.sb.As(" "+expr, fnIdx))
+	dbq.aggregation = m.newResult()
+	return nil
+}
+
+// The json of the value of a field in a document, or of its missing value
+func (dbq *dbSubQuery) metricValue(field *dsl.AggField) (string, error) {
+	value, err := dbq.fieldExpr(cleanseKeyField(field.Field), `NULLIF(content -> %s, 'null')`)
+	if err != nil {
+		return "", err
+	}
+	if field.Missing == nil {
+		return value, nil
+	}
+	missing, _ := json.Marshal(field.Missing.String())
+	if _, err := strconv.ParseFloat(field.Missing.String(), 64); err == nil {
+		missing = []byte(field.Missing.String())
+	}
+	return fmt.Sprintf(`COALESCE(%s, %s)`, value, dbq.sb.Var(string(missing))), nil
+}
+
+// The result of a metric from its state in a row
+func (m *metric) result(raw interface{}) (metricResult, error) {
+	st, err := parseMetricState(raw)
+	if err != nil {
+		return nil, err
+	}
+	r := m.newResult()
+	r.set(st)
+	return r, nil
+}
+
+// The state is null when there were no documents to aggregate
+func parseMetricState(raw interface{}) (metricState, error) {
+	var st metricState
+	if s, ok := raw.(string); ok {
+		if err := json.Unmarshal([]byte(s), &st); err != nil {
+			return st, err
+		}
+	}
+	return st, nil
+}
+
+type metricResult interface {
+	Aggregation
+	set(st metricState)
+}
+
+func (m *metric) newResult() metricResult {
+	switch m.typ {
+	case "percentiles", "percentile_ranks":
+		return &MetricMultipleAggregation{metric: m}
+	case "stats":
+		return &StatsAggregation{metric: m}
+	case "extended_stats":
+		return &ExtendedStatsAggregation{StatsAggregation: StatsAggregation{metric: m}}
+	}
+	return &MetricSingleAggregation{metric: m}
+}
+
+// The state of a metric aggregation of its own, in its one row
+func scanMetric(rows *sqlx.Rows, r metricResult) error {
+	var raw interface{}
+	for rows.Next() {
+		if err := rows.Scan(&raw); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	st, err := parseMetricState(raw)
+	if err != nil {
+		return err
+	}
+	r.set(st)
+	return nil
+}
+
+// Dates print in the format of the aggregation
+func (m *metric) asString(v *float64) string {
+	if m.format == "" || v == nil {
+		return ""
+	}
+	s, _ := date.Format(m.format, time.UnixMilli(int64(math.Round(*v))).UTC())
+	return fmt.Sprint(s)
+}
+
+// Results that aren't finite are null, as ES shows them
+func finite(v float64) *float64 {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return nil
+	}
+	return &v
+}
+
+func (m *MetricSingleAggregation) set(st metricState) {
+	switch m.metric.typ {
+	case "min":
+		m.Value = st.Min
+	case "max":
+		m.Value = st.Max
+	case "sum":
+		m.Value = finite(st.Sum)
+	case "avg":
+		if st.Count > 0 {
+			m.Value = finite(st.Sum / float64(st.Count))
+		}
+	case "weighted_avg":
+		if st.Weight != 0 {
+			m.Value = finite(st.Sum / st.Weight)
+		}
+	case "value_count":
+		m.Value = finite(float64(st.Count))
+	case "cardinality":
+		m.Value = finite(float64(st.Cardinality))
+	case "median_absolute_deviation":
+		if st.Count > 0 {
+			m.Value = finite(m.metric.digest(st).medianAbsoluteDeviation())
+		}
+	}
+	if m.metric.typ != "value_count" && m.metric.typ != "cardinality" && m.metric.typ != "median_absolute_deviation" {
+		m.ValueAsString = m.metric.asString(m.Value)
+	}
+}
+
+func (m *MetricSingleAggregation) SerializeResultset(rows *sqlx.Rows, dbq *dbSubQuery) error {
+	return scanMetric(rows, m)
+}
+
+type StatsAggregation struct {
+	Count       int64    `json:"count"`
+	Min         *float64 `json:"min"`
+	Max         *float64 `json:"max"`
+	Avg         *float64 `json:"avg"`
+	Sum         float64  `json:"sum"`
+	MinAsString string   `json:"min_as_string,omitempty"`
+	MaxAsString string   `json:"max_as_string,omitempty"`
+	AvgAsString string   `json:"avg_as_string,omitempty"`
+	SumAsString string   `json:"sum_as_string,omitempty"`
+	metric      *metric
+}
+
+func (m StatsAggregation) GetAggregateCategory() dsl.AggregationCategory {
+	return dsl.MetricsMultiple
+}
+
+func (m *StatsAggregation) set(st metricState) {
+	m.Count, m.Min, m.Max, m.Sum = st.Count, st.Min, st.Max, st.Sum
+	if st.Count > 0 {
+		m.Avg = finite(st.Sum / float64(st.Count))
+		m.MinAsString, m.MaxAsString = m.metric.asString(m.Min), m.metric.asString(m.Max)
+		m.AvgAsString, m.SumAsString = m.metric.asString(m.Avg), m.metric.asString(&m.Sum)
+	}
+}
+
+func (m *StatsAggregation) SerializeResultset(rows *sqlx.Rows, dbq *dbSubQuery) error {
+	return scanMetric(rows, m)
+}
+
+type ExtendedStatsAggregation struct {
+	StatsAggregation
+	SumOfSquares           *float64           `json:"sum_of_squares"`
+	Variance               *float64           `json:"variance"`
+	VariancePopulation     *float64           `json:"variance_population"`
+	VarianceSampling       *float64           `json:"variance_sampling"`
+	StdDeviation           *float64           `json:"std_deviation"`
+	StdDeviationPopulation *float64           `json:"std_deviation_population"`
+	StdDeviationSampling   *float64           `json:"std_deviation_sampling"`
+	StdDeviationBounds     StdDeviationBounds `json:"std_deviation_bounds"`
+}
+
+type StdDeviationBounds struct {
+	Upper           *float64 `json:"upper"`
+	Lower           *float64 `json:"lower"`
+	UpperPopulation *float64 `json:"upper_population"`
+	LowerPopulation *float64 `json:"lower_population"`
+	UpperSampling   *float64 `json:"upper_sampling"`
+	LowerSampling   *float64 `json:"lower_sampling"`
+}
+
+func (m *ExtendedStatsAggregation) set(st metricState) {
+	m.StatsAggregation.set(st)
+	if st.Count == 0 {
+		return
+	}
+	n := float64(st.Count)
+	avg := st.Sum / n
+	// As ES computes it, which is a little more precise than the mean of the
+	// squares less the square of the mean
+	population := math.Max((st.SumOfSquares-st.Sum*st.Sum/n)/n, 0)
+	m.SumOfSquares = finite(st.SumOfSquares)
+	m.Variance, m.VariancePopulation = finite(population), finite(population)
+	m.StdDeviation, m.StdDeviationPopulation = finite(math.Sqrt(population)), finite(math.Sqrt(population))
+	bounds := func(sd float64) (upper, lower *float64) {
+		return finite(avg + m.metric.sigma*sd), finite(avg - m.metric.sigma*sd)
+	}
+	m.StdDeviationBounds.Upper, m.StdDeviationBounds.Lower = bounds(math.Sqrt(population))
+	m.StdDeviationBounds.UpperPopulation, m.StdDeviationBounds.LowerPopulation = bounds(math.Sqrt(population))
+	if st.Count > 1 {
+		sampling := math.Max((st.SumOfSquares-st.Sum*st.Sum/n)/(n-1), 0)
+		m.VarianceSampling, m.StdDeviationSampling = finite(sampling), finite(math.Sqrt(sampling))
+		m.StdDeviationBounds.UpperSampling, m.StdDeviationBounds.LowerSampling = bounds(math.Sqrt(sampling))
+	}
+}
+
+func (m *ExtendedStatsAggregation) SerializeResultset(rows *sqlx.Rows, dbq *dbSubQuery) error {
+	return scanMetric(rows, m)
+}
+
+// As with ES, percentiles are of these percents by default
+var defaultPercents = []float64{1, 5, 25, 50, 75, 95, 99}
+
+// The percents, values, keying and compression of the aggregations computed
+// from a t-digest
+func (m *metric) digestOptions(agg *dsl.Aggregate) error {
+	if agg.MedianAbsoluteDeviation != nil {
+		if c := agg.MedianAbsoluteDeviation.Compression; c != nil {
+			m.compression = *c
+		}
+	} else {
+		p := agg.Percentiles
+		m.percents = defaultPercents
+		if p == nil {
+			p = agg.PercentileRanks
+			if len(p.Values) == 0 {
+				return &QueryError{Reason: fmt.Sprintf("[values] must not be null or empty: [%s]", m.label)}
+			}
+			m.percents = p.Values
+		} else if p.Percents != nil {
+			if len(p.Percents) == 0 {
+				return &QueryError{Reason: fmt.Sprintf("[percents] must not be empty: [%s]", m.label)}
+			}
+			for _, pct := range p.Percents {
+				if pct < 0 || pct > 100 {
+					return &QueryError{Reason: fmt.Sprintf("percent must be in [0,100], got [%v]: [%s]", pct, m.label)}
+				}
+			}
+			m.percents = p.Percents
+		}
+		if p.Hdr != nil {
+			return &QueryError{Reason: fmt.Sprintf("[hdr] percentiles are not supported, only [tdigest]: [%s]", m.label)}
+		}
+		m.keyed = p.Keyed == nil || *p.Keyed
+		if p.TDigest != nil && p.TDigest.Compression != nil {
+			m.compression = *p.TDigest.Compression
+		}
+	}
+	if m.compression <= 0 {
+		return &QueryError{Reason: fmt.Sprintf("[compression] must be greater than 0. Found [%v] in [%s]", m.compression, m.label)}
+	}
+	return nil
+}
+
+// The t-digest of the values in a metric's state
+func (m *metric) digest(st metricState) *tdigest {
+	d := newTDigest(m.compression)
+	d.centroids = st.Centroids
+	for _, c := range st.Centroids {
+		d.count += c.Count
+	}
+	if st.Min != nil && st.Max != nil {
+		d.min, d.max = *st.Min, *st.Max
+	}
+	return d
+}
+
+// The percentiles or percentile ranks of a field, keyed by the percent or value
+// they are for, in the order they were asked for
+type MetricMultipleAggregation struct {
+	Values []percentileValue
+	metric *metric
+}
+
+type percentileValue struct {
+	Key           float64  `json:"key"`
+	Value         *float64 `json:"value"`
+	ValueAsString string   `json:"value_as_string,omitempty"`
+}
+
+func (m *MetricMultipleAggregation) set(st metricState) {
+	d := m.metric.digest(st)
+	m.Values = make([]percentileValue, len(m.metric.percents))
+	for i, pct := range m.metric.percents {
+		pv := percentileValue{Key: pct}
+		if st.Count > 0 {
+			if m.metric.typ == "percentile_ranks" {
+				pv.Value = finite(d.cdf(pct) * 100)
+			} else {
+				pv.Value = finite(d.quantile(pct / 100))
+				pv.ValueAsString = m.metric.asString(pv.Value)
+			}
+		}
+		m.Values[i] = pv
+	}
+}
+
+func (m *MetricMultipleAggregation) SerializeResultset(rows *sqlx.Rows, dbq *dbSubQuery) error {
+	return scanMetric(rows, m)
+}
+
+// Keyed, the values are an object from the percent as java prints it, eg. 99.0,
+// to the value, along with its value as a string for dates
+func (m *MetricMultipleAggregation) MarshalJSON() ([]byte, error) {
+	if !m.metric.keyed {
+		return json.Marshal(struct {
+			Values []percentileValue `json:"values"`
+		}{m.Values})
+	}
+	buf := bytes.NewBufferString(`{"values":{`)
+	for i, pv := range m.Values {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key := javaDouble(pv.Key)
+		k, _ := json.Marshal(key)
+		v, _ := json.Marshal(pv.Value)
+		fmt.Fprintf(buf, "%s:%s", k, v)
+		if pv.ValueAsString != "" {
+			k, _ = json.Marshal(key + "_as_string")
+			s, _ := json.Marshal(pv.ValueAsString)
+			fmt.Fprintf(buf, ",%s:%s", k, s)
+		}
+	}
+	buf.WriteString("}}")
+	return buf.Bytes(), nil
+}
+
+// The values in the json of a field: each element of an array, as a number, or
+// as itself when anything is counted
+func metricValues(raw interface{}, values string) []interface{} {
+	s, ok := raw.(string)
+	if !ok {
+		return nil
+	}
+	var v interface{}
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil
+	}
+	elems, ok := v.([]interface{})
+	if !ok {
+		elems = []interface{}{v}
+	}
+	out := make([]interface{}, 0, len(elems))
+	for _, e := range elems {
+		if e == nil {
+			continue
+		}
+		if values == metricAny {
+			if _, ok := e.(map[string]interface{}); !ok {
+				out = append(out, e)
+			}
+			continue
+		}
+		if f, ok := metricNumber(e, values); ok {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// A value as a number. Numeric strings are numbers, as ES coerces them, and for
+// dates strings are parsed as such
+func metricNumber(v interface{}, values string) (float64, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	case string:
+		if values == metricDates {
+			t, err := date.Parse(date.DefaultFormat, n, time.UTC, false)
+			return float64(t.UnixMilli()), err == nil
+		}
+		f, err := strconv.ParseFloat(strings.TrimSpace(n), 64)
+		return f, err == nil && !math.IsNaN(f) && !math.IsInf(f, 0)
+	}
+	return 0, false
+}
+
+// metric_stats(value, values) counts the values of a field and adds them up
+type statsAggregator struct {
+	st metricState
+}
+
+func newStatsAggregator() *statsAggregator {
+	return &statsAggregator{}
+}
+
+func (a *statsAggregator) Step(raw interface{}, values string) {
+	for _, v := range metricValues(raw, values) {
+		a.st.Count++
+		f, ok := v.(float64)
+		if !ok {
+			continue
+		}
+		if a.st.Min == nil || f < *a.st.Min {
+			a.st.Min = &f
+		}
+		if a.st.Max == nil || f > *a.st.Max {
+			a.st.Max = &f
+		}
+		a.st.Sum += f
+		a.st.SumOfSquares += f * f
+	}
+}
+
+func (a *statsAggregator) Done() (string, error) {
+	b, err := json.Marshal(a.st)
+	return string(b), err
+}
+
+// metric_weighted_avg(value, weight, values) weighs each value by the single
+// weight of its document
+type weightedAvgAggregator struct {
+	st metricState
+}
+
+func newWeightedAvgAggregator() *weightedAvgAggregator {
+	return &weightedAvgAggregator{}
+}
+
+func (a *weightedAvgAggregator) Step(raw interface{}, rawWeight interface{}, values string) error {
+	weights := metricValues(rawWeight, metricNumbers)
+	if len(weights) > 1 {
+		return fmt.Errorf("Encountered more than one weight for a single document. Use a script to combine multiple weights-per-doc into a single value.")
+	}
+	for _, v := range metricValues(raw, values) {
+		if len(weights) == 0 {
+			continue
+		}
+		w := weights[0].(float64)
+		a.st.Count++
+		a.st.Sum += v.(float64) * w
+		a.st.Weight += w
+	}
+	return nil
+}
+
+func (a *weightedAvgAggregator) Done() (string, error) {
+	b, err := json.Marshal(a.st)
+	return string(b), err
+}
+
+// metric_digest(value, values, compression) summarizes the values of a field in a
+// t-digest, along with their count and bounds
+type digestAggregator struct {
+	digest *tdigest
+	st     metricState
+}
+
+func newDigestAggregator() *digestAggregator {
+	return &digestAggregator{}
+}
+
+func (a *digestAggregator) Step(raw interface{}, values string, compression float64) {
+	if a.digest == nil {
+		a.digest = newTDigest(compression)
+	}
+	for _, v := range metricValues(raw, values) {
+		f := v.(float64)
+		a.digest.add(f, 1)
+		a.st.Count++
+		if a.st.Min == nil || f < *a.st.Min {
+			a.st.Min = &f
+		}
+		if a.st.Max == nil || f > *a.st.Max {
+			a.st.Max = &f
+		}
+	}
+}
+
+func (a *digestAggregator) Done() (string, error) {
+	if a.digest != nil {
+		a.st.Centroids = a.digest.summary()
+	}
+	b, err := json.Marshal(a.st)
+	return string(b), err
+}
+
+// As with ES, counts are exact up to 3000 distinct values by default, and no
+// more than 40000
+const (
+	defaultPrecisionThreshold = 3000
+	maxPrecisionThreshold     = 40000
+)
+
+// metric_cardinality(value, precision_threshold) counts the distinct values of a
+// field. As HyperLogLog++ does, it keeps the hashes of the values while there
+// are few enough of them, and estimates the count from a HyperLogLog sketch of
+// the hashes once there are more than the threshold
+type cardinalityAggregator struct {
+	hashes    map[uint64]struct{}
+	registers []uint8
+	precision uint
+}
+
+func newCardinalityAggregator() *cardinalityAggregator {
+	return &cardinalityAggregator{hashes: make(map[uint64]struct{})}
+}
+
+func (a *cardinalityAggregator) Step(raw interface{}, threshold int) {
+	if threshold > maxPrecisionThreshold {
+		threshold = maxPrecisionThreshold
+	}
+	for _, v := range metricValues(raw, metricAny) {
+		h := hashValue(v)
+		if a.registers != nil {
+			a.add(h)
+			continue
+		}
+		a.hashes[h] = struct{}{}
+		if len(a.hashes) > threshold {
+			// Enough registers to estimate within a few percent of the threshold
+			a.precision = uint(bits.Len(uint(threshold))) + 2
+			if a.precision < 4 {
+				a.precision = 4
+			} else if a.precision > 18 {
+				a.precision = 18
+			}
+			a.registers = make([]uint8, 1<<a.precision)
+			for h := range a.hashes {
+				a.add(h)
+			}
+			a.hashes = nil
+		}
+	}
+}
+
+func (a *cardinalityAggregator) add(h uint64) {
+	idx := h >> (64 - a.precision)
+	rank := uint8(bits.LeadingZeros64(h<<a.precision|1<<(a.precision-1)) + 1)
+	if rank > a.registers[idx] {
+		a.registers[idx] = rank
+	}
+}
+
+func (a *cardinalityAggregator) Done() (string, error) {
+	st := metricState{Cardinality: int64(len(a.hashes))}
+	if a.registers != nil {
+		st.Cardinality = a.estimate()
+	}
+	b, err := json.Marshal(st)
+	return string(b), err
+}
+
+func (a *cardinalityAggregator) estimate() int64 {
+	m := float64(len(a.registers))
+	sum, zeros := 0.0, 0
+	for _, r := range a.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	alpha := 0.7213 / (1 + 1.079/m)
+	estimate := alpha * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		// Linear counting is more accurate for small counts
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int64(math.Round(estimate))
+}
+
+// A 64 bit hash of a value, where numbers that are equal hash the same however
+// they were written
+func hashValue(v interface{}) uint64 {
+	h := fnv.New64a()
+	switch n := v.(type) {
+	case json.Number:
+		if f, err := n.Float64(); err == nil {
+			fmt.Fprintf(h, "n%v", f)
+			break
+		}
+		fmt.Fprintf(h, "s%s", n)
+	case string:
+		fmt.Fprintf(h, "s%s", n)
+	default:
+		fmt.Fprintf(h, "o%v", n)
+	}
+	// fnv doesn't spread its bits well enough for the registers, so finish it as
+	// splitmix64 does
+	x := h.Sum64()
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
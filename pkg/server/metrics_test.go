@@ -0,0 +1,154 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+
+	require "github.com/alecthomas/assert/v2"
+)
+
+func TestMetricAggregations(t *testing.T) {
+	rec := doRequest(http.MethodPut, "/_template/metrics", `{
+		"index_patterns": "metrics-*",
+		"mappings": {"properties": {"ts": {"type": "date"}}}
+	}`)
+	require.Equal(t, rec.Code, http.StatusOK, rec.Body.String())
+	bulkRequest(t, "/metrics-000001/_bulk", `
+{"index": {}}
+{"price": 2, "grade": 80, "weight": 1, "tags": ["a", "b"], "ts": "2022-11-11T13:00:00Z", "host": "one"}
+{"index": {}}
+{"price": 4, "grade": 90, "weight": 3, "tags": ["b"], "ts": "2022-11-12T13:00:00Z", "host": "two"}
+{"index": {}}
+{"price": [6, "8"], "grade": 100, "tags": "c", "host": "one"}
+{"index": {}}
+{"price": "free", "host": null}
+`)
+	metric := func(agg string) string {
+		t.Helper()
+		return aggregationResult(t, "metrics-000001", `{"a": `+agg+`}`)
+	}
+
+	require.Equal(t, metric(`{"min": {"field": "price"}}`), `{"value":2}`)
+	require.Equal(t, metric(`{"max": {"field": "price"}}`), `{"value":8}`)
+	require.Equal(t, metric(`{"sum": {"field": "price"}}`), `{"value":20}`)
+	require.Equal(t, metric(`{"avg": {"field": "price"}}`), `{"value":5}`)
+	require.Equal(t, metric(`{"value_count": {"field": "price"}}`), `{"value":5}`)
+	require.Equal(t, metric(`{"value_count": {"field": "tags"}}`), `{"value":4}`)
+	require.Equal(t, metric(`{"cardinality": {"field": "tags"}}`), `{"value":3}`)
+	require.Equal(t, metric(`{"cardinality": {"field": "host"}}`), `{"value":2}`)
+
+	// Nothing to aggregate
+	require.Equal(t, metric(`{"min": {"field": "nothing"}}`), `{"value":null}`)
+	require.Equal(t, metric(`{"avg": {"field": "nothing"}}`), `{"value":null}`)
+	require.Equal(t, metric(`{"sum": {"field": "nothing"}}`), `{"value":0}`)
+	require.Equal(t, metric(`{"value_count": {"field": "nothing"}}`), `{"value":0}`)
+
+	// Documents without a value take the missing one
+	require.Equal(t, metric(`{"avg": {"field": "grade", "missing": 30}}`), `{"value":75}`)
+	require.Equal(t, metric(`{"min": {"field": "grade", "missing": "10"}}`), `{"value":10}`)
+	require.Equal(t, metric(`{"cardinality": {"field": "host", "missing": "none"}}`), `{"value":3}`)
+
+	require.Equal(t, metric(`{"max": {"field": "ts"}}`), `{"value":1668258000000,"value_as_string":"2022-11-12T13:00:00.000Z"}`)
+	require.Equal(t, metric(`{"min": {"field": "ts", "format": "yyyy-MM-dd"}}`), `{"value":1668171600000,"value_as_string":"2022-11-11"}`)
+
+	require.Equal(t, metric(`{"stats": {"field": "price"}}`), `{"count":4,"min":2,"max":8,"avg":5,"sum":20}`)
+	require.Equal(t, metric(`{"stats": {"field": "nothing"}}`), `{"count":0,"min":null,"max":null,"avg":null,"sum":0}`)
+	require.Equal(t, metric(`{"extended_stats": {"field": "grade"}}`),
+		`{"count":3,"min":80,"max":100,"avg":90,"sum":270,"sum_of_squares":24500,`+
+			`"variance":66.66666666666667,"variance_population":66.66666666666667,"variance_sampling":100,`+
+			`"std_deviation":8.16496580927726,"std_deviation_population":8.16496580927726,"std_deviation_sampling":10,`+
+			`"std_deviation_bounds":{"upper":106.32993161855453,"lower":73.67006838144547,"upper_population":106.32993161855453,"lower_population":73.67006838144547,"upper_sampling":110,"lower_sampling":70}}`)
+	require.True(t, strings.Contains(metric(`{"extended_stats": {"field": "grade", "sigma": 1}}`), `"upper_sampling":100,"lower_sampling":80`))
+	require.True(t, strings.Contains(metric(`{"extended_stats": {"field": "nothing"}}`), `"variance":null`))
+
+	require.Equal(t, metric(`{"weighted_avg": {"value": {"field": "grade"}, "weight": {"field": "weight"}}}`), `{"value":87.5}`)
+	require.Equal(t, metric(`{"weighted_avg": {"value": {"field": "grade"}, "weight": {"field": "weight", "missing": 1}}}`), `{"value":90}`)
+
+	// Metrics within buckets are keyed by their name
+	require.Equal(t, metric(`{"range": {"field": "grade", "ranges": [{"to": 95}]}, "aggregations": {"total": {"sum": {"field": "price"}}, "s": {"stats": {"field": "weight"}}}}`),
+		`{"buckets":[{"key":"*-95.0","to":95,"doc_count":2,"s":{"count":2,"min":1,"max":3,"avg":2,"sum":4},"total":{"value":6}}]}`)
+
+	for _, agg := range []string{
+		`{"extended_stats": {"field": "grade", "sigma": -1}}`,
+		`{"cardinality": {"field": "host", "precision_threshold": -1}}`,
+		`{"max": {"field": "ts", "format": "yyyy-qq"}}`,
+		`{"weighted_avg": {"value": {"field": "grade"}, "weight": {"field": "price"}}}`,
+	} {
+		rec := doRequest(http.MethodPost, "/metrics-000001/_search", `{"size": 0, "aggs": {"a": `+agg+`}}`)
+		require.True(t, rec.Code >= http.StatusBadRequest, agg)
+	}
+}
+
+func TestCardinalityEstimate(t *testing.T) {
+	for _, n := range []int{100, 5000, 100000} {
+		a := newCardinalityAggregator()
+		for i := 0; i < n; i++ {
+			a.Step(fmt.Sprintf(`"value-%d"`, i), 1000)
+			// Repeated values count once
+			a.Step(fmt.Sprintf(`%d`, i%10), 1000)
+		}
+		st, err := a.Done()
+		require.NoError(t, err)
+		count, _ := parseMetricState(st)
+		want := float64(n + 10)
+		if n <= 1000 {
+			require.Equal(t, count.Cardinality, int64(want))
+		} else {
+			require.True(t, math.Abs(float64(count.Cardinality)-want)/want < 0.05, fmt.Sprint(n, count.Cardinality))
+		}
+	}
+}
+
+func TestPercentiles(t *testing.T) {
+	docs := strings.Builder{}
+	for i := 1; i <= 100; i++ {
+		fmt.Fprintf(&docs, "{\"index\": {}}\n{\"duration\": %d, \"ts\": %d}\n", i, 1668173400000+i*1000)
+	}
+	rec := doRequest(http.MethodPut, "/_template/percentiles", `{
+		"index_patterns": "pct-*",
+		"mappings": {"properties": {"ts": {"type": "date"}}}
+	}`)
+	require.Equal(t, rec.Code, http.StatusOK, rec.Body.String())
+	bulkRequest(t, "/pct-000001/_bulk", docs.String())
+	metric := func(agg string) string {
+		t.Helper()
+		return aggregationResult(t, "pct-000001", `{"a": `+agg+`}`)
+	}
+
+	require.Equal(t, metric(`{"percentiles": {"field": "duration"}}`),
+		`{"values":{"1.0":1.5,"5.0":5.5,"25.0":25.5,"50.0":50.5,"75.0":75.5,"95.0":95.5,"99.0":99.5}}`)
+	require.Equal(t, metric(`{"percentiles": {"field": "duration", "percents": [99.9, 0], "keyed": false}}`),
+		`{"values":[{"key":99.9,"value":100},{"key":0,"value":1}]}`)
+	require.Equal(t, metric(`{"percentiles": {"field": "ts", "percents": [50], "format": "epoch_second"}}`),
+		`{"values":{"50.0":1668173450500,"50.0_as_string":"1668173450.5"}}`)
+	require.Equal(t, metric(`{"percentiles": {"field": "nothing", "percents": [50]}}`), `{"values":{"50.0":null}}`)
+	require.Equal(t, metric(`{"percentiles": {"field": "duration", "percents": [50], "tdigest": {"compression": 10}}}`),
+		`{"values":{"50.0":50.5}}`)
+
+	require.Equal(t, metric(`{"percentile_ranks": {"field": "duration", "values": [10, 1000, 0.5]}}`),
+		`{"values":{"10.0":9.5,"1000.0":100,"0.5":0}}`)
+	require.Equal(t, metric(`{"percentile_ranks": {"field": "duration", "values": [50], "keyed": false}}`),
+		`{"values":[{"key":50,"value":49.5}]}`)
+
+	require.Equal(t, metric(`{"median_absolute_deviation": {"field": "duration"}}`), `{"value":25}`)
+	require.Equal(t, metric(`{"median_absolute_deviation": {"field": "nothing"}}`), `{"value":null}`)
+
+	// Within buckets
+	require.Equal(t, metric(`{"range": {"field": "duration", "ranges": [{"to": 11}]}, "aggregations": {"p": {"percentiles": {"field": "duration", "percents": [50]}}}}`),
+		`{"buckets":[{"key":"*-11.0","to":11,"doc_count":10,"p":{"values":{"50.0":5.5}}}]}`)
+
+	for _, agg := range []string{
+		`{"percentiles": {"field": "duration", "percents": [101]}}`,
+		`{"percentiles": {"field": "duration", "percents": []}}`,
+		`{"percentiles": {"field": "duration", "hdr": {"number_of_significant_value_digits": 3}}}`,
+		`{"percentiles": {"field": "duration", "tdigest": {"compression": -1}}}`,
+		`{"percentile_ranks": {"field": "duration"}}`,
+		`{"median_absolute_deviation": {"field": "duration", "compression": 0}}`,
+	} {
+		rec := doRequest(http.MethodPost, "/pct-000001/_search", `{"size": 0, "aggs": {"a": `+agg+`}}`)
+		require.Equal(t, rec.Code, http.StatusBadRequest, agg)
+	}
+}
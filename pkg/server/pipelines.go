@@ -0,0 +1,768 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/atomic77/gopensearch/pkg/date"
+	"github.com/atomic77/gopensearch/pkg/dsl"
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+
+Pipeline aggregations compute their values from those of other aggregations once
+these have run, rather than from documents. Parent pipelines, such as derivative
+or bucket_script, add a value to each of the buckets of the aggregation they are
+in, or select and sort them. Sibling pipelines, such as avg_bucket, compute one
+value over the buckets of an aggregation next to them, at the top level or within
+each bucket of their parent.
+
+https://www.elastic.co/guide/en/elasticsearch/reference/7.17/search-aggregations-pipeline.html
+
+*/
+
+// The value of a pipeline aggregation, which is null when it isn't a number
+type PipelineValueAggregation struct {
+	Value         *float64 `json:"value"`
+	ValueAsString string   `json:"value_as_string,omitempty"`
+	// Of a derivative with a unit, its value per unit of the keys
+	NormalizedValue *float64 `json:"normalized_value,omitempty"`
+}
+
+func (m PipelineValueAggregation) GetAggregateCategory() dsl.AggregationCategory {
+	return dsl.Pipeline
+}
+
+// Pipelines are computed from other aggregations, not from rows
+func (m *PipelineValueAggregation) SerializeResultset(rows *sqlx.Rows, dbq *dbSubQuery) error {
+	return nil
+}
+
+// Of a max_bucket or min_bucket, the keys of the buckets with the value
+type BucketKeysAggregation struct {
+	PipelineValueAggregation
+	Keys []string `json:"keys"`
+}
+
+// One of the elements of a buckets_path: the name of an aggregation, _count or
+// _key, and the key of one of its buckets, or of a value of a multi-value metric,
+// eg. sale_type['hat']>sales or load_time.99
+type pathElem struct {
+	name string
+	key  string
+}
+
+type pipelineSort struct {
+	path []pathElem
+	desc bool
+}
+
+type pipeline struct {
+	label string
+	typ   string
+	// By the names of the params of a bucket_script or bucket_selector, or as
+	// _value the one path of the others
+	paths     map[string][]pathElem
+	gapPolicy string
+	format    string
+	// The millis of the unit of a derivative
+	unit          float64
+	window, shift int
+	lag           int
+	script        *script
+	params        map[string]interface{}
+	sort          []pipelineSort
+	from, size    int
+}
+
+// The lengths of calendar units, as ES estimates them for derivatives
+var derivativeUnits = map[string]time.Duration{
+	"second": time.Second, "minute": time.Minute, "hour": time.Hour, "day": 24 * time.Hour,
+	"week": 7 * 24 * time.Hour, "1w": 7 * 24 * time.Hour,
+	"month": 2629746 * time.Second, "1M": 2629746 * time.Second,
+	"quarter": 7889238 * time.Second, "1q": 7889238 * time.Second,
+	"year": 31556952 * time.Second, "1y": 31556952 * time.Second,
+}
+
+func newPipeline(label string, agg *dsl.Aggregate) (*pipeline, error) {
+	p := &pipeline{label: label, size: -1}
+	paths := dsl.BucketsPath{}
+	field := func(typ string, f *dsl.PipelineField) {
+		p.typ, p.gapPolicy, p.format = typ, f.GapPolicy, f.Format
+		paths["_value"] = f.BucketsPath
+	}
+	switch {
+	case agg.Derivative != nil:
+		field("derivative", &agg.Derivative.PipelineField)
+		if unit := agg.Derivative.Unit; unit != "" {
+			d, ok := derivativeUnits[unit]
+			if !ok {
+				var err error
+				if d, err = date.ParseDuration(unit); err != nil || d <= 0 {
+					return nil, &QueryError{Reason: fmt.Sprintf("failed to parse [unit] of derivative [%s] with value [%s]", label, unit)}
+				}
+			}
+			p.unit = float64(d.Milliseconds())
+		}
+	case agg.CumulativeSum != nil:
+		field("cumulative_sum", agg.CumulativeSum)
+		// Gaps add nothing to the sum
+		p.gapPolicy = "insert_zeros"
+	case agg.MovingFn != nil:
+		field("moving_fn", &agg.MovingFn.PipelineField)
+		if agg.MovingFn.Window == nil || *agg.MovingFn.Window <= 0 {
+			return nil, &QueryError{Reason: "[window] must be a positive, non-zero integer."}
+		}
+		p.window, p.shift = *agg.MovingFn.Window, agg.MovingFn.Shift
+		p.params = agg.MovingFn.Script.Params
+		var err error
+		if p.script, err = compileScript(agg.MovingFn.Script.Source); err != nil {
+			return nil, err
+		}
+	case agg.SerialDiff != nil:
+		field("serial_diff", &agg.SerialDiff.PipelineField)
+		p.lag = 1
+		if agg.SerialDiff.Lag != nil {
+			if p.lag = *agg.SerialDiff.Lag; p.lag <= 0 {
+				return nil, &QueryError{Reason: "[lag] must be a positive integer: [" + label + "]"}
+			}
+		}
+	case agg.AvgBucket != nil:
+		field("avg_bucket", agg.AvgBucket)
+	case agg.MaxBucket != nil:
+		field("max_bucket", agg.MaxBucket)
+	case agg.MinBucket != nil:
+		field("min_bucket", agg.MinBucket)
+	case agg.SumBucket != nil:
+		field("sum_bucket", agg.SumBucket)
+	case agg.StatsBucket != nil:
+		field("stats_bucket", agg.StatsBucket)
+	case agg.BucketScript != nil || agg.BucketSelector != nil:
+		bs := agg.BucketScript
+		p.typ = "bucket_script"
+		if bs == nil {
+			bs, p.typ = agg.BucketSelector, "bucket_selector"
+		}
+		p.gapPolicy, p.format, p.params = bs.GapPolicy, bs.Format, bs.Script.Params
+		if len(bs.BucketsPath) == 0 {
+			return nil, &QueryError{Reason: "[buckets_path] must not be null: [" + label + "]"}
+		}
+		paths = bs.BucketsPath
+		var err error
+		if p.script, err = compileScript(bs.Script.Source); err != nil {
+			return nil, err
+		}
+	case agg.BucketSort != nil:
+		bs := agg.BucketSort
+		p.typ, p.gapPolicy, p.from = "bucket_sort", bs.GapPolicy, bs.From
+		if bs.From < 0 {
+			return nil, &QueryError{Reason: "[from] must be a non-negative integer: [" + strconv.Itoa(bs.From) + "]"}
+		}
+		if bs.Size != nil {
+			if p.size = *bs.Size; p.size <= 0 {
+				return nil, &QueryError{Reason: "[size] must be a positive integer: [" + strconv.Itoa(p.size) + "]"}
+			}
+		}
+		for _, s := range bs.Sort {
+			elems, err := parseBucketsPath(s.Key)
+			if err != nil {
+				return nil, err
+			}
+			switch s.Direction {
+			case "", "asc", "desc":
+			default:
+				return nil, &QueryError{Reason: "Unknown SortOrder [" + s.Direction + "]"}
+			}
+			p.sort = append(p.sort, pipelineSort{path: elems, desc: s.Direction == "desc"})
+		}
+	}
+
+	switch p.gapPolicy {
+	case "":
+		p.gapPolicy = "skip"
+	case "skip", "insert_zeros", "keep_values":
+	default:
+		return nil, &QueryError{Reason: fmt.Sprintf("Invalid gap policy: [%s], accepted values: [skip, insert_zeros, keep_values]", p.gapPolicy)}
+	}
+	p.paths = make(map[string][]pathElem, len(paths))
+	for name, path := range paths {
+		if path == "" {
+			return nil, &QueryError{Reason: "[buckets_path] must not be null: [" + label + "]"}
+		}
+		elems, err := parseBucketsPath(path)
+		if err != nil {
+			return nil, err
+		}
+		p.paths[name] = elems
+	}
+	return p, nil
+}
+
+func parseBucketsPath(path string) ([]pathElem, error) {
+	parts := strings.Split(path, ">")
+	elems := make([]pathElem, 0, len(parts))
+	for i, part := range parts {
+		e := pathElem{name: part}
+		if j := strings.IndexByte(part, '['); j >= 0 {
+			if !strings.HasSuffix(part, "]") {
+				return nil, &QueryError{Reason: fmt.Sprintf("Invalid path element [%s] in path [%s]", part, path)}
+			}
+			e.name, e.key = part[:j], strings.Trim(part[j+1:len(part)-1], `'"`)
+		} else if j := strings.IndexByte(part, '.'); j >= 0 && i == len(parts)-1 {
+			// Only the last element can be a metric
+			e.name, e.key = part[:j], part[j+1:]
+		}
+		if e.name == "" {
+			return nil, &QueryError{Reason: fmt.Sprintf("Invalid path element [%s] in path [%s]", part, path)}
+		}
+		elems = append(elems, e)
+	}
+	return elems, nil
+}
+
+// Parent pipelines work on the buckets of their parent, siblings on those of the
+// aggregation next to them their path starts with
+func (p *pipeline) parentType() bool {
+	switch p.typ {
+	case "avg_bucket", "max_bucket", "min_bucket", "sum_bucket", "stats_bucket":
+		return false
+	}
+	return true
+}
+
+func (p *pipeline) histogramParent() bool {
+	switch p.typ {
+	case "derivative", "cumulative_sum", "moving_fn", "serial_diff":
+		return true
+	}
+	return false
+}
+
+// The pipelines among aggregations, which are those of a parent aggregation or at
+// the top level, checked against their siblings and sorted so that those that
+// take values from others come after them
+func newPipelines(parent *dsl.Aggregate, aggs map[string]dsl.Aggregate) ([]*pipeline, error) {
+	pending := make(map[string]*pipeline)
+	for label, a := range aggs {
+		a := a
+		if a.GenAggregationCategory() != dsl.Pipeline {
+			continue
+		}
+		p, err := newPipeline(label, &a)
+		if err != nil {
+			return nil, err
+		}
+		if len(a.Aggs) > 0 {
+			return nil, &QueryError{Reason: fmt.Sprintf("Aggregator [%s] of type [%s] cannot accept sub-aggregations", label, p.typ)}
+		}
+		if p.histogramParent() && (parent == nil ||
+			parent.Histogram == nil && parent.DateHistogram == nil && parent.AutoDateHistogram == nil) {
+			return nil, &QueryError{Reason: fmt.Sprintf(
+				"%s aggregation [%s] must have a histogram, date_histogram or auto_date_histogram as parent", p.typ, label)}
+		}
+		if p.parentType() && (parent == nil || parent.GenAggregationCategory() != dsl.Bucket) {
+			return nil, &QueryError{Reason: fmt.Sprintf("%s aggregation [%s] must be declared inside of another aggregation", p.typ, label)}
+		}
+		if p.parentType() && (parent.Filter != nil || parent.Missing != nil || parent.Global != nil) {
+			return nil, &QueryError{Reason: fmt.Sprintf("%s aggregation [%s] must be declared inside of a multi-bucket aggregation", p.typ, label)}
+		}
+		paths := make([][]pathElem, 0, len(p.paths)+len(p.sort))
+		for _, elems := range p.paths {
+			paths = append(paths, elems)
+		}
+		for _, s := range p.sort {
+			paths = append(paths, s.path)
+		}
+		for _, elems := range paths {
+			first := elems[0].name
+			if p.parentType() && (first == "_count" || first == "_key") {
+				continue
+			}
+			sibling, ok := aggs[first]
+			if !ok {
+				return nil, &QueryError{Reason: fmt.Sprintf("No aggregation found for path [%s] of [%s]", first, label)}
+			}
+			if !p.parentType() && (sibling.GenAggregationCategory() != dsl.Bucket || len(elems) < 2) {
+				return nil, &QueryError{Reason: fmt.Sprintf(
+					"The first aggregation in buckets_path must be a multi-bucket aggregation for aggregation [%s]; found [%s]", label, first)}
+			}
+		}
+		pending[label] = p
+	}
+
+	labels := make([]string, 0, len(pending))
+	for label := range pending {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	ordered := make([]*pipeline, 0, len(pending))
+	for len(pending) > 0 {
+		progressed := false
+		for _, label := range labels {
+			p, ok := pending[label]
+			if !ok || p.dependsOn(pending) {
+				continue
+			}
+			ordered = append(ordered, p)
+			delete(pending, label)
+			progressed = true
+		}
+		if !progressed {
+			return nil, &QueryError{Reason: "Cyclic buckets_path among the pipeline aggregations [" + strings.Join(labels, ", ") + "]"}
+		}
+	}
+	return ordered, nil
+}
+
+func (p *pipeline) dependsOn(pending map[string]*pipeline) bool {
+	for _, elems := range p.paths {
+		if _, ok := pending[elems[0].name]; ok {
+			return true
+		}
+	}
+	for _, s := range p.sort {
+		if _, ok := pending[s.path[0].name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply the pipelines of a bucket aggregation once its buckets and their
+// sub-aggregations are known
+func applyPipelines(pipelines []*pipeline, parent bucketsAggregation) error {
+	for _, p := range pipelines {
+		if p.parentType() {
+			if err := p.applyToParent(parent); err != nil {
+				return err
+			}
+			continue
+		}
+		buckets := parent.buckets()
+		for i := range buckets {
+			b := &buckets[i]
+			r, err := p.siblingResult(b.subaggregates[p.paths["_value"][0].name])
+			if err != nil {
+				return err
+			}
+			b.subaggregates[p.label] = r
+		}
+	}
+	return nil
+}
+
+// Apply the pipelines at the top level, which can only be siblings
+func applyTopLevelPipelines(pipelines []*pipeline, aggs map[string]Aggregation) error {
+	for _, p := range pipelines {
+		r, err := p.siblingResult(aggs[p.paths["_value"][0].name])
+		if err != nil {
+			return err
+		}
+		aggs[p.label] = r
+	}
+	return nil
+}
+
+// The value that a path resolves to within a bucket, where gaps are buckets
+// without documents, or without a value, and are NaN unless the gap policy fills
+// them
+func (p *pipeline) bucketValue(b *Bucket, elems []pathElem) (float64, error) {
+	v, err := resolveBucketsPath(b, elems)
+	if err != nil {
+		return 0, err
+	}
+	count := len(elems) == 1 && elems[0].name == "_count"
+	if math.IsNaN(v) || math.IsInf(v, 0) || (b.DocCount == 0 && !count) {
+		switch {
+		case p.gapPolicy == "insert_zeros":
+			return 0, nil
+		case p.gapPolicy == "keep_values" && !math.IsNaN(v) && !math.IsInf(v, 0):
+			return v, nil
+		}
+		return math.NaN(), nil
+	}
+	return v, nil
+}
+
+func resolveBucketsPath(b *Bucket, elems []pathElem) (float64, error) {
+	e := elems[0]
+	switch e.name {
+	case "_count":
+		return float64(b.DocCount), nil
+	case "_key":
+		if k, ok := termsKeyNumber(b.Key); ok {
+			return k, nil
+		}
+		return math.NaN(), nil
+	}
+	// As with the first bucket of a derivative, which has no value
+	r, ok := b.subaggregates[e.name]
+	if !ok {
+		return math.NaN(), nil
+	}
+	if single, ok := r.(*SingleBucketAggregation); ok {
+		if len(elems) == 1 {
+			return float64(single.bucket[0].DocCount), nil
+		}
+		return resolveBucketsPath(&single.bucket[0], elems[1:])
+	}
+	if multi, ok := r.(bucketsAggregation); ok {
+		buckets := multi.buckets()
+		if e.key == "_bucket_count" {
+			return float64(len(buckets)), nil
+		}
+		if e.key == "" || len(elems) == 1 {
+			return 0, &QueryError{Reason: fmt.Sprintf("buckets_path must select one of the buckets of [%s] and a value of it", e.name)}
+		}
+		for i := range buckets {
+			if bucketKeyString(&buckets[i]) == e.key || fmt.Sprint(buckets[i].Key) == e.key {
+				return resolveBucketsPath(&buckets[i], elems[1:])
+			}
+		}
+		return math.NaN(), nil
+	}
+	if len(elems) > 1 {
+		return 0, &QueryError{Reason: "[" + e.name + "] is not a multi-bucket aggregation"}
+	}
+	v, ok := aggregationValue(r, e.key)
+	if !ok {
+		return math.NaN(), nil
+	}
+	return v, nil
+}
+
+// The key of a bucket as ES shows it in the keys of a max_bucket or min_bucket
+func bucketKeyString(b *Bucket) string {
+	if b.KeyAsString != "" {
+		return b.KeyAsString
+	}
+	if f, ok := b.Key.(float64); ok {
+		// As Java shows doubles
+		if f == math.Trunc(f) && math.Abs(f) < 1e7 {
+			return strconv.FormatFloat(f, 'f', 1, 64)
+		}
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+	return fmt.Sprint(b.Key)
+}
+
+func (p *pipeline) newValue(v float64) *PipelineValueAggregation {
+	r := &PipelineValueAggregation{Value: finite(v)}
+	if r.Value != nil && p.format != "" {
+		r.ValueAsString = decimalFormat(p.format, v)
+	}
+	return r
+}
+
+// A value over the buckets of a sibling aggregation
+func (p *pipeline) siblingResult(sibling interface{}) (Aggregation, error) {
+	elems := p.paths["_value"]
+	multi, ok := sibling.(bucketsAggregation)
+	if !ok {
+		return nil, &QueryError{Reason: fmt.Sprintf(
+			"The first aggregation in buckets_path must be a multi-bucket aggregation for aggregation [%s]; found [%s]", p.label, elems[0].name)}
+	}
+	buckets := multi.buckets()
+	values := make([]float64, 0, len(buckets))
+	keys := make([]string, 0, len(buckets))
+	for i := range buckets {
+		v, err := p.bucketValue(&buckets[i], elems[1:])
+		if err != nil {
+			return nil, err
+		}
+		if !math.IsNaN(v) {
+			values = append(values, v)
+			keys = append(keys, bucketKeyString(&buckets[i]))
+		}
+	}
+
+	st := metricState{Count: int64(len(values))}
+	for _, v := range values {
+		st.Sum += v
+		if st.Min == nil || v < *st.Min {
+			min := v
+			st.Min = &min
+		}
+		if st.Max == nil || v > *st.Max {
+			max := v
+			st.Max = &max
+		}
+	}
+	switch p.typ {
+	case "avg_bucket":
+		return p.newValue(st.Sum / float64(st.Count)), nil
+	case "sum_bucket":
+		return p.newValue(st.Sum), nil
+	case "stats_bucket":
+		r := &StatsAggregation{metric: &metric{label: p.label, typ: "stats"}}
+		r.set(st)
+		return r, nil
+	}
+	extreme := st.Max
+	if p.typ == "min_bucket" {
+		extreme = st.Min
+	}
+	r := &BucketKeysAggregation{Keys: make([]string, 0)}
+	if extreme != nil {
+		r.PipelineValueAggregation = *p.newValue(*extreme)
+		for i, v := range values {
+			if v == *extreme {
+				r.Keys = append(r.Keys, keys[i])
+			}
+		}
+	}
+	return r, nil
+}
+
+// Add a value to each of the buckets of the parent, or select or sort them
+func (p *pipeline) applyToParent(parent bucketsAggregation) error {
+	buckets := parent.buckets()
+	switch p.typ {
+	case "bucket_script":
+		return p.bucketScript(buckets)
+	case "bucket_selector":
+		kept := make([]Bucket, 0, len(buckets))
+		for i := range buckets {
+			params, _, err := p.scriptParams(&buckets[i], false)
+			if err != nil {
+				return err
+			}
+			v, err := p.script.run(&scriptEnv{params: params})
+			if err != nil {
+				return err
+			}
+			keep, ok := v.(bool)
+			if !ok {
+				return &QueryError{Reason: fmt.Sprintf("bucket_selector aggregation [%s] must return a boolean, not [%v]", p.label, v)}
+			}
+			if keep {
+				kept = append(kept, buckets[i])
+			}
+		}
+		parent.setBuckets(kept)
+		return nil
+	case "bucket_sort":
+		return p.bucketSort(parent)
+	}
+
+	values := make([]float64, len(buckets))
+	for i := range buckets {
+		v, err := p.bucketValue(&buckets[i], p.paths["_value"])
+		if err != nil {
+			return err
+		}
+		values[i] = v
+	}
+	switch p.typ {
+	case "derivative":
+		for i := 1; i < len(buckets); i++ {
+			r := p.newValue(values[i] - values[i-1])
+			if p.unit > 0 {
+				x, _ := termsKeyNumber(buckets[i].Key)
+				last, _ := termsKeyNumber(buckets[i-1].Key)
+				r.NormalizedValue = finite((values[i] - values[i-1]) / ((x - last) / p.unit))
+			}
+			buckets[i].subaggregates[p.label] = r
+		}
+	case "cumulative_sum":
+		sum := 0.0
+		for i := range buckets {
+			sum += values[i]
+			buckets[i].subaggregates[p.label] = p.newValue(sum)
+		}
+	case "moving_fn":
+		// The window is over the buckets that have a value, and by default ends
+		// before the current one
+		window := make([]float64, 0, len(values))
+		for _, v := range values {
+			if !math.IsNaN(v) {
+				window = append(window, v)
+			}
+		}
+		clamp := func(i int) int {
+			if i < 0 {
+				return 0
+			} else if i > len(window) {
+				return len(window)
+			}
+			return i
+		}
+		idx := 0
+		for i := range buckets {
+			if math.IsNaN(values[i]) {
+				continue
+			}
+			from, to := clamp(idx-p.window+p.shift), clamp(idx+p.shift)
+			v, err := p.script.run(&scriptEnv{params: p.params, values: window[from:to]})
+			if err != nil {
+				return err
+			}
+			n, err := scriptNumber(v)
+			if err != nil {
+				return &QueryError{Reason: fmt.Sprintf("moving_fn aggregation [%s] must return a number, not [%v]", p.label, v)}
+			}
+			buckets[i].subaggregates[p.label] = p.newValue(n)
+			idx++
+		}
+	case "serial_diff":
+		for i := p.lag; i < len(buckets); i++ {
+			if !math.IsNaN(values[i]) && !math.IsNaN(values[i-p.lag]) {
+				buckets[i].subaggregates[p.label] = p.newValue(values[i] - values[i-p.lag])
+			}
+		}
+	}
+	return nil
+}
+
+// The params of a script in a bucket, with the values of the paths. With the skip
+// gap policy, buckets where any of them is missing can be skipped
+func (p *pipeline) scriptParams(b *Bucket, skipGaps bool) (map[string]interface{}, bool, error) {
+	params := make(map[string]interface{}, len(p.params)+len(p.paths))
+	for k, v := range p.params {
+		params[k] = v
+	}
+	for name, elems := range p.paths {
+		v, err := p.bucketValue(b, elems)
+		if err != nil {
+			return nil, false, err
+		}
+		if skipGaps && p.gapPolicy == "skip" && math.IsNaN(v) {
+			return nil, true, nil
+		}
+		params[name] = v
+	}
+	return params, false, nil
+}
+
+func (p *pipeline) bucketScript(buckets []Bucket) error {
+	for i := range buckets {
+		params, skip, err := p.scriptParams(&buckets[i], true)
+		if err != nil {
+			return err
+		}
+		if skip {
+			continue
+		}
+		v, err := p.script.run(&scriptEnv{params: params})
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			continue
+		}
+		n, err := scriptNumber(v)
+		if err != nil {
+			return &QueryError{Reason: fmt.Sprintf("bucket_script aggregation [%s] must return a Number, not [%v]", p.label, v)}
+		}
+		buckets[i].subaggregates[p.label] = p.newValue(n)
+	}
+	return nil
+}
+
+// Buckets without a value to sort by go last, whichever the order
+func (p *pipeline) bucketSort(parent bucketsAggregation) error {
+	buckets := parent.buckets()
+	values := make([][]float64, len(buckets))
+	for i := range buckets {
+		values[i] = make([]float64, len(p.sort))
+		for j, s := range p.sort {
+			if s.path[0].name == "_key" {
+				continue
+			}
+			v, err := p.bucketValue(&buckets[i], s.path)
+			if err != nil {
+				return err
+			}
+			values[i][j] = v
+		}
+	}
+	idx := make([]int, len(buckets))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(x, y int) bool {
+		a, b := idx[x], idx[y]
+		for j, s := range p.sort {
+			var c int
+			if s.path[0].name == "_key" {
+				c = compareTermsKeys(buckets[a].Key, buckets[b].Key)
+			} else {
+				va, vb := values[a][j], values[b][j]
+				switch {
+				case math.IsNaN(va) && math.IsNaN(vb):
+					continue
+				case math.IsNaN(va):
+					return false
+				case math.IsNaN(vb):
+					return true
+				}
+				c = compareFloats(va, vb)
+			}
+			if s.desc {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+
+	sorted := make([]Bucket, 0, len(buckets))
+	for i := p.from; i < len(idx) && (p.size < 0 || len(sorted) < p.size); i++ {
+		sorted = append(sorted, buckets[idx[i]])
+	}
+	parent.setBuckets(sorted)
+	return nil
+}
+
+// A value as formatted by a java DecimalFormat pattern, such as #,##0.00, as far
+// as its digits and grouping go
+func decimalFormat(pattern string, v float64) string {
+	intPattern, fracPattern := pattern, ""
+	if i := strings.IndexByte(pattern, '.'); i >= 0 {
+		intPattern, fracPattern = pattern[:i], pattern[i+1:]
+	}
+	minFrac := strings.Count(fracPattern, "0")
+	maxFrac := minFrac + strings.Count(fracPattern, "#")
+	s := strconv.FormatFloat(math.Abs(v), 'f', maxFrac, 64)
+	intDigits, frac := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		intDigits, frac = s[:i], s[i+1:]
+	}
+	for len(frac) > minFrac && strings.HasSuffix(frac, "0") {
+		frac = frac[:len(frac)-1]
+	}
+
+	minInt := strings.Count(intPattern, "0")
+	if intDigits == "0" && minInt == 0 && frac != "" {
+		intDigits = ""
+	}
+	for len(intDigits) < minInt {
+		intDigits = "0" + intDigits
+	}
+	if strings.Contains(intPattern, ",") {
+		var grouped strings.Builder
+		for i, d := range intDigits {
+			if i > 0 && (len(intDigits)-i)%3 == 0 {
+				grouped.WriteByte(',')
+			}
+			grouped.WriteRune(d)
+		}
+		intDigits = grouped.String()
+	}
+
+	s = intDigits
+	if frac != "" {
+		s += "." + frac
+	}
+	if v < 0 && strings.Trim(s, "0.,") != "" {
+		s = "-" + s
+	}
+	return s
+}
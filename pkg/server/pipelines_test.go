@@ -0,0 +1,139 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	require "github.com/alecthomas/assert/v2"
+)
+
+func TestPipelineAggregations(t *testing.T) {
+	bulkRequest(t, "/pipelineaggs/_bulk", `
+{"index": {}}
+{"ts": "2022-11-01T10:00:00Z", "sales": 10, "type": "hat"}
+{"index": {}}
+{"ts": "2022-11-01T12:00:00Z", "sales": 20, "type": "bag"}
+{"index": {}}
+{"ts": "2022-11-02T10:00:00Z", "sales": 30, "type": "hat"}
+{"index": {}}
+{"ts": "2022-11-04T10:00:00Z", "sales": 60, "type": "hat"}
+{"index": {}}
+{"ts": "2022-11-04T12:00:00Z", "sales": 15, "type": "bag"}
+`)
+	// What a pipeline adds to each of the days, of which the 3rd is empty
+	perDay := func(pipeline string) []string {
+		t.Helper()
+		var resp struct {
+			Buckets []map[string]json.RawMessage `json:"buckets"`
+		}
+		aggs := `{"a": {"date_histogram": {"field": "ts", "calendar_interval": "day"}, "aggs": {
+			"sales": {"sum": {"field": "sales"}}, "p": ` + pipeline + `}}}`
+		require.NoError(t, json.Unmarshal([]byte(aggregationResult(t, "pipelineaggs", aggs)), &resp))
+		values := make([]string, len(resp.Buckets))
+		for i, b := range resp.Buckets {
+			values[i] = string(b["p"])
+		}
+		return values
+	}
+
+	// Gaps are skipped by default, which leaves no value to take a difference from
+	require.Equal(t, perDay(`{"derivative": {"buckets_path": "sales"}}`),
+		[]string{"", `{"value":0}`, `{"value":null}`, `{"value":null}`})
+	require.Equal(t, perDay(`{"derivative": {"buckets_path": "sales", "gap_policy": "insert_zeros", "unit": "hour"}}`),
+		[]string{"", `{"value":0,"normalized_value":0}`, `{"value":-30,"normalized_value":-1.25}`, `{"value":75,"normalized_value":3.125}`})
+	require.Equal(t, perDay(`{"derivative": {"buckets_path": "_count"}}`),
+		[]string{"", `{"value":-1}`, `{"value":-1}`, `{"value":2}`})
+	require.Equal(t, perDay(`{"cumulative_sum": {"buckets_path": "sales", "format": "#,##0.0"}}`),
+		[]string{`{"value":30,"value_as_string":"30.0"}`, `{"value":60,"value_as_string":"60.0"}`,
+			`{"value":60,"value_as_string":"60.0"}`, `{"value":135,"value_as_string":"135.0"}`})
+	require.Equal(t, perDay(`{"serial_diff": {"buckets_path": "_count", "lag": 2}}`),
+		[]string{"", "", `{"value":-2}`, `{"value":1}`})
+
+	// The window of moving_fn ends before each bucket with a value
+	require.Equal(t, perDay(`{"moving_fn": {"buckets_path": "sales", "window": 2, "script": "MovingFunctions.unweightedAvg(values)"}}`),
+		[]string{`{"value":null}`, `{"value":30}`, "", `{"value":30}`})
+	require.Equal(t, perDay(`{"moving_fn": {"buckets_path": "sales", "window": 2, "shift": 1, "script": {"source": "MovingFunctions.max(values) * params.k", "params": {"k": 2}}}}`),
+		[]string{`{"value":60}`, `{"value":60}`, "", `{"value":150}`})
+
+	require.Equal(t, perDay(`{"bucket_script": {"buckets_path": {"s": "sales", "n": "_count"}, "script": "params.s / params.n"}}`),
+		[]string{`{"value":15}`, `{"value":30}`, "", `{"value":37.5}`})
+	require.Equal(t, perDay(`{"bucket_script": {"buckets_path": {"s": "sales"}, "gap_policy": "insert_zeros", "script": "params.s > 40 ? 1 : 0"}}`),
+		[]string{`{"value":0}`, `{"value":0}`, `{"value":0}`, `{"value":1}`})
+
+	days := func(aggs string) string {
+		t.Helper()
+		return aggregationResult(t, "pipelineaggs", `{"a": {"date_histogram": {"field": "ts", "calendar_interval": "day", "format": "MM-dd"}, "aggs": {
+			"sales": {"sum": {"field": "sales"}}, `+aggs+`}}}`)
+	}
+	require.Equal(t, days(`"busy": {"bucket_selector": {"buckets_path": {"n": "_count"}, "script": "params.n > 1"}}`),
+		`{"buckets":[`+
+			`{"key_as_string":"11-01","key":1667260800000,"doc_count":2,"sales":{"value":30}},`+
+			`{"key_as_string":"11-04","key":1667520000000,"doc_count":2,"sales":{"value":75}}]}`)
+	require.Equal(t, days(`"top": {"bucket_sort": {"sort": [{"sales": {"order": "desc"}}], "size": 2}}`),
+		`{"buckets":[`+
+			`{"key_as_string":"11-04","key":1667520000000,"doc_count":2,"sales":{"value":75}},`+
+			`{"key_as_string":"11-01","key":1667260800000,"doc_count":2,"sales":{"value":30}}]}`)
+	require.Equal(t, days(`"page": {"bucket_sort": {"from": 3}}`),
+		`{"buckets":[{"key_as_string":"11-04","key":1667520000000,"doc_count":2,"sales":{"value":75}}]}`)
+	// Pipelines can take the values of others
+	require.Equal(t, days(`"diff": {"derivative": {"buckets_path": "sales", "gap_policy": "insert_zeros"}},
+		"drops": {"bucket_selector": {"buckets_path": {"d": "diff"}, "gap_policy": "keep_values", "script": "params.d < 0"}}`),
+		`{"buckets":[{"key_as_string":"11-03","key":1667433600000,"doc_count":0,"diff":{"value":-30},"sales":{"value":0}}]}`)
+
+	// Sibling pipelines, at the top level and in each bucket
+	rec := doRequest(http.MethodPost, "/pipelineaggs/_search", `{"size": 0, "aggs": {
+		"days": {"date_histogram": {"field": "ts", "calendar_interval": "day", "format": "yyyy-MM-dd"}, "aggs": {"sales": {"sum": {"field": "sales"}}}},
+		"avg": {"avg_bucket": {"buckets_path": "days>sales"}},
+		"max": {"max_bucket": {"buckets_path": "days>sales"}},
+		"min": {"min_bucket": {"buckets_path": "days>sales"}},
+		"sum": {"sum_bucket": {"buckets_path": "days>sales"}},
+		"stats": {"stats_bucket": {"buckets_path": "days>sales"}},
+		"busiest": {"max_bucket": {"buckets_path": "days>_count"}},
+		"types": {"terms": {"field": "type"}, "aggs": {
+			"days": {"date_histogram": {"field": "ts", "calendar_interval": "day"}},
+			"peak": {"max_bucket": {"buckets_path": "days>_count"}}}}
+	}}`)
+	require.Equal(t, rec.Code, http.StatusOK, rec.Body.String())
+	var resp struct {
+		Aggregations map[string]json.RawMessage `json:"aggregations"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	require.Equal(t, string(resp.Aggregations["avg"]), `{"value":45}`)
+	require.Equal(t, string(resp.Aggregations["max"]), `{"value":75,"keys":["2022-11-04"]}`)
+	require.Equal(t, string(resp.Aggregations["min"]), `{"value":30,"keys":["2022-11-01","2022-11-02"]}`)
+	require.Equal(t, string(resp.Aggregations["sum"]), `{"value":135}`)
+	require.Equal(t, string(resp.Aggregations["stats"]), `{"count":3,"min":30,"max":75,"avg":45,"sum":135}`)
+	require.Equal(t, string(resp.Aggregations["busiest"]), `{"value":2,"keys":["2022-11-01","2022-11-04"]}`)
+	var types struct {
+		Buckets []map[string]json.RawMessage `json:"buckets"`
+	}
+	require.NoError(t, json.Unmarshal(resp.Aggregations["types"], &types))
+	require.Equal(t, string(types.Buckets[0]["peak"]), `{"value":1,"keys":["2022-11-01T00:00:00.000Z","2022-11-02T00:00:00.000Z","2022-11-04T00:00:00.000Z"]}`)
+	require.Equal(t, string(types.Buckets[1]["peak"]), `{"value":1,"keys":["2022-11-01T00:00:00.000Z","2022-11-04T00:00:00.000Z"]}`)
+
+	for _, aggs := range []string{
+		`{"d": {"derivative": {"buckets_path": "_count"}}}`,
+		`{"a": {"terms": {"field": "type"}, "aggs": {"d": {"derivative": {"buckets_path": "_count"}}}}}`,
+		`{"a": {"terms": {"field": "type"}, "aggs": {"d": {"bucket_script": {"buckets_path": {"x": "nothing"}, "script": "params.x"}}}}}`,
+		`{"a": {"terms": {"field": "type"}, "aggs": {"d": {"bucket_script": {"buckets_path": {"x": "_count"}, "script": "params.x +"}}}}}`,
+		`{"a": {"terms": {"field": "type"}, "aggs": {"d": {"bucket_selector": {"buckets_path": {"x": "_count"}, "script": "params.x"}}}}}`,
+		`{"a": {"terms": {"field": "type"}, "aggs": {
+			"x": {"bucket_script": {"buckets_path": {"v": "y"}, "script": "params.v"}},
+			"y": {"bucket_script": {"buckets_path": {"v": "x"}, "script": "params.v"}}}}}`,
+		`{"a": {"avg": {"field": "sales"}}, "m": {"max_bucket": {"buckets_path": "a"}}}`,
+		`{"a": {"histogram": {"field": "sales", "interval": 10}, "aggs": {"d": {"moving_fn": {"buckets_path": "_count", "script": "MovingFunctions.sum(values)"}}}}}`,
+		`{"a": {"histogram": {"field": "sales", "interval": 10}, "aggs": {"d": {"derivative": {"buckets_path": "_count", "gap_policy": "none"}}}}}`,
+	} {
+		rec := doRequest(http.MethodPost, "/pipelineaggs/_search", `{"size": 0, "aggs": `+aggs+`}`)
+		require.Equal(t, rec.Code, http.StatusBadRequest, aggs)
+	}
+}
+
+func TestDecimalFormat(t *testing.T) {
+	require.Equal(t, decimalFormat("#,##0.00", 1234.5), "1,234.50")
+	require.Equal(t, decimalFormat("#.##", 0.5), ".5")
+	require.Equal(t, decimalFormat("#.##", 2.456), "2.46")
+	require.Equal(t, decimalFormat("0", -2.75), "-3")
+	require.Equal(t, decimalFormat("000.0", 7), "007.0")
+}
@@ -0,0 +1,406 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/atomic77/gopensearch/pkg/date"
+	"github.com/atomic77/gopensearch/pkg/dsl"
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+
+Range aggregations join the documents to a table of their ranges, so that a
+document is counted in each range it falls in and the buckets group by the index
+of the range. Ranges without any documents are added as the results are read
+
+https://www.elastic.co/guide/en/elasticsearch/reference/7.17/search-aggregations-bucket-range-aggregation.html
+https://www.elastic.co/guide/en/elasticsearch/reference/7.17/search-aggregations-bucket-daterange-aggregation.html
+https://www.elastic.co/guide/en/elasticsearch/reference/7.17/search-aggregations-bucket-iprange-aggregation.html
+
+*/
+
+type RangeAggregation struct {
+	Buckets []Bucket
+	keyed   bool
+	ranges  []aggRange
+	agg     *dsl.Aggregate
+}
+
+func (m RangeAggregation) GetAggregateCategory() dsl.AggregationCategory {
+	return dsl.Bucket
+}
+
+// One of the ranges of an aggregation. The bounds are as compared in sql, while
+// the bucket has them as they are shown
+type aggRange struct {
+	lower, upper interface{}
+	bucket       Bucket
+}
+
+// The ranges of a range, date_range or ip_range aggregation, sorted as ES does by
+// their lower and then upper bounds
+func newRanges(agg *dsl.RangeAgg, bounds func(r dsl.AggRange) (aggRange, error),
+	less func(a, b interface{}) int) ([]aggRange, error) {
+	if len(agg.Ranges) == 0 {
+		return nil, &QueryError{Reason: "No [ranges] specified for the [" + agg.Field + "] aggregation"}
+	}
+	ranges := make([]aggRange, 0, len(agg.Ranges))
+	for _, r := range agg.Ranges {
+		ar, err := bounds(r)
+		if err != nil {
+			return nil, err
+		}
+		if r.Key != "" {
+			ar.bucket.Key = r.Key
+		}
+		ranges = append(ranges, ar)
+	}
+	// Unbounded sorts first for the lower bound, and last for the upper one
+	compare := func(a, b interface{}, unbounded int) int {
+		switch {
+		case a == nil && b == nil:
+			return 0
+		case a == nil:
+			return unbounded
+		case b == nil:
+			return -unbounded
+		}
+		return less(a, b)
+	}
+	sort.SliceStable(ranges, func(i, j int) bool {
+		if c := compare(ranges[i].lower, ranges[j].lower, -1); c != 0 {
+			return c < 0
+		}
+		return compare(ranges[i].upper, ranges[j].upper, 1) < 0
+	})
+	return ranges, nil
+}
+
+func compareFloats(a, b interface{}) int {
+	x, y := a.(float64), b.(float64)
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+func compareMillis(a, b interface{}) int {
+	return compareFloats(float64(a.(int64)), float64(b.(int64)))
+}
+
+func compareIPKeys(a, b interface{}) int {
+	return bytes.Compare(a.([]byte), b.([]byte))
+}
+
+// Numeric ranges are keyed by their bounds as java prints doubles, eg. 100.0-200.0
+func numericRanges(agg *dsl.RangeAgg) ([]aggRange, error) {
+	parse := func(v *dsl.StringOrNumber) (interface{}, error) {
+		if v == nil {
+			return nil, nil
+		}
+		f, err := strconv.ParseFloat(v.String(), 64)
+		if err != nil {
+			return nil, &QueryError{Reason: fmt.Sprintf("[range] failed to parse [%s] as a number", v.String())}
+		}
+		return f, nil
+	}
+	return newRanges(agg, func(r dsl.AggRange) (aggRange, error) {
+		var err error
+		ar := aggRange{bucket: makeBucket()}
+		if ar.lower, err = parse(r.From); err != nil {
+			return ar, err
+		}
+		if ar.upper, err = parse(r.To); err != nil {
+			return ar, err
+		}
+		var from, to string
+		if ar.lower != nil {
+			ar.bucket.From, from = ar.lower, javaDouble(ar.lower.(float64))
+		}
+		if ar.upper != nil {
+			ar.bucket.To, to = ar.upper, javaDouble(ar.upper.(float64))
+		}
+		ar.bucket.Key = rangeKey(from, to)
+		return ar, nil
+	}, compareFloats)
+}
+
+// Dates can be in the format of the aggregation, date math or epoch millis, and
+// are compared as epoch millis
+func dateRanges(agg *dsl.RangeAgg, prop Property) ([]aggRange, error) {
+	format, err := aggDateFormat(agg.Format, prop)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := date.ParseTimeZone(agg.TimeZone)
+	if err != nil {
+		return nil, &QueryError{Reason: err.Error()}
+	}
+	now := time.Now()
+	parse := func(v *dsl.StringOrNumber) (interface{}, string, error) {
+		if v == nil {
+			return nil, "", nil
+		}
+		t, err := date.ParseMath(v.String(), format+"||epoch_millis", loc, false, now)
+		if err != nil {
+			return nil, "", &QueryError{Reason: err.Error()}
+		}
+		s, _ := date.Format(format, t.In(loc))
+		return t.UnixMilli(), fmt.Sprint(s), nil
+	}
+	return newRanges(agg, func(r dsl.AggRange) (aggRange, error) {
+		var err error
+		ar := aggRange{bucket: makeBucket()}
+		if ar.lower, ar.bucket.FromAsString, err = parse(r.From); err != nil {
+			return ar, err
+		}
+		if ar.upper, ar.bucket.ToAsString, err = parse(r.To); err != nil {
+			return ar, err
+		}
+		if ar.lower != nil {
+			ar.bucket.From = float64(ar.lower.(int64))
+		}
+		if ar.upper != nil {
+			ar.bucket.To = float64(ar.upper.(int64))
+		}
+		ar.bucket.Key = rangeKey(ar.bucket.FromAsString, ar.bucket.ToAsString)
+		return ar, nil
+	}, compareMillis)
+}
+
+// Ip ranges are compared by ip_key, and a mask is the range from its network
+// address up to the one after its broadcast address
+func ipRanges(agg *dsl.RangeAgg) ([]aggRange, error) {
+	parse := func(v *dsl.StringOrNumber) (string, error) {
+		if v == nil {
+			return "", nil
+		}
+		if ipKey(v.String()) == nil {
+			return "", &QueryError{Reason: fmt.Sprintf("'%s' is not an IP string literal", v.String())}
+		}
+		return v.String(), nil
+	}
+	return newRanges(agg, func(r dsl.AggRange) (aggRange, error) {
+		var err error
+		var from, to string
+		ar := aggRange{bucket: makeBucket()}
+		if r.Mask != "" {
+			if r.From != nil || r.To != nil {
+				return ar, &QueryError{Reason: "[mask] cannot be used with [from] or [to]"}
+			}
+			if from, to, err = maskRange(r.Mask); err != nil {
+				return ar, err
+			}
+			ar.bucket.Key = r.Mask
+		} else {
+			if from, err = parse(r.From); err != nil {
+				return ar, err
+			}
+			if to, err = parse(r.To); err != nil {
+				return ar, err
+			}
+			ar.bucket.Key = rangeKey(from, to)
+		}
+		if from != "" {
+			ar.lower, ar.bucket.From = ipKey(from), from
+		}
+		if to != "" {
+			ar.upper, ar.bucket.To = ipKey(to), to
+		}
+		return ar, nil
+	}, compareIPKeys)
+}
+
+// The first address of a CIDR block and the one after its last, which for a block
+// at the very end of the address space has no upper bound
+func maskRange(mask string) (from, to string, err error) {
+	_, network, err := net.ParseCIDR(mask)
+	if err != nil {
+		return "", "", &QueryError{Reason: fmt.Sprintf("invalid IP range mask [%s]", mask)}
+	}
+	ip := network.IP
+	last := make(net.IP, len(ip))
+	for i := range ip {
+		last[i] = ip[i] | ^network.Mask[i]
+	}
+	for i := len(last) - 1; i >= 0; i-- {
+		last[i]++
+		if last[i] != 0 {
+			return ip.String(), last.String(), nil
+		}
+	}
+	return ip.String(), "", nil
+}
+
+// The key of a range from its bounds as strings, with * for either that is
+// unbounded
+func rangeKey(from, to string) string {
+	if from == "" {
+		from = "*"
+	}
+	if to == "" {
+		to = "*"
+	}
+	return from + "-" + to
+}
+
+// A double as java's Double.toString prints it, which ES uses for the keys of
+// numeric ranges: 100.0, 0.5, 1.0E7
+func javaDouble(f float64) string {
+	if abs := math.Abs(f); abs == 0 || (abs >= 1e-3 && abs < 1e7) {
+		s := strconv.FormatFloat(f, 'f', -1, 64)
+		if !strings.Contains(s, ".") {
+			s += ".0"
+		}
+		return s
+	}
+	s := strconv.FormatFloat(f, 'E', -1, 64)
+	mantissa, exp := s[:strings.Index(s, "E")], s[strings.Index(s, "E")+1:]
+	if !strings.Contains(mantissa, ".") {
+		mantissa += ".0"
+	}
+	exp = strings.TrimPrefix(exp, "+")
+	if strings.HasPrefix(exp, "-") {
+		exp = "-" + strings.TrimLeft(exp[1:], "0")
+	} else {
+		exp = strings.TrimLeft(exp, "0")
+	}
+	return mantissa + "E" + exp
+}
+
+// The sql for the value of a document as it compares with the bounds: a number,
+// epoch millis or an ip_key
+func (m *RangeAggregation) valueExpr(dbq *dbSubQuery) (string, error) {
+	value, err := dbq.fieldExpr(cleanseKeyField(rangeAggregation(m.agg).Field), `JSON_EXTRACT(content, %s)`)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case m.agg.Range != nil:
+		return fmt.Sprintf(`(CASE WHEN typeof(%s) IN ('integer', 'real') THEN %s END)`, value, value), nil
+	case m.agg.DateRange != nil:
+		return epochMillis(value, "typeof("+value+")"), nil
+	}
+	return fmt.Sprintf(`ip_key(CASE WHEN typeof(%s) = 'text' THEN %s END)`, value, value), nil
+}
+
+// Join the documents to the ranges that their value is in, by the index of each
+// range. value is the sql for the value as it compares with the bounds
+func (dbq *dbSubQuery) joinRanges(ranges []aggRange, value string, alias string) string {
+	selects := make([]string, len(ranges))
+	for i, r := range ranges {
+		selects[i] = fmt.Sprintf("SELECT %d AS idx, %s AS lower, %s AS upper", i, dbq.sb.Var(r.lower), dbq.sb.Var(r.upper))
+	}
+	dbq.sb.Join(fmt.Sprintf("(%s) AS %s", strings.Join(selects, " UNION ALL "), alias),
+		fmt.Sprintf("%s IS NOT NULL", value),
+		fmt.Sprintf("(%s.lower IS NULL OR %s >= %s.lower)", alias, value, alias),
+		fmt.Sprintf("(%s.upper IS NULL OR %s < %s.upper)", alias, value, alias),
+	)
+	return alias + ".idx"
+}
+
+func (m *RangeAggregation) SerializeResultset(rows *sqlx.Rows, dbq *dbSubQuery) error {
+	found := make(map[int64]Bucket)
+	for rows.Next() {
+		dest := make(map[string]interface{})
+		if err := rows.MapScan(dest); err != nil {
+			return err
+		}
+		for k := range dbq.groupAliases {
+			if idx, ok := dest[k].(int64); ok {
+				b, err := scanBucket(dest, dbq)
+				if err != nil {
+					return err
+				}
+				found[idx] = b
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	m.Buckets = make([]Bucket, len(m.ranges))
+	for i, r := range m.ranges {
+		b := r.bucket
+		if f, ok := found[int64(i)]; ok {
+			b.DocCount, b.subaggregates = f.DocCount, f.subaggregates
+		}
+		m.Buckets[i] = b
+	}
+	return nil
+}
+
+func (m *RangeAggregation) buckets() []Bucket {
+	return m.Buckets
+}
+
+func (m *RangeAggregation) setBuckets(buckets []Bucket) {
+	m.Buckets = buckets
+}
+
+func (m *RangeAggregation) bucketFilter(dbq *dbSubQuery, b *Bucket) (string, error) {
+	value, err := m.valueExpr(dbq)
+	if err != nil {
+		return "", err
+	}
+	for i := range m.Buckets {
+		if &m.Buckets[i] != b {
+			continue
+		}
+		r := m.ranges[i]
+		preds := []string{value + " IS NOT NULL"}
+		if r.lower != nil {
+			preds = append(preds, fmt.Sprintf("%s >= %s", value, dbq.sb.Var(r.lower)))
+		}
+		if r.upper != nil {
+			preds = append(preds, fmt.Sprintf("%s < %s", value, dbq.sb.Var(r.upper)))
+		}
+		return dbq.sb.And(preds...), nil
+	}
+	return "", fmt.Errorf("bucket [%v] is not one of the ranges", b.Key)
+}
+
+// Keyed, the buckets are an object by their keys, in the order of the ranges
+func (m *RangeAggregation) MarshalJSON() ([]byte, error) {
+	if !m.keyed {
+		return json.Marshal(struct {
+			Buckets []Bucket `json:"buckets"`
+		}{m.Buckets})
+	}
+	buf := bytes.NewBufferString(`{"buckets":{`)
+	for i := range m.Buckets {
+		b, err := json.Marshal(&m.Buckets[i])
+		if err != nil {
+			return nil, err
+		}
+		fields := make(map[string]json.RawMessage)
+		if err := json.Unmarshal(b, &fields); err != nil {
+			return nil, err
+		}
+		delete(fields, "key")
+		key, _ := json.Marshal(fmt.Sprint(m.Buckets[i].Key))
+		if b, err = json.Marshal(fields); err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(b)
+	}
+	buf.WriteString("}}")
+	return buf.Bytes(), nil
+}
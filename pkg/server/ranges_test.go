@@ -0,0 +1,70 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	require "github.com/alecthomas/assert/v2"
+)
+
+func TestRangeAggregations(t *testing.T) {
+	rec := doRequest(http.MethodPut, "/_template/rangeagg", `{
+		"index_patterns": "rangeagg-*",
+		"mappings": {"properties": {"ts": {"type": "date", "format": "yyyy-MM-dd||epoch_millis"}, "addr": {"type": "ip"}}}
+	}`)
+	require.Equal(t, rec.Code, http.StatusOK, rec.Body.String())
+	bulkRequest(t, "/rangeagg-000001/_bulk", `
+{"index": {}}
+{"price": 5, "ts": "2022-11-11", "addr": "10.0.0.5", "n": 1}
+{"index": {}}
+{"price": 100, "ts": "2022-11-20", "addr": "10.0.0.200", "n": 2}
+{"index": {}}
+{"price": 150.5, "ts": "2022-12-25", "addr": "192.168.1.1", "n": 3}
+{"index": {}}
+{"price": "free", "addr": "::1"}
+`)
+
+	require.Equal(t, aggregationResult(t, "rangeagg-000001", `{"a": {"range": {"field": "price", "ranges": [{"from": 100, "to": 200}, {"to": 100}, {"from": 200}]}}}`),
+		`{"buckets":[{"key":"*-100.0","to":100,"doc_count":1},{"key":"100.0-200.0","from":100,"to":200,"doc_count":2},{"key":"200.0-*","from":200,"doc_count":0}]}`)
+	require.Equal(t, aggregationResult(t, "rangeagg-000001", `{"a": {"range": {"field": "price", "keyed": true, "ranges": [{"key": "cheap", "to": 100}, {"from": 100}]}}}`),
+		`{"buckets":{"cheap":{"doc_count":1,"to":100},"100.0-*":{"doc_count":2,"from":100}}}`)
+	// Ranges can overlap
+	require.Equal(t, aggregationResult(t, "rangeagg-000001", `{"a": {"range": {"field": "price", "ranges": [{"from": 0, "to": 1.0E7}, {"from": 0.5, "to": 120}]},
+		"aggregations": {"m": {"max": {"field": "n"}}}}}`),
+		`{"buckets":[{"key":"0.0-1.0E7","from":0,"to":10000000,"doc_count":3,"m":{"value":3}},{"key":"0.5-120.0","from":0.5,"to":120,"doc_count":2,"m":{"value":2}}]}`)
+
+	require.Equal(t, aggregationResult(t, "rangeagg-000001", `{"a": {"date_range": {"field": "ts", "ranges": [{"to": "2022-11-15"}, {"from": "2022-11-15", "to": "2022-12-01"}, {"from": "2022-12-01"}]}}}`),
+		`{"buckets":[{"key":"*-2022-11-15","to":1668470400000,"to_as_string":"2022-11-15","doc_count":1},`+
+			`{"key":"2022-11-15-2022-12-01","from":1668470400000,"from_as_string":"2022-11-15","to":1669852800000,"to_as_string":"2022-12-01","doc_count":1},`+
+			`{"key":"2022-12-01-*","from":1669852800000,"from_as_string":"2022-12-01","doc_count":1}]}`)
+	require.Equal(t, aggregationResult(t, "rangeagg-000001", `{"a": {"date_range": {"field": "ts", "format": "MM-yyyy", "keyed": true, "ranges": [{"from": "11-2022", "to": "12-2022"}, {"from": 1669852800000}]}}}`),
+		`{"buckets":{"11-2022-12-2022":{"doc_count":2,"from":1667260800000,"from_as_string":"11-2022","to":1669852800000,"to_as_string":"12-2022"},"12-2022-*":{"doc_count":1,"from":1669852800000,"from_as_string":"12-2022"}}}`)
+	require.Equal(t, aggregationResult(t, "rangeagg-000001", `{"a": {"date_range": {"field": "ts", "time_zone": "+01:00", "ranges": [{"key": "november", "from": "2022-11-01", "to": "2022-11-01||+1M"}]}}}`),
+		`{"buckets":[{"key":"november","from":1667257200000,"from_as_string":"2022-11-01","to":1669849200000,"to_as_string":"2022-12-01","doc_count":2}]}`)
+
+	require.Equal(t, aggregationResult(t, "rangeagg-000001", `{"a": {"ip_range": {"field": "addr", "ranges": [{"to": "10.0.0.100"}, {"from": "10.0.0.100"}]}}}`),
+		`{"buckets":[{"key":"*-10.0.0.100","to":"10.0.0.100","doc_count":2},{"key":"10.0.0.100-*","from":"10.0.0.100","doc_count":2}]}`)
+	require.Equal(t, aggregationResult(t, "rangeagg-000001", `{"a": {"ip_range": {"field": "addr", "keyed": true, "ranges": [{"mask": "10.0.0.0/25"}, {"mask": "10.0.0.128/25"}, {"mask": "255.255.255.0/24"}]}}}`),
+		`{"buckets":{"10.0.0.0/25":{"doc_count":1,"from":"10.0.0.0","to":"10.0.0.128"},"10.0.0.128/25":{"doc_count":1,"from":"10.0.0.128","to":"10.0.1.0"},"255.255.255.0/24":{"doc_count":0,"from":"255.255.255.0"}}}`)
+
+	for _, agg := range []string{
+		`{"range": {"field": "price"}}`,
+		`{"range": {"field": "price", "ranges": [{"from": "lots"}]}}`,
+		`{"date_range": {"field": "ts", "ranges": [{"from": "yesterday"}]}}`,
+		`{"date_range": {"field": "ts", "time_zone": "Mars/Olympus", "ranges": [{"from": "2022-11-01"}]}}`,
+		`{"ip_range": {"field": "addr", "ranges": [{"from": "10.0.0.300"}]}}`,
+		`{"ip_range": {"field": "addr", "ranges": [{"mask": "10.0.0.0/33"}]}}`,
+		`{"ip_range": {"field": "addr", "ranges": [{"mask": "10.0.0.0/8", "to": "10.0.0.1"}]}}`,
+	} {
+		rec := doRequest(http.MethodPost, "/rangeagg-000001/_search", `{"size": 0, "aggs": {"a": `+agg+`}}`)
+		require.Equal(t, rec.Code, http.StatusBadRequest, agg)
+	}
+}
+
+func TestJavaDouble(t *testing.T) {
+	for f, want := range map[float64]string{
+		0: "0.0", 100: "100.0", -0.5: "-0.5", 1e7: "1.0E7", 1.5e-4: "1.5E-4", 123456789: "1.23456789E8",
+	} {
+		require.Equal(t, javaDouble(f), want)
+	}
+}
@@ -0,0 +1,879 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+/*
+
+The scripts of bucket_script, bucket_selector and moving_fn aggregations. ES runs
+them as painless; this is the subset of it they are written in: a single
+expression over `params`, the values of a moving_fn window as `values`, numbers,
+booleans and strings, arithmetic, comparisons, logical operators, the ternary
+operator, and the functions of `Math` and `MovingFunctions`. Nothing else can be
+reached from a script
+
+https://www.elastic.co/guide/en/elasticsearch/reference/7.17/search-aggregations-pipeline-movfn-aggregation.html#_pre_built_functions
+
+*/
+
+// What a script runs with: the params, with the values of the buckets_path of its
+// aggregation, and for moving_fn the values of the window
+type scriptEnv struct {
+	params map[string]interface{}
+	values []float64
+}
+
+type scriptExpr func(env *scriptEnv) (interface{}, error)
+
+type script struct {
+	source string
+	expr   scriptExpr
+}
+
+// As with the script.max_size_in_bytes setting of ES. Scripts are parsed and run
+// recursively, so there are limits to both how long they are and how deeply
+// their expressions nest
+const (
+	maxScriptSize  = 65535
+	maxScriptDepth = 64
+)
+
+func compileScript(source string) (*script, error) {
+	if len(source) > maxScriptSize {
+		return nil, scriptError(source[:64]+"...", fmt.Errorf("script is longer than the maximum of [%d] bytes", maxScriptSize))
+	}
+	src := strings.TrimSpace(source)
+	src = strings.TrimSpace(strings.TrimSuffix(src, ";"))
+	if strings.HasPrefix(src, "return ") || strings.HasPrefix(src, "return(") {
+		src = strings.TrimPrefix(src, "return")
+	}
+	tokens, err := scanScript(src)
+	if err != nil {
+		return nil, scriptError(source, err)
+	}
+	p := &scriptParser{tokens: tokens}
+	expr, err := p.ternary()
+	if err == nil && p.peek().kind != tokEnd {
+		err = fmt.Errorf("unexpected [%s]", p.peek().text)
+	}
+	if err != nil {
+		return nil, scriptError(source, err)
+	}
+	return &script{source: source, expr: expr}, nil
+}
+
+func scriptError(source string, err error) error {
+	return &QueryError{Reason: fmt.Sprintf("compile error in script [%s]: %s", source, err)}
+}
+
+func (s *script) run(env *scriptEnv) (interface{}, error) {
+	v, err := s.expr(env)
+	if err != nil {
+		return nil, &QueryError{Reason: fmt.Sprintf("runtime error in script [%s]: %s", s.source, err)}
+	}
+	return v, nil
+}
+
+type tokenKind int
+
+const (
+	tokEnd tokenKind = iota
+	tokNumber
+	tokString
+	tokIdent
+	tokOp
+)
+
+type scriptToken struct {
+	kind tokenKind
+	text string
+	num  float64
+}
+
+func scanScript(src string) ([]scriptToken, error) {
+	tokens := make([]scriptToken, 0)
+	rs := []rune(src)
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case unicode.IsDigit(r) || (r == '.' && i+1 < len(rs) && unicode.IsDigit(rs[i+1])):
+			j := i
+			for j < len(rs) && (unicode.IsDigit(rs[j]) || rs[j] == '.') {
+				j++
+			}
+			if j < len(rs) && (rs[j] == 'e' || rs[j] == 'E') {
+				j++
+				if j < len(rs) && (rs[j] == '+' || rs[j] == '-') {
+					j++
+				}
+				for j < len(rs) && unicode.IsDigit(rs[j]) {
+					j++
+				}
+			}
+			n, err := strconv.ParseFloat(string(rs[i:j]), 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number [%s]", string(rs[i:j]))
+			}
+			// Java's suffixes for the type of a literal
+			if j < len(rs) && strings.ContainsRune("dDfFlL", rs[j]) {
+				j++
+			}
+			tokens = append(tokens, scriptToken{kind: tokNumber, text: string(rs[i:j]), num: n})
+			i = j
+		case unicode.IsLetter(r) || r == '_' || r == '$':
+			j := i
+			for j < len(rs) && (unicode.IsLetter(rs[j]) || unicode.IsDigit(rs[j]) || rs[j] == '_' || rs[j] == '$') {
+				j++
+			}
+			tokens = append(tokens, scriptToken{kind: tokIdent, text: string(rs[i:j])})
+			i = j
+		case r == '\'' || r == '"':
+			var sb strings.Builder
+			j := i + 1
+			for ; j < len(rs) && rs[j] != r; j++ {
+				if rs[j] == '\\' && j+1 < len(rs) {
+					j++
+				}
+				sb.WriteRune(rs[j])
+			}
+			if j == len(rs) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			tokens = append(tokens, scriptToken{kind: tokString, text: sb.String()})
+			i = j + 1
+		default:
+			op := ""
+			if i+1 < len(rs) {
+				switch two := string(rs[i : i+2]); two {
+				case "&&", "||", "==", "!=", "<=", ">=":
+					op = two
+				}
+			}
+			if op == "" {
+				if !strings.ContainsRune("+-*/%!<>?:()[].,", r) {
+					return nil, fmt.Errorf("unexpected character [%c]", r)
+				}
+				op = string(r)
+			}
+			tokens = append(tokens, scriptToken{kind: tokOp, text: op})
+			i += len(op)
+		}
+	}
+	return tokens, nil
+}
+
+type scriptParser struct {
+	tokens []scriptToken
+	pos    int
+	// Of the expressions being parsed
+	depth int
+}
+
+// Parses an expression nested in the one being parsed
+func (p *scriptParser) nested(parse func() (scriptExpr, error)) (scriptExpr, error) {
+	if p.depth == maxScriptDepth {
+		return nil, fmt.Errorf("expressions are nested more than the maximum depth of [%d]", maxScriptDepth)
+	}
+	p.depth++
+	defer func() { p.depth-- }()
+	return parse()
+}
+
+func (p *scriptParser) peek() scriptToken {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return scriptToken{kind: tokEnd}
+}
+
+// Consumes the operator if it is next
+func (p *scriptParser) accept(op string) bool {
+	if t := p.peek(); t.kind == tokOp && t.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *scriptParser) expect(op string) error {
+	if !p.accept(op) {
+		if t := p.peek(); t.kind != tokEnd {
+			return fmt.Errorf("expected [%s] but found [%s]", op, t.text)
+		}
+		return fmt.Errorf("expected [%s] at the end of the script", op)
+	}
+	return nil
+}
+
+func (p *scriptParser) ternary() (scriptExpr, error) {
+	cond, err := p.binary(0)
+	if err != nil || !p.accept("?") {
+		return cond, err
+	}
+	then, err := p.nested(p.ternary)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	otherwise, err := p.nested(p.ternary)
+	if err != nil {
+		return nil, err
+	}
+	return func(env *scriptEnv) (interface{}, error) {
+		c, err := scriptBool(cond, env)
+		if err != nil {
+			return nil, err
+		}
+		if c {
+			return then(env)
+		}
+		return otherwise(env)
+	}, nil
+}
+
+// Binary operators from the lowest precedence to the highest
+var scriptPrecedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!="},
+	{"<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *scriptParser) binary(level int) (scriptExpr, error) {
+	if level == len(scriptPrecedence) {
+		return p.unary()
+	}
+	left, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := ""
+		for _, o := range scriptPrecedence[level] {
+			if p.accept(o) {
+				op = o
+				break
+			}
+		}
+		if op == "" {
+			return left, nil
+		}
+		right, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpr(op, left, right)
+	}
+}
+
+func binaryExpr(op string, left, right scriptExpr) scriptExpr {
+	switch op {
+	case "&&", "||":
+		return func(env *scriptEnv) (interface{}, error) {
+			l, err := scriptBool(left, env)
+			if err != nil || l == (op == "||") {
+				return l, err
+			}
+			return scriptBool(right, env)
+		}
+	}
+	return func(env *scriptEnv) (interface{}, error) {
+		l, err := left(env)
+		if err != nil {
+			return nil, err
+		}
+		r, err := right(env)
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case "==":
+			return scriptEquals(l, r), nil
+		case "!=":
+			return !scriptEquals(l, r), nil
+		case "+":
+			// Strings are concatenated
+			ls, lok := l.(string)
+			rs, rok := r.(string)
+			if lok || rok {
+				if !lok {
+					ls = scriptString(l)
+				}
+				if !rok {
+					rs = scriptString(r)
+				}
+				return ls + rs, nil
+			}
+		}
+		x, err := scriptNumber(l)
+		if err != nil {
+			return nil, err
+		}
+		y, err := scriptNumber(r)
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case "<":
+			return x < y, nil
+		case "<=":
+			return x <= y, nil
+		case ">":
+			return x > y, nil
+		case ">=":
+			return x >= y, nil
+		case "+":
+			return x + y, nil
+		case "-":
+			return x - y, nil
+		case "*":
+			return x * y, nil
+		case "/":
+			return x / y, nil
+		}
+		return math.Mod(x, y), nil
+	}
+}
+
+func (p *scriptParser) unary() (scriptExpr, error) {
+	for _, op := range []string{"-", "+", "!"} {
+		if !p.accept(op) {
+			continue
+		}
+		operand, err := p.nested(p.unary)
+		if err != nil {
+			return nil, err
+		}
+		return func(env *scriptEnv) (interface{}, error) {
+			if op == "!" {
+				b, err := scriptBool(operand, env)
+				return !b, err
+			}
+			v, err := operand(env)
+			if err != nil {
+				return nil, err
+			}
+			n, err := scriptNumber(v)
+			if op == "-" {
+				n = -n
+			}
+			return n, err
+		}, nil
+	}
+	return p.postfix()
+}
+
+func (p *scriptParser) postfix() (scriptExpr, error) {
+	t := p.peek()
+	if t.kind == tokIdent && (t.text == "Math" || t.text == "MovingFunctions") {
+		return p.call()
+	}
+	expr, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.accept("."):
+			name := p.peek()
+			if name.kind != tokIdent {
+				return nil, fmt.Errorf("expected a name after [.]")
+			}
+			p.pos++
+			if p.peek().kind == tokOp && p.peek().text == "(" {
+				args, err := p.args()
+				if err != nil {
+					return nil, err
+				}
+				expr = methodExpr(expr, name.text, args)
+			} else {
+				expr = memberExpr(expr, constExpr(name.text))
+			}
+		case p.accept("["):
+			index, err := p.nested(p.ternary)
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			expr = memberExpr(expr, index)
+		default:
+			return expr, nil
+		}
+	}
+}
+
+// A function of Math or MovingFunctions, which are known when the script is
+// compiled
+func (p *scriptParser) call() (scriptExpr, error) {
+	class := p.peek().text
+	p.pos++
+	if err := p.expect("."); err != nil {
+		return nil, err
+	}
+	name := class + "." + p.peek().text
+	fn, ok := scriptFunctions[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown function [%s]", name)
+	}
+	p.pos++
+	args, err := p.args()
+	if err != nil {
+		return nil, err
+	}
+	return func(env *scriptEnv) (interface{}, error) {
+		values := make([]interface{}, len(args))
+		for i, arg := range args {
+			v, err := arg(env)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = v
+		}
+		return fn(values)
+	}, nil
+}
+
+func (p *scriptParser) args() ([]scriptExpr, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	args := make([]scriptExpr, 0)
+	if p.accept(")") {
+		return args, nil
+	}
+	for {
+		arg, err := p.nested(p.ternary)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if p.accept(")") {
+			return args, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *scriptParser) primary() (scriptExpr, error) {
+	t := p.peek()
+	p.pos++
+	switch t.kind {
+	case tokNumber:
+		return constExpr(t.num), nil
+	case tokString:
+		return constExpr(t.text), nil
+	case tokIdent:
+		switch t.text {
+		case "true", "false":
+			return constExpr(t.text == "true"), nil
+		case "null":
+			return constExpr(nil), nil
+		case "params":
+			return func(env *scriptEnv) (interface{}, error) { return env.params, nil }, nil
+		case "values":
+			return func(env *scriptEnv) (interface{}, error) { return env.values, nil }, nil
+		}
+		return nil, fmt.Errorf("cannot resolve variable [%s]", t.text)
+	case tokOp:
+		if t.text == "(" {
+			expr, err := p.nested(p.ternary)
+			if err != nil {
+				return nil, err
+			}
+			return expr, p.expect(")")
+		}
+	case tokEnd:
+		return nil, fmt.Errorf("unexpected end of script")
+	}
+	return nil, fmt.Errorf("unexpected [%s]", t.text)
+}
+
+func constExpr(v interface{}) scriptExpr {
+	return func(*scriptEnv) (interface{}, error) { return v, nil }
+}
+
+// A param by its name, or one of the values by its index
+func memberExpr(expr, key scriptExpr) scriptExpr {
+	return func(env *scriptEnv) (interface{}, error) {
+		v, err := expr(env)
+		if err != nil {
+			return nil, err
+		}
+		k, err := key(env)
+		if err != nil {
+			return nil, err
+		}
+		switch c := v.(type) {
+		case map[string]interface{}:
+			return c[scriptString(k)], nil
+		case []float64:
+			if k == "length" {
+				return float64(len(c)), nil
+			}
+			n, err := scriptNumber(k)
+			if err != nil {
+				return nil, err
+			}
+			if i := int(n); i >= 0 && i < len(c) {
+				return c[i], nil
+			}
+			return nil, fmt.Errorf("index [%v] out of bounds for length [%d]", k, len(c))
+		}
+		return nil, fmt.Errorf("cannot access [%v] of [%v]", k, v)
+	}
+}
+
+func methodExpr(expr scriptExpr, name string, args []scriptExpr) scriptExpr {
+	return func(env *scriptEnv) (interface{}, error) {
+		v, err := expr(env)
+		if err != nil {
+			return nil, err
+		}
+		values := make([]interface{}, len(args))
+		for i, arg := range args {
+			if values[i], err = arg(env); err != nil {
+				return nil, err
+			}
+		}
+		switch c := v.(type) {
+		case map[string]interface{}:
+			switch {
+			case name == "get" && len(values) == 1:
+				return c[scriptString(values[0])], nil
+			case name == "containsKey" && len(values) == 1:
+				_, ok := c[scriptString(values[0])]
+				return ok, nil
+			}
+		case []float64:
+			if name == "size" && len(values) == 0 {
+				return float64(len(c)), nil
+			}
+		}
+		return nil, fmt.Errorf("unknown method [%s] with [%d] arguments", name, len(values))
+	}
+}
+
+func scriptBool(expr scriptExpr, env *scriptEnv) (bool, error) {
+	v, err := expr(env)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("cannot cast [%v] to boolean", v)
+	}
+	return b, nil
+}
+
+// Params can be any json number, as well as the values of buckets
+func scriptNumber(v interface{}) (float64, error) {
+	switch n := v.(type) {
+	case float64:
+		return n, nil
+	case int:
+		return float64(n), nil
+	case int64:
+		return float64(n), nil
+	}
+	return 0, fmt.Errorf("cannot cast [%v] to a number", v)
+}
+
+func scriptString(v interface{}) string {
+	if n, err := scriptNumber(v); err == nil {
+		return strconv.FormatFloat(n, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+func scriptEquals(a, b interface{}) bool {
+	x, xerr := scriptNumber(a)
+	y, yerr := scriptNumber(b)
+	if xerr == nil && yerr == nil {
+		return x == y
+	}
+	// Maps and lists are equal as in java, by their contents, and can't be
+	// compared with ==
+	return reflect.DeepEqual(a, b)
+}
+
+func scriptValues(v interface{}) ([]float64, error) {
+	switch values := v.(type) {
+	case []float64:
+		return values, nil
+	case []interface{}:
+		fs := make([]float64, len(values))
+		for i, value := range values {
+			n, err := scriptNumber(value)
+			if err != nil {
+				return nil, err
+			}
+			fs[i] = n
+		}
+		return fs, nil
+	}
+	return nil, fmt.Errorf("cannot cast [%v] to double[]", v)
+}
+
+type scriptFunction func(args []interface{}) (interface{}, error)
+
+// Of Math, those that take and return doubles
+func mathFunction(arity int, fn func(args []float64) float64) scriptFunction {
+	return func(args []interface{}) (interface{}, error) {
+		if len(args) != arity {
+			return nil, fmt.Errorf("expected [%d] arguments but found [%d]", arity, len(args))
+		}
+		xs := make([]float64, len(args))
+		for i, arg := range args {
+			x, err := scriptNumber(arg)
+			if err != nil {
+				return nil, err
+			}
+			xs[i] = x
+		}
+		return fn(xs), nil
+	}
+}
+
+// Of MovingFunctions, which all take the values of the window, then any of a
+// number of doubles, ints, and for holtWinters a boolean
+func movingFunction(params string, fn func(values []float64, args []interface{}) (float64, error)) scriptFunction {
+	return func(args []interface{}) (interface{}, error) {
+		if len(args) != len(params)+1 {
+			return nil, fmt.Errorf("expected [%d] arguments but found [%d]", len(params)+1, len(args))
+		}
+		values, err := scriptValues(args[0])
+		if err != nil {
+			return nil, err
+		}
+		for i, typ := range params {
+			if typ == 'b' {
+				if _, ok := args[i+1].(bool); !ok {
+					return nil, fmt.Errorf("cannot cast [%v] to boolean", args[i+1])
+				}
+			} else if _, err := scriptNumber(args[i+1]); err != nil {
+				return nil, err
+			}
+		}
+		return fn(values, args[1:])
+	}
+}
+
+func numArg(args []interface{}, i int) float64 {
+	n, _ := scriptNumber(args[i])
+	return n
+}
+
+var scriptFunctions = map[string]scriptFunction{
+	"Math.abs":   mathFunction(1, func(x []float64) float64 { return math.Abs(x[0]) }),
+	"Math.ceil":  mathFunction(1, func(x []float64) float64 { return math.Ceil(x[0]) }),
+	"Math.floor": mathFunction(1, func(x []float64) float64 { return math.Floor(x[0]) }),
+	// Halves are rounded up, as with Java
+	"Math.round":  mathFunction(1, func(x []float64) float64 { return math.Floor(x[0] + 0.5) }),
+	"Math.sqrt":   mathFunction(1, func(x []float64) float64 { return math.Sqrt(x[0]) }),
+	"Math.cbrt":   mathFunction(1, func(x []float64) float64 { return math.Cbrt(x[0]) }),
+	"Math.exp":    mathFunction(1, func(x []float64) float64 { return math.Exp(x[0]) }),
+	"Math.log":    mathFunction(1, func(x []float64) float64 { return math.Log(x[0]) }),
+	"Math.log10":  mathFunction(1, func(x []float64) float64 { return math.Log10(x[0]) }),
+	"Math.pow":    mathFunction(2, func(x []float64) float64 { return math.Pow(x[0], x[1]) }),
+	"Math.max":    mathFunction(2, func(x []float64) float64 { return math.Max(x[0], x[1]) }),
+	"Math.min":    mathFunction(2, func(x []float64) float64 { return math.Min(x[0], x[1]) }),
+	"Math.signum": mathFunction(1, signum),
+
+	"MovingFunctions.max": movingFunction("", func(values []float64, _ []interface{}) (float64, error) {
+		return movingExtreme(values, math.Max), nil
+	}),
+	"MovingFunctions.min": movingFunction("", func(values []float64, _ []interface{}) (float64, error) {
+		return movingExtreme(values, math.Min), nil
+	}),
+	"MovingFunctions.sum": movingFunction("", func(values []float64, _ []interface{}) (float64, error) {
+		sum := 0.0
+		for _, v := range values {
+			if !math.IsNaN(v) {
+				sum += v
+			}
+		}
+		return sum, nil
+	}),
+	"MovingFunctions.unweightedAvg": movingFunction("", func(values []float64, _ []interface{}) (float64, error) {
+		return unweightedAvg(values), nil
+	}),
+	"MovingFunctions.linearWeightedAvg": movingFunction("", func(values []float64, _ []interface{}) (float64, error) {
+		avg, weights, weight := 0.0, 0.0, 1.0
+		for _, v := range values {
+			if !math.IsNaN(v) {
+				avg += v * weight
+				weights += weight
+				weight++
+			}
+		}
+		return avg / weights, nil
+	}),
+	"MovingFunctions.stdDev": movingFunction("d", func(values []float64, args []interface{}) (float64, error) {
+		avg := numArg(args, 0)
+		if math.IsNaN(avg) {
+			return math.NaN(), nil
+		}
+		squares, n := 0.0, 0.0
+		for _, v := range values {
+			if !math.IsNaN(v) {
+				squares += (v - avg) * (v - avg)
+				n++
+			}
+		}
+		return math.Sqrt(squares / n), nil
+	}),
+	"MovingFunctions.ewma": movingFunction("d", func(values []float64, args []interface{}) (float64, error) {
+		alpha := numArg(args, 0)
+		avg := math.NaN()
+		for _, v := range values {
+			if math.IsNaN(v) {
+				continue
+			}
+			if math.IsNaN(avg) {
+				avg = v
+			} else {
+				avg = v*alpha + avg*(1-alpha)
+			}
+		}
+		return avg, nil
+	}),
+	"MovingFunctions.holt": movingFunction("dd", func(values []float64, args []interface{}) (float64, error) {
+		return holt(values, numArg(args, 0), numArg(args, 1)), nil
+	}),
+	"MovingFunctions.holtWinters": movingFunction("dddib", func(values []float64, args []interface{}) (float64, error) {
+		return holtWinters(values, numArg(args, 0), numArg(args, 1), numArg(args, 2), int(numArg(args, 3)), args[4].(bool))
+	}),
+}
+
+func signum(x []float64) float64 {
+	switch {
+	case x[0] > 0:
+		return 1
+	case x[0] < 0:
+		return -1
+	}
+	return x[0]
+}
+
+func movingExtreme(values []float64, pick func(x, y float64) float64) float64 {
+	extreme := math.NaN()
+	for _, v := range values {
+		if math.IsNaN(extreme) {
+			extreme = v
+		} else if !math.IsNaN(v) {
+			extreme = pick(extreme, v)
+		}
+	}
+	return extreme
+}
+
+func unweightedAvg(values []float64) float64 {
+	sum, n := 0.0, 0.0
+	for _, v := range values {
+		if !math.IsNaN(v) {
+			sum += v
+			n++
+		}
+	}
+	return sum / n
+}
+
+// The level of double exponential smoothing, which is the forecast of the next
+// value
+func holt(values []float64, alpha, beta float64) float64 {
+	s, b := math.NaN(), 0.0
+	for _, v := range values {
+		if math.IsNaN(v) {
+			continue
+		}
+		if math.IsNaN(s) {
+			s = v
+			continue
+		}
+		last := s
+		s = alpha*v + (1-alpha)*(last+b)
+		b = beta*(s-last) + (1-beta)*b
+	}
+	return s
+}
+
+// The forecast of the next value by triple exponential smoothing, as ES computes
+// it, with seasons of period values
+func holtWinters(values []float64, alpha, beta, gamma float64, period int, multiplicative bool) (float64, error) {
+	if len(values) == 0 {
+		return math.NaN(), nil
+	}
+	if period <= 0 || len(values) < 2*period {
+		return 0, fmt.Errorf("Holt-Winters aggregation requires at least (2 * period == 2 * %d == %d) data-points to function.  Only [%d] were provided.",
+			period, 2*period, len(values))
+	}
+	// Multiplicative seasons would divide by zero
+	padding := 0.0
+	if multiplicative {
+		padding = 0.0000000001
+	}
+	vs := make([]float64, len(values))
+	n := 0
+	for _, v := range values {
+		if !math.IsNaN(v) {
+			vs[n] = v + padding
+			n++
+		}
+	}
+	if n == 0 {
+		return math.NaN(), nil
+	}
+
+	// The level is first that of the first season, and the trend the average of
+	// the slopes from it to the second
+	s, b := 0.0, 0.0
+	for i := 0; i < period; i++ {
+		s += vs[i]
+		b += (vs[i+period] - vs[i]) / float64(period)
+	}
+	s /= float64(period)
+	b /= float64(period)
+	seasonal := make([]float64, len(vs))
+	if s != 0 {
+		for i := 0; i < period; i++ {
+			seasonal[i] = vs[i] / s
+		}
+	}
+	// As with ES, the first step doesn't take the initial trend
+	lastS, lastB := s, 0.0
+	for i := period; i < len(vs); i++ {
+		if multiplicative {
+			s = alpha*(vs[i]/seasonal[i-period]) + (1-alpha)*(lastS+lastB)
+		} else {
+			s = alpha*(vs[i]-seasonal[i-period]) + (1-alpha)*(lastS+lastB)
+		}
+		b = beta*(s-lastS) + (1-beta)*lastB
+		if multiplicative {
+			seasonal[i] = gamma*(vs[i]/(lastS+lastB)) + (1-gamma)*seasonal[i-period]
+		} else {
+			seasonal[i] = gamma*(vs[i]-(lastS-lastB)) + (1-gamma)*seasonal[i-period]
+		}
+		lastS, lastB = s, b
+	}
+	idx := len(values) - period
+	if multiplicative {
+		return (s + b) * seasonal[idx], nil
+	}
+	return s + b + seasonal[idx], nil
+}
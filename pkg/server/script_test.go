@@ -0,0 +1,85 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"testing"
+
+	require "github.com/alecthomas/assert/v2"
+)
+
+func TestScripts(t *testing.T) {
+	run := func(source string, params map[string]interface{}) interface{} {
+		t.Helper()
+		s, err := compileScript(source)
+		require.NoError(t, err)
+		v, err := s.run(&scriptEnv{params: params})
+		require.NoError(t, err)
+		return v
+	}
+	params := map[string]interface{}{"a": 1.0, "b": 2.0}
+	require.Equal(t, run("params.a + params.b * 2", params), 5.0)
+	require.Equal(t, run("(params.a + params.b) * 2", params), 6.0)
+	require.Equal(t, run("return params['a'] > 0 && !(params.b == 3);", params), true)
+	require.Equal(t, run("Math.max(params.a, 4) % 3", params), 1.0)
+	require.Equal(t, run("params.c == null ? 0 : -params.c", params), 0.0)
+	require.Equal(t, run("params.get('b') >= 2 || params.c > 0", params), true)
+	require.Equal(t, run("'x' + params.a", params), "x1")
+	require.Equal(t, run("1.5e1d / 10", params), 1.5)
+	// Objects and lists compare by their contents
+	objects := map[string]interface{}{
+		"o": map[string]interface{}{"x": 1.0}, "p": map[string]interface{}{"x": 1.0}, "l": []interface{}{1.0, "y"},
+	}
+	require.Equal(t, run("params.o == params.o", objects), true)
+	require.Equal(t, run("params.o == params.p", objects), true)
+	require.Equal(t, run("params.o != params.l", objects), true)
+	require.Equal(t, run("params.l == params.l", objects), true)
+
+	for _, source := range []string{"params.a +", "foo", "Math.nothing(1)", "params.a )", "params.a = 1"} {
+		_, err := compileScript(source)
+		require.Error(t, err, source)
+	}
+	// Nesting is limited, rather than overflowing the stack
+	require.Equal(t, run(strings.Repeat("(", 60)+"params.a"+strings.Repeat(")", 60), params), 1.0)
+	for _, source := range []string{
+		strings.Repeat("(", 100000) + "1" + strings.Repeat(")", 100000),
+		strings.Repeat("-", 100000) + "1",
+		strings.Repeat("Math.abs(", 1000) + "1" + strings.Repeat(")", 1000),
+		strings.Repeat("1 + ", 20000) + "1",
+	} {
+		_, err := compileScript(source)
+		var qe *QueryError
+		require.True(t, errors.As(err, &qe), source[:20])
+	}
+
+	for _, source := range []string{"params.a ? 1 : 2", "!params.a", "params.a * 'x'", "MovingFunctions.holtWinters(values, 0.5, 0.5, 0.5, 4, false)"} {
+		s, err := compileScript(source)
+		require.NoError(t, err, source)
+		_, err = s.run(&scriptEnv{params: params, values: []float64{1, 2, 3}})
+		require.Error(t, err, source)
+	}
+}
+
+func TestMovingFunctions(t *testing.T) {
+	moving := func(source string, values ...float64) float64 {
+		t.Helper()
+		s, err := compileScript(source)
+		require.NoError(t, err)
+		v, err := s.run(&scriptEnv{values: values})
+		require.NoError(t, err)
+		return v.(float64)
+	}
+	values := []float64{1, 2, math.NaN(), 3, 4}
+	require.Equal(t, moving("MovingFunctions.max(values)", values...), 4.0)
+	require.Equal(t, moving("MovingFunctions.min(values)", values...), 1.0)
+	require.Equal(t, moving("MovingFunctions.sum(values)", values...), 10.0)
+	require.Equal(t, moving("MovingFunctions.unweightedAvg(values)", values...), 2.5)
+	require.Equal(t, moving("MovingFunctions.linearWeightedAvg(values)", values...), 3.0)
+	require.Equal(t, moving("MovingFunctions.stdDev(values, MovingFunctions.unweightedAvg(values))", values...), math.Sqrt(1.25))
+	require.Equal(t, moving("MovingFunctions.ewma(values, 0.5)", values...), 3.125)
+	require.Equal(t, moving("MovingFunctions.holt(values, 0.5, 0.5)", values...), 3.46875)
+	require.Equal(t, moving("MovingFunctions.sum(values)"), 0.0)
+	require.True(t, math.IsNaN(moving("MovingFunctions.unweightedAvg(values)")))
+	require.True(t, math.IsNaN(moving("MovingFunctions.max(values)")))
+}
@@ -3,23 +3,40 @@ package server
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"strings"
 
 	"github.com/alecthomas/repr"
 	"github.com/atomic77/gopensearch/pkg/dsl"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/jmoiron/sqlx"
-
-	_ "github.com/mattn/go-sqlite3"
 )
 
+// How long a connection waits for a lock held by another writer before failing
+const dbBusyTimeoutMs = 5000
+
+// Transactions take the write lock as they begin, so that a writer waits for
+// another to finish rather than failing immediately, as it would if it tried to
+// upgrade a read lock it already held
 func openDb(loc string) *sqlx.DB {
-	d, err := sqlx.Open("sqlite3", loc)
+	for _, param := range []string{fmt.Sprintf("_busy_timeout=%d", dbBusyTimeoutMs), "_txlock=immediate"} {
+		name := param[:strings.Index(param, "=")]
+		if strings.Contains(loc, name) {
+			continue
+		}
+		sep := "?"
+		if strings.Contains(loc, "?") {
+			sep = "&"
+		}
+		loc = loc + sep + param
+	}
+	d, err := sqlx.Open(sqliteDriver, loc)
 	if err != nil {
 		panic(err)
 	}
@@ -32,14 +49,22 @@ func openDb(loc string) *sqlx.DB {
 func (s *Server) registerRoutes() {
 	r := mux.NewRouter()
 	r.HandleFunc("/{index:[a-zA-Z0-9\\-]+}", s.CreateIndexHandler).Methods("PUT")
-	r.HandleFunc("/{index:[a-zA-Z0-9\\-]+}/_create", s.IndexDocumentHandler).Methods("POST")
-	r.HandleFunc("/{index:[a-zA-Z0-9\\-]+}/_search", s.SearchDocumentHandler).Methods("POST")
-	// FIXME Fix this when adding support for searching over multiple indices
-	r.HandleFunc("/{index:[a-zA-Z0-9\\-]+},{[a-zA-Z0-9\\-]+},{[a-zA-Z0-9\\-]+}/_search", s.SearchDocumentHandler).Methods("POST")
-	r.HandleFunc("/{index:[a-zA-Z0-9\\-]+}/_bulk", s.BulkHandler).Methods("POST")
+	r.HandleFunc("/{index:[a-zA-Z0-9\\-]+}/_create", s.CreateDocumentHandler).Methods("POST")
+
+	// Single document apis
+	r.HandleFunc("/{index:[a-zA-Z0-9\\-_.]+}/_doc", s.IndexDocumentHandler).Methods("POST")
+	r.HandleFunc("/{index:[a-zA-Z0-9\\-_.]+}/_doc/{id}", s.IndexDocumentHandler).Methods("PUT", "POST")
+	r.HandleFunc("/{index:[a-zA-Z0-9\\-_.]+}/_create/{id}", s.CreateDocumentHandler).Methods("PUT", "POST")
+	r.HandleFunc("/{index:[a-zA-Z0-9\\-_.]+}/_doc/{id}", s.GetDocumentHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/{index:[a-zA-Z0-9\\-_.]+}/_source/{id}", s.GetSourceHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/{index:[a-zA-Z0-9\\-_.]+}/_doc/{id}", s.DeleteDocumentHandler).Methods("DELETE")
+	// Searches accept a comma-separated list of indices and/or wildcard patterns
+	r.HandleFunc("/{index:[a-zA-Z0-9\\-_.,*]+}/_search", s.SearchDocumentHandler).Methods("GET", "POST")
+	r.HandleFunc("/_search", s.SearchDocumentHandler).Methods("GET", "POST")
+	r.HandleFunc("/{index:[a-zA-Z0-9\\-_.]+}/_bulk", s.BulkHandler).Methods("POST")
 	r.HandleFunc("/_bulk", s.BulkHandler).Methods("POST")
 
-	r.HandleFunc("/{index:[a-zA-Z0-9\\-]+}/_msearch", s.MSearchHandler).Methods("GET", "POST")
+	r.HandleFunc("/{index:[a-zA-Z0-9\\-_.,*]+}/_msearch", s.MSearchHandler).Methods("GET", "POST")
 	r.HandleFunc("/_msearch", s.MSearchHandler).Methods("GET", "POST")
 
 	// Administrative functions
@@ -47,12 +72,22 @@ func (s *Server) registerRoutes() {
 	r.HandleFunc("/", s.ClusterStatusHandler).Methods("GET")
 	r.HandleFunc("/_cat/indices", s.CatalogIndicesHandler).Methods("GET")
 
+	// Alias-related
+	r.HandleFunc("/_aliases", s.UpdateAliasesHandler).Methods("POST")
+	r.HandleFunc("/_alias", s.GetAliasHandler).Methods("GET")
+	r.HandleFunc("/_alias/{name:[a-zA-Z0-9\\-_.,*]+}", s.GetAliasHandler).Methods("GET")
+	r.HandleFunc("/{index:[a-zA-Z0-9\\-_.,*]+}/_alias", s.GetAliasHandler).Methods("GET")
+	r.HandleFunc("/{index:[a-zA-Z0-9\\-_.,*]+}/{kind:_alias|_aliases}/{name:[a-zA-Z0-9\\-_.,*]+}", s.GetAliasHandler).Methods("GET")
+	r.HandleFunc("/{index:[a-zA-Z0-9\\-_.,*]+}/{kind:_alias|_aliases}/{name:[a-zA-Z0-9\\-_.]+}", s.PutAliasHandler).Methods("PUT", "POST")
+	r.HandleFunc("/{index:[a-zA-Z0-9\\-_.,*]+}/{kind:_alias|_aliases}/{name:[a-zA-Z0-9\\-_.,*]+}", s.DeleteAliasHandler).Methods("DELETE")
+
 	// Template-related
 	r.HandleFunc("/_template/{target:[a-zA-Z0-9\\-]+}", s.CreateTemplateHandler).Methods("PUT")
 	r.HandleFunc("/{target:[a-zA-Z0-9\\-]+}/_mapping", s.GetMappingDefinitionHandler).Methods("GET")
 	r.HandleFunc("/_mapping", s.GetMappingDefinitionHandler).Methods("GET")
 
 	r.PathPrefix("/").HandlerFunc(s.DefaultHandler)
+	r.Use(s.limitBodyMiddleware)
 	if s.Cfg.Debug {
 		r.Use(debugMiddleware)
 	}
@@ -65,7 +100,11 @@ func (s *Server) Init() {
 	s.db = openDb(s.Cfg.DbLocation)
 	s.registerRoutes()
 	s.createMetadata()
+	if err := s.migrateTables(); err != nil {
+		panic(err)
+	}
 	s.loadTemplateMetadata()
+	s.loadAliasMetadata()
 }
 
 func debugMiddleware(next http.Handler) http.Handler {
@@ -80,41 +119,23 @@ func debugMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-func (s *Server) IndexDocumentHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	index := vars["index"]
-
-	// Check if we need to implicitly create this index
-	idxMap, err := s.ListTables()
-	if err != nil {
-		handleErrorResponse(w, err)
-		return
-	}
+// As with http.max_content_length, request bodies are limited to 100mb by default
+const defaultMaxContentLength = 100 << 20
 
-	if _, ok := idxMap[index]; !ok {
-		err = s.CreateTable(index)
-		if err != nil {
-			handleErrorResponse(w, err)
+func (s *Server) limitBodyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := s.Cfg.MaxContentLength
+		if limit < 1 {
+			limit = defaultMaxContentLength
+		}
+		if r.ContentLength > limit {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			fmt.Fprintf(w, "request body of [%d] bytes is larger than the maximum of [%d]", r.ContentLength, limit)
 			return
 		}
-	}
-
-	b, _ := io.ReadAll(r.Body)
-	err = s.IndexDocument(string(b), index)
-	if err != nil {
-		handleErrorResponse(w, err)
-		return
-	}
-	resp := IndexDocumentResponse{
-		Index: index,
-		// TODO Check if we can easily get back the rowid after the insert
-		Id:      0,
-		Version: 1,
-		Result:  "created",
-	}
-	j, _ := json.Marshal(resp)
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(j)
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next.ServeHTTP(w, r)
+	})
 }
 
 func (s *Server) CreateIndexHandler(w http.ResponseWriter, r *http.Request) {
@@ -124,12 +145,57 @@ func (s *Server) CreateIndexHandler(w http.ResponseWriter, r *http.Request) {
 	if !ok {
 		fmt.Fprintf(w, "index name is missing in parameters")
 	}
-	err := s.CreateTable(index)
+	req := CreateIndexRequest{}
+	buf, _ := io.ReadAll(r.Body)
+	if len(bytes.TrimSpace(buf)) > 0 {
+		if err := json.Unmarshal(buf, &req); err != nil {
+			handleErrorResponse(w, errors.New("unable to parse json "+err.Error()))
+			return
+		}
+	}
+	// Aliases can be created along with the index, eg. for rollover setups. They
+	// are checked before the index is created, so that it isn't left behind
+	s.aliasMu.Lock()
+	defer s.aliasMu.Unlock()
+	if _, ok := s.Aliases[index]; ok {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "an alias exists with the same name as the index [%s]", index)
+		return
+	}
+	if err := validateIndexName(index); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	actions := make([]AliasAction, 0, len(req.Aliases))
+	for alias, props := range req.Aliases {
+		actions = append(actions, AliasAction{Add: &AliasActionSpec{
+			Index: index, Alias: alias, IsWriteIndex: props.IsWriteIndex,
+		}})
+	}
+	idxMap, err := s.ListTables()
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, "failure "+err.Error())
 		return
 	}
+	idxMap[index] = 42
+	aliases, err := s.Aliases.apply(actions, idxMap)
+	if err != nil {
+		handleAliasErrorResponse(w, err)
+		return
+	}
+	if err = s.CreateTable(index); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "failure "+err.Error())
+		return
+	}
+	if len(actions) > 0 {
+		if err = s.setAliases(aliases); err != nil {
+			handleAliasErrorResponse(w, err)
+			return
+		}
+	}
 	resp := CreateIndexResponse{
 		Acknowledged:       true,
 		ShardsAcknowledged: true,
@@ -160,15 +226,21 @@ func (bkt *Bucket) MarshalJSON() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	if len(bkt.subaggregates) > 0 {
-		s, err := json.Marshal(bkt.subaggregates)
-		if err != nil {
-			return nil, err
-		}
-		b[len(b)-1] = ','
-		b = append(b, s[1:]...)
+	return appendSubaggregates(b, bkt.subaggregates)
+}
+
+// Sub-aggregations are shown by their names alongside the fields of the bucket
+// they are in, which b is the json object of
+func appendSubaggregates(b []byte, subaggregates map[string]interface{}) ([]byte, error) {
+	if len(subaggregates) == 0 {
+		return b, nil
+	}
+	s, err := json.Marshal(subaggregates)
+	if err != nil {
+		return nil, err
 	}
-	return b, nil
+	b[len(b)-1] = ','
+	return append(b, s[1:]...), nil
 }
 
 func (s *Server) SearchDocumentHandler(w http.ResponseWriter, r *http.Request) {
@@ -177,45 +249,55 @@ func (s *Server) SearchDocumentHandler(w http.ResponseWriter, r *http.Request) {
 
 	buf, _ := io.ReadAll(r.Body)
 	q := &dsl.Dsl{}
-	err := json.Unmarshal(buf, &q)
-
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
-		return
+	if len(bytes.TrimSpace(buf)) > 0 {
+		err := json.Unmarshal(buf, &q)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "failure trying to parse "+err.Error())
+			return
+		}
 	}
 
 	if r.Header.Get("X-Gopensearch-Dsl-Dump") != "" {
 		log.Println(repr.String(q))
 	}
 
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "failure trying to parse "+err.Error())
-		return
+	ignoreUnavailable := r.URL.Query().Get("ignore_unavailable") == "true"
+	indices, err := s.ResolveIndices([]string{index}, ignoreUnavailable)
+	if err == nil {
+		var sr *SearchResponse
+		sr, err = s.getSearchResponse(indices, q)
+		if err == nil {
+			j, _ := json.Marshal(sr)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(j)
+			return
+		}
 	}
 
-	sr, err := s.getSearchResponse(index, q)
-	if err != nil {
-		eresp := &GenericErrorResponse{
-			Reason:       err.Error(),
-			Index:        index,
-			ResourceId:   index,
-			ResourceType: "index_or_alias",
-		}
-		j, _ := json.Marshal(eresp)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotFound)
-		w.Write(j)
-		return
+	resource := index
+	status := http.StatusNotFound
+	if nf, ok := err.(*IndexNotFoundError); ok {
+		resource = nf.Index
 	}
-	j, _ := json.Marshal(sr)
+	var qe *QueryError
+	if errors.As(err, &qe) {
+		status = http.StatusBadRequest
+	}
+	eresp := &GenericErrorResponse{
+		Reason:       err.Error(),
+		Index:        resource,
+		ResourceId:   resource,
+		ResourceType: "index_or_alias",
+	}
+	j, _ := json.Marshal(eresp)
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 	w.Write(j)
 }
 
-func (s *Server) getSearchResponse(index string, q *dsl.Dsl) (*SearchResponse, error) {
-	docs, aggs, err := s.SearchItem(index, q)
+func (s *Server) getSearchResponse(indices []string, q *dsl.Dsl) (*SearchResponse, error) {
+	docs, aggs, err := s.SearchItem(indices, q)
 	if err != nil {
 		return nil, err
 	}
@@ -224,8 +306,9 @@ func (s *Server) getSearchResponse(index string, q *dsl.Dsl) (*SearchResponse, e
 		TimedOut: false,
 		Shards:   MakeShardsInfo(),
 		Hits: &Hits{
-			Total: len(docs),
-			Hits:  docs,
+			Total:    len(docs),
+			MaxScore: maxScore(docs),
+			Hits:     docs,
 		},
 	}
 	sr.Aggregations = make(map[string]Aggregation)
@@ -235,132 +318,14 @@ func (s *Server) getSearchResponse(index string, q *dsl.Dsl) (*SearchResponse, e
 	return sr, nil
 }
 
-/*
-
-Bulk requests can be one of four types :
-- index
-- create
-- update
-- delete
-
-https://www.elastic.co/guide/en/elasticsearch/reference/master/docs-bulk.html
-
-The response is somewhat complex and is used by the python bulk helper client:
-https://www.elastic.co/guide/en/elasticsearch/reference/master/docs-bulk.html#docs-bulk-api-example
-
-*/
-
-func (s *Server) BulkHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	index := vars["index"]
-
-	// Current table map to see if we need to create any on the fly
-	idxMap, err := s.ListTables()
-	if err != nil {
-		handleErrorResponse(w, err)
-		return
-	}
-	var bulkReq map[string]interface{}
-	bulkResp := BulkResponse{
-		Took:  123,
-		Items: make([]map[string]BulkResponseItem, 0),
-	}
-
-	decoder := json.NewDecoder(r.Body)
-	decoder.DisallowUnknownFields()
-
-	for {
-		err := decoder.Decode(&bulkReq)
-
-		if err == io.EOF {
-			break
+func maxScore(docs []Document) *float64 {
+	var max *float64
+	for _, doc := range docs {
+		if doc.Score != nil && (max == nil || *doc.Score > *max) {
+			max = doc.Score
 		}
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintf(w, "failure trying to parse "+err.Error())
-			return
-		}
-
-		keys := make([]string, 0, len(bulkReq))
-		for k := range bulkReq {
-			keys = append(keys, k)
-		}
-
-		switch keys[0] {
-		case "index":
-			var doc map[string]interface{}
-			err = decoder.Decode(&doc)
-			if err != nil {
-				resp := BulkResponseItem{
-					Index:   index,
-					Id:      "123",
-					Version: 1,
-					// Error:   nil,
-					Status: 500,
-				}
-				var respWrapped = map[string]BulkResponseItem{"index": resp}
-				bulkResp.Items = append(bulkResp.Items, respWrapped)
-			} else {
-				b, _ := json.Marshal(doc)
-
-				keys2 := make([]string, 0, len(bulkReq))
-				for k := range bulkReq {
-					keys2 = append(keys2, k)
-				}
-				// FIXME Properly parse this structure
-				idxType := bulkReq["index"].(map[string]interface{})
-				if idx, ok := idxType["_index"].(string); ok {
-					index = idx
-				}
-
-				// Check if we need to create a table implicitly
-				if _, ok := idxMap[index]; !ok {
-					err = s.CreateTable(index)
-					if err != nil {
-						handleErrorResponse(w, err)
-						return
-					}
-					idxMap[index] = 42
-				}
-				err = s.IndexDocument(string(b), index)
-				if err == nil {
-
-					resp := BulkResponseItem{
-						Index:       index,
-						Id:          "123",
-						Type:        "_doc",
-						Version:     1,
-						SeqNo:       3,
-						PrimaryTerm: 1,
-						Result:      "created",
-						Shards:      MakeShardsInfo(),
-						// Error:   map[string]string{},
-						Status: 201,
-					}
-					var respWrapped = map[string]BulkResponseItem{"index": resp}
-					bulkResp.Items = append(bulkResp.Items, respWrapped)
-				} else {
-
-					if err != nil {
-						w.WriteHeader(http.StatusInternalServerError)
-						fmt.Fprintf(w, "failure during bulk indexing: "+err.Error())
-						return
-					}
-
-				}
-			}
-
-		case "update", "create", "delete":
-			// Not implemented
-		default:
-
-		}
-
 	}
-	bulkResp.Errors = false
-	j, _ := json.Marshal(bulkResp)
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(j)
+	return max
 }
 
 // Similar to bulk handler, but for querying
@@ -370,8 +335,6 @@ func (s *Server) MSearchHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	index := vars["index"]
 
-	msearchHeader := MSearchHeader{}
-
 	decoder := json.NewDecoder(r.Body)
 	decoder.DisallowUnknownFields()
 	responses := make([]*SearchResponse, 0)
@@ -380,6 +343,7 @@ func (s *Server) MSearchHandler(w http.ResponseWriter, r *http.Request) {
 
 		// MSearch requests come in the form of a "header" request, a new line,
 		// and the standard search query
+		msearchHeader := MSearchHeader{}
 		err := decoder.Decode(&msearchHeader)
 
 		if err == io.EOF {
@@ -400,18 +364,24 @@ func (s *Server) MSearchHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		var sr *SearchResponse
-		if msearchHeader.Index != nil {
-			sr, err = s.getSearchResponse(*msearchHeader.Index, qDsl)
-		} else if msearchHeader.Indices != nil {
-			// FIXME Search only the first for now until we can enable search
-			// support against multiple indices seamlessly
-			sr, err = s.getSearchResponse(*msearchHeader.Indices[0], qDsl)
-
-		} else {
-			sr, err = s.getSearchResponse(index, qDsl)
+		// The header can name its own indices, otherwise fall back to any
+		// provided in the url
+		exprs := append([]string{}, msearchHeader.Index...)
+		for _, idx := range msearchHeader.Indices {
+			exprs = append(exprs, *idx)
 		}
+		if len(exprs) == 0 && index != "" {
+			exprs = []string{index}
+		}
+		ignoreUnavailable := msearchHeader.IgnoreUnavailable != nil && *msearchHeader.IgnoreUnavailable
 
+		indices, err := s.ResolveIndices(exprs, ignoreUnavailable)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintln(w, "failure when searching ", err.Error())
+			return
+		}
+		sr, err := s.getSearchResponse(indices, qDsl)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			fmt.Fprintln(w, "failure when searching ", err.Error())
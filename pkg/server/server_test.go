@@ -2,8 +2,11 @@ package server
 
 import (
 	"encoding/json"
+	"net/http"
+	"strings"
 	"testing"
 
+	require "github.com/alecthomas/assert/v2"
 	"github.com/alecthomas/repr"
 )
 
@@ -25,3 +28,14 @@ func TestCustomJsonSer(t *testing.T) {
 
 	repr.Println(j)
 }
+
+func TestMaxContentLength(t *testing.T) {
+	prev := s.Cfg.MaxContentLength
+	s.Cfg.MaxContentLength = 1024
+	defer func() { s.Cfg.MaxContentLength = prev }()
+
+	rec := doRequest(http.MethodPost, "/_search", `{"query": {"query_string": {"query": "`+strings.Repeat("a ", 1024)+`"}}}`)
+	require.Equal(t, rec.Code, http.StatusRequestEntityTooLarge)
+	rec = doRequest(http.MethodPost, "/_search", `{"query": {"query_string": {"query": "a"}}}`)
+	require.Equal(t, rec.Code, http.StatusOK)
+}
@@ -0,0 +1,320 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/atomic77/gopensearch/pkg/dsl"
+	"github.com/huandu/go-sqlbuilder"
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+
+Significant terms are the terms of a field that are more frequent among the
+documents of a bucket, or those matching the query at the top level, than among
+all of those in the indices. The terms of the foreground are counted as those of a
+terms aggregation are, and joined to those of the background, and then scored by
+a heuristic over how many documents of each set have them
+
+https://www.elastic.co/guide/en/elasticsearch/reference/7.17/search-aggregations-bucket-significantterms-aggregation.html
+
+*/
+
+type SignificantTermsAggregation struct {
+	// The number of documents in the foreground and background
+	DocCount int64    `json:"doc_count"`
+	BgCount  int64    `json:"bg_count"`
+	Buckets  []Bucket `json:"buckets"`
+	sig      *significantTerms
+}
+
+func (m SignificantTermsAggregation) GetAggregateCategory() dsl.AggregationCategory {
+	return dsl.Bucket
+}
+
+// A significant_terms aggregation as planned
+type significantTerms struct {
+	terms     *termsAgg
+	heuristic significanceHeuristic
+	// The terms of the background, and the number of documents in either set
+	background               *sqlbuilder.SelectBuilder
+	subsetSize, supersetSize *sqlbuilder.SelectBuilder
+}
+
+// The score of a term from the number of documents with it in the foreground, the
+// subset, and the background, the superset, and the numbers of documents in each
+type significanceHeuristic func(subsetFreq, subsetSize, supersetFreq, supersetSize float64) float64
+
+const (
+	supersetFreqAlias = "superset_freq"
+	subsetSizeAlias   = "subset_size"
+	supersetSizeAlias = "superset_size"
+)
+
+func newSignificanceHeuristic(st *dsl.SignificantTerms) (significanceHeuristic, error) {
+	n := 0
+	var h significanceHeuristic = jlh
+	if st.JLH != nil {
+		n++
+	}
+	if st.ChiSquare != nil {
+		h = nxyHeuristic(st.ChiSquare, chiSquare)
+		n++
+	}
+	if st.MutualInformation != nil {
+		h = nxyHeuristic(st.MutualInformation, mutualInformation)
+		n++
+	}
+	if st.GND != nil {
+		h = gnd(st.GND)
+		n++
+	}
+	if n > 1 {
+		return nil, &QueryError{Reason: "Only one significance heuristic can be set, of [jlh], [chi_square], [mutual_information] and [gnd]"}
+	}
+	return h, nil
+}
+
+func (dbq *dbSubQuery) genSignificantTermsSelectExprs(st *dsl.SignificantTerms, grpIdx, fnIdx string) error {
+	label := *dbq.label
+	ta := &termsAgg{field: st.Field, size: 10, minDocCount: 3}
+	if st.Size != nil {
+		if ta.size = *st.Size; ta.size <= 0 {
+			return &QueryError{Reason: fmt.Sprintf("[size] must be greater than 0. Found [%d] in [%s]", ta.size, label)}
+		}
+	}
+	if st.MinDocCount != nil {
+		n, err := strconv.ParseInt(st.MinDocCount.String(), 10, 64)
+		if err != nil || n < 0 {
+			return &QueryError{Reason: fmt.Sprintf("[min_doc_count] must be greater than or equal to 0. Found [%s] in [%s]", st.MinDocCount.String(), label)}
+		}
+		ta.minDocCount = n
+	}
+	heuristic, err := newSignificanceHeuristic(st)
+	if err != nil {
+		return err
+	}
+	sig := &significantTerms{terms: ta, heuristic: heuristic}
+
+	t := &dsl.AggTerms{Field: st.Field, Include: st.Include, Exclude: st.Exclude}
+	if err := dbq.genTermsJoin(t, ta, grpIdx, fnIdx); err != nil {
+		return err
+	}
+
+	// The background is all of the documents of the indices, or those of its
+	// filter, whatever the query and buckets
+	bgSource := &aggSource{indices: dbq.source.indices, mappings: dbq.source.mappings, q: &dsl.Dsl{Query: st.BackgroundFilter}}
+	bg := makeDbSubQuery()
+	bg.mapping = dbq.mapping
+	if err := bg.genTermsJoin(t, &termsAgg{field: st.Field}, "bg_key", supersetFreqAlias); err != nil {
+		return err
+	}
+	bg.genSelectExpression()
+	if err := bg.genDocSource(bgSource.indices, bgSource.mappings, bgSource.q); err != nil {
+		return err
+	}
+	bg.sb.GroupBy("bg_key")
+	sig.background = bg.sb
+
+	subset := makeDbSubQuery()
+	subset.filters = dbq.filters
+	subset.sb.Select("COUNT(*)")
+	if err := subset.genDocSource(dbq.source.indices, dbq.source.mappings, dbq.source.q); err != nil {
+		return err
+	}
+	sig.subsetSize = subset.sb
+	superset := makeDbSubQuery()
+	superset.sb.Select("COUNT(*)")
+	if err := superset.genDocSource(bgSource.indices, bgSource.mappings, bgSource.q); err != nil {
+		return err
+	}
+	sig.supersetSize = superset.sb
+
+	dbq.aggregation = &SignificantTermsAggregation{sig: sig}
+	return nil
+}
+
+// The terms of the foreground, with their background counts. The sizes of the
+// sets are joined to them so that there is a row for them even without any terms
+func (dbq *dbSubQuery) genSignificantTermsOrder(sig *significantTerms) {
+	ta := sig.terms
+	if ta.minDocCount > 1 {
+		dbq.sb.Having(dbq.sb.GreaterEqualThan(ta.countAlias, ta.minDocCount))
+	}
+	outer := sqlbuilder.SQLite.NewSelectBuilder()
+	outer.Select("sizes.*", "fg.*", "bg."+supersetFreqAlias).
+		From(fmt.Sprintf("(SELECT (%s) AS %s, (%s) AS %s) AS sizes",
+			outer.Var(sig.subsetSize), subsetSizeAlias, outer.Var(sig.supersetSize), supersetSizeAlias)).
+		JoinWithOption(sqlbuilder.LeftJoin, outer.BuilderAs(dbq.sb, "fg"), "1").
+		JoinWithOption(sqlbuilder.LeftJoin, outer.BuilderAs(sig.background, "bg"), "bg.bg_key IS fg."+ta.keyAlias)
+	dbq.sb = outer
+}
+
+// The terms with a positive score, the most significant first
+func (m *SignificantTermsAggregation) SerializeResultset(rows *sqlx.Rows, dbq *dbSubQuery) error {
+	ta := m.sig.terms
+	m.Buckets = make([]Bucket, 0)
+	scores := make([]float64, 0)
+	for rows.Next() {
+		dest := make(map[string]interface{})
+		if err := rows.MapScan(dest); err != nil {
+			return err
+		}
+		m.DocCount, _ = dest[subsetSizeAlias].(int64)
+		m.BgCount, _ = dest[supersetSizeAlias].(int64)
+		if dest[ta.keyAlias] == nil {
+			continue
+		}
+		b, err := scanBucket(dest, dbq)
+		if err != nil {
+			return err
+		}
+		b.Key = dest[ta.keyAlias]
+		bgCount, _ := dest[supersetFreqAlias].(int64)
+		score := m.sig.heuristic(float64(b.DocCount), float64(m.DocCount), float64(bgCount), float64(m.BgCount))
+		if !(score > 0) || math.IsInf(score, 0) {
+			continue
+		}
+		b.Score, b.BgCount = &score, &bgCount
+		m.Buckets = append(m.Buckets, b)
+		scores = append(scores, score)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	sort.SliceStable(m.Buckets, func(i, j int) bool {
+		if *m.Buckets[i].Score != *m.Buckets[j].Score {
+			return *m.Buckets[i].Score > *m.Buckets[j].Score
+		}
+		return compareTermsKeys(m.Buckets[i].Key, m.Buckets[j].Key) < 0
+	})
+	if len(m.Buckets) > ta.size {
+		m.Buckets = m.Buckets[:ta.size]
+	}
+	for i := range m.Buckets {
+		ta.setKey(&m.Buckets[i])
+	}
+	return nil
+}
+
+func (m *SignificantTermsAggregation) buckets() []Bucket {
+	return m.Buckets
+}
+
+func (m *SignificantTermsAggregation) setBuckets(buckets []Bucket) {
+	m.Buckets = buckets
+}
+
+func (m *SignificantTermsAggregation) bucketFilter(dbq *dbSubQuery, b *Bucket) (string, error) {
+	return m.sig.terms.bucketFilter(dbq, b)
+}
+
+// JLH, the change in how probable a term is, absolute times relative, for terms
+// more probable in the foreground
+func jlh(subsetFreq, subsetSize, supersetFreq, supersetSize float64) float64 {
+	if subsetSize == 0 || supersetSize == 0 {
+		return 0
+	}
+	subsetProbability := subsetFreq / subsetSize
+	supersetProbability := supersetFreq / supersetSize
+	absoluteChange := subsetProbability - supersetProbability
+	if absoluteChange <= 0 {
+		return 0
+	}
+	return absoluteChange * (subsetProbability / supersetProbability)
+}
+
+// The counts of documents in or out of the foreground, the class, and with or
+// without a term, as chi square and mutual information have them: eg. n10 is of
+// those not in the class that have the term
+type nxyFrequencies struct {
+	n00, n01, n10, n11 float64
+	n0_, n1_, n_0, n_1 float64
+	n                  float64
+}
+
+func nxyHeuristic(h *dsl.SignificanceHeuristic, score func(f *nxyFrequencies) float64) significanceHeuristic {
+	superset := h.BackgroundIsSuperset == nil || *h.BackgroundIsSuperset
+	includeNegatives := h.IncludeNegatives
+	return func(subsetFreq, subsetSize, supersetFreq, supersetSize float64) float64 {
+		var f nxyFrequencies
+		if superset {
+			f = nxyFrequencies{
+				n00: supersetSize - supersetFreq - (subsetSize - subsetFreq),
+				n01: subsetSize - subsetFreq,
+				n10: supersetFreq - subsetFreq,
+				n11: subsetFreq,
+				n0_: supersetSize - supersetFreq,
+				n1_: supersetFreq,
+				n_0: supersetSize - subsetSize,
+				n_1: subsetSize,
+				n:   supersetSize,
+			}
+		} else {
+			f = nxyFrequencies{
+				n00: supersetSize - supersetFreq,
+				n01: subsetSize - subsetFreq,
+				n10: supersetFreq,
+				n11: subsetFreq,
+				n0_: supersetSize - supersetFreq + subsetSize - subsetFreq,
+				n1_: supersetFreq + subsetFreq,
+				n_0: supersetSize,
+				n_1: subsetSize,
+				n:   supersetSize + subsetSize,
+			}
+		}
+		// Unless asked for, terms less frequent in the foreground than outside of
+		// it are not significant
+		if !includeNegatives && f.n11/f.n_1 < f.n10/f.n_0 {
+			return math.Inf(-1)
+		}
+		return score(&f)
+	}
+}
+
+func chiSquare(f *nxyFrequencies) float64 {
+	return f.n * math.Pow(f.n11*f.n00-f.n01*f.n10, 2) / (f.n_1 * f.n1_ * f.n0_ * f.n_0)
+}
+
+func mutualInformation(f *nxyFrequencies) float64 {
+	term := func(nxy, nx_, n_y, n float64) float64 {
+		numerator := math.Abs(n * nxy)
+		denominator := math.Abs(nx_ * n_y)
+		factor := math.Abs(nxy / n)
+		if numerator < 1e-7 && factor < 1e-7 {
+			return 0
+		}
+		return factor * math.Log(numerator/denominator)
+	}
+	score := (term(f.n00, f.n0_, f.n_0, f.n) + term(f.n01, f.n0_, f.n_1, f.n) +
+		term(f.n10, f.n1_, f.n_0, f.n) + term(f.n11, f.n1_, f.n_1, f.n)) / math.Ln2
+	if math.IsNaN(score) {
+		return math.Inf(-1)
+	}
+	return score
+}
+
+// Google normalized distance, inverted so that terms that occur together with
+// the foreground score higher
+func gnd(h *dsl.SignificanceHeuristic) significanceHeuristic {
+	superset := h.BackgroundIsSuperset == nil || *h.BackgroundIsSuperset
+	return func(subsetFreq, subsetSize, supersetFreq, supersetSize float64) float64 {
+		fx, fy, fxy, n := subsetSize, supersetFreq, subsetFreq, supersetSize
+		if !superset {
+			fy += subsetFreq
+			n += subsetSize
+		}
+		if fxy == 0 {
+			return 0
+		}
+		if fx == fy && fx == fxy {
+			return 1
+		}
+		score := (math.Max(math.Log(fx), math.Log(fy)) - math.Log(fxy)) /
+			(math.Log(n) - math.Min(math.Log(fx), math.Log(fy)))
+		return math.Exp(-score)
+	}
+}
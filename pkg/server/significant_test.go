@@ -0,0 +1,91 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	require "github.com/alecthomas/assert/v2"
+)
+
+func TestSignificantTermsAggregations(t *testing.T) {
+	bulkRequest(t, "/significantaggs/_bulk", `
+{"index": {}}
+{"service": "api", "status": 500, "error": "timeout"}
+{"index": {}}
+{"service": "api", "status": 503, "error": "timeout"}
+{"index": {}}
+{"service": "api", "status": 500, "error": "timeout"}
+{"index": {}}
+{"service": "api", "status": 200}
+{"index": {}}
+{"service": "web", "status": 500, "error": "crash"}
+{"index": {}}
+{"service": "web", "status": 200}
+{"index": {}}
+{"service": "web", "status": 200}
+{"index": {}}
+{"service": "db", "status": 200}
+{"index": {}}
+{"service": "db", "status": 200}
+{"index": {}}
+{"service": "db", "status": 200}
+`)
+	errors := `"query": {"range": {"status": {"gte": 500}}}`
+	significant := func(query, aggs string) string {
+		t.Helper()
+		rec := doRequest(http.MethodPost, "/significantaggs/_search", `{"size": 0, `+query+`, "aggs": `+aggs+`}`)
+		require.Equal(t, rec.Code, http.StatusOK, rec.Body.String())
+		var resp struct {
+			Aggregations map[string]json.RawMessage `json:"aggregations"`
+		}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		return string(resp.Aggregations["a"])
+	}
+
+	// The services of most of the errors, scored by jlh
+	require.Equal(t, significant(errors, `{"a": {"significant_terms": {"field": "service", "min_doc_count": 1}}}`),
+		`{"doc_count":4,"bg_count":10,"buckets":[{"key":"api","doc_count":3,"score":0.65625,"bg_count":4}]}`)
+	require.Equal(t, significant(errors, `{"a": {"significant_terms": {"field": "service"}}}`),
+		`{"doc_count":4,"bg_count":10,"buckets":[{"key":"api","doc_count":3,"score":0.65625,"bg_count":4}]}`)
+	require.Equal(t, significant(errors, `{"a": {"significant_terms": {"field": "service", "min_doc_count": 4}}}`),
+		`{"doc_count":4,"bg_count":10,"buckets":[]}`)
+	require.Equal(t, significant(errors, `{"a": {"significant_terms": {"field": "service", "min_doc_count": 1, "gnd": {}}}}`),
+		`{"doc_count":4,"bg_count":10,"buckets":[{"key":"api","doc_count":3,"score":0.7305455114033802,"bg_count":4},`+
+			`{"key":"web","doc_count":1,"score":0.31618326373026057,"bg_count":3}]}`)
+	require.Equal(t, significant(errors, `{"a": {"significant_terms": {"field": "service", "min_doc_count": 1, "chi_square": {}}}}`),
+		`{"doc_count":4,"bg_count":10,"buckets":[{"key":"api","doc_count":3,"score":3.4027777777777777,"bg_count":4}]}`)
+	require.Equal(t, significant(errors, `{"a": {"significant_terms": {"field": "service", "min_doc_count": 1, "mutual_information": {}}}}`),
+		`{"doc_count":4,"bg_count":10,"buckets":[{"key":"api","doc_count":3,"score":0.2564258916820029,"bg_count":4}]}`)
+
+	// Against a background of the documents of other services, and in buckets
+	require.Equal(t, significant(errors, `{"a": {"significant_terms": {"field": "service", "min_doc_count": 1,
+		"background_filter": {"term": {"service": "db"}}}}}`),
+		`{"doc_count":4,"bg_count":3,"buckets":[]}`)
+	require.Equal(t, significant(`"query": {"match_all": {}}`, `{"a": {"terms": {"field": "service"}, "aggs": {
+		"s": {"significant_terms": {"field": "status", "min_doc_count": 1}}}}}`),
+		`{"doc_count_error_upper_bound":0,"sum_other_doc_count":0,"buckets":[`+
+			`{"key":"api","doc_count":4,"s":{"doc_count":4,"bg_count":10,"buckets":[`+
+			`{"key":503,"doc_count":1,"score":0.375,"bg_count":1},{"key":500,"doc_count":2,"score":0.33333333333333337,"bg_count":3}]}},`+
+			`{"key":"db","doc_count":3,"s":{"doc_count":3,"bg_count":10,"buckets":[{"key":200,"doc_count":3,"score":0.6666666666666667,"bg_count":6}]}},`+
+			`{"key":"web","doc_count":3,"s":{"doc_count":3,"bg_count":10,"buckets":[`+
+			`{"key":200,"doc_count":2,"score":0.07407407407407406,"bg_count":6},{"key":500,"doc_count":1,"score":0.03703703703703703,"bg_count":3}]}}]}`)
+
+	// The least frequent terms
+	require.Equal(t, aggregationResult(t, "significantaggs", `{"a": {"rare_terms": {"field": "status"}}}`),
+		`{"buckets":[{"key":503,"doc_count":1}]}`)
+	require.Equal(t, aggregationResult(t, "significantaggs", `{"a": {"rare_terms": {"field": "error", "max_doc_count": 3},
+		"aggs": {"services": {"terms": {"field": "service"}}}}}`),
+		`{"buckets":[{"key":"crash","doc_count":1,"services":{"doc_count_error_upper_bound":0,"sum_other_doc_count":0,"buckets":[{"key":"web","doc_count":1}]}},`+
+			`{"key":"timeout","doc_count":3,"services":{"doc_count_error_upper_bound":0,"sum_other_doc_count":0,"buckets":[{"key":"api","doc_count":3}]}}]}`)
+
+	for _, aggs := range []string{
+		`{"a": {"significant_terms": {"field": "service", "size": 0}}}`,
+		`{"a": {"significant_terms": {"field": "service", "jlh": {}, "gnd": {}}}}`,
+		`{"a": {"rare_terms": {"field": "service", "max_doc_count": 0}}}`,
+		`{"a": {"rare_terms": {"field": "service", "max_doc_count": 101}}}`,
+	} {
+		rec := doRequest(http.MethodPost, "/significantaggs/_search", `{"size": 0, "aggs": `+aggs+`}`)
+		require.Equal(t, rec.Code, http.StatusBadRequest, aggs)
+	}
+}
@@ -1,9 +1,13 @@
 package server
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/atomic77/gopensearch/pkg/date"
 	"github.com/atomic77/gopensearch/pkg/dsl"
@@ -17,6 +21,19 @@ type dbSubQuery struct {
 	groupAliases map[string]interface{}
 	fnAliases    map[string]interface{}
 	label        *string
+	// Window functions over the documents, which have to be computed before they
+	// are grouped
+	sourceExprs []string
+	// The index a branch of the doc source selects from, and its mapping if a
+	// template has one for it
+	index   string
+	mapping *TemplateMapping
+	// Of an aggregation: what it runs over, the buckets of its ancestors that
+	// documents have to be in, and its bucket and pipeline sub-aggregations
+	source     *aggSource
+	filters    []docFilter
+	subBuckets map[string]dsl.Aggregate
+	pipelines  []*pipeline
 }
 
 func makeDbSubQuery() dbSubQuery {
@@ -32,127 +49,939 @@ func (dbq *dbSubQuery) isAggregation() bool {
 	return dbq.aggregation != nil
 }
 
-func GenPlan(index string, q *dsl.Dsl) ([]dbSubQuery, error) {
+// Mappings are those of the indices being searched, for any that have one
+func GenPlan(indices []string, mappings map[string]*TemplateMapping, q *dsl.Dsl) ([]dbSubQuery, error) {
 
 	plan := make([]dbSubQuery, 0)
 
+	src := &aggSource{indices: indices, mappings: mappings, q: q}
 	for label, a := range q.Aggs {
-		aggQ := makeDbSubQuery()
-		aggQ.label = &label
-		aggQ.genAggregateSelectExprs(&a)
-
-		aggQ.genSelectExpression()
-		aggQ.sb.From(fmt.Sprintf(`"%s"`, index))
-		aggQ.genQueryWherePredicates(q)
-		aggQ.genAggGroupBy()
-		plan = append(plan, aggQ)
+		a := a
+		// Pipelines are applied to the results of the others
+		if a.GenAggregationCategory() == dsl.Pipeline {
+			continue
+		}
+		aggQ, err := genAggregationPlan(label, &a, src, nil)
+		if err != nil {
+			return nil, err
+		}
+		plan = append(plan, *aggQ)
 	}
 
 	// Handle hits selection case
 	hitsQ := makeDbSubQuery()
-	hitsQ.genHitsSelect(index, q)
-	hitsQ.genQueryWherePredicates(q)
-	hitsQ.genSort(q.Sort)
+	if err := hitsQ.genHitsSelect(indices, mappings, q); err != nil {
+		return nil, err
+	}
+	if err := hitsQ.genSort(q.Sort); err != nil {
+		return nil, err
+	}
 	hitsQ.genLimit(q)
 	hitsQ.aggregation = nil
 	plan = append(plan, hitsQ)
 	return plan, nil
 }
 
-// Generate sql statement for a given Query DSL
-func (dbq *dbSubQuery) genQueryWherePredicates(q *dsl.Dsl) error {
-	// var sql string
-	if q.Query == nil {
-		dbq.sb.Where("1 = 1")
+// Aggregations run over all of the indices being searched, and take the types of
+// fields from the first of them that has a mapping
+func aggregationMapping(indices []string, mappings map[string]*TemplateMapping) *TemplateMapping {
+	for _, index := range indices {
+		if tm := mappings[index]; tm != nil {
+			return tm
+		}
+	}
+	return nil
+}
+
+// Every query runs against a UNION ALL of the indices being searched. The query
+// predicates are applied within each branch so they have access to the underlying
+// fts5 table, and the outer select (hits or aggregations) only needs to know about
+// the _index, _rowid, _id, content and _score columns of the combined set
+func (dbq *dbSubQuery) genDocSource(indices []string, mappings map[string]*TemplateMapping, q *dsl.Dsl) error {
+	branches := make([]sqlbuilder.Builder, 0, len(indices))
+	for _, index := range indices {
+		branch := makeDbSubQuery()
+		branch.index = index
+		branch.mapping = mappings[index]
+		clause, err := branch.genQueryClause(q.Query)
+		if err != nil {
+			return err
+		}
+		branch.sb.Select(
+			branch.sb.As(branch.sb.Var(index), "_index"),
+			branch.sb.As("rowid", "_rowid"),
+			"_id",
+			"content",
+			branch.sb.As(clause.score, "_score"),
+		).
+			// Looks like the Sqlite dialect doesn't properly escape tables with odd characters
+			From(fmt.Sprintf(`%s AS %s`, tableName(index), branchAlias)).
+			Where(clause.pred)
+		branches = append(branches, branch.sb)
+	}
+	if len(branches) == 0 {
+		// Nothing matched the index expression, so search an empty set rather than
+		// generating invalid sql
+		branches = append(branches, sqlbuilder.Buildf(`SELECT NULL AS _index, NULL AS _rowid, NULL AS _id, NULL AS content, NULL AS _score WHERE 0`))
+	}
+	src := sqlbuilder.UnionAll(branches...)
+	preds := make([]string, 0, len(dbq.filters)+1)
+	if q.MinScore != nil {
+		preds = append(preds, dbq.sb.GreaterEqualThan("_score", *q.MinScore))
+	}
+	// The documents of a sub-aggregation are those in its ancestors' buckets
+	for _, filter := range dbq.filters {
+		pred, err := filter(dbq)
+		if err != nil {
+			return err
+		}
+		preds = append(preds, pred)
+	}
+	if len(dbq.sourceExprs) > 0 {
+		where := ""
+		if len(preds) > 0 {
+			where = " WHERE " + dbq.sb.And(preds...)
+		}
+		dbq.sb.From(fmt.Sprintf("(SELECT *, %s FROM (%s)%s) AS docs",
+			strings.Join(dbq.sourceExprs, ", "), dbq.sb.Var(src), where))
 		return nil
 	}
-	if q.Query.Bool != nil {
-		dbq.handleBool(q.Query.Bool)
-	} else if q.Query.Term != nil {
-		dbq.handleTerm(q.Query.Term)
-	} else if q.Query.Match != nil {
-		dbq.handleMatch(q.Query.Match)
-	} else if q.Query.Range != nil {
-		dbq.handleRange(q.Query.Range)
-	} else if q.Query.QueryString != nil {
-		dbq.handleQueryString(q.Query.QueryString)
+	dbq.sb.From(dbq.sb.BuilderAs(src, "docs"))
+	if len(preds) > 0 {
+		dbq.sb.Where(preds...)
 	}
-
 	return nil
 }
 
-func (dbq *dbSubQuery) handleBool(b *dsl.Bool) error {
+// A query compiled to sql against a single index: a predicate selecting the
+// matching documents, and an expression for the relevance score of each
+type sqlClause struct {
+	pred  string
+	score string
+}
+
+// A table quoted for sql built with sqlbuilder, which also needs any $ escaped
+// so that it isn't taken for a placeholder
+func tableName(name string) string {
+	return strings.ReplaceAll(quoteIdent(name), "$", "$$")
+}
+
+// The alias of the fts5 table within a branch of the doc source, so that scoring
+// subqueries against the same table can refer back to the document being scored
+const branchAlias = "doc"
+
+// Used for queries that match everything with a constant score, as match_all does
+func matchAllClause(boost *float64) sqlClause {
+	return sqlClause{pred: "1 = 1", score: fmt.Sprintf("%g", boostValue(boost))}
+}
+
+func boostValue(boost *float64) float64 {
+	if boost == nil {
+		return 1.0
+	}
+	return *boost
+}
+
+// Combine clauses that must all match, summing their scores
+func allOf(clauses []sqlClause) sqlClause {
+	if len(clauses) == 1 {
+		return clauses[0]
+	}
+	preds := make([]string, len(clauses))
+	scores := make([]string, len(clauses))
+	for i, c := range clauses {
+		preds[i] = "(" + c.pred + ")"
+		scores[i] = "(" + c.score + ")"
+	}
+	return sqlClause{pred: strings.Join(preds, " AND "), score: strings.Join(scores, " + ")}
+}
+
+// Generate sql for a given Query DSL
+func (dbq *dbSubQuery) genQueryClause(q *dsl.Query) (sqlClause, error) {
+	if q == nil {
+		return matchAllClause(nil), nil
+	}
+	if q.Bool != nil {
+		return dbq.handleBool(q.Bool)
+	} else if q.Term != nil {
+		return dbq.handleTerm(q.Term)
+	} else if q.Match != nil {
+		return dbq.handleMatch(q.Match, false)
+	} else if q.MatchBoolPrefix != nil {
+		return dbq.handleMatch(q.MatchBoolPrefix, true)
+	} else if q.MatchPhrase != nil {
+		return dbq.handleMatchPhrase(q.MatchPhrase, false)
+	} else if q.MatchPhrasePrefix != nil {
+		return dbq.handleMatchPhrase(q.MatchPhrasePrefix, true)
+	} else if q.MultiMatch != nil {
+		return dbq.handleMultiMatch(q.MultiMatch)
+	} else if q.Range != nil {
+		return dbq.handleRange(q.Range)
+	} else if q.QueryString != nil {
+		return dbq.handleQueryString(q.QueryString)
+	} else if q.SimpleQueryString != nil {
+		return dbq.handleSimpleQueryString(q.SimpleQueryString)
+	} else if q.Terms != nil {
+		return dbq.handleTerms(q.Terms)
+	} else if q.Prefix != nil {
+		return dbq.handlePrefix(q.Prefix)
+	} else if q.Wildcard != nil {
+		return dbq.handleWildcard(q.Wildcard)
+	} else if q.Regexp != nil {
+		return dbq.handleRegexp(q.Regexp)
+	} else if q.Fuzzy != nil {
+		return dbq.handleFuzzy(q.Fuzzy)
+	} else if q.Exists != nil {
+		return dbq.handleExists(q.Exists)
+	} else if q.Ids != nil {
+		return dbq.handleIds(q.Ids)
+	} else if q.MatchNone != nil {
+		return sqlClause{pred: "0", score: "0"}, nil
+	} else if q.MatchAll != nil {
+		return matchAllClause(q.MatchAll.Boost), nil
+	}
+	return matchAllClause(nil), nil
+}
+
+func (dbq *dbSubQuery) genQueryClauses(queries []dsl.Query) ([]sqlClause, error) {
+	clauses := make([]sqlClause, 0, len(queries))
+	for _, v := range queries {
+		v := v
+		c, err := dbq.genQueryClause(&v)
+		if err != nil {
+			return nil, err
+		}
+		clauses = append(clauses, c)
+	}
+	return clauses, nil
+}
+
+// Compile a bool query into a tree of AND/OR/NOT predicates, with nested bool
+// queries compiled recursively through genQueryClause
+// https://www.elastic.co/guide/en/elasticsearch/reference/7.17/query-dsl-bool-query.html
+func (dbq *dbSubQuery) handleBool(b *dsl.Bool) (sqlClause, error) {
+	must, err := dbq.genQueryClauses(b.Must)
+	if err != nil {
+		return sqlClause{}, err
+	}
+	filter, err := dbq.genQueryClauses(b.Filter)
+	if err != nil {
+		return sqlClause{}, err
+	}
+	should, err := dbq.genQueryClauses(b.Should)
+	if err != nil {
+		return sqlClause{}, err
+	}
+	mustNot, err := dbq.genQueryClauses(b.MustNot)
+	if err != nil {
+		return sqlClause{}, err
+	}
+	if len(must)+len(filter)+len(should)+len(mustNot) == 0 {
+		return matchAllClause(b.Boost), nil
+	}
+
+	// Should clauses are optional when there is anything else that has to match,
+	// unless minimum_should_match says otherwise
+	requiredShould := 0
+	if len(should) > 0 && len(must)+len(filter) == 0 {
+		requiredShould = 1
+	}
+	if b.MinimumShouldMatch != "" {
+		if requiredShould, err = minimumShouldMatch(string(b.MinimumShouldMatch), len(should)); err != nil {
+			return sqlClause{}, err
+		}
+	}
+
+	preds := make([]string, 0)
+	scores := make([]string, 0)
+	for _, c := range must {
+		preds = append(preds, "("+c.pred+")")
+		scores = append(scores, "("+c.score+")")
+	}
+	// Filter clauses have to match, but don't contribute to the score
+	for _, c := range filter {
+		preds = append(preds, "("+c.pred+")")
+	}
+	// Predicates on missing fields are NULL, which must_not has to treat as not
+	// matching rather than letting the NULL through
+	for _, c := range mustNot {
+		preds = append(preds, fmt.Sprintf("NOT COALESCE((%s), 0)", c.pred))
+	}
+	// Should clauses add to the score of documents they match
+	shouldPreds := make([]string, 0, len(should))
+	shouldCounts := make([]string, 0, len(should))
+	for _, c := range should {
+		shouldPreds = append(shouldPreds, "("+c.pred+")")
+		shouldCounts = append(shouldCounts, fmt.Sprintf("(CASE WHEN %s THEN 1 ELSE 0 END)", c.pred))
+		scores = append(scores, fmt.Sprintf("CASE WHEN %s THEN %s ELSE 0 END", c.pred, c.score))
+	}
+	switch {
+	case requiredShould == 1:
+		preds = append(preds, "("+strings.Join(shouldPreds, " OR ")+")")
+	case requiredShould > 1:
+		preds = append(preds, fmt.Sprintf("(%s) >= %d", strings.Join(shouldCounts, " + "), requiredShould))
+	}
+	if len(preds) == 0 {
+		preds = append(preds, "1 = 1")
+	}
+	if len(scores) == 0 {
+		scores = append(scores, "0")
+	}
+
+	return sqlClause{
+		pred:  strings.Join(preds, " AND "),
+		score: fmt.Sprintf("(%s) * %g", strings.Join(scores, " + "), boostValue(b.Boost)),
+	}, nil
+}
+
+func (dbq *dbSubQuery) handleMatch(matches map[string]dsl.Match, lastPrefix bool) (sqlClause, error) {
+	clauses := make([]sqlClause, 0, len(matches))
+	for key, val := range matches {
+		value, err := dbq.fieldValue(cleanseKeyField(key))
+		if err != nil {
+			return sqlClause{}, err
+		}
+		c, err := dbq.matchClause(value, val, lastPrefix)
+		if err != nil {
+			return sqlClause{}, err
+		}
+		clauses = append(clauses, c)
+	}
+	return allOf(clauses), nil
+}
 
-	if b.Must != nil {
-		for _, v := range b.Must {
-			if v.Match != nil {
-				dbq.handleMatch(v.Match)
-			} else if v.Term != nil {
-				dbq.handleTerm(v.Term)
-			} else if v.Range != nil {
-				dbq.handleRange(v.Range)
-			} else if v.QueryString != nil {
-				dbq.handleQueryString(v.QueryString)
+func (dbq *dbSubQuery) handleMatchPhrase(phrases map[string]dsl.MatchPhrase, prefix bool) (sqlClause, error) {
+	clauses := make([]sqlClause, 0, len(phrases))
+	for key, val := range phrases {
+		value, err := dbq.fieldValue(cleanseKeyField(key))
+		if err != nil {
+			return sqlClause{}, err
+		}
+		c, err := dbq.phraseClause(value, val, prefix)
+		if err != nil {
+			return sqlClause{}, err
+		}
+		clauses = append(clauses, c)
+	}
+	return allOf(clauses), nil
+}
+
+// https://www.elastic.co/guide/en/elasticsearch/reference/7.17/query-dsl-multi-match-query.html
+func (dbq *dbSubQuery) handleMultiMatch(mm *dsl.MultiMatch) (sqlClause, error) {
+	type boostedField struct {
+		value string
+		boost float64
+	}
+	fields := make([]boostedField, 0, len(mm.Fields))
+	for _, f := range mm.Fields {
+		// Fields can be boosted individually, eg. `title^3`
+		bf := boostedField{boost: 1.0}
+		if i := strings.LastIndex(f, "^"); i >= 0 {
+			b, err := strconv.ParseFloat(f[i+1:], 64)
+			if err != nil {
+				return sqlClause{}, &QueryError{Reason: fmt.Sprintf("invalid boost in field [%s]", f)}
 			}
+			f, bf.boost = f[:i], b
 		}
-	} else if b.Should != nil {
-		for _, v := range b.Should {
-			if v.Match != nil {
-				dbq.handleMatch(v.Match)
-			} else if v.Term != nil {
-				dbq.handleTerm(v.Term)
-			} else if v.Range != nil {
-				dbq.handleRange(v.Range)
-			} else if v.QueryString != nil {
-				dbq.handleQueryString(v.QueryString)
+		value, err := dbq.fieldValue(cleanseKeyField(f))
+		if err != nil {
+			return sqlClause{}, err
+		}
+		bf.value = value
+		fields = append(fields, bf)
+	}
+	if len(fields) == 0 {
+		fields = append(fields, boostedField{value: "content", boost: 1.0})
+	}
+
+	match := dsl.Match{
+		Query:               mm.Query,
+		Analyzer:            mm.Analyzer,
+		Fuzziness:           mm.Fuzziness,
+		PrefixLength:        mm.PrefixLength,
+		MaxExpansions:       mm.MaxExpansions,
+		FuzzyTranspositions: mm.FuzzyTranspositions,
+		Operator:            mm.Operator,
+		MinimumShouldMatch:  mm.MinimumShouldMatch,
+		ZeroTermsQuery:      mm.ZeroTermsQuery,
+		Lenient:             mm.Lenient,
+	}
+	phrase := dsl.MatchPhrase{
+		Query:          mm.Query,
+		Analyzer:       mm.Analyzer,
+		Slop:           mm.Slop,
+		MaxExpansions:  mm.MaxExpansions,
+		ZeroTermsQuery: mm.ZeroTermsQuery,
+	}
+
+	var (
+		c   sqlClause
+		err error
+	)
+	if mm.Type == "cross_fields" {
+		// The fields are searched as if they were one big field, so each token can
+		// be found in any of them, and scored with the highest of their boosts
+		values := make([]string, len(fields))
+		boost := fields[0].boost
+		for i, f := range fields {
+			values[i] = f.value
+			if f.boost > boost {
+				boost = f.boost
+			}
+		}
+		match.Boost = &boost
+		c, err = dbq.matchClause(fmt.Sprintf("json_array(%s)", strings.Join(values, ", ")), match, false)
+	} else {
+		clauses := make([]sqlClause, 0, len(fields))
+		for _, f := range fields {
+			boost := f.boost
+			match.Boost, phrase.Boost = &boost, &boost
+			var fc sqlClause
+			switch mm.Type {
+			case "", "best_fields", "most_fields":
+				fc, err = dbq.matchClause(f.value, match, false)
+			case "bool_prefix":
+				fc, err = dbq.matchClause(f.value, match, true)
+			case "phrase":
+				fc, err = dbq.phraseClause(f.value, phrase, false)
+			case "phrase_prefix":
+				fc, err = dbq.phraseClause(f.value, phrase, true)
+			default:
+				return sqlClause{}, &QueryError{Reason: fmt.Sprintf("unknown multi_match type [%s]", mm.Type)}
+			}
+			if err != nil {
+				return sqlClause{}, err
 			}
+			clauses = append(clauses, fc)
 		}
-	} else if b.Filter != nil {
-		for _, v := range b.Filter {
-			if v.Match != nil {
-				dbq.handleMatch(v.Match)
-			} else if v.Term != nil {
-				dbq.handleTerm(v.Term)
-			} else if v.Range != nil {
-				dbq.handleRange(v.Range)
-			} else if v.QueryString != nil {
-				dbq.handleQueryString(v.QueryString)
+		// Most fields adds up the scores of every field that matches, the others
+		// take the best field plus tie_breaker times the rest
+		if mm.Type == "most_fields" || mm.Type == "bool_prefix" {
+			c = anyOf(clauses, nil)
+		} else {
+			tieBreaker := 0.0
+			if mm.TieBreaker != nil {
+				tieBreaker = *mm.TieBreaker
 			}
+			c = anyOf(clauses, &tieBreaker)
 		}
 	}
-	return nil
+	if err != nil {
+		return sqlClause{}, err
+	}
+	c.score = fmt.Sprintf("(%s) * %g", c.score, boostValue(mm.Boost))
+	return c, nil
 }
 
-func (dbq *dbSubQuery) handleMatch(matches map[string]dsl.Match) error {
-	// TODO This is just a glorified terms query now - need to add support for
-	// other match capabilities and start leveraging FTS5's capabilities
-	for _key, val := range matches {
-		key := cleanseKeyField(_key)
-		iVal, err := strconv.ParseInt(val.Query, 10, 64)
-		if err == nil {
-			// Interpret this as an integer
-			dbq.sb.Where(fmt.Sprintf(` JSON_EXTRACT(content, '$.%s') = %d `, key, iVal))
-		} else {
-			dbq.sb.Where(fmt.Sprintf(` JSON_EXTRACT(content, '$.%s') = '%s' `, key, val.Query))
+// Combine clauses of which at least one has to match. The scores of those that do
+// are summed, or with a tieBreaker combined as dis_max does, ie. the best score
+// plus tieBreaker times the others
+func anyOf(clauses []sqlClause, tieBreaker *float64) sqlClause {
+	if len(clauses) == 1 {
+		return clauses[0]
+	}
+	preds := make([]string, len(clauses))
+	scores := make([]string, len(clauses))
+	for i, c := range clauses {
+		preds[i] = "(" + c.pred + ")"
+		scores[i] = fmt.Sprintf("CASE WHEN %s THEN %s ELSE 0 END", c.pred, c.score)
+	}
+	sum := strings.Join(scores, " + ")
+	score := sum
+	if tieBreaker != nil {
+		best := fmt.Sprintf("MAX(%s)", strings.Join(scores, ", "))
+		score = best
+		if *tieBreaker != 0 {
+			score = fmt.Sprintf("%s + %g * ((%s) - %s)", best, *tieBreaker, sum, best)
 		}
 	}
+	return sqlClause{pred: strings.Join(preds, " OR "), score: score}
+}
 
-	return nil
+// The sql for the json value of a field, as the full text functions expect it.
+// With no field, the whole document is searched
+func (dbq *dbSubQuery) fieldValue(field string) (string, error) {
+	if field == "" || field == "*" {
+		return "content", nil
+	}
+	return dbq.fieldExpr(field, `content -> %s`)
 }
 
-func (dbq *dbSubQuery) handleTerm(terms map[string]dsl.Term) error {
-	for _key, val := range terms {
-		key := cleanseKeyField(_key)
-		iVal, err := strconv.ParseInt(val.Value, 10, 64)
-		if err == nil {
-			// Interpret this as an integer
-			dbq.sb.Where(fmt.Sprintf(` JSON_EXTRACT(content, '$.%s') = %d `, key, iVal))
-		} else {
-			dbq.sb.Where(fmt.Sprintf(` JSON_EXTRACT(content, '$.%s') = '%s' `, key, val.Value))
+// Format an expression on the value of a field with a placeholder for its json
+// path. When a field name has dots in it, the field may be either nested objects
+// or a key with the dots in it, so the expression is tried with each
+func (dbq *dbSubQuery) fieldExpr(field string, format string) (string, error) {
+	paths, err := jsonPaths(field)
+	if err != nil {
+		return "", err
+	}
+	exprs := make([]string, len(paths))
+	for i, path := range paths {
+		exprs[i] = fmt.Sprintf(format, dbq.sb.Var(path))
+	}
+	if len(exprs) == 1 {
+		return exprs[0], nil
+	}
+	return fmt.Sprintf("COALESCE(%s)", strings.Join(exprs, ", ")), nil
+}
+
+// The sqlite json paths a field name can refer to. As in ES, dots separate the
+// names of nested objects, but failing that the field can also be a key that has
+// the dots in it. Keys are quoted so that they can hold any other character.
+// sqlite compares keys with their escaped form in the json, and can't have a
+// double quote within a quoted key, but does allow one in an unquoted key
+func jsonPaths(field string) ([]string, error) {
+	invalid := &QueryError{Reason: fmt.Sprintf("invalid field name [%s]", field)}
+	if field == "" {
+		return nil, invalid
+	}
+	paths := make([]string, 0, 2)
+	parts := strings.Split(field, ".")
+	nested := "$"
+	for _, part := range parts {
+		key, ok := jsonPathKey(part)
+		if !ok {
+			nested = ""
+			break
+		}
+		nested += "." + key
+	}
+	if nested != "" {
+		paths = append(paths, nested)
+	}
+	if len(parts) > 1 {
+		if key, ok := jsonPathKey(field); ok {
+			paths = append(paths, "$."+key)
 		}
 	}
+	if len(paths) == 0 {
+		return nil, invalid
+	}
+	return paths, nil
+}
 
-	return nil
+func jsonPathKey(key string) (string, bool) {
+	if key == "" {
+		return "", false
+	}
+	buf := bytes.Buffer{}
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(key); err != nil {
+		return "", false
+	}
+	escaped := strings.TrimSpace(buf.String())
+	escaped = escaped[1 : len(escaped)-1]
+	switch {
+	case !strings.Contains(escaped, `"`):
+		return `"` + escaped + `"`, true
+	case !strings.ContainsAny(escaped, ".["):
+		return escaped, true
+	}
+	return "", false
+}
+
+// Full text queries on text that analyzes to nothing, eg. only punctuation or an
+// empty string, match either nothing or everything
+func zeroTermsClause(zeroTermsQuery string, boost *float64) (sqlClause, error) {
+	switch zeroTermsQuery {
+	case "", "none":
+		return sqlClause{pred: "0", score: "0"}, nil
+	case "all":
+		return matchAllClause(boost), nil
+	}
+	return sqlClause{}, &QueryError{Reason: fmt.Sprintf("unknown zero_terms_query [%s]", zeroTermsQuery)}
+}
+
+// Analyze the query text and search for its tokens in the json value of a field,
+// scored with bm25. The bm25 statistics are those of the whole document rather
+// than just the field. With lastPrefix set, the last token is searched for as a
+// prefix as match_bool_prefix does.
+//
+// Fields aren't typed at query time, so values that can't match the type of a
+// field simply don't match, as they would with `lenient` set
+func (dbq *dbSubQuery) matchClause(value string, m dsl.Match, lastPrefix bool) (sqlClause, error) {
+	tokens, err := analyze(m.Analyzer, m.Query)
+	if err != nil {
+		return sqlClause{}, &QueryError{Reason: err.Error()}
+	}
+	if len(tokens) == 0 {
+		return zeroTermsClause(m.ZeroTermsQuery, m.Boost)
+	}
+	fuzziness := string(m.Fuzziness)
+	if _, err = maxEdits(fuzziness, ""); err != nil {
+		return sqlClause{}, &QueryError{Reason: err.Error()}
+	}
+	required, err := matchRequiredTokens(m, len(distinctTokens(tokens)))
+	if err != nil {
+		return sqlClause{}, err
+	}
+
+	transpositions := m.FuzzyTranspositions == nil || *m.FuzzyTranspositions
+	check := fmt.Sprintf(
+		`fts_match(%s, %s, %s, %s, %d, %t, %t) >= %d`,
+		value, dbq.sb.Var(m.Query), dbq.sb.Var(m.Analyzer), dbq.sb.Var(fuzziness),
+		m.PrefixLength, transpositions, lastPrefix, required,
+	)
+	ftsExpr := dbq.ftsMatchExpr(tokens, required == len(distinctTokens(tokens)), m, lastPrefix)
+	return dbq.ftsClause(check, ftsExpr, m.Boost), nil
+}
+
+// Search for the tokens of the query text in order within the json value of a
+// field, scored with bm25. FTS5 phrases are used to find candidates, or NEAR groups
+// when some slop is allowed. With prefix set the last token is a prefix, as for
+// match_phrase_prefix
+func (dbq *dbSubQuery) phraseClause(value string, p dsl.MatchPhrase, prefix bool) (sqlClause, error) {
+	tokens, err := analyze(p.Analyzer, p.Query)
+	if err != nil {
+		return sqlClause{}, &QueryError{Reason: err.Error()}
+	}
+	if len(tokens) == 0 {
+		return zeroTermsClause(p.ZeroTermsQuery, p.Boost)
+	}
+	check := fmt.Sprintf(
+		`fts_phrase(%s, %s, %s, %d, %t)`,
+		value, dbq.sb.Var(p.Query), dbq.sb.Var(p.Analyzer), p.Slop, prefix,
+	)
+
+	ftsToks := make([]string, 0, len(tokens))
+	for _, tok := range tokens {
+		ftsToks = append(ftsToks, ftsTokens(tok)...)
+	}
+	ftsExpr := ""
+	if len(ftsToks) > 0 {
+		phrase := ftsQuote(strings.Join(ftsToks, " "))
+		if prefix {
+			phrase += " *"
+		}
+		if p.Slop > 0 && len(ftsToks) > 1 {
+			// NEAR doesn't care about order, and counts the tokens between the first
+			// and last phrase, so allow for the terms in between as well as the slop
+			quoted := make([]string, len(ftsToks))
+			for i, tok := range ftsToks {
+				quoted[i] = ftsQuote(tok)
+			}
+			if prefix {
+				quoted[len(quoted)-1] += " *"
+			}
+			phrase = fmt.Sprintf("NEAR(%s, %d)", strings.Join(quoted, " "), p.Slop+len(ftsToks))
+		}
+		ftsExpr = dbq.sb.Var(phrase)
+	}
+	return dbq.ftsClause(check, ftsExpr, p.Boost), nil
+}
+
+// Combine the check of a full text query on a field with the FTS5 query that finds
+// the candidates for it, scored by bm25. If there's nothing the FTS5 index can
+// look up, eg. punctuation with the whitespace analyzer, only the check applies
+func (dbq *dbSubQuery) ftsClause(check string, ftsExpr string, boost *float64) sqlClause {
+	if ftsExpr == "" {
+		return sqlClause{pred: check, score: fmt.Sprintf("%g", boostValue(boost))}
+	}
+	table := tableName(dbq.index)
+	pred := fmt.Sprintf(`rowid IN (SELECT rowid FROM %s WHERE %s MATCH %s) AND %s`, table, table, ftsExpr, check)
+	score := fmt.Sprintf(
+		`COALESCE((SELECT -bm25(%s) FROM %s WHERE %s MATCH %s AND rowid = %s.rowid), 0) * %g`,
+		table, table, table, ftsExpr, branchAlias, boostValue(boost),
+	)
+	return sqlClause{pred: pred, score: score}
+}
+
+// How many of the distinct tokens of a match query a document needs to contain
+func matchRequiredTokens(m dsl.Match, tokens int) (int, error) {
+	switch strings.ToLower(m.Operator) {
+	case "and":
+		return tokens, nil
+	case "", "or":
+	default:
+		return 0, &QueryError{Reason: fmt.Sprintf("unknown operator [%s]", m.Operator)}
+	}
+	if m.MinimumShouldMatch == "" {
+		return 1, nil
+	}
+	required, err := minimumShouldMatch(string(m.MinimumShouldMatch), tokens)
+	if err != nil {
+		return 0, err
+	}
+	// At least one token always has to match
+	if required < 1 {
+		required = 1
+	}
+	return required, nil
+}
+
+// Build the sql expression for an FTS5 query that finds the candidates for a match
+// query. Whatever the analyzer, the FTS5 index only knows the standard tokens of
+// the text, so those are what's looked up. With fuzziness each token is expanded
+// to the terms of the index vocabulary it could match, other than a last token
+// that is a prefix.
+func (dbq *dbSubQuery) ftsMatchExpr(tokens []string, all bool, m dsl.Match, lastPrefix bool) string {
+	ftsToks := make([]string, 0, len(tokens))
+	for _, tok := range tokens {
+		ftsToks = append(ftsToks, ftsTokens(tok)...)
+	}
+	ftsToks = distinctTokens(ftsToks)
+	if len(ftsToks) == 0 {
+		return ""
+	}
+	op := " OR "
+	if all {
+		op = " AND "
+	}
+
+	isPrefix := func(i int) bool {
+		return lastPrefix && i == len(ftsToks)-1
+	}
+
+	fuzziness := string(m.Fuzziness)
+	if fuzziness == "" || fuzziness == "0" {
+		quoted := make([]string, len(ftsToks))
+		for i, tok := range ftsToks {
+			quoted[i] = ftsQuote(tok)
+			if isPrefix(i) {
+				quoted[i] += "*"
+			}
+		}
+		return dbq.sb.Var(strings.Join(quoted, op))
+	}
+
+	maxExpansions := 50
+	if m.MaxExpansions != nil {
+		maxExpansions = *m.MaxExpansions
+	}
+	transpositions := m.FuzzyTranspositions == nil || *m.FuzzyTranspositions
+	groups := make([]string, len(ftsToks))
+	for i, tok := range ftsToks {
+		if isPrefix(i) {
+			groups[i] = dbq.sb.Var(ftsQuote(tok) + "*")
+			continue
+		}
+		tokVar := dbq.sb.Var(tok)
+		// Exact matches first, then the terms found in the most documents. If
+		// nothing is close enough fall back to the token itself, which won't match
+		groups[i] = fmt.Sprintf(
+			`COALESCE((SELECT group_concat('"' || term || '"', ' OR ') FROM (`+
+				`SELECT term FROM %s WHERE fts_fuzzy(term, %s, %s, %d, %t) ORDER BY term <> %s, doc DESC LIMIT %d`+
+				`)), %s)`,
+			tableName(vocabTable(dbq.index)), tokVar, dbq.sb.Var(fuzziness), m.PrefixLength, transpositions,
+			tokVar, maxExpansions, dbq.sb.Var(ftsQuote(tok)),
+		)
+	}
+	return fmt.Sprintf(`('(' || %s || ')')`, strings.Join(groups, fmt.Sprintf(` || ')%s(' || `, op)))
+}
+
+// Term level queries aren't analyzed, so they all score the same
+// https://www.elastic.co/guide/en/elasticsearch/reference/7.17/term-level-queries.html
+func (dbq *dbSubQuery) handleTerm(terms map[string]dsl.Term) (sqlClause, error) {
+	clauses := make([]sqlClause, 0, len(terms))
+	for key, val := range terms {
+		pred, err := dbq.termsPred(cleanseKeyField(key), []string{string(val.Value)}, val.CaseInsensitive)
+		if err != nil {
+			return sqlClause{}, err
+		}
+		clauses = append(clauses, sqlClause{pred: pred, score: fmt.Sprintf("%g", boostValue(val.Boost))})
+	}
+	return allOf(clauses), nil
+}
+
+func (dbq *dbSubQuery) handleTerms(t *dsl.Terms) (sqlClause, error) {
+	field := cleanseKeyField(t.Field)
+	score := fmt.Sprintf("%g", boostValue(t.Boost))
+	if t.Lookup == nil {
+		pred, err := dbq.termsPred(field, t.Values, false)
+		return sqlClause{pred: pred, score: score}, err
+	}
+	// The values are looked up from a field of another document as the query runs
+	lk := t.Lookup
+	if lk.Index == "" || lk.Id == "" || lk.Path == "" {
+		return sqlClause{}, &QueryError{Reason: "[terms] query lookup requires an index, id and path"}
+	}
+	if err := validateIndexName(lk.Index); err != nil {
+		return sqlClause{}, &QueryError{Reason: err.Error()}
+	}
+	lookupDoc := fmt.Sprintf(`(SELECT content FROM %s WHERE _id = %s)`, tableName(lk.Index), dbq.sb.Var(lk.Id))
+	lookup, err := dbq.fieldElements(cleanseKeyField(lk.Path), lookupDoc)
+	if err != nil {
+		return sqlClause{}, err
+	}
+	elements, err := dbq.fieldElements(field, "content")
+	if err != nil {
+		return sqlClause{}, err
+	}
+	pred := fmt.Sprintf(`EXISTS (SELECT 1 FROM %s WHERE value IN (SELECT value FROM %s))`, elements, lookup)
+	return sqlClause{pred: pred, score: score}, nil
+}
+
+// The indices that terms queries look up values from, anywhere in the query or
+// the filters of its aggregations, which have to exist before the query can run
+func lookupIndices(q *dsl.Dsl) []string {
+	indices := make([]string, 0)
+	var walkQuery func(q *dsl.Query)
+	walkQuery = func(q *dsl.Query) {
+		if q == nil {
+			return
+		}
+		if q.Terms != nil && q.Terms.Lookup != nil && validateIndexName(q.Terms.Lookup.Index) == nil {
+			indices = append(indices, q.Terms.Lookup.Index)
+		}
+		if b := q.Bool; b != nil {
+			for _, clauses := range [][]dsl.Query{b.Must, b.Should, b.Filter, b.MustNot} {
+				for i := range clauses {
+					walkQuery(&clauses[i])
+				}
+			}
+		}
+	}
+	var walkAggs func(aggs map[string]dsl.Aggregate)
+	walkAggs = func(aggs map[string]dsl.Aggregate) {
+		for _, a := range aggs {
+			walkQuery(a.Filter)
+			if a.Filters != nil {
+				for _, f := range a.Filters.Filters {
+					f := f
+					walkQuery(&f)
+				}
+				for i := range a.Filters.Anonymous {
+					walkQuery(&a.Filters.Anonymous[i])
+				}
+			}
+			if a.SignificantTerms != nil {
+				walkQuery(a.SignificantTerms.BackgroundFilter)
+			}
+			walkAggs(a.Aggs)
+		}
+	}
+	walkQuery(q.Query)
+	walkAggs(q.Aggs)
+	return indices
+}
+
+// The rows of a field's value that term level queries compare with, from the json
+// of doc; one for each element of an array, or just the one for any other value
+func (dbq *dbSubQuery) fieldElements(field string, doc string) (string, error) {
+	paths, err := jsonPaths(field)
+	if err != nil {
+		return "", err
+	}
+	if len(paths) == 1 {
+		return fmt.Sprintf(`json_each(%s, %s)`, doc, dbq.sb.Var(paths[0])), nil
+	}
+	each := make([]string, len(paths))
+	for i, path := range paths {
+		each[i] = fmt.Sprintf(`SELECT value, type FROM json_each(%s, %s)`, doc, dbq.sb.Var(path))
+	}
+	return "(" + strings.Join(each, " UNION ALL ") + ")", nil
+}
+
+// Whether the field has any of the values. Numbers in json are compared as such,
+// so values that look like numbers are compared as both a number and a string
+func (dbq *dbSubQuery) termsPred(field string, values []string, caseInsensitive bool) (string, error) {
+	if len(values) == 0 {
+		return "0", nil
+	}
+	elements, err := dbq.fieldElements(field, "content")
+	if err != nil {
+		return "", err
+	}
+	vars := make([]string, 0, len(values))
+	types := make([]string, 0)
+	for _, v := range values {
+		if caseInsensitive {
+			vars = append(vars, dbq.sb.Var(strings.ToLower(v)))
+			continue
+		}
+		vars = append(vars, dbq.sb.Var(v))
+		if i, err := strconv.ParseInt(v, 10, 64); err == nil {
+			vars = append(vars, dbq.sb.Var(i))
+		} else if f, err := strconv.ParseFloat(v, 64); err == nil {
+			vars = append(vars, dbq.sb.Var(f))
+		} else if v == "true" || v == "false" {
+			types = append(types, dbq.sb.Var(v))
+		}
+	}
+	value := "value"
+	if caseInsensitive {
+		value = "lower(value)"
+	}
+	cond := fmt.Sprintf(`%s IN (%s)`, value, strings.Join(vars, ", "))
+	if len(types) > 0 {
+		cond = fmt.Sprintf(`(%s OR type IN (%s))`, cond, strings.Join(types, ", "))
+	}
+	return fmt.Sprintf(`EXISTS (SELECT 1 FROM %s WHERE %s)`, elements, cond), nil
+}
+
+func (dbq *dbSubQuery) handleIds(ids *dsl.Ids) (sqlClause, error) {
+	if len(ids.Values) == 0 {
+		return sqlClause{pred: "0", score: "0"}, nil
+	}
+	vars := make([]string, len(ids.Values))
+	for i, id := range ids.Values {
+		vars[i] = dbq.sb.Var(id)
+	}
+	return sqlClause{
+		pred:  fmt.Sprintf(`_id IN (%s)`, strings.Join(vars, ", ")),
+		score: fmt.Sprintf("%g", boostValue(ids.Boost)),
+	}, nil
+}
+
+func (dbq *dbSubQuery) handlePrefix(prefixes map[string]dsl.Prefix) (sqlClause, error) {
+	wildcards := make(map[string]dsl.Wildcard, len(prefixes))
+	for key, val := range prefixes {
+		wildcards[key] = dsl.Wildcard{
+			Value:           escapeWildcards(val.Value) + "*",
+			Boost:           val.Boost,
+			CaseInsensitive: val.CaseInsensitive,
+		}
+	}
+	return dbq.handleWildcard(wildcards)
+}
+
+// Regular expressions use Go's RE2 syntax, which covers the common operators of
+// Lucene's, and like them have to match a whole value or term
+func (dbq *dbSubQuery) handleRegexp(regexps map[string]dsl.Regexp) (sqlClause, error) {
+	clauses := make([]sqlClause, 0, len(regexps))
+	for key, val := range regexps {
+		if _, err := compileRegexp(val.Value, val.CaseInsensitive); err != nil {
+			return sqlClause{}, &QueryError{Reason: fmt.Sprintf("invalid regular expression [%s]: %s", val.Value, err)}
+		}
+		value, err := dbq.fieldValue(cleanseKeyField(key))
+		if err != nil {
+			return sqlClause{}, err
+		}
+		pred := fmt.Sprintf(`fts_regexp(%s, %s, %t)`, value, dbq.sb.Var(val.Value), val.CaseInsensitive)
+		clauses = append(clauses, sqlClause{pred: pred, score: fmt.Sprintf("%g", boostValue(val.Boost))})
+	}
+	return allOf(clauses), nil
+}
+
+// Fuzzy queries find the terms of a field within an edit distance of the value,
+// which the match machinery already does; unlike match though, the score is
+// constant
+func (dbq *dbSubQuery) handleFuzzy(fuzzies map[string]dsl.Fuzzy) (sqlClause, error) {
+	clauses := make([]sqlClause, 0, len(fuzzies))
+	for key, val := range fuzzies {
+		fuzziness := val.Fuzziness
+		if fuzziness == "" {
+			fuzziness = "AUTO"
+		}
+		value, err := dbq.fieldValue(cleanseKeyField(key))
+		if err != nil {
+			return sqlClause{}, err
+		}
+		c, err := dbq.matchClause(value, dsl.Match{
+			Query:               val.Value,
+			Fuzziness:           fuzziness,
+			PrefixLength:        val.PrefixLength,
+			MaxExpansions:       val.MaxExpansions,
+			FuzzyTranspositions: val.Transpositions,
+			Operator:            "and",
+		}, false)
+		if err != nil {
+			return sqlClause{}, err
+		}
+		clauses = append(clauses, sqlClause{pred: c.pred, score: fmt.Sprintf("%g", boostValue(val.Boost))})
+	}
+	return allOf(clauses), nil
 }
 
 func cleanseKeyField(f string) string {
@@ -161,133 +990,708 @@ func cleanseKeyField(f string) string {
 	return key
 }
 
-func (dbq *dbSubQuery) handleRange(rngFlds map[string]dsl.Range) error {
-	// TODO Currently only working for date ranges
-	fmtStr := "epoch_millis"
-	var (
-		dVal *string
-		err  error
-	)
-	for fld, rng := range rngFlds {
+func (dbq *dbSubQuery) handleRange(rngFlds map[string]dsl.Range) (sqlClause, error) {
+	clauses := make([]sqlClause, 0, len(rngFlds))
+	for key, rng := range rngFlds {
+		field := cleanseKeyField(key)
+		loc, err := date.ParseTimeZone(rng.TimeZone)
+		if err != nil {
+			return sqlClause{}, &QueryError{Reason: err.Error()}
+		}
+		prop, _ := dbq.mapping.fieldType(field)
+		kind, isRangeField := mappedRangeKind(prop.Type)
+		rc := rangeCompare{dbq: dbq, field: field, kind: kind, format: prop.Format, loc: loc}
 		if rng.Format != nil {
-			fmtStr = *rng.Format
+			rc.format = *rng.Format
+			rc.dateFormat = true
 		}
-		if rng.Lte != nil {
-			dVal, err = date.DateFormat(fmtStr, *rng.Lte)
-			dbq.sb.Where(fmt.Sprintf(` DATETIME(JSON_EXTRACT(content, '$.%s'), 'auto') <= '%s' `, fld, *dVal))
-		} else if rng.Lt != nil {
-			dVal, err = date.DateFormat(fmtStr, *rng.Lt)
-			dbq.sb.Where(fmt.Sprintf(` DATETIME(JSON_EXTRACT(content, '$.%s'), 'auto') < '%s' `, fld, *dVal))
+		lower, upper := rangeBounds(rng)
+
+		var pred string
+		if isRangeField {
+			pred, err = rc.rangeFieldPred(rng.Relation, lower, upper)
+		} else {
+			pred, err = rc.valuePred(rng.Relation, lower, upper)
 		}
-		if rng.Gte != nil {
-			dVal, err = date.DateFormat(fmtStr, *rng.Gte)
-			dbq.sb.Where(fmt.Sprintf(` DATETIME(JSON_EXTRACT(content, '$.%s'), 'auto') >= '%s' `, fld, *dVal))
-		} else if rng.Gt != nil {
-			dVal, err = date.DateFormat(fmtStr, *rng.Gt)
-			dbq.sb.Where(fmt.Sprintf(` DATETIME(JSON_EXTRACT(content, '$.%s'), 'auto') > '%s' `, fld, *dVal))
+		if err != nil {
+			return sqlClause{}, err
 		}
+		clauses = append(clauses, sqlClause{pred: pred, score: fmt.Sprintf("%g", boostValue(rng.Boost))})
+	}
+	if len(clauses) == 0 {
+		return matchAllClause(nil), nil
+	}
+	return allOf(clauses), nil
+}
 
+// A bound of a range query and the comparison it makes, eg. >= for gte
+type rangeBound struct {
+	value string
+	op    string
+}
+
+// As with dates given to some precision, date math rounds up for the bounds that
+// include the whole of the unit, gt and lte
+func (b *rangeBound) roundUp() bool {
+	return b.op == ">" || b.op == "<="
+}
+
+// The lower and upper bounds of a range, if it has them. gte takes precedence over
+// gt, lte over lt, and either over the older from/to form
+func rangeBounds(rng dsl.Range) (lower, upper *rangeBound) {
+	inclusive := func(b *bool) bool { return b == nil || *b }
+	switch {
+	case rng.Gte != nil:
+		lower = &rangeBound{string(*rng.Gte), ">="}
+	case rng.Gt != nil:
+		lower = &rangeBound{string(*rng.Gt), ">"}
+	case rng.From != nil:
+		lower = &rangeBound{string(*rng.From), ">"}
+		if inclusive(rng.IncludeLower) {
+			lower.op = ">="
+		}
+	}
+	switch {
+	case rng.Lte != nil:
+		upper = &rangeBound{string(*rng.Lte), "<="}
+	case rng.Lt != nil:
+		upper = &rangeBound{string(*rng.Lt), "<"}
+	case rng.To != nil:
+		upper = &rangeBound{string(*rng.To), "<"}
+		if inclusive(rng.IncludeUpper) {
+			upper.op = "<="
+		}
+	}
+	return lower, upper
+}
+
+// How values are compared with the bounds of a range, by the mapped type of the
+// field
+type rangeKind int
+
+const (
+	rangeUnmapped rangeKind = iota
+	rangeNumeric
+	rangeKeyword
+	rangeDate
+	rangeDateNanos
+	rangeIP
+	// An integer bound of an unmapped field, which is either a number or epoch
+	// millis depending on the value it's compared with
+	rangeInteger
+)
+
+// The kind of comparison for a mapped type, and whether the type is one of the
+// range types whose values are themselves ranges
+func mappedRangeKind(typ string) (rangeKind, bool) {
+	switch typ {
+	case "long", "integer", "short", "byte", "double", "float", "half_float", "scaled_float", "unsigned_long":
+		return rangeNumeric, false
+	case "keyword", "constant_keyword", "wildcard", "text", "match_only_text":
+		return rangeKeyword, false
+	case "date":
+		return rangeDate, false
+	case "date_nanos":
+		return rangeDateNanos, false
+	case "ip":
+		return rangeIP, false
+	case "integer_range", "long_range", "float_range", "double_range":
+		return rangeNumeric, true
+	case "date_range":
+		return rangeDate, true
+	case "ip_range":
+		return rangeIP, true
+	}
+	return rangeUnmapped, false
+}
+
+type rangeCompare struct {
+	dbq   *dbSubQuery
+	field string
+	kind  rangeKind
+	// The format for date bounds, either the query's or the mapping's
+	format     string
+	dateFormat bool
+	loc        *time.Location
+}
+
+// Compare a value of the field, and its json type, with a bound. Dates are
+// compared as epoch millis; mapped date fields are stored as RFC3339 strings, but
+// numbers are taken to be epoch millis already. date_nanos fields compare to the
+// nanosecond
+func (rc *rangeCompare) compare(value, typ, op string, b *rangeBound) (string, error) {
+	kind := rc.kind
+	if kind == rangeUnmapped {
+		kind = rc.unmappedKind(b)
+	}
+	switch kind {
+	case rangeNumeric:
+		n, err := strconv.ParseFloat(b.value, 64)
 		if err != nil {
-			return err
+			return "", &QueryError{Reason: fmt.Sprintf("failed to parse [%s] as a number for field [%s]", b.value, rc.field)}
+		}
+		arg := rc.dbq.sb.Var(n)
+		if i, err := strconv.ParseInt(b.value, 10, 64); err == nil {
+			arg = rc.dbq.sb.Var(i)
+		}
+		return fmt.Sprintf(`(CASE WHEN %s IN ('integer', 'real') THEN %s WHEN %s = 'text' THEN CAST(%s AS NUMERIC) END) %s %s`,
+			typ, value, typ, value, op, arg), nil
+	case rangeDate, rangeDateNanos:
+		t, err := date.ParseMath(b.value, rc.format, rc.loc, b.roundUp(), time.Now())
+		if err != nil {
+			return "", &QueryError{Reason: err.Error()}
+		}
+		if kind == rangeDateNanos {
+			// Stored with a fixed width fraction, so they compare as strings
+			return fmt.Sprintf(`(CASE WHEN %s = 'text' THEN %s END) %s %s`,
+				typ, value, op, rc.dbq.sb.Var(date.StoredDate(t, true))), nil
+		}
+		return fmt.Sprintf(`%s %s %s`, epochMillis(value, typ), op, rc.dbq.sb.Var(t.UnixMilli())), nil
+	case rangeInteger:
+		i, err := strconv.ParseInt(b.value, 10, 64)
+		if err != nil {
+			return "", &QueryError{Reason: fmt.Sprintf("failed to parse [%s] as a number for field [%s]", b.value, rc.field)}
+		}
+		return fmt.Sprintf(`(CASE WHEN %s IN ('integer', 'real') THEN %s %s %s ELSE %s %s %s END)`,
+			typ, value, op, rc.dbq.sb.Var(i), epochMillis(value, typ), op, rc.dbq.sb.Var(i)), nil
+	case rangeIP:
+		key := ipKey(b.value)
+		if key == nil {
+			return "", &QueryError{Reason: fmt.Sprintf("'%s' is not an IP string literal", b.value)}
 		}
-		break
+		return fmt.Sprintf(`ip_key(%s) %s %s`, value, op, rc.dbq.sb.Var(key)), nil
+	case rangeKeyword:
+		return fmt.Sprintf(`CAST(%s AS TEXT) %s %s`, value, op, rc.dbq.sb.Var(b.value)), nil
 	}
-	return nil
+	return fmt.Sprintf(`%s %s %s`, value, op, rc.dbq.sb.Var(b.value)), nil
 }
 
-func (dbq *dbSubQuery) handleQueryString(qs *dsl.QueryString) error {
-	// TODO Make a best effort to convert ES/Lucene's query format to sqlite
-	// Pass string as is to FTS5 GLOB operator for now
+// The epoch millis of the date of a field
+func (dbq *dbSubQuery) dateMillis(field string) (string, error) {
+	value, err := dbq.fieldExpr(field, `JSON_EXTRACT(content, %s)`)
+	if err != nil {
+		return "", err
+	}
+	return epochMillis(value, "typeof("+value+")"), nil
+}
 
-	dbq.sb.Where(fmt.Sprintf(` content GLOB '%s'`, qs.Query))
+// A date value as epoch millis: numbers are taken to be epoch millis already, and
+// strings are dates as sqlite understands them, which include those stored for
+// mapped date fields
+func epochMillis(value, typ string) string {
+	return fmt.Sprintf(`(CASE WHEN %s IN ('integer', 'real') THEN %s ELSE CAST(ROUND((julianday(%s) - 2440587.5) * 86400000) AS INTEGER) END)`,
+		typ, value, value)
+}
 
-	return nil
+// Without a mapping to go on, a bound decides how it is compared. A format or
+// date math makes it a date. An integer is compared as a number with numeric
+// values and as epoch_millis with anything else, never as a date in another
+// format, where it could be read as a year. Other numbers are compared as
+// numbers, and anything else as a string, which also works for ISO dates
+func (rc *rangeCompare) unmappedKind(b *rangeBound) rangeKind {
+	if rc.dateFormat || strings.HasPrefix(b.value, "now") || strings.Contains(b.value, "||") {
+		return rangeDate
+	}
+	if _, err := strconv.ParseInt(b.value, 10, 64); err == nil {
+		return rangeInteger
+	}
+	if _, err := strconv.ParseFloat(b.value, 64); err == nil {
+		return rangeNumeric
+	}
+	return rangeUnmapped
+}
+
+// Any of the values of a field can fall within the range. With no bounds at all,
+// it matches any document that has a value
+func (rc *rangeCompare) valuePred(relation string, lower, upper *rangeBound) (string, error) {
+	if _, err := rangeRelation(relation); err != nil {
+		return "", err
+	}
+	elements, err := rc.dbq.fieldElements(rc.field, "content")
+	if err != nil {
+		return "", err
+	}
+	conds := []string{"type != 'null'"}
+	for _, b := range []*rangeBound{lower, upper} {
+		if b == nil {
+			continue
+		}
+		cond, err := rc.compare("value", "type", b.op, b)
+		if err != nil {
+			return "", err
+		}
+		conds = append(conds, cond)
+	}
+	return fmt.Sprintf(`EXISTS (SELECT 1 FROM %s WHERE %s)`, elements, strings.Join(conds, " AND ")), nil
+}
+
+func rangeRelation(relation string) (string, error) {
+	switch r := strings.ToLower(relation); r {
+	case "":
+		return "intersects", nil
+	case "intersects", "contains", "within":
+		return r, nil
+	}
+	return "", &QueryError{Reason: fmt.Sprintf("[range] query does not support relation [%s]", relation)}
+}
+
+// The values of range fields are objects with gte/gt and lte/lt bounds of their
+// own, either of which can be missing. The relation decides whether the query's
+// range must intersect them, contain them or be within them
+// https://www.elastic.co/guide/en/elasticsearch/reference/7.17/range.html
+func (rc *rangeCompare) rangeFieldPred(relation string, lower, upper *rangeBound) (string, error) {
+	relation, err := rangeRelation(relation)
+	if err != nil {
+		return "", err
+	}
+	bound := func(key string) (string, string) {
+		return fmt.Sprintf(`json_extract(value, '$.%s')`, key), fmt.Sprintf(`json_type(value, '$.%s')`, key)
+	}
+	unbounded := func(incl, excl string) string {
+		return fmt.Sprintf(`COALESCE(json_type(value, '$.%s'), 'null') = 'null' AND COALESCE(json_type(value, '$.%s'), 'null') = 'null'`, incl, excl)
+	}
+	// Any of a number of comparisons between the bounds of the value and b
+	anyOf := func(b *rangeBound, alts ...string) (string, error) {
+		conds := make([]string, 0, len(alts))
+		for i := 0; i < len(alts); i += 2 {
+			if alts[i+1] == "" {
+				conds = append(conds, alts[i])
+				continue
+			}
+			value, typ := bound(alts[i])
+			cond, err := rc.compare(value, typ, alts[i+1], b)
+			if err != nil {
+				return "", err
+			}
+			conds = append(conds, cond)
+		}
+		return "(" + strings.Join(conds, " OR ") + ")", nil
+	}
+	pick := func(cond bool, yes, no string) string {
+		if cond {
+			return yes
+		}
+		return no
+	}
+
+	conds := make([]string, 0, 2)
+	add := func(cond string, err error) error {
+		if err == nil {
+			conds = append(conds, cond)
+		}
+		return err
+	}
+	switch relation {
+	case "intersects":
+		if upper != nil {
+			err = add(anyOf(upper, unbounded("gte", "gt"), "", "gte", pick(upper.op == "<=", "<=", "<"), "gt", "<"))
+		}
+		if err == nil && lower != nil {
+			err = add(anyOf(lower, unbounded("lte", "lt"), "", "lte", pick(lower.op == ">=", ">=", ">"), "lt", ">"))
+		}
+	case "contains":
+		if lower == nil {
+			conds = append(conds, unbounded("gte", "gt"))
+		} else {
+			err = add(anyOf(lower, unbounded("gte", "gt"), "", "gte", "<=", "gt", pick(lower.op == ">=", "<", "<=")))
+		}
+		if err == nil && upper == nil {
+			conds = append(conds, unbounded("lte", "lt"))
+		} else if err == nil {
+			err = add(anyOf(upper, unbounded("lte", "lt"), "", "lte", ">=", "lt", pick(upper.op == "<=", ">", ">=")))
+		}
+	case "within":
+		if lower != nil {
+			err = add(anyOf(lower, "gte", pick(lower.op == ">=", ">=", ">"), "gt", ">="))
+		}
+		if err == nil && upper != nil {
+			err = add(anyOf(upper, "lte", pick(upper.op == "<=", "<=", "<"), "lt", "<="))
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(conds) == 0 {
+		conds = append(conds, "1 = 1")
+	}
+	elements, err := rc.dbq.rangeElements(rc.field)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(`EXISTS (SELECT 1 FROM %s WHERE %s)`, elements, strings.Join(conds, " AND ")), nil
+}
+
+// The range objects of a range field, which can be a single object or an array of
+// them
+func (dbq *dbSubQuery) rangeElements(field string) (string, error) {
+	paths, err := jsonPaths(field)
+	if err != nil {
+		return "", err
+	}
+	each := make([]string, len(paths))
+	for i, path := range paths {
+		each[i] = fmt.Sprintf(
+			`SELECT value FROM json_each(content, %s) WHERE json_type(content, %s) = 'array' UNION ALL SELECT content -> %s WHERE json_type(content, %s) = 'object'`,
+			dbq.sb.Var(path), dbq.sb.Var(path), dbq.sb.Var(path), dbq.sb.Var(path),
+		)
+	}
+	return "(" + strings.Join(each, " UNION ALL ") + ")", nil
+}
+
+// The Lucene syntax of the query is parsed into DSL queries, which are compiled
+// as they would be if they had been given directly
+func (dbq *dbSubQuery) handleQueryString(qs *dsl.QueryString) (sqlClause, error) {
+	q, err := qs.Parse()
+	if err != nil {
+		return sqlClause{}, &QueryError{Reason: fmt.Sprintf("Failed to parse query [%s]: %s", qs.Query, err)}
+	}
+	return dbq.genQueryClause(q)
 }
-func (dbq *dbSubQuery) genSort(sortFields []map[string]dsl.Sort) {
+
+func (dbq *dbSubQuery) handleSimpleQueryString(sq *dsl.SimpleQueryString) (sqlClause, error) {
+	q, err := sq.Parse()
+	if err != nil {
+		return sqlClause{}, &QueryError{Reason: fmt.Sprintf("Failed to parse query [%s]: %s", sq.Query, err)}
+	}
+	return dbq.genQueryClause(q)
+}
+
+// Wildcards are matched against each value of a field, and each of the terms the
+// standard analyzer finds in it, as the field may be either a keyword or text
+func (dbq *dbSubQuery) handleWildcard(wildcards map[string]dsl.Wildcard) (sqlClause, error) {
+	clauses := make([]sqlClause, 0, len(wildcards))
+	for key, val := range wildcards {
+		pattern := val.Value
+		if pattern == "" {
+			pattern = val.Wildcard
+		}
+		value, err := dbq.fieldValue(cleanseKeyField(key))
+		if err != nil {
+			return sqlClause{}, err
+		}
+		pred := fmt.Sprintf(`fts_wildcard(%s, %s, %t)`, value, dbq.sb.Var(pattern), val.CaseInsensitive)
+		clauses = append(clauses, sqlClause{pred: pred, score: fmt.Sprintf("%g", boostValue(val.Boost))})
+	}
+	return allOf(clauses), nil
+}
+
+// A field exists if it has any value other than null or an empty array
+func (dbq *dbSubQuery) handleExists(e *dsl.Exists) (sqlClause, error) {
+	field := cleanseKeyField(e.Field)
+	if field == "" {
+		return sqlClause{}, &QueryError{Reason: "[exists] must be provided with a [field]"}
+	}
+	// json_each has a row for each element of an array, or for the value itself
+	elements, err := dbq.fieldElements(field, "content")
+	if err != nil {
+		return sqlClause{}, err
+	}
+	pred := fmt.Sprintf(`EXISTS (SELECT 1 FROM %s WHERE type != 'null')`, elements)
+	return sqlClause{pred: pred, score: fmt.Sprintf("%g", boostValue(e.Boost))}, nil
+}
+
+// Resolve a minimum_should_match spec against the number of optional clauses
+// https://www.elastic.co/guide/en/elasticsearch/reference/7.17/query-dsl-minimum-should-match.html
+func minimumShouldMatch(spec string, optional int) (int, error) {
+	spec = strings.TrimSpace(spec)
+	invalid := &QueryError{Reason: fmt.Sprintf("invalid minimum_should_match [%s]", spec)}
+
+	if strings.Contains(spec, "<") {
+		// Conditional specs, eg. `3<90%` or `2<-25% 9<-3`. All of the clauses are
+		// required up to the lowest bound, and after that the spec of the highest
+		// bound below the number of clauses applies
+		type cond struct {
+			bound int
+			spec  string
+		}
+		conds := make([]cond, 0)
+		for _, c := range strings.Fields(spec) {
+			parts := strings.SplitN(c, "<", 2)
+			if len(parts) != 2 {
+				return 0, invalid
+			}
+			bound, err := strconv.Atoi(parts[0])
+			if err != nil {
+				return 0, invalid
+			}
+			conds = append(conds, cond{bound, parts[1]})
+		}
+		sort.Slice(conds, func(i, j int) bool { return conds[i].bound < conds[j].bound })
+		result := optional
+		for _, c := range conds {
+			if optional <= c.bound {
+				break
+			}
+			var err error
+			if result, err = minimumShouldMatch(c.spec, optional); err != nil {
+				return 0, err
+			}
+		}
+		return result, nil
+	}
+
+	num := strings.TrimPrefix(spec, "-")
+	var (
+		n   int
+		err error
+	)
+	if strings.HasSuffix(num, "%") {
+		var pct float64
+		pct, err = strconv.ParseFloat(strings.TrimSuffix(num, "%"), 64)
+		// Percentages round down to a whole number of clauses
+		n = int(float64(optional) * pct / 100)
+	} else {
+		n, err = strconv.Atoi(num)
+	}
+	if err != nil {
+		return 0, invalid
+	}
+	if strings.HasPrefix(spec, "-") {
+		// Negative values are the number of clauses that can be missing
+		n = optional - n
+	}
+	if n < 0 {
+		n = 0
+	} else if n > optional {
+		n = optional
+	}
+	return n, nil
+}
+
+func (dbq *dbSubQuery) genSort(sortFields []map[string]dsl.Sort) error {
 
 	if len(sortFields) == 0 {
-		return
+		// Most relevant first, falling back to the order documents were indexed in
+		dbq.sb.OrderBy("_score DESC", "_index", "_rowid")
+		return nil
 	}
 
 	for _, m := range sortFields {
 		for k, v := range m {
-			dbq.sb.OrderBy(fmt.Sprintf(
-				` JSON_EXTRACT(content, '$.%s') %s `,
-				k, strings.ToUpper(v.Order),
-			))
+			order := strings.ToUpper(v.Order)
+			if order != "" && order != "ASC" && order != "DESC" {
+				return &QueryError{Reason: fmt.Sprintf("Unknown SortOrder [%s]", v.Order)}
+			}
+			if k == "_score" {
+				if order == "" {
+					order = "DESC"
+				}
+				dbq.sb.OrderBy("_score " + order)
+				continue
+			}
+			value, err := dbq.fieldExpr(k, `JSON_EXTRACT(content, %s)`)
+			if err != nil {
+				return err
+			}
+			dbq.sb.OrderBy(strings.TrimSpace(value + " " + order))
+		}
+	}
+	return nil
+}
+
+// Scores are always computed when sorting by relevance, but as with ES when sorting
+// by a field they are only returned on request
+func tracksScores(q *dsl.Dsl) bool {
+	if len(q.Sort) == 0 || q.TrackScores {
+		return true
+	}
+	for _, m := range q.Sort {
+		if _, ok := m["_score"]; ok {
+			return true
 		}
 	}
+	return false
 }
 
 func (dbq *dbSubQuery) genSelectExpression() {
 	dbq.sb.Select(dbq.selectExprs...)
 }
 
-func (dbq *dbSubQuery) genHitsSelect(index string, _q *dsl.Dsl) {
-	dbq.sb.
-		Select("rowid", "JSON(content)").
-		// Looks like the Sqlite dialect doesn't properly escape tables with odd characters
-		From(fmt.Sprintf(`"%s"`, index))
+func (dbq *dbSubQuery) genHitsSelect(indices []string, mappings map[string]*TemplateMapping, q *dsl.Dsl) error {
+	score := "NULL"
+	if tracksScores(q) {
+		score = "_score"
+	}
+	dbq.sb.Select("_index", "_id", "JSON(content)", score)
+	return dbq.genDocSource(indices, mappings, q)
 }
 
-// TODO Overdue for an overhaul and/or refactor once we try to enable
-// support for real subqueries generated from nested aggregate clauses. For now
-// it can handle only simple aggregate cases
-func (dbq *dbSubQuery) genAggregateSelectExprs(agg *dsl.Aggregate) {
+// The select of an aggregation, with its metric sub-aggregations embedded. Its
+// bucket sub-aggregations are planned to validate them, and kept to be run for
+// each of its buckets
+func (dbq *dbSubQuery) genAggregateSelectExprs(agg *dsl.Aggregate) error {
 
 	grpIdx := dbq.getNextGrpAlias()
 	fnIdx := dbq.getNextFnAlias()
 
 	if agg.Terms != nil {
-		dbq.groupAliases[grpIdx] = agg.Terms
-		dbq.fnAliases[fnIdx] = agg.Terms
-		fld := cleanseKeyField(agg.Terms.Field)
+		if err := dbq.genTermsSelectExprs(agg, grpIdx, fnIdx); err != nil {
+			return err
+		}
+	} else if agg.DateHistogram != nil {
+		field := cleanseKeyField(agg.DateHistogram.Field)
+		prop, _ := dbq.mapping.fieldType(field)
+		hist, err := newDateHistogram(agg.DateHistogram, prop)
+		if err != nil {
+			return err
+		}
+		dbq.groupAliases[grpIdx] = agg.DateHistogram
+		dbq.fnAliases[fnIdx] = agg.DateHistogram
+		millis, err := dbq.dateMillis(field)
+		if err != nil {
+			return err
+		}
 		dbq.selectExprs = append(dbq.selectExprs,
-			dbq.sb.As(fmt.Sprintf(` JSON_EXTRACT(content, '$.%s')`, fld), grpIdx),
+			dbq.sb.As(" "+hist.keyExpr(dbq, millis), grpIdx),
 			dbq.sb.As("COUNT(*)", fnIdx),
 		)
 
-		dbq.aggregation = &BucketAggregation{}
-	} else if agg.DateHistogram != nil {
-		dbq.groupAliases[grpIdx] = agg.DateHistogram
-		dbq.fnAliases[fnIdx] = agg.DateHistogram
-		fld := cleanseKeyField(agg.DateHistogram.Field)
-		// TODO Can cast dates to an epoch, then divide by the number of seconds the
-		// interval corresponds to, eg:
-		// SELECT strftime("%s", JSON_EXTRACT(content, '$.Time')) / 1234 as a0  FROM "test-202206" LIMIT 5;
+		dbq.aggregation = &DateHistogramAggregation{hist: hist, field: field}
+	} else if agg.AutoDateHistogram != nil {
+		field := cleanseKeyField(agg.AutoDateHistogram.Field)
+		prop, _ := dbq.mapping.fieldType(field)
+		hist, err := newAutoDateHistogram(agg.AutoDateHistogram, prop)
+		if err != nil {
+			return err
+		}
+		dbq.groupAliases[grpIdx] = agg.AutoDateHistogram
+		dbq.fnAliases[fnIdx] = agg.AutoDateHistogram
+		millis, err := dbq.dateMillis(field)
+		if err != nil {
+			return err
+		}
+		// The interval depends on the range of dates, which each row has
+		dbq.sourceExprs = append(dbq.sourceExprs,
+			fmt.Sprintf("MIN(%s) OVER () AS auto_min", millis),
+			fmt.Sprintf("MAX(%s) OVER () AS auto_max", millis),
+		)
 		dbq.selectExprs = append(dbq.selectExprs,
-			dbq.sb.As(fmt.Sprintf(` JSON_EXTRACT(content, '$.%s')`, fld), grpIdx),
+			dbq.sb.As(" "+hist.keyExpr(dbq, millis), grpIdx),
 			dbq.sb.As("COUNT(*)", fnIdx),
+			dbq.sb.As("CAST(MIN(auto_min) AS INTEGER)", "auto_first"),
+			dbq.sb.As("CAST(MAX(auto_max) AS INTEGER)", "auto_last"),
 		)
 
-		dbq.aggregation = &BucketAggregation{}
-	} else if agg.Avg != nil {
-		dbq.fnAliases[fnIdx] = agg.Avg
-		fld := cleanseKeyField(agg.Avg.Field)
+		dbq.aggregation = &AutoDateHistogramAggregation{hist: hist, field: field}
+	} else if agg.Histogram != nil {
+		fill, err := newHistogram(agg.Histogram)
+		if err != nil {
+			return err
+		}
+		dbq.groupAliases[grpIdx] = agg.Histogram
+		dbq.fnAliases[fnIdx] = agg.Histogram
+		m := &HistogramAggregation{fill: fill, agg: agg.Histogram}
+		key, err := m.keyExpr(dbq)
+		if err != nil {
+			return err
+		}
 		dbq.selectExprs = append(dbq.selectExprs,
-			dbq.sb.As(fmt.Sprintf(` AVG(JSON_EXTRACT(content, '$.%s')`, fld), fnIdx),
+			dbq.sb.As(" "+key, grpIdx),
+			dbq.sb.As("COUNT(*)", fnIdx),
 		)
-		dbq.aggregation = &MetricSingleAggregation{}
-	} else if agg.Max != nil {
-		dbq.fnAliases[fnIdx] = agg.Max
-		fld := cleanseKeyField(agg.Max.Field)
+
+		dbq.aggregation = m
+	} else if rng := rangeAggregation(agg); rng != nil {
+		var (
+			ranges []aggRange
+			err    error
+		)
+		switch {
+		case agg.Range != nil:
+			ranges, err = numericRanges(rng)
+		case agg.DateRange != nil:
+			prop, _ := dbq.mapping.fieldType(cleanseKeyField(rng.Field))
+			ranges, err = dateRanges(rng, prop)
+		default:
+			ranges, err = ipRanges(rng)
+		}
+		if err != nil {
+			return err
+		}
+		m := &RangeAggregation{keyed: rng.Keyed, ranges: ranges, agg: agg}
+		value, err := m.valueExpr(dbq)
+		if err != nil {
+			return err
+		}
+		dbq.groupAliases[grpIdx] = rng
+		dbq.fnAliases[fnIdx] = rng
 		dbq.selectExprs = append(dbq.selectExprs,
-			dbq.sb.As(fmt.Sprintf(` MAX(JSON_EXTRACT(content, '$.%s'))`, fld), fnIdx),
+			dbq.sb.As(" "+dbq.joinRanges(ranges, value, "ranges_"+grpIdx), grpIdx),
+			dbq.sb.As("COUNT(*)", fnIdx),
 		)
-		dbq.aggregation = &MetricSingleAggregation{}
+
+		dbq.aggregation = m
+	} else if agg.Filter != nil || agg.Missing != nil || agg.Global != nil {
+		if err := dbq.genSingleBucketSelectExprs(agg, fnIdx); err != nil {
+			return err
+		}
+	} else if agg.Filters != nil {
+		if err := dbq.genFiltersSelectExprs(agg.Filters, grpIdx, fnIdx); err != nil {
+			return err
+		}
+	} else if agg.Composite != nil {
+		if err := dbq.genCompositeSelectExprs(agg, grpIdx, fnIdx); err != nil {
+			return err
+		}
+	} else if agg.SignificantTerms != nil {
+		if err := dbq.genSignificantTermsSelectExprs(agg.SignificantTerms, grpIdx, fnIdx); err != nil {
+			return err
+		}
+	} else if agg.RareTerms != nil {
+		if err := dbq.genRareTermsSelectExprs(agg.RareTerms, grpIdx, fnIdx); err != nil {
+			return err
+		}
+	} else if agg.TopHits != nil || agg.TopMetrics != nil {
+		if err := dbq.genTopHitsSelectExprs(agg); err != nil {
+			return err
+		}
+	} else if err := dbq.genMetricSelectExpr(agg, fnIdx); err != nil {
+		return err
+	}
+	if m, ok := dbq.fnAliases[fnIdx].(*metric); ok && len(agg.Aggs) > 0 {
+		return &QueryError{Reason: fmt.Sprintf("Aggregator [%s] of type [%s] cannot accept sub-aggregations", m.label, m.typ)}
 	}
 	if agg.Aggs != nil {
-		// Experiment with embedding (SELECT) clauses right into the SQL. Sqlite
-		// seems to handle this well
+		var err error
+		if dbq.pipelines, err = newPipelines(agg, agg.Aggs); err != nil {
+			return err
+		}
+		// Metrics are embedded as (SELECT) clauses right into the SQL, where they
+		// aggregate the rows of each group, while bucket aggregations and top hits
+		// are run for each of the buckets, and pipelines over them
 		for label, subAgg := range agg.Aggs {
+			label, subAgg := label, subAgg
+			if subAgg.GenAggregationCategory() == dsl.Pipeline {
+				continue
+			}
+			if subAgg.Global != nil {
+				return &QueryError{Reason: fmt.Sprintf("Aggregation [%s] cannot have a global sub-aggregation [%s]. Global aggregations can only be defined as top level aggregations", *dbq.label, label)}
+			}
+			if subAgg.Composite != nil {
+				return &QueryError{Reason: fmt.Sprintf("[composite] aggregation [%s] cannot be used with a parent aggregation [%s]", label, *dbq.label)}
+			}
+			if cat := subAgg.GenAggregationCategory(); cat == dsl.Bucket || cat == dsl.Hits {
+				// Planned now only to validate it, as its filters depend on the
+				// buckets
+				if _, err := genAggregationPlan(label, &subAgg, dbq.source, dbq.filters); err != nil {
+					return err
+				}
+				if dbq.subBuckets == nil {
+					dbq.subBuckets = make(map[string]dsl.Aggregate)
+				}
+				dbq.subBuckets[label] = subAgg
+				continue
+			}
 			subQry := makeDbSubQuery()
 			subQry.label = &label
-			subQry.genAggregateSelectExprs(&subAgg)
-			subQry.genSelectExpression()
-			// sqlbuilder always adds to any select statement "FROM" even though
-			// we haven't added any tables, so we have to wrap this in parenthesis manually
-			subSql := subQry.sb.String()
-			subSql = strings.TrimSuffix(subSql, "FROM ")
+			// The subquery's arguments are bound by the parent's builder, as it is
+			// only ever run embedded in the parent
+			subQry.sb = dbq.sb
+			subQry.mapping = dbq.mapping
+			if err := subQry.genAggregateSelectExprs(&subAgg); err != nil {
+				return err
+			}
+			subSql := "SELECT " + strings.Join(subQry.selectExprs, ", ")
 			fnIdx = dbq.getNextFnAlias()
 			dbq.appendSubQuery(&subQry)
 			dbq.selectExprs = append(dbq.selectExprs,
@@ -295,6 +1699,18 @@ func (dbq *dbSubQuery) genAggregateSelectExprs(agg *dsl.Aggregate) {
 			)
 		}
 	}
+	return nil
+}
+
+// The range, date_range or ip_range of an aggregation, which share their options
+func rangeAggregation(agg *dsl.Aggregate) *dsl.RangeAgg {
+	switch {
+	case agg.Range != nil:
+		return agg.Range
+	case agg.DateRange != nil:
+		return agg.DateRange
+	}
+	return agg.IpRange
 }
 
 func (dbq *dbSubQuery) getNextGrpAlias() string {
@@ -317,7 +1733,7 @@ func (dbq *dbSubQuery) appendSubQuery(subQry *dbSubQuery) {
 	}
 
 	for _, v := range subQry.groupAliases {
-		k := fmt.Sprintf("g%d", fnIdx)
+		k := fmt.Sprintf("g%d", grpIdx)
 		dbq.groupAliases[k] = v
 		grpIdx++
 	}
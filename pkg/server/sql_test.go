@@ -2,6 +2,8 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
@@ -10,6 +12,7 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	require "github.com/alecthomas/assert/v2"
 	"github.com/alecthomas/repr"
@@ -59,7 +62,9 @@ func loadFixtureData() {
 		rec := httptest.NewRecorder()
 		req := httptest.NewRequest(http.MethodPost, "/_bulk", strings.NewReader(string(b)))
 		s.Router.ServeHTTP(rec, req)
-		if rec.Result().StatusCode != http.StatusOK {
+		bulkResp := BulkResponse{}
+		if rec.Result().StatusCode != http.StatusOK ||
+			json.Unmarshal(rec.Body.Bytes(), &bulkResp) != nil || bulkResp.Errors {
 			log.Fatal("bulk load failed with response " + repr.String(rec))
 		}
 	}
@@ -137,6 +142,119 @@ func TestBool(t *testing.T) {
 	require.Equal(t, len(d.Hits.Hits), 1)
 }
 
+func TestMultiIndexSearch(t *testing.T) {
+	q := `{ "query": { "term": {"operationName": "HTTP GET /"} } }`
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/jaeger-span-2021-11-11,jaeger-span-2022-11-11/_search", strings.NewReader(q))
+	s.Router.ServeHTTP(rec, req)
+	d := getResponse(t, rec.Result())
+	require.Equal(t, len(d.Hits.Hits), 3)
+
+	perIndex := make(map[string]int)
+	for _, h := range d.Hits.Hits {
+		perIndex[h.Index]++
+	}
+	require.Equal(t, perIndex, map[string]int{"jaeger-span-2021-11-11": 1, "jaeger-span-2022-11-11": 2})
+}
+
+func TestWildcardSearch(t *testing.T) {
+	q := `{ "query": { "term": {"operationName": "HTTP GET /"} } }`
+
+	for _, path := range []string{"/jaeger-*/_search", "/_all/_search", "/_search", "/jaeger-span-*,jaeger-service-*/_search"} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(q))
+		s.Router.ServeHTTP(rec, req)
+		d := getResponse(t, rec.Result())
+		require.Equal(t, len(d.Hits.Hits), 4, path)
+	}
+
+	// Exclusions only apply to what came before them
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/jaeger-*,-jaeger-service-*/_search", strings.NewReader(q))
+	s.Router.ServeHTTP(rec, req)
+	d := getResponse(t, rec.Result())
+	require.Equal(t, len(d.Hits.Hits), 3)
+
+	// Wildcards that match nothing are not an error
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/nothing-here-*/_search", strings.NewReader(q))
+	s.Router.ServeHTTP(rec, req)
+	d = getResponse(t, rec.Result())
+	require.Equal(t, len(d.Hits.Hits), 0)
+}
+
+func TestMissingIndexSearch(t *testing.T) {
+	q := `{ "query": { "term": {"operationName": "HTTP GET /"} } }`
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/jaeger-span-2022-11-11,jaeger-span-1999-01-01/_search", strings.NewReader(q))
+	s.Router.ServeHTTP(rec, req)
+	require.Equal(t, rec.Result().StatusCode, http.StatusNotFound)
+	require.Contains(t, rec.Body.String(), "jaeger-span-1999-01-01")
+
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/jaeger-span-2022-11-11,jaeger-span-1999-01-01/_search?ignore_unavailable=true", strings.NewReader(q))
+	s.Router.ServeHTTP(rec, req)
+	d := getResponse(t, rec.Result())
+	require.Equal(t, len(d.Hits.Hits), 2)
+}
+
+func TestMultiIndexAggregate(t *testing.T) {
+	q := `
+	{
+		"aggs":{
+			"ops": { "terms":{"field":"operationName"} },
+			"maxDuration": { "max":{"field":"duration"} }
+		},
+		"size":0
+	}`
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/jaeger-span-*/_search", strings.NewReader(q))
+	s.Router.ServeHTTP(rec, req)
+	d := getResponse(t, rec.Result())
+
+	buckets := d.Aggregations["ops"].(map[string]interface{})["buckets"].([]interface{})
+	require.Equal(t, len(buckets), 1)
+	require.Equal(t, buckets[0].(map[string]interface{})["doc_count"], 3.0)
+	require.Equal(t, d.Aggregations["maxDuration"].(map[string]interface{})["value"], 8190.0)
+}
+
+func TestMSearchMultiIndex(t *testing.T) {
+	q := `{"index": ["jaeger-span-2021-11-11", "jaeger-span-2022-11-11"]}
+{"query": { "term": {"operationName": "HTTP GET /"} } }
+{"index": "jaeger-span-*"}
+{"query": { "term": {"operationName": "HTTP GET /"} } }
+{"index": "jaeger-span-1999-01-01,jaeger-span-2021-11-11", "ignore_unavailable": true}
+{"query": { "term": {"operationName": "HTTP GET /"} } }
+`
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/_msearch", strings.NewReader(q))
+	s.Router.ServeHTTP(rec, req)
+	require.Equal(t, rec.Result().StatusCode, http.StatusOK)
+
+	msr := struct {
+		Responses []testResponse `json:"responses"`
+	}{}
+	err := json.Unmarshal(rec.Body.Bytes(), &msr)
+	require.NoError(t, err)
+	require.Equal(t, len(msr.Responses), 3)
+	require.Equal(t, len(msr.Responses[0].Hits.Hits), 3)
+	require.Equal(t, len(msr.Responses[1].Hits.Hits), 3)
+	require.Equal(t, len(msr.Responses[2].Hits.Hits), 1)
+}
+
+func TestIndexPatternMatch(t *testing.T) {
+	require.True(t, indexPatternMatch("jaeger-span-*", "jaeger-span-2022-11-11"))
+	require.True(t, indexPatternMatch("*-span-*", "jaeger-span-2022-11-11"))
+	require.True(t, indexPatternMatch("*", "anything"))
+	require.True(t, indexPatternMatch("_all", "anything"))
+	require.True(t, indexPatternMatch("a*b*b", "abb"))
+	require.False(t, indexPatternMatch("jaeger-span-*", "jaeger-service-2022-11-11"))
+	require.False(t, indexPatternMatch("a*a", "a"))
+	require.False(t, indexPatternMatch("jaeger", "jaeger-span"))
+}
+
 //////////////////
 // TODO Finish migrating the rest of these to be real tests of the functionality,
 // rather than just ensuring that the query plan looks sane
@@ -173,7 +291,7 @@ func TestRange(t *testing.T) {
     }`
 	err := json.Unmarshal([]byte(q), &d)
 	require.NoError(t, err)
-	plan, err2 := GenPlan("testindex", d)
+	plan, err2 := GenPlan([]string{"testindex"}, nil, d)
 	if len(plan) != 1 {
 		t.Error("Expected only one query in plan")
 	}
@@ -197,7 +315,7 @@ func TestAggTerms(t *testing.T) {
     `
 	err := json.Unmarshal([]byte(q), &d)
 	require.NoError(t, err)
-	plan, err2 := GenPlan("testindex", d)
+	plan, err2 := GenPlan([]string{"testindex"}, nil, d)
 	if len(plan) != 2 {
 		t.Error("Expected two queries in plan")
 	}
@@ -213,7 +331,7 @@ func TestDateHistogram(t *testing.T) {
 		{
 			"aggs":{
 				"dates": {
-					"date_histogram":{"field":"startTimeMillis","buckets":200}
+					"date_histogram":{"field":"startTimeMillis","fixed_interval":"1h"}
 				}
 			},
 			"size":0
@@ -253,7 +371,7 @@ func TestSubAggregate(t *testing.T) {
 
 	err := json.Unmarshal([]byte(q), &d)
 	require.NoError(t, err)
-	plan, err2 := GenPlan("testindex", d)
+	plan, err2 := GenPlan([]string{"testindex"}, nil, d)
 
 	// if !strings.Contains(plan[1].sb.String(), "f1") {
 	// 	t.Error("Did not find a second function statement")
@@ -317,3 +435,739 @@ func TestSubSelectBuild(t *testing.T) {
 	sb.Select("c1", "c2", sb.BuilderAs(subSelect, "f3"))
 	repr.Println(sb.String())
 }
+
+func TestScoring(t *testing.T) {
+	bulkRequest(t, "/score-000001/_bulk", `
+{"index": {"_id": "1"}}
+{"title": "the quick brown fox", "body": "jumps over the lazy dog", "n": 1}
+{"index": {"_id": "2"}}
+{"title": "a fox", "body": "nothing here", "n": 2}
+{"index": {"_id": "3"}}
+{"title": "a dog", "body": "the cat is elsewhere", "n": 3}
+{"index": {"_id": "4"}}
+{"title": "quick thinking", "body": "", "n": 4}
+{"index": {"_id": "5"}}
+{"title": "lorem ipsum", "body": "dolor sit amet", "n": 5}
+{"index": {"_id": "6"}}
+{"title": "consectetur", "body": "adipiscing elit", "n": 6}
+{"index": {"_id": "7"}}
+{"title": "sed do", "body": "a fox in the body", "n": 7}
+{"index": {"_id": "8"}}
+{"title": "eiusmod tempor", "body": "incididunt", "n": 8}
+{"index": {"_id": "9"}}
+{"title": "ut labore", "body": "et dolore", "n": 9}
+`)
+
+	search := func(q string) *testResponse {
+		rec := doRequest(http.MethodPost, "/score-000001/_search", q)
+		return getResponse(t, rec.Result())
+	}
+
+	// Only the title field is searched, and hits come back most relevant first
+	d := search(`{"query": {"match": {"title": "quick fox"}}}`)
+	require.Equal(t, len(d.Hits.Hits), 3)
+	require.Equal(t, d.Hits.Hits[0].Id, "1")
+	require.NotZero(t, d.Hits.MaxScore)
+	require.Equal(t, *d.Hits.MaxScore, *d.Hits.Hits[0].Score)
+	for i := 1; i < len(d.Hits.Hits); i++ {
+		require.True(t, *d.Hits.Hits[i-1].Score >= *d.Hits.Hits[i].Score)
+	}
+
+	// Scores below min_score are left out
+	min := *d.Hits.Hits[1].Score
+	d = search(fmt.Sprintf(`{"query": {"match": {"title": "quick fox"}}, "min_score": %g}`, min))
+	require.Equal(t, len(d.Hits.Hits), 2)
+
+	// Boosting a should clause changes the ranking
+	d = search(`{"query": {"bool": {"should": [
+		{"match": {"title": "fox"}},
+		{"match": {"title": "thinking"}}
+	]}}}`)
+	require.Equal(t, len(d.Hits.Hits), 3)
+	require.Equal(t, d.Hits.Hits[0].Id, "4")
+	d = search(`{"query": {"bool": {"should": [
+		{"match": {"title": {"query": "fox", "boost": 10}}},
+		{"match": {"title": "thinking"}}
+	]}}}`)
+	require.Equal(t, len(d.Hits.Hits), 3)
+	require.NotEqual(t, d.Hits.Hits[0].Id, "4")
+
+	// Filters restrict hits without being scored
+	d = search(`{"query": {"bool": {
+		"must": {"match": {"title": "fox"}},
+		"filter": [{"term": {"n": "2"}}]
+	}}}`)
+	require.Equal(t, len(d.Hits.Hits), 1)
+	require.Equal(t, d.Hits.Hits[0].Id, "2")
+
+	// Sorting on a field doesn't report scores unless asked to
+	d = search(`{"query": {"match": {"title": "fox"}}, "sort": [{"n": {"order": "desc"}}]}`)
+	require.Equal(t, d.Hits.Hits[0].Id, "2")
+	require.Zero(t, d.Hits.Hits[0].Score)
+	require.Zero(t, d.Hits.MaxScore)
+	d = search(`{"query": {"match": {"title": "fox"}}, "sort": [{"n": {"order": "desc"}}], "track_scores": true}`)
+	require.NotZero(t, d.Hits.Hits[0].Score)
+
+	// Without a query everything scores the same
+	d = search(`{"size": 20}`)
+	require.Equal(t, len(d.Hits.Hits), 9)
+	require.Equal(t, *d.Hits.Hits[8].Score, 1.0)
+}
+
+func TestMatchQueries(t *testing.T) {
+	bulkRequest(t, "/match-000001/_bulk", `
+{"index": {"_id": "1"}}
+{"title": "quick brown fox", "tags": ["Red Fox", "animal"]}
+{"index": {"_id": "2"}}
+{"title": "quick brown dog"}
+{"index": {"_id": "3"}}
+{"title": "slow brown turtle"}
+{"index": {"_id": "4"}}
+{"title": "HTTP GET /"}
+{"index": {"_id": "5"}}
+{"title": "quikc fix"}
+`)
+
+	tests := []struct {
+		query string
+		hits  int
+	}{
+		{`{"match": {"title": "quick fox"}}`, 2},
+		{`{"match": {"title": {"query": "quick fox", "operator": "and"}}}`, 1},
+		{`{"match": {"title": {"query": "quick brown fox", "minimum_should_match": 2}}}`, 2},
+		{`{"match": {"title": {"query": "quick brown fox", "minimum_should_match": "100%"}}}`, 1},
+		{`{"match": {"title": {"query": "quick brown fox", "minimum_should_match": "-1"}}}`, 2},
+		{`{"match": {"title": {"query": "quick brown fox", "minimum_should_match": "2<-25%"}}}`, 1},
+		{`{"match": {"title": {"query": "quikc", "fuzziness": "AUTO"}}}`, 3},
+		{`{"match": {"title": {"query": "quikc", "fuzziness": "AUTO", "fuzzy_transpositions": false}}}`, 1},
+		{`{"match": {"title": {"query": "fax", "fuzziness": 1}}}`, 2},
+		{`{"match": {"title": {"query": "fax", "fuzziness": 1, "prefix_length": 2}}}`, 0},
+		{`{"match": {"title": {"query": "quick turtle", "fuzziness": "AUTO", "operator": "and"}}}`, 0},
+		{`{"match": {"title": "/"}}`, 0},
+		{`{"match": {"title": {"query": "/", "zero_terms_query": "all"}}}`, 5},
+		{`{"match": {"title": {"query": "HTTP GET /", "analyzer": "keyword"}}}`, 1},
+		{`{"match": {"title": {"query": "HTTP GET", "analyzer": "keyword"}}}`, 0},
+		{`{"match": {"tags": "fox"}}`, 1},
+		{`{"match": {"tags": {"query": "red fox", "analyzer": "keyword"}}}`, 0},
+		{`{"query_string": {"query": "turtle"}}`, 1},
+	}
+	for _, test := range tests {
+		rec := doRequest(http.MethodPost, "/match-000001/_search", `{"query": `+test.query+`}`)
+		d := getResponse(t, rec.Result())
+		require.Equal(t, len(d.Hits.Hits), test.hits, test.query)
+	}
+
+	for _, q := range []string{
+		`{"match": {"title": {"query": "quick", "operator": "xor"}}}`,
+		`{"match": {"title": {"query": "quick", "fuzziness": "LOTS"}}}`,
+		`{"match": {"title": {"query": "quick", "minimum_should_match": "most"}}}`,
+		`{"match": {"title": {"query": "quick", "analyzer": "klingon"}}}`,
+	} {
+		rec := doRequest(http.MethodPost, "/match-000001/_search", `{"query": `+q+`}`)
+		require.Equal(t, rec.Code, http.StatusBadRequest, q)
+	}
+}
+
+func TestMinimumShouldMatch(t *testing.T) {
+	tests := []struct {
+		spec     string
+		optional int
+		required int
+	}{
+		{"3", 5, 3},
+		{"-2", 5, 3},
+		{"75%", 4, 3},
+		{"-25%", 4, 3},
+		{"10", 4, 4},
+		{"3<90%", 3, 3},
+		{"3<90%", 10, 9},
+		{"2<-25% 9<-3", 2, 2},
+		{"2<-25% 9<-3", 8, 6},
+		{"2<-25% 9<-3", 12, 9},
+	}
+	for _, test := range tests {
+		required, err := minimumShouldMatch(test.spec, test.optional)
+		require.NoError(t, err)
+		require.Equal(t, required, test.required, test.spec)
+	}
+	_, err := minimumShouldMatch("3<", 4)
+	require.Error(t, err)
+}
+
+func TestPhraseQueries(t *testing.T) {
+	bulkRequest(t, "/phrase-000001/_bulk", `
+{"index": {"_id": "1"}}
+{"title": "quick brown fox", "body": "jumps over the lazy dog"}
+{"index": {"_id": "2"}}
+{"title": "brown quick fox", "body": "the dog sleeps"}
+{"index": {"_id": "3"}}
+{"title": "the quick red fox", "body": "quick brown"}
+{"index": {"_id": "4"}}
+{"title": "quickly browsing", "body": "nothing", "tags": ["quick", "brown fox"]}
+`)
+
+	tests := []struct {
+		query string
+		hits  int
+	}{
+		{`{"match_phrase": {"title": "quick brown"}}`, 1},
+		{`{"match_phrase": {"title": "quick fox"}}`, 1},
+		{`{"match_phrase": {"title": {"query": "quick fox", "slop": 1}}}`, 3},
+		{`{"match_phrase": {"title": {"query": "quick brown", "slop": 2}}}`, 2},
+		{`{"match_phrase": {"tags": "quick brown"}}`, 0},
+		{`{"match_phrase": {"tags": "brown fox"}}`, 1},
+		{`{"match_phrase_prefix": {"title": "quick bro"}}`, 1},
+		{`{"match_phrase_prefix": {"title": "qui"}}`, 4},
+		{`{"match_bool_prefix": {"title": "fox qui"}}`, 4},
+		{`{"match_bool_prefix": {"title": {"query": "fox qui", "operator": "and"}}}`, 3},
+		{`{"multi_match": {"query": "quick brown", "fields": ["title", "body"]}}`, 3},
+		{`{"multi_match": {"query": "quick brown", "fields": ["title", "body"], "type": "phrase"}}`, 2},
+		{`{"multi_match": {"query": "quick bro", "fields": ["title", "body"], "type": "phrase_prefix"}}`, 2},
+		{`{"multi_match": {"query": "fox lazy", "fields": ["title", "body"], "operator": "and"}}`, 0},
+		{`{"multi_match": {"query": "fox lazy", "fields": ["title", "body"], "operator": "and", "type": "cross_fields"}}`, 1},
+		{`{"multi_match": {"query": "sleeps", "type": "most_fields"}}`, 1},
+	}
+	for _, test := range tests {
+		rec := doRequest(http.MethodPost, "/phrase-000001/_search", `{"query": `+test.query+`}`)
+		d := getResponse(t, rec.Result())
+		require.Equal(t, len(d.Hits.Hits), test.hits, test.query)
+	}
+
+	// Field boosts change the ranking
+	rec := doRequest(http.MethodPost, "/phrase-000001/_search",
+		`{"query": {"multi_match": {"query": "quick", "fields": ["title", "tags^10"]}}}`)
+	d := getResponse(t, rec.Result())
+	require.Equal(t, len(d.Hits.Hits), 4)
+	require.Equal(t, d.Hits.Hits[0].Id, "4")
+
+	rec = doRequest(http.MethodPost, "/phrase-000001/_search",
+		`{"query": {"multi_match": {"query": "quick", "type": "fuzzy_fields"}}}`)
+	require.Equal(t, rec.Code, http.StatusBadRequest)
+}
+
+func TestBoolQueries(t *testing.T) {
+	bulkRequest(t, "/bool-000001/_bulk", `
+{"index": {"_id": "1"}}
+{"service": "frontend", "status": 200, "level": "info", "msg": "request ok"}
+{"index": {"_id": "2"}}
+{"service": "frontend", "status": 500, "level": "error", "msg": "request failed"}
+{"index": {"_id": "3"}}
+{"service": "backend", "status": 500, "level": "error", "msg": "db timeout"}
+{"index": {"_id": "4"}}
+{"service": "backend", "status": 200, "level": "info"}
+{"index": {"_id": "5"}}
+{"service": "backend", "level": "debug", "msg": "cache miss"}
+`)
+
+	should := `[
+		{"term": {"service": "frontend"}},
+		{"term": {"level": "error"}},
+		{"match": {"msg": "request"}}
+	]`
+	tests := []struct {
+		query string
+		hits  int
+	}{
+		{`{"bool": {"must": {"term": {"service": "frontend"}}, "should": {"term": {"level": "error"}}}}`, 2},
+		{`{"bool": {"must": {"term": {"service": "frontend"}}, "should": {"term": {"level": "error"}}, "minimum_should_match": 1}}`, 1},
+		{`{"bool": {"should": ` + should + `}}`, 3},
+		{`{"bool": {"should": ` + should + `, "minimum_should_match": 2}}`, 2},
+		{`{"bool": {"should": ` + should + `, "minimum_should_match": "100%"}}`, 1},
+		{`{"bool": {"should": ` + should + `, "minimum_should_match": "-1"}}`, 2},
+		{`{"bool": {"should": ` + should + `, "minimum_should_match": "2<-25%"}}`, 1},
+		{`{"bool": {"must_not": {"term": {"status": "500"}}}}`, 3},
+		{`{"bool": {"must_not": [{"match": {"msg": "request"}}]}}`, 3},
+		{`{"bool": {"filter": {"term": {"service": "backend"}}}}`, 3},
+		{`{"bool": {
+			"must": {"bool": {"should": [{"term": {"service": "frontend"}}, {"term": {"status": "200"}}]}},
+			"must_not": {"term": {"level": "debug"}}
+		}}`, 3},
+		{`{"bool": {
+			"filter": [{"bool": {"must_not": {"bool": {"should": [
+				{"term": {"level": "info"}},
+				{"bool": {"must": [{"term": {"service": "backend"}}, {"term": {"level": "error"}}]}}
+			]}}}}]
+		}}`, 2},
+	}
+	for _, test := range tests {
+		rec := doRequest(http.MethodPost, "/bool-000001/_search", `{"query": `+test.query+`}`)
+		d := getResponse(t, rec.Result())
+		require.Equal(t, len(d.Hits.Hits), test.hits, test.query)
+	}
+
+	// Only the scoring clauses contribute to the score
+	rec := doRequest(http.MethodPost, "/bool-000001/_search", `{"query": {"bool": {"must_not": {"term": {"level": "info"}}}}}`)
+	d := getResponse(t, rec.Result())
+	require.Equal(t, *d.Hits.MaxScore, 0.0)
+}
+
+func TestQueryStringQueries(t *testing.T) {
+	bulkRequest(t, "/qs-000001/_bulk", `
+{"index": {"_id": "1"}}
+{"service": "frontend", "status": 200, "level": "info", "msg": "request ok", "user": "ann"}
+{"index": {"_id": "2"}}
+{"service": "frontend", "status": 404, "level": "warn", "msg": "page not found"}
+{"index": {"_id": "3"}}
+{"service": "frontend", "status": 503, "level": "debug", "msg": "upstream unavailable debug"}
+{"index": {"_id": "4"}}
+{"service": "backend", "status": 500, "level": "error", "msg": "db timeout", "user": "bob"}
+{"index": {"_id": "5"}}
+{"service": "backend-worker", "status": 599, "level": "error", "msg": "queue stalled", "user": null}
+`)
+
+	tests := []struct {
+		query string
+		hits  int
+	}{
+		{`{"query_string": {"query": "service:frontend AND status:[400 TO 599] -debug"}}`, 1},
+		{`{"query_string": {"query": "status:{404 TO 599}"}}`, 2},
+		{`{"query_string": {"query": "status:[404 TO 599}"}}`, 3},
+		{`{"query_string": {"query": "status:>=500"}}`, 3},
+		{`{"query_string": {"query": "status:[* TO 404]"}}`, 2},
+		{`{"query_string": {"query": "frontend OR backend"}}`, 5},
+		{`{"query_string": {"query": "frontend backend", "default_operator": "AND"}}`, 0},
+		{`{"query_string": {"query": "level:error OR level:warn AND service:frontend"}}`, 1},
+		{`{"query_string": {"query": "+level:error -service:worker"}}`, 1},
+		{`{"query_string": {"query": "NOT level:error"}}`, 3},
+		{`{"query_string": {"query": "level:(error OR warn) && !status:599"}}`, 2},
+		{`{"query_string": {"query": "msg:\"not found\""}}`, 1},
+		{`{"query_string": {"query": "msg:\"page found\"~1"}}`, 1},
+		{`{"query_string": {"query": "msg:\"page found\""}}`, 0},
+		{`{"query_string": {"query": "service:back*"}}`, 2},
+		{`{"query_string": {"query": "msg:up?tream"}}`, 1},
+		{`{"query_string": {"query": "_exists_:user"}}`, 2},
+		{`{"query_string": {"query": "user:*"}}`, 2},
+		{`{"query_string": {"query": "*:*"}}`, 5},
+		{`{"query_string": {"query": "msg:timout~1"}}`, 1},
+		{`{"query_string": {"query": "timeout", "default_field": "service"}}`, 0},
+		{`{"query_string": {"query": "timeout", "fields": ["service", "msg"]}}`, 1},
+		{`{"query_string": {"query": "error frontend", "fields": ["level", "service"], "minimum_should_match": 2}}`, 0},
+		{`{"simple_query_string": {"query": "frontend + -debug"}}`, 2},
+		{`{"simple_query_string": {"query": "\"db timeout\" | stalled"}}`, 2},
+		{`{"simple_query_string": {"query": "back*", "fields": ["service"]}}`, 2},
+		{`{"simple_query_string": {"query": "timout~1"}}`, 1},
+		{`{"simple_query_string": {"query": "frontend warn", "default_operator": "and"}}`, 1},
+		{`{"simple_query_string": {"query": "(frontend | backend) + error", "fields": ["service", "level"]}}`, 2},
+		{`{"simple_query_string": {"query": "frontend -debug", "flags": "NONE"}}`, 3},
+	}
+	for _, test := range tests {
+		rec := doRequest(http.MethodPost, "/qs-000001/_search", `{"query": `+test.query+`}`)
+		d := getResponse(t, rec.Result())
+		require.Equal(t, len(d.Hits.Hits), test.hits, test.query)
+	}
+
+	// Boosted terms score higher than the rest
+	rec := doRequest(http.MethodPost, "/qs-000001/_search", `{"query": {"query_string": {"query": "level:warn^5 OR level:error"}}}`)
+	d := getResponse(t, rec.Result())
+	require.Equal(t, d.Hits.Hits[0].Id, "2")
+
+	// Syntax errors are reported as bad requests, but simple_query_string never fails
+	rec = doRequest(http.MethodPost, "/qs-000001/_search", `{"query": {"query_string": {"query": "status:[400 TO"}}}`)
+	require.Equal(t, rec.Code, http.StatusBadRequest)
+	rec = doRequest(http.MethodPost, "/qs-000001/_search", `{"query": {"query_string": {"query": "*end", "allow_leading_wildcard": false}}}`)
+	require.Equal(t, rec.Code, http.StatusBadRequest)
+	rec = doRequest(http.MethodPost, "/qs-000001/_search", `{"query": {"simple_query_string": {"query": "(\"frontend"}}}`)
+	require.Equal(t, rec.Code, http.StatusOK)
+}
+
+func TestTermLevelQueries(t *testing.T) {
+	bulkRequest(t, "/termlvl-000001/_bulk", `
+{"index": {"_id": "1"}}
+{"host": "web-01.prod", "status": 200, "tags": ["blue", "canary"], "up": true, "owner": "ann"}
+{"index": {"_id": "2"}}
+{"host": "web-02.prod", "status": 500, "tags": ["green"], "up": false}
+{"index": {"_id": "3"}}
+{"host": "db-01.staging", "status": "404", "tags": [], "up": true, "owner": null}
+{"index": {"_id": "4"}}
+{"host": "Cache-01.Prod", "status": 200.5, "msg": "quick brown fox"}
+`)
+	bulkRequest(t, "/termlvl-lookup/_bulk", `
+{"index": {"_id": "on-call"}}
+{"hosts": ["web-02.prod", "db-01.staging"]}
+`)
+
+	tests := []struct {
+		query string
+		hits  int
+	}{
+		{`{"term": {"status": {"value": 200}}}`, 1},
+		{`{"term": {"status": 404}}`, 1},
+		{`{"term": {"status": 200.5}}`, 1},
+		{`{"term": {"up": true}}`, 2},
+		{`{"term": {"tags": "canary"}}`, 1},
+		{`{"term": {"host": {"value": "CACHE-01.PROD", "case_insensitive": true}}}`, 1},
+		{`{"terms": {"host": ["web-01.prod", "db-01.staging"], "boost": 2}}`, 2},
+		{`{"terms": {"tags": ["green", "blue"]}}`, 2},
+		{`{"terms": {"status": [200, 500]}}`, 2},
+		{`{"terms": {"host": {"index": "termlvl-lookup", "id": "on-call", "path": "hosts"}}}`, 2},
+		{`{"terms": {"host": {"index": "termlvl-lookup", "id": "nobody", "path": "hosts"}}}`, 0},
+		{`{"prefix": {"host": "web-"}}`, 2},
+		{`{"prefix": {"host": {"value": "cache", "case_insensitive": true}}}`, 1},
+		{`{"wildcard": {"host": "*.prod"}}`, 2},
+		{`{"wildcard": {"host": {"wildcard": "*-0?.*", "case_insensitive": true}}}`, 4},
+		{`{"regexp": {"host": "web-0[2-9]\\.prod"}}`, 1},
+		{`{"regexp": {"host": {"value": "cache.*", "case_insensitive": true}}}`, 1},
+		{`{"regexp": {"msg": "br.wn"}}`, 1},
+		{`{"exists": {"field": "owner"}}`, 1},
+		{`{"exists": {"field": "tags"}}`, 2},
+		{`{"ids": {"values": ["1", "4", "9"]}}`, 2},
+		{`{"fuzzy": {"msg": "quikc"}}`, 1},
+		{`{"fuzzy": {"msg": {"value": "quikc", "fuzziness": 1, "transpositions": false}}}`, 0},
+		{`{"match_all": {}}`, 4},
+		{`{"match_none": {}}`, 0},
+		{`{"bool": {"filter": [{"prefix": {"host": "web"}}, {"exists": {"field": "owner"}}]}}`, 1},
+		{`{"bool": {"must_not": [{"terms": {"tags": ["green", "blue"]}}]}}`, 2},
+	}
+	for _, test := range tests {
+		rec := doRequest(http.MethodPost, "/termlvl-000001/_search", `{"query": `+test.query+`}`)
+		d := getResponse(t, rec.Result())
+		require.Equal(t, len(d.Hits.Hits), test.hits, test.query)
+	}
+
+	rec := doRequest(http.MethodPost, "/termlvl-000001/_search", `{"query": {"match_all": {"boost": 1.5}}}`)
+	d := getResponse(t, rec.Result())
+	require.Equal(t, *d.Hits.MaxScore, 1.5)
+
+	// Lookups of indices that don't exist are found wherever they are, before
+	// the query runs
+	var nf *IndexNotFoundError
+	for _, body := range []string{
+		`{"query": {"bool": {"filter": [{"terms": {"host": {"index": "termlvl-none", "id": "on-call", "path": "hosts"}}}]}}}`,
+		`{"aggs": {"a": {"filter": {"terms": {"host": {"index": "termlvl-none", "id": "on-call", "path": "hosts"}}}}}}`,
+	} {
+		q := dsl.Dsl{}
+		require.NoError(t, json.Unmarshal([]byte(body), &q))
+		_, _, err := s.SearchItem([]string{"termlvl-000001"}, &q)
+		require.True(t, errors.As(err, &nf), body)
+		require.Equal(t, nf.Index, "termlvl-none")
+	}
+
+	rec = doRequest(http.MethodPost, "/termlvl-000001/_search", `{"query": {"regexp": {"host": "web-(01"}}}`)
+	require.Equal(t, rec.Code, http.StatusBadRequest)
+}
+
+func TestJsonPaths(t *testing.T) {
+	tests := []struct {
+		field string
+		paths []string
+	}{
+		{"status", []string{`$."status"`}},
+		{"process.serviceName", []string{`$."process"."serviceName"`, `$."process.serviceName"`}},
+		{"with space", []string{`$."with space"`}},
+		{"it's", []string{`$."it's"`}},
+		{`say "hi"`, []string{`$.say \"hi\"`}},
+		{`"quoted"`, []string{`$.\"quoted\"`}},
+		{`a.say "hi"`, []string{`$."a".say \"hi\"`}},
+		{`back\slash`, []string{`$."back\\slash"`}},
+		{"a.", []string{`$."a."`}},
+		{"a..b", []string{`$."a..b"`}},
+	}
+	for _, test := range tests {
+		paths, err := jsonPaths(test.field)
+		require.NoError(t, err, test.field)
+		require.Equal(t, paths, test.paths, test.field)
+	}
+	for _, field := range []string{"", `a["b"]`, `"a[0]"`} {
+		_, err := jsonPaths(field)
+		require.Error(t, err, field)
+	}
+}
+
+func TestValidateIndexName(t *testing.T) {
+	for _, index := range []string{"logs-000001", "jaeger-span-2022-11-11", ".kibana", "a_b+c"} {
+		require.NoError(t, validateIndexName(index), index)
+	}
+	for _, index := range []string{"", ".", "..", "Logs", "a b", `a"b`, "a/b", "a*", "a,b", "a:b", "_docids", "-a", "+a", strings.Repeat("a", 256)} {
+		require.Error(t, validateIndexName(index), index)
+	}
+}
+
+const hostileDocs = `
+{"index": {"_id": "1"}}
+{"a": {"b": "nested"}, "status": 200, "msg": "first"}
+{"index": {"_id": "2"}}
+{"a.b": "literal", "status": 500, "msg": "second"}
+{"index": {"_id": "3"}}
+{"with space": "x", "it's": "y", "say \"hi\"": "z", "back\\slash": "w", "status": 404}
+`
+
+// Values, field names and options from a request must only ever be bound or
+// quoted, so anything a client sends is either a valid query or a 400
+var hostileInputs = []string{
+	`' OR 1=1 --`,
+	`'); DROP TABLE "hostile-000001"; --`,
+	`") OR 1=1 --`,
+	`a') OR 1=1 --`,
+	`$1`,
+	`?`,
+	`*/ OR /*`,
+	`"`,
+	`\`,
+	"\x00",
+	`content`,
+	`1 = 1`,
+}
+
+func TestHostileInputs(t *testing.T) {
+	bulkRequest(t, "/hostile-000001/_bulk", hostileDocs)
+
+	tests := []struct {
+		query string
+		hits  int
+	}{
+		{`{"term": {"a.b": "nested"}}`, 1},
+		{`{"term": {"a.b": "literal"}}`, 1},
+		{`{"exists": {"field": "a.b"}}`, 2},
+		{`{"term": {"with space": "x"}}`, 1},
+		{`{"term": {"it's": "y"}}`, 1},
+		{`{"term": {"say \"hi\"": "z"}}`, 1},
+		{`{"term": {"back\\slash": "w"}}`, 1},
+		{`{"match": {"it's": "y"}}`, 1},
+		{`{"range": {"status": {"gte": 404}}}`, 2},
+	}
+	for _, test := range tests {
+		rec := doRequest(http.MethodPost, "/hostile-000001/_search", `{"query": `+test.query+`}`)
+		d := getResponse(t, rec.Result())
+		require.Equal(t, len(d.Hits.Hits), test.hits, test.query)
+	}
+
+	for _, input := range hostileInputs {
+		v, _ := json.Marshal(input)
+		queries := []string{
+			fmt.Sprintf(`{"query": {"term": {"msg": %s}}}`, v),
+			fmt.Sprintf(`{"query": {"term": {%s: "first"}}}`, v),
+			fmt.Sprintf(`{"query": {"terms": {"msg": [%s, %s]}}}`, v, v),
+			fmt.Sprintf(`{"query": {"match": {%s: %s}}}`, v, v),
+			fmt.Sprintf(`{"query": {"match_phrase": {"msg": %s}}}`, v),
+			fmt.Sprintf(`{"query": {"range": {%s: {"gte": 1}}}}`, v),
+			fmt.Sprintf(`{"query": {"range": {"status": {"gte": 1, "format": %s}}}}`, v),
+			fmt.Sprintf(`{"query": {"wildcard": {%s: %s}}}`, v, v),
+			fmt.Sprintf(`{"query": {"exists": {"field": %s}}}`, v),
+			fmt.Sprintf(`{"query": {"ids": {"values": [%s]}}}`, v),
+			fmt.Sprintf(`{"query": {"terms": {"msg": {"index": %s, "id": %s, "path": %s}}}}`, v, v, v),
+			fmt.Sprintf(`{"query": {"query_string": {"query": %s}}}`, v),
+			fmt.Sprintf(`{"sort": [{%s: {"order": "asc"}}]}`, v),
+			fmt.Sprintf(`{"sort": [{"status": {"order": %s}}]}`, v),
+			fmt.Sprintf(`{"aggs": {"a": {"terms": {"field": %s}}}}`, v),
+			fmt.Sprintf(`{"aggs": {"a": {"max": {"field": %s}}}}`, v),
+		}
+		for _, q := range queries {
+			rec := doRequest(http.MethodPost, "/hostile-000001/_search", q)
+			if rec.Code == http.StatusNotFound {
+				// A terms lookup can name an index that doesn't exist
+				var eresp GenericErrorResponse
+				require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &eresp))
+				require.Equal(t, eresp.Reason, (&IndexNotFoundError{Index: input}).Error(), q)
+				continue
+			}
+			require.True(t, rec.Code == http.StatusOK || rec.Code == http.StatusBadRequest, q)
+			if rec.Code == http.StatusOK {
+				// Nothing hostile can be made to match every document
+				d := getResponse(t, rec.Result())
+				require.True(t, len(d.Hits.Hits) < 3 || !strings.Contains(q, `"query"`), q)
+			}
+		}
+	}
+
+	// Queries nested deeply enough to exhaust the stack are refused
+	deep := strings.Repeat("(", 1000000) + "a" + strings.Repeat(")", 1000000)
+	rec := doRequest(http.MethodPost, "/hostile-000001/_search", `{"query": {"query_string": {"query": "`+deep+`"}}}`)
+	require.Equal(t, rec.Code, http.StatusBadRequest)
+	rec = doRequest(http.MethodPost, "/hostile-000001/_search", `{"query": {"simple_query_string": {"query": "`+deep+`"}}}`)
+	require.Equal(t, rec.Code, http.StatusOK)
+
+	// As are those whose bool queries nest deeper than sqlite can parse the sql of,
+	// right up to the deepest that can be, with the deepest of clauses
+	nested := func(n int) string {
+		q := "a~"
+		for i := 0; i < n; i++ {
+			q = "(a~ OR " + q + ")"
+		}
+		return q
+	}
+	for query, status := range map[string]int{
+		nested(5): http.StatusOK,
+		nested(6): http.StatusBadRequest,
+		strings.Repeat("(a AND ", 20) + "a" + strings.Repeat(")", 20): http.StatusBadRequest,
+	} {
+		for _, kind := range []string{"query_string", "simple_query_string"} {
+			if kind == "simple_query_string" {
+				query = strings.ReplaceAll(strings.ReplaceAll(query, " OR ", " | "), " AND ", " + ")
+			}
+			body := `{"query": {"` + kind + `": {"query": "` + query + `", "fields": ["msg", "status"]}}}`
+			rec = doRequest(http.MethodPost, "/hostile-000001/_search", body)
+			require.Equal(t, rec.Code, status, body)
+			aggs := `{"size": 0, "aggs": {"f": {"filter": {"` + kind + `": {"query": "` + query + `", "fields": ["msg", "status"]}}}}}`
+			rec = doRequest(http.MethodPost, "/hostile-000001/_search", aggs)
+			require.Equal(t, rec.Code, status, aggs)
+		}
+	}
+	// Each change of operator nests the query so far in another bool query
+	for _, alternations := range []int{10, 3000} {
+		query := "a" + strings.Repeat(" +b |a", alternations/2)
+		rec = doRequest(http.MethodPost, "/hostile-000001/_search", `{"query": {"simple_query_string": {"query": "`+query+`"}}}`)
+		require.Equal(t, rec.Code, http.StatusBadRequest, query[:20])
+	}
+
+	rec = doRequest(http.MethodPost, "/hostile-000001/_search", `{}`)
+	d := getResponse(t, rec.Result())
+	require.Equal(t, len(d.Hits.Hits), 3)
+}
+
+func TestInvalidIndexNames(t *testing.T) {
+	for _, index := range []string{"Upper", "-dash"} {
+		rec := doRequest(http.MethodPut, "/"+index, "")
+		require.Equal(t, rec.Code, http.StatusBadRequest, index)
+		rec = doRequest(http.MethodPut, "/"+index+"/_doc/1", `{"a": 1}`)
+		require.Equal(t, rec.Code, http.StatusBadRequest, index)
+	}
+
+	resp := bulkRequest(t, "/_bulk", `{"index": {"_index": "Bad\"Name"}}
+{"a": 1}
+`)
+	require.True(t, resp.Errors)
+	require.Equal(t, resp.Items[0]["index"].Status, http.StatusBadRequest)
+	require.Equal(t, resp.Items[0]["index"].Error.Type, "invalid_index_name_exception")
+
+	idxMap, err := s.ListTables()
+	require.NoError(t, err)
+	for index := range idxMap {
+		require.NoError(t, validateIndexName(index), index)
+	}
+}
+
+func FuzzTermQuery(f *testing.F) {
+	if rec := doRequest(http.MethodPost, "/fuzzterm-000001/_bulk", hostileDocs); rec.Code != http.StatusOK {
+		f.Fatal(rec.Body.String())
+	}
+	for _, input := range hostileInputs {
+		f.Add("msg", input)
+		f.Add(input, "first")
+	}
+	f.Fuzz(func(t *testing.T, field string, value string) {
+		fld, _ := json.Marshal(field)
+		v, _ := json.Marshal(value)
+		rec := doRequest(http.MethodPost, "/fuzzterm-000001/_search",
+			fmt.Sprintf(`{"query": {"term": {%s: %s}}, "sort": [{%s: {"order": "asc"}}]}`, fld, v, fld))
+		if rec.Code != http.StatusOK && rec.Code != http.StatusBadRequest {
+			t.Fatalf("unexpected status %d for field %q value %q: %s", rec.Code, field, value, rec.Body.String())
+		}
+		rec = doRequest(http.MethodPost, "/fuzzterm-000001/_search", `{}`)
+		d := getResponse(t, rec.Result())
+		require.Equal(t, len(d.Hits.Hits), 3)
+	})
+}
+
+func FuzzJsonPaths(f *testing.F) {
+	for _, seed := range []string{"a", "a.b", `say "hi"`, `"`, "a..b", "a[0]", "it's"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, field string) {
+		paths, err := jsonPaths(field)
+		if err != nil {
+			return
+		}
+		for _, path := range paths {
+			// Every path must be one sqlite accepts, whatever the field was
+			var ok int
+			if err := s.db.Get(&ok, `SELECT json_extract('{}', ?) IS NULL`, path); err != nil {
+				t.Fatalf("invalid path %q for field %q: %s", path, field, err)
+			}
+		}
+	})
+}
+
+func TestRangeQueries(t *testing.T) {
+	rec := doRequest(http.MethodPut, "/_template/ranges", `
+	{
+		"index_patterns": "ranges-*",
+		"mappings": {
+			"properties": {
+				"price": {"type": "double"},
+				"count": {"type": "long"},
+				"name": {"type": "keyword"},
+				"ts": {"type": "date", "format": "epoch_millis"},
+				"net": {"properties": {"addr": {"type": "ip"}}},
+				"span": {"type": "long_range"},
+				"period": {"type": "date_range"}
+			}
+		}
+	}`)
+	require.Equal(t, rec.Code, http.StatusOK, rec.Body.String())
+
+	recent := time.Now().Add(-time.Hour).UnixMilli()
+	bulkRequest(t, "/ranges-000001/_bulk", fmt.Sprintf(`
+{"index": {"_id": "1"}}
+{"price": 10.5, "count": 5, "name": "apple", "ts": 1668173489840, "net": {"addr": "10.0.0.5"}, "span": {"gte": 1, "lte": 10}, "period": {"gte": "2022-11-01", "lte": "2022-11-30"}, "readings": [1, 50], "qty": 5, "year": 2021}
+{"index": {"_id": "2"}}
+{"price": 99, "count": 50, "name": "banana", "ts": %d, "net": {"addr": "192.168.1.1"}, "span": {"gte": 5, "lt": 20}, "period": {"gte": "2022-12-01"}, "qty": 50, "year": 2019}
+{"index": {"_id": "3"}}
+{"price": "7", "count": 500, "name": "cherry", "ts": 1577836800000, "net": {"addr": "::1"}, "span": [{"gte": 100, "lte": 200}, {"gt": 30, "lte": 40}], "seen": "2022-11-11T00:00:00Z"}
+{"index": {"_id": "4"}}
+{"name": "date"}
+`, recent))
+
+	tests := []struct {
+		query string
+		hits  int
+	}{
+		{`{"price": {"gte": 10}}`, 2},
+		{`{"price": {"lt": 10}}`, 1},
+		{`{"price": {"from": 10.5, "include_lower": false}}`, 1},
+		{`{"price": {"from": 10.5, "to": 99}}`, 2},
+		{`{"price": {"from": 10.5, "to": 99, "include_lower": false, "include_upper": false}}`, 0},
+		{`{"count": {"gt": 5, "lte": 50}}`, 1},
+		{`{"count": {"gte": null, "lt": 50}}`, 1},
+		{`{"count": {}}`, 3},
+		{`{"price": {"gte": 10}, "count": {"lt": 50}}`, 1},
+		{`{"name": {"gte": "b", "lt": "c"}}`, 1},
+		{`{"name": {"gte": "banana"}}`, 3},
+		{`{"ts": {"gte": "2022-11-11", "format": "strict_date_optional_time"}}`, 2},
+		{`{"ts": {"lte": "2022-11-11", "format": "strict_date_optional_time"}}`, 2},
+		{`{"ts": {"lt": "2022-11-11", "format": "strict_date_optional_time"}}`, 1},
+		{`{"ts": {"gte": 1668173489840, "lte": 1668173489840}}`, 1},
+		{`{"ts": {"gte": 1668173489000, "lt": 1668173489840}}`, 0},
+		{`{"ts": {"gte": "now-1d"}}`, 1},
+		{`{"ts": {"gte": "now-1d/d", "lte": "now/d"}}`, 1},
+		{`{"ts": {"gt": "2022-11-11||/d", "format": "strict_date_optional_time"}}`, 1},
+		{`{"ts": {"gte": "2022-11-11T14:00:00", "format": "strict_date_optional_time"}}`, 1},
+		{`{"ts": {"gte": "2022-11-11T14:00:00", "format": "strict_date_optional_time", "time_zone": "+01:00"}}`, 2},
+		{`{"net.addr": {"gte": "10.0.0.0", "lte": "10.255.255.255"}}`, 1},
+		{`{"net.addr": {"gte": "::", "lt": "10.0.0.0"}}`, 1},
+		{`{"span": {"gte": 8, "lte": 9}}`, 2},
+		{`{"span": {"gte": 20, "lte": 35}}`, 1},
+		{`{"span": {"gte": 2, "lte": 9, "relation": "contains"}}`, 1},
+		{`{"span": {"gte": 0, "lte": 15, "relation": "within"}}`, 1},
+		{`{"span": {"gte": 100, "lte": 200, "relation": "WITHIN"}}`, 1},
+		{`{"period": {"gte": "2022-11-15", "lte": "2022-11-16"}}`, 1},
+		{`{"period": {"gte": "2023-01-01", "relation": "contains"}}`, 1},
+		{`{"period": {"gte": "2022-11-01", "lt": "2022-12-01", "relation": "within"}}`, 1},
+		{`{"readings": {"gte": 40, "lte": 60}}`, 1},
+		{`{"readings": {"gte": 2, "lte": 40}}`, 0},
+		// Integer bounds of unmapped fields are numbers, or epoch millis for dates,
+		// but never years
+		{`{"qty": {"gte": 1000}}`, 0},
+		{`{"qty": {"gte": 10, "lt": 1000}}`, 1},
+		{`{"year": {"gte": 2020}}`, 1},
+		{`{"year": {"gte": 2019, "lt": 2021}}`, 1},
+		{`{"seen": {"gte": 1668124800000}}`, 1},
+		{`{"seen": {"gt": 1668124800000}}`, 0},
+	}
+	for _, test := range tests {
+		rec := doRequest(http.MethodPost, "/ranges-000001/_search", `{"query": {"range": `+test.query+`}}`)
+		d := getResponse(t, rec.Result())
+		require.Equal(t, len(d.Hits.Hits), test.hits, test.query)
+	}
+
+	for _, query := range []string{
+		`{"price": {"gte": "abc"}}`,
+		`{"net.addr": {"gte": "bogus"}}`,
+		`{"ts": {"gte": "2022-11-11"}}`,
+		`{"ts": {"gte": "now-1q"}}`,
+		`{"ts": {"gte": "now", "time_zone": "Mars/Olympus"}}`,
+		`{"span": {"gte": 1, "relation": "disjoint"}}`,
+	} {
+		rec := doRequest(http.MethodPost, "/ranges-000001/_search", `{"query": {"range": `+query+`}}`)
+		require.Equal(t, rec.Code, http.StatusBadRequest, query)
+	}
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"math"
+	"sort"
+)
+
+/*
+
+A merging t-digest, which summarizes a distribution with centroids that are
+small near the tails and larger towards the median, so that percentiles are most
+accurate at the extremes where latency dashboards look. Compression bounds the
+number of centroids, as with the tdigest option of ES
+
+https://github.com/tdunning/t-digest/blob/main/docs/t-digest-paper/histo.pdf
+
+*/
+
+const defaultCompression = 100.0
+
+type centroid struct {
+	Mean  float64 `json:"mean"`
+	Count float64 `json:"count"`
+}
+
+type tdigest struct {
+	compression float64
+	centroids   []centroid
+	// Values added since the centroids were last merged
+	buffer   []centroid
+	count    float64
+	min, max float64
+}
+
+func newTDigest(compression float64) *tdigest {
+	if compression <= 0 {
+		compression = defaultCompression
+	}
+	return &tdigest{compression: compression, min: math.Inf(1), max: math.Inf(-1)}
+}
+
+func (d *tdigest) add(x, w float64) {
+	d.buffer = append(d.buffer, centroid{x, w})
+	d.count += w
+	d.min, d.max = math.Min(d.min, x), math.Max(d.max, x)
+	if len(d.buffer) > int(10*d.compression) {
+		d.compress()
+	}
+}
+
+// The scale function k1, under which a centroid spans no more than one unit
+func (d *tdigest) scale(q float64) float64 {
+	return d.compression / (2 * math.Pi) * math.Asin(2*q-1)
+}
+
+func (d *tdigest) compress() {
+	if len(d.buffer) == 0 {
+		return
+	}
+	all := append(d.centroids, d.buffer...)
+	sort.Slice(all, func(i, j int) bool { return all[i].Mean < all[j].Mean })
+	merged := make([]centroid, 0, len(all))
+	merged = append(merged, all[0])
+	// The weight of the centroids before the last one
+	before := 0.0
+	for _, c := range all[1:] {
+		last := &merged[len(merged)-1]
+		if d.scale((before+last.Count+c.Count)/d.count)-d.scale(before/d.count) <= 1 {
+			last.Count += c.Count
+			last.Mean += (c.Mean - last.Mean) * c.Count / last.Count
+			continue
+		}
+		before += last.Count
+		merged = append(merged, c)
+	}
+	d.centroids, d.buffer = merged, nil
+}
+
+// The centroids, merged
+func (d *tdigest) summary() []centroid {
+	d.compress()
+	return d.centroids
+}
+
+// The value at quantile q, from 0 to 1. Each centroid is taken to be centered on
+// its mean, and values between them are interpolated
+func (d *tdigest) quantile(q float64) float64 {
+	cs := d.summary()
+	switch {
+	case len(cs) == 0:
+		return math.NaN()
+	case q <= 0:
+		return d.min
+	case q >= 1:
+		return d.max
+	case len(cs) == 1:
+		return cs[0].Mean
+	}
+	index := q * d.count
+	if index < cs[0].Count/2 {
+		return d.min + (cs[0].Mean-d.min)*index/(cs[0].Count/2)
+	}
+	center := cs[0].Count / 2
+	for i := 0; i < len(cs)-1; i++ {
+		next := center + (cs[i].Count+cs[i+1].Count)/2
+		if index <= next {
+			return cs[i].Mean + (cs[i+1].Mean-cs[i].Mean)*(index-center)/(next-center)
+		}
+		center = next
+	}
+	last := cs[len(cs)-1]
+	return last.Mean + (d.max-last.Mean)*(index-center)/(last.Count/2)
+}
+
+// The fraction of values below x, with those equal to it counting half, from 0
+// to 1
+func (d *tdigest) cdf(x float64) float64 {
+	cs := d.summary()
+	switch {
+	case len(cs) == 0:
+		return math.NaN()
+	case x < d.min:
+		return 0
+	case x >= d.max:
+		return 1
+	case d.max == d.min:
+		return 0.5
+	}
+	first := cs[0]
+	if x < first.Mean {
+		return first.Count / 2 * (x - d.min) / (first.Mean - d.min) / d.count
+	}
+	center := first.Count / 2
+	for i := 0; i < len(cs)-1; i++ {
+		next := center + (cs[i].Count+cs[i+1].Count)/2
+		if x < cs[i+1].Mean {
+			return (center + (next-center)*(x-cs[i].Mean)/(cs[i+1].Mean-cs[i].Mean)) / d.count
+		}
+		center = next
+	}
+	last := cs[len(cs)-1]
+	return (center + last.Count/2*(x-last.Mean)/(d.max-last.Mean)) / d.count
+}
+
+// The median absolute deviation, approximated as ES does from the deviations of
+// the centroids from the median
+func (d *tdigest) medianAbsoluteDeviation() float64 {
+	median := d.quantile(0.5)
+	deviations := newTDigest(d.compression)
+	for _, c := range d.summary() {
+		deviations.add(math.Abs(c.Mean-median), c.Count)
+	}
+	return deviations.quantile(0.5)
+}
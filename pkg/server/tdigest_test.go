@@ -0,0 +1,45 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+
+	require "github.com/alecthomas/assert/v2"
+)
+
+func TestTDigestExact(t *testing.T) {
+	d := newTDigest(100)
+	for i := 1; i <= 100; i++ {
+		d.add(float64(i), 1)
+	}
+	// Few enough values that each is its own centroid
+	require.Equal(t, d.quantile(0.5), 50.5)
+	require.Equal(t, d.quantile(0), 1.0)
+	require.Equal(t, d.quantile(1), 100.0)
+	require.Equal(t, d.cdf(0), 0.0)
+	require.Equal(t, d.cdf(50), 0.495)
+	require.Equal(t, d.cdf(100), 1.0)
+	require.Equal(t, d.medianAbsoluteDeviation(), 25.0)
+
+	single := newTDigest(100)
+	single.add(42, 1)
+	require.Equal(t, single.quantile(0.99), 42.0)
+	require.True(t, math.IsNaN(newTDigest(100).quantile(0.5)))
+}
+
+func TestTDigestAccuracy(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	d := newTDigest(100)
+	n := 100000
+	for i := 0; i < n; i++ {
+		d.add(r.Float64()*1000, 1)
+	}
+	require.True(t, len(d.summary()) < 200, fmt.Sprint(len(d.summary())))
+	for _, q := range []float64{0.01, 0.05, 0.5, 0.95, 0.99, 0.999} {
+		got := d.quantile(q)
+		require.True(t, math.Abs(got-q*1000) < 10, fmt.Sprint(q, got))
+		require.True(t, math.Abs(d.cdf(q*1000)-q) < 0.01, fmt.Sprint(q, d.cdf(q*1000)))
+	}
+}
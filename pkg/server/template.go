@@ -29,6 +29,8 @@ type Property struct {
 	Type        string `json:"type"`
 	IgnoreAbove int    `json:"ignore_above"`
 	Format      string `json:"format"`
+	// The fields of an object, or of a nested type
+	Properties map[string]Property `json:"properties,omitempty"`
 }
 type CreateTemplateResponse struct {
 	Acknowledged bool `json:"acknowledged"`
@@ -37,6 +39,9 @@ type CreateTemplateResponse struct {
 type TemplateMapping struct {
 	IndexPatterns string              `json:"index_patterns"`
 	Fields        map[string]Property `json:"properties"`
+	// Compiled form of IndexPatterns, so we don't have to compile the pattern
+	// every time we check an index against it
+	pattern *regexp.Regexp
 }
 
 func makeTemplateMapping() TemplateMapping {
@@ -72,6 +77,10 @@ func (s *Server) CreateTemplateHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	tm := createTemplateMappingForReq(req)
+	if err = tm.compile(); err != nil {
+		handleErrorResponse(w, errors.New("invalid index pattern "+err.Error()))
+		return
+	}
 	s.TemplateMappings[target] = tm
 	s.saveTemplateMetadata()
 
@@ -89,13 +98,31 @@ func createTemplateMappingForReq(req CreateTemplateRequest) TemplateMapping {
 	// FIXME Look into how ES style template patterns like *-idx-* can be made to work nicely with golang's RE package
 	// Can replace all `*` with `.*` but there may be a better way
 	tm.IndexPatterns = req.IndexPatterns
-	for fld, prop := range req.Mappings.Properties {
-		// We're only interested in date types for now
-		if prop.Type == "date" {
-			tm.Fields[fld] = prop
+	addMappedFields(tm.Fields, "", req.Mappings.Properties)
+	return tm
+}
+
+// Fields of objects are kept under their full dotted name, which is how queries
+// refer to them
+func addMappedFields(fields map[string]Property, prefix string, props map[string]Property) {
+	for fld, prop := range props {
+		if prop.Properties != nil {
+			addMappedFields(fields, prefix+fld+".", prop.Properties)
+			prop.Properties = nil
+		}
+		if prop.Type != "" {
+			fields[prefix+fld] = prop
 		}
 	}
-	return tm
+}
+
+// The mapped type of a field, if any
+func (tm *TemplateMapping) fieldType(field string) (Property, bool) {
+	if tm == nil {
+		return Property{}, false
+	}
+	prop, ok := tm.Fields[field]
+	return prop, ok
 }
 
 func (s *Server) createMetadata() {
@@ -111,6 +138,17 @@ func (s *Server) createMetadata() {
 	if err != nil {
 		panic(err)
 	}
+
+	ab := sqlbuilder.NewCreateTableBuilder()
+	ab.CreateTable("__aliases").IfNotExists()
+	ab.Define("alias", "text")
+	ab.Define("index_name", "text")
+	ab.Define("body", "text")
+
+	_, err = s.db.Exec(ab.String())
+	if err != nil {
+		panic(err)
+	}
 }
 
 func (s *Server) loadTemplateMetadata() {
@@ -133,6 +171,9 @@ func (s *Server) loadTemplateMetadata() {
 		if err != nil {
 			panic(err)
 		}
+		if err = tm.compile(); err != nil {
+			panic(err)
+		}
 		s.TemplateMappings[target] = tm
 	}
 
@@ -160,18 +201,22 @@ func (s *Server) saveTemplateMetadata() {
 	tx.Commit()
 }
 
+func (tm *TemplateMapping) compile() error {
+	re, err := regexp.Compile(tm.IndexPatterns)
+	if err != nil {
+		return err
+	}
+	tm.pattern = re
+	return nil
+}
+
 func (s *Server) findMatchingTemplate(index string) *TemplateMapping {
 	// This is not efficient, but will do for now given how few of these
 	// there will likely to be. Iterate over all Template mappings
 	// And check if the regex matches any
 
 	for _, tm := range s.TemplateMappings {
-		match, err := regexp.MatchString(tm.IndexPatterns, index)
-		if err != nil {
-			// Probably a regexp we haven't properly cleansed
-			panic(err)
-		}
-		if match {
+		if tm.pattern.MatchString(index) {
 			return &tm
 		}
 	}
@@ -185,10 +230,18 @@ func (s *Server) GetMappingDefinitionHandler(w http.ResponseWriter, r *http.Requ
 
 	var targMappings map[string]TemplateMapping
 	if ok {
-		templ := s.findMatchingTemplate(target)
+		indices, err := s.ResolveIndices([]string{target}, false)
+		if err != nil {
+			// Mappings can be requested for indices that will be created
+			// implicitly later, so fall back to matching the name as given
+			indices = []string{target}
+		}
 		targMappings = make(map[string]TemplateMapping, 0)
-		if templ != nil {
-			targMappings[target] = *templ
+		for _, idx := range indices {
+			templ := s.findMatchingTemplate(idx)
+			if templ != nil {
+				targMappings[idx] = *templ
+			}
 		}
 	} else {
 		targMappings = s.TemplateMappings
@@ -0,0 +1,611 @@
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/bits"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/atomic77/gopensearch/pkg/date"
+	"github.com/atomic77/gopensearch/pkg/dsl"
+	"github.com/huandu/go-sqlbuilder"
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+
+Terms aggregations join each document to the values of its field with json_each,
+so that a document with an array of values is counted in the bucket of each of
+them. The buckets are ordered and limited in sql, unless they are ordered by a
+sub-aggregation, whose results are only known once the rows have been read. As
+there is only ever the one shard, counts are exact and the error upper bound is
+always 0
+
+https://www.elastic.co/guide/en/elasticsearch/reference/7.17/search-aggregations-bucket-terms-aggregation.html
+
+*/
+
+type BucketAggregation struct {
+	DocCountErrorUpperBound int      `json:"doc_count_error_upper_bound"`
+	SumOtherDocCount        int64    `json:"sum_other_doc_count"`
+	Buckets                 []Bucket `json:"buckets"`
+	terms                   *termsAgg
+}
+
+// The alias of the doc count of all of the buckets, including those beyond the
+// size of the aggregation
+const termsTotalAlias = "terms_total"
+
+// A terms aggregation as planned
+type termsAgg struct {
+	field       string
+	missing     *dsl.StringOrNumber
+	size        int
+	minDocCount int64
+	// Of rare terms
+	maxDocCount int64
+	order       []termsOrder
+	// Ordered by a sub-aggregation, the buckets are sorted as they are read
+	bySubAgg bool
+	// The aliases of the key and doc count of each bucket
+	keyAlias, countAlias string
+	// Date keys are epoch millis shown in a format, and boolean ones 1 or 0
+	dateFormat string
+	boolean    bool
+}
+
+// One of the criteria of the order, by _count, _key or the value of a metric
+// sub-aggregation, eg. stats.avg or percentiles[99.0]
+type termsOrder struct {
+	key  string
+	prop string
+	desc bool
+}
+
+func newTerms(t *dsl.AggTerms, label string, aggs map[string]dsl.Aggregate) (*termsAgg, error) {
+	ta := &termsAgg{field: t.Field, missing: t.Missing, size: 10, minDocCount: 1}
+	if t.Size != nil {
+		if ta.size = *t.Size; ta.size <= 0 {
+			return nil, &QueryError{Reason: fmt.Sprintf("[size] must be greater than 0. Found [%d] in [%s]", ta.size, label)}
+		}
+	}
+	if t.MinDocCount != nil {
+		n, err := strconv.ParseInt(t.MinDocCount.String(), 10, 64)
+		if err != nil || n < 0 {
+			return nil, &QueryError{Reason: fmt.Sprintf("[min_doc_count] must be greater than or equal to 0. Found [%s] in [%s]", t.MinDocCount.String(), label)}
+		}
+		ta.minDocCount = n
+	}
+
+	order := t.Order
+	if len(order) == 0 {
+		order = dsl.TermsOrder{{Key: "_count", Direction: "desc"}}
+	}
+	byKey := false
+	for _, c := range order {
+		o, err := newTermsOrder(c, aggs)
+		if err != nil {
+			return nil, err
+		}
+		byKey = byKey || o.key == "_key"
+		ta.bySubAgg = ta.bySubAgg || (o.key != "_key" && o.key != "_count")
+		ta.order = append(ta.order, o)
+	}
+	// As with ES, ties are always broken by the key
+	if !byKey {
+		ta.order = append(ta.order, termsOrder{key: "_key"})
+	}
+	return ta, nil
+}
+
+func newTermsOrder(c dsl.OrderCriterion, aggs map[string]dsl.Aggregate) (termsOrder, error) {
+	var o termsOrder
+	switch strings.ToLower(c.Direction) {
+	case "asc":
+	case "desc":
+		o.desc = true
+	default:
+		return o, &QueryError{Reason: fmt.Sprintf("Unknown order direction [%s]", c.Direction)}
+	}
+	switch c.Key {
+	case "_count", "_key":
+		o.key = c.Key
+		return o, nil
+	case "_term":
+		// The deprecated name of _key
+		o.key = "_key"
+		return o, nil
+	}
+
+	o.key = c.Key
+	if i := strings.IndexAny(c.Key, ".["); i >= 0 {
+		o.key, o.prop = c.Key[:i], strings.TrimSuffix(strings.TrimPrefix(c.Key[i:], "."), "]")
+		o.prop = strings.TrimPrefix(o.prop, "[")
+	}
+	sub, ok := aggs[o.key]
+	if !ok {
+		return o, &QueryError{Reason: fmt.Sprintf("Invalid aggregator order path [%s]. Unknown aggregation [%s]", c.Key, o.key)}
+	}
+	switch sub.GenAggregationCategory() {
+	case dsl.MetricsSingle:
+		if o.prop != "" && o.prop != "value" {
+			return o, &QueryError{Reason: fmt.Sprintf("Invalid aggregation order path [%s]. Unknown value key [%s] of single-value metric aggregation [%s]", c.Key, o.prop, o.key)}
+		}
+	case dsl.MetricsMultiple:
+		if o.prop == "" {
+			return o, &QueryError{Reason: fmt.Sprintf("Invalid aggregation order path [%s]. When ordering on a multi-value metrics aggregation a metric name must be specified.", c.Key)}
+		}
+	default:
+		return o, &QueryError{Reason: fmt.Sprintf("Invalid aggregation order path [%s]. Buckets can only be sorted on a sub-aggregator path that is built out of zero or more single-bucket aggregations within the path and a final single-bucket or a metrics aggregation at the path end.", c.Key)}
+	}
+	return o, nil
+}
+
+func (dbq *dbSubQuery) genTermsSelectExprs(agg *dsl.Aggregate, grpIdx, fnIdx string) error {
+	ta, err := newTerms(agg.Terms, *dbq.label, agg.Aggs)
+	if err != nil {
+		return err
+	}
+	if err := dbq.genTermsJoin(agg.Terms, ta, grpIdx, fnIdx); err != nil {
+		return err
+	}
+	dbq.aggregation = &BucketAggregation{terms: ta}
+	return nil
+}
+
+// The select expressions of the terms of a field, to each of whose distinct values
+// documents are joined
+func (dbq *dbSubQuery) genTermsJoin(t *dsl.AggTerms, ta *termsAgg, grpIdx, fnIdx string) error {
+	ta.keyAlias, ta.countAlias = grpIdx, fnIdx
+	field := cleanseKeyField(t.Field)
+	values, err := ta.valuesExpr(dbq)
+	if err != nil {
+		return err
+	}
+
+	each := "terms_" + grpIdx
+	value := each + ".value"
+	conds := []string{
+		fmt.Sprintf(`%s.type NOT IN ('null', 'object', 'array')`, each),
+		// A value repeated within an array only counts the document once
+		fmt.Sprintf(`NOT EXISTS (SELECT 1 FROM json_each(%s) AS seen WHERE seen.key < %s.key AND seen.value IS %s)`,
+			values, each, value),
+	}
+	if t.Include != nil {
+		cond, err := dbq.termsFilter(t.Include, value, "include")
+		if err != nil {
+			return err
+		}
+		conds = append(conds, cond)
+	}
+	if t.Exclude != nil {
+		cond, err := dbq.termsFilter(t.Exclude, value, "exclude")
+		if err != nil {
+			return err
+		}
+		conds = append(conds, "NOT "+cond)
+	}
+	dbq.sb.Join(fmt.Sprintf("json_each(%s) AS %s", values, each), conds...)
+
+	key := value
+	switch prop, _ := dbq.mapping.fieldType(field); prop.Type {
+	case "date", "date_nanos":
+		if ta.dateFormat, err = aggDateFormat(t.Format, prop); err != nil {
+			return err
+		}
+		key = epochMillis(value, each+".type")
+	case "boolean":
+		ta.boolean = true
+	}
+
+	dbq.groupAliases[grpIdx] = t
+	dbq.fnAliases[fnIdx] = t
+	dbq.selectExprs = append(dbq.selectExprs,
+		dbq.sb.As(" "+key, grpIdx),
+		dbq.sb.As("COUNT(*)", fnIdx),
+	)
+	return nil
+}
+
+// Rare terms are those of terms aggregations with at most max_doc_count
+// documents, all of which are shown, the rarest first
+//
+// https://www.elastic.co/guide/en/elasticsearch/reference/7.17/search-aggregations-bucket-rare-terms-aggregation.html
+type RareTermsAggregation struct {
+	*BucketAggregation
+}
+
+// Rare terms are exact, so there's no error or other count to show
+func (m *RareTermsAggregation) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Buckets []Bucket `json:"buckets"`
+	}{m.Buckets})
+}
+
+// As index.max_terms_count is by default
+const maxRareTermsDocCount = 100
+
+func (dbq *dbSubQuery) genRareTermsSelectExprs(rt *dsl.RareTerms, grpIdx, fnIdx string) error {
+	ta := &termsAgg{field: rt.Field, missing: rt.Missing, size: math.MaxInt32, minDocCount: 1, maxDocCount: 1,
+		order: []termsOrder{{key: "_count"}, {key: "_key"}}}
+	if rt.MaxDocCount != nil {
+		ta.maxDocCount = int64(*rt.MaxDocCount)
+	}
+	if ta.maxDocCount <= 0 {
+		return &QueryError{Reason: "[max_doc_count] must be greater than 0."}
+	}
+	if ta.maxDocCount > maxRareTermsDocCount {
+		return &QueryError{Reason: fmt.Sprintf("[max_doc_count] must be smaller than or equal to [%d].", maxRareTermsDocCount)}
+	}
+	t := &dsl.AggTerms{Field: rt.Field, Missing: rt.Missing, Include: rt.Include, Exclude: rt.Exclude}
+	if err := dbq.genTermsJoin(t, ta, grpIdx, fnIdx); err != nil {
+		return err
+	}
+	dbq.aggregation = &RareTermsAggregation{&BucketAggregation{terms: ta}}
+	return nil
+}
+
+// The json of the values of a document, or of its missing value
+func (ta *termsAgg) valuesExpr(dbq *dbSubQuery) (string, error) {
+	return dbq.metricValue(&dsl.AggField{Field: ta.field, Missing: ta.missing})
+}
+
+// The condition of an include or exclude, as a regular expression, a list of
+// values, or a partition of the values by their hash
+func (dbq *dbSubQuery) termsFilter(ie *dsl.IncludeExclude, value, name string) (string, error) {
+	switch {
+	case ie.Regexp != "":
+		if _, err := compileRegexp(ie.Regexp, false); err != nil {
+			return "", &QueryError{Reason: fmt.Sprintf("[%s] invalid regular expression [%s]: %v", name, ie.Regexp, err)}
+		}
+		return fmt.Sprintf("terms_match(%s, %s)", value, dbq.sb.Var(ie.Regexp)), nil
+	case ie.Values != nil:
+		vars := make([]string, len(ie.Values))
+		for i, v := range ie.Values {
+			if n, ok := v.(json.Number); ok {
+				if whole, err := n.Int64(); err == nil {
+					v = whole
+				} else if v, err = n.Float64(); err != nil {
+					return "", &QueryError{Reason: fmt.Sprintf("[%s] failed to parse [%s] as a number", name, n)}
+				}
+			}
+			vars[i] = dbq.sb.Var(v)
+		}
+		return fmt.Sprintf("%s IN (%s)", value, strings.Join(vars, ", ")), nil
+	case ie.NumPartitions != nil || ie.Partition != nil:
+		if name == "exclude" {
+			return "", &QueryError{Reason: "Cannot use partitioned exclude, only include supports partitions"}
+		}
+		if ie.NumPartitions == nil || ie.Partition == nil {
+			return "", &QueryError{Reason: "Missing [partition] or [num_partitions] parameter for partition-based include"}
+		}
+		if *ie.NumPartitions <= 0 || *ie.Partition < 0 || *ie.Partition >= *ie.NumPartitions {
+			return "", &QueryError{Reason: fmt.Sprintf("[partition] must be from 0 to [num_partitions] - 1, found [%d] of [%d]", *ie.Partition, *ie.NumPartitions)}
+		}
+		return fmt.Sprintf("terms_partition(%s, %s) = %s", value, dbq.sb.Var(*ie.NumPartitions), dbq.sb.Var(*ie.Partition)), nil
+	}
+	return "", &QueryError{Reason: fmt.Sprintf("[%s] must be a regular expression, an array of values or partitions", name)}
+}
+
+// The buckets with enough documents, in order and up to the size of the
+// aggregation, unless that has to wait for the sub-aggregations. The doc count of
+// all of the buckets is summed over those that were grouped, as sqlite won't have
+// a window function alongside the aggregates of sub-aggregations. Composite
+// aggregations are ordered by their keys instead, and top hits as hits are
+func (dbq *dbSubQuery) genAggOrder() {
+	var m *BucketAggregation
+	switch a := dbq.aggregation.(type) {
+	case *CompositeAggregation:
+		dbq.genCompositeOrder(a.composite)
+		return
+	case *TopHitsAggregation:
+		dbq.genTopHitsOrder(a.top)
+		return
+	case *TopMetricsAggregation:
+		dbq.genTopHitsOrder(a.top)
+		return
+	case *SignificantTermsAggregation:
+		dbq.genSignificantTermsOrder(a.sig)
+		return
+	case *RareTermsAggregation:
+		m = a.BucketAggregation
+	case *BucketAggregation:
+		m = a
+	default:
+		return
+	}
+	ta := m.terms
+	if ta.minDocCount > 1 {
+		dbq.sb.Having(dbq.sb.GreaterEqualThan(ta.countAlias, ta.minDocCount))
+	}
+	if ta.maxDocCount > 0 {
+		dbq.sb.Having(dbq.sb.LessEqualThan(ta.countAlias, ta.maxDocCount))
+	}
+	if ta.bySubAgg {
+		return
+	}
+	outer := sqlbuilder.SQLite.NewSelectBuilder()
+	outer.Select("*", outer.As(fmt.Sprintf("SUM(%s) OVER ()", ta.countAlias), termsTotalAlias)).
+		From(outer.BuilderAs(dbq.sb, "buckets"))
+	for _, o := range ta.order {
+		alias := ta.keyAlias
+		if o.key == "_count" {
+			alias = ta.countAlias
+		}
+		if o.desc {
+			outer.OrderBy(alias + " DESC")
+		} else {
+			outer.OrderBy(alias + " ASC")
+		}
+	}
+	outer.Limit(ta.size)
+	dbq.sb = outer
+}
+
+func (m *BucketAggregation) SerializeResultset(rows *sqlx.Rows, dbq *dbSubQuery) error {
+	ta := m.terms
+	m.Buckets = make([]Bucket, 0)
+	var total int64
+	for rows.Next() {
+		dest := make(map[string]interface{})
+		if err := rows.MapScan(dest); err != nil {
+			return err
+		}
+		b, err := scanBucket(dest, dbq)
+		if err != nil {
+			return err
+		}
+		b.Key = dest[ta.keyAlias]
+		if n, ok := dest[termsTotalAlias].(int64); ok {
+			total = n
+		} else {
+			total += b.DocCount
+		}
+		m.Buckets = append(m.Buckets, b)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if ta.bySubAgg {
+		sort.SliceStable(m.Buckets, func(i, j int) bool {
+			return ta.compare(&m.Buckets[i], &m.Buckets[j]) < 0
+		})
+		if len(m.Buckets) > ta.size {
+			m.Buckets = m.Buckets[:ta.size]
+		}
+	}
+	m.SumOtherDocCount = total
+	for i := range m.Buckets {
+		m.SumOtherDocCount -= m.Buckets[i].DocCount
+		ta.setKey(&m.Buckets[i])
+	}
+	return nil
+}
+
+func (m *BucketAggregation) buckets() []Bucket {
+	return m.Buckets
+}
+
+func (m *BucketAggregation) setBuckets(buckets []Bucket) {
+	m.Buckets = buckets
+}
+
+func (m *BucketAggregation) bucketFilter(dbq *dbSubQuery, b *Bucket) (string, error) {
+	return m.terms.bucketFilter(dbq, b)
+}
+
+// The documents of a bucket are those with its key among their values
+func (ta *termsAgg) bucketFilter(dbq *dbSubQuery, b *Bucket) (string, error) {
+	values, err := ta.valuesExpr(dbq)
+	if err != nil {
+		return "", err
+	}
+	value := "term.value"
+	if ta.dateFormat != "" {
+		value = epochMillis(value, "term.type")
+	}
+	return fmt.Sprintf("EXISTS (SELECT 1 FROM json_each(%s) AS term WHERE %s IS %s)",
+		values, value, dbq.sb.Var(b.Key)), nil
+}
+
+func (ta *termsAgg) compare(a, b *Bucket) int {
+	for _, o := range ta.order {
+		var c int
+		switch o.key {
+		case "_count":
+			c = compareFloats(float64(a.DocCount), float64(b.DocCount))
+		case "_key":
+			c = compareTermsKeys(a.Key, b.Key)
+		default:
+			x, xok := aggregationValue(a.subaggregates[o.key], o.prop)
+			y, yok := aggregationValue(b.subaggregates[o.key], o.prop)
+			// Buckets without a value go last, whichever the direction
+			switch {
+			case !xok && !yok:
+			case !xok:
+				return 1
+			case !yok:
+				return -1
+			default:
+				c = compareFloats(x, y)
+			}
+		}
+		if o.desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// Numbers sort before strings
+func compareTermsKeys(a, b interface{}) int {
+	x, xnum := termsKeyNumber(a)
+	y, ynum := termsKeyNumber(b)
+	switch {
+	case xnum && ynum:
+		return compareFloats(x, y)
+	case xnum:
+		return -1
+	case ynum:
+		return 1
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+func termsKeyNumber(k interface{}) (float64, bool) {
+	switch n := k.(type) {
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// The value of a metric or pipeline sub-aggregation, as buckets are ordered by it
+// or pipelines take it, if it has one
+func aggregationValue(r interface{}, prop string) (float64, bool) {
+	var v *float64
+	switch m := r.(type) {
+	case *MetricSingleAggregation:
+		v = m.Value
+	case *TopMetricsAggregation:
+		// Of the top document
+		if len(m.Top) == 0 {
+			return 0, false
+		}
+		f, ok := termsKeyNumber(m.Top[0].Metrics[prop])
+		if !ok {
+			return 0, false
+		}
+		v = &f
+	case *MetricMultipleAggregation:
+		pct, err := strconv.ParseFloat(prop, 64)
+		if err != nil {
+			return 0, false
+		}
+		for _, pv := range m.Values {
+			if pv.Key == pct {
+				v = pv.Value
+			}
+		}
+	default:
+		// Stats are ordered by any of the values they show
+		b, err := json.Marshal(r)
+		if err != nil {
+			return 0, false
+		}
+		values := make(map[string]interface{})
+		if err := json.Unmarshal(b, &values); err != nil {
+			return 0, false
+		}
+		if prop == "" {
+			prop = "value"
+		}
+		f, ok := values[prop].(float64)
+		v = &f
+		if !ok {
+			return 0, false
+		}
+	}
+	if v == nil || math.IsNaN(*v) {
+		return 0, false
+	}
+	return *v, true
+}
+
+// Keys are shown as ES does for the type of their field
+func (ta *termsAgg) setKey(b *Bucket) {
+	switch {
+	case ta.dateFormat != "":
+		ms, _ := termsKeyNumber(b.Key)
+		s, _ := date.Format(ta.dateFormat, time.UnixMilli(int64(ms)).UTC())
+		b.Key, b.KeyAsString = int64(ms), fmt.Sprint(s)
+	case ta.boolean:
+		if n, ok := b.Key.(int64); ok {
+			b.KeyAsString = strconv.FormatBool(n != 0)
+		}
+	}
+}
+
+// terms_match(value, pattern) is true if a string value matches the whole of a
+// regular expression
+func termsMatch(value interface{}, pattern string) bool {
+	s, ok := value.(string)
+	if !ok {
+		return false
+	}
+	// The pattern was already validated when the query was planned
+	re, err := compileRegexp(pattern, false)
+	return err == nil && re.MatchString(s)
+}
+
+// terms_partition(value, n) is the partition of a value among n of them, by the
+// same hashes as ES: murmur3 of strings, and a mix of the bits of numbers
+func termsPartition(value interface{}, n int64) int64 {
+	var h int64
+	switch v := value.(type) {
+	case string:
+		h = int64(int32(murmur3([]byte(v), 31)))
+	case int64:
+		h = mix64(v)
+	case float64:
+		h = mix64(int64(math.Float64bits(v)))
+	}
+	// Java's floorMod, which is never negative
+	return ((h % n) + n) % n
+}
+
+// The 32 bit x86 variant of murmur3, as lucene's StringHelper has it
+func murmur3(data []byte, seed uint32) uint32 {
+	const c1, c2 = 0xcc9e2d51, 0x1b873593
+	h := seed
+	n := len(data) / 4
+	for i := 0; i < n; i++ {
+		k := binary.LittleEndian.Uint32(data[i*4:])
+		k *= c1
+		k = bits.RotateLeft32(k, 15)
+		k *= c2
+		h ^= k
+		h = bits.RotateLeft32(h, 13)
+		h = h*5 + 0xe6546b64
+	}
+	var k uint32
+	switch tail := data[n*4:]; len(tail) {
+	case 3:
+		k ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		k ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		k ^= uint32(tail[0])
+		k *= c1
+		k = bits.RotateLeft32(k, 15)
+		k *= c2
+		h ^= k
+	}
+	h ^= uint32(len(data))
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
+
+// hppc's BitMixer.mix64
+func mix64(v int64) int64 {
+	z := uint64(v)
+	z = (z ^ (z >> 32)) * 0x4cd6944c5cc20b6d
+	z = (z ^ (z >> 29)) * 0xfc12c5b19d3259e9
+	return int64(z ^ (z >> 32))
+}
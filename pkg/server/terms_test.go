@@ -0,0 +1,106 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	require "github.com/alecthomas/assert/v2"
+)
+
+func TestTermsAggregation(t *testing.T) {
+	rec := doRequest(http.MethodPut, "/_template/termsagg", `{
+		"index_patterns": "termsagg-*",
+		"mappings": {"properties": {"ts": {"type": "date"}, "up": {"type": "boolean"}}}
+	}`)
+	require.Equal(t, rec.Code, http.StatusOK, rec.Body.String())
+	bulkRequest(t, "/termsagg-000001/_bulk", `
+{"index": {}}
+{"host": "web-01", "tags": ["a", "b", "a"], "status": 200, "lat": 10, "up": true, "ts": "2022-11-11T00:00:00Z"}
+{"index": {}}
+{"host": "web-02", "tags": ["b"], "status": 500, "lat": 30, "up": false, "ts": "2022-11-12T00:00:00Z"}
+{"index": {}}
+{"host": "web-01", "tags": "c", "status": 200, "lat": 20, "up": true, "ts": "2022-11-11T00:00:00Z"}
+{"index": {}}
+{"host": "db-01", "status": 404, "lat": 5}
+{"index": {}}
+{"host": null}
+`)
+	terms := func(agg string) string {
+		t.Helper()
+		return aggregationResult(t, "termsagg-000001", `{"a": `+agg+`}`)
+	}
+
+	// By doc count, with ties broken by the key
+	require.Equal(t, terms(`{"terms": {"field": "host.keyword"}}`),
+		`{"doc_count_error_upper_bound":0,"sum_other_doc_count":0,"buckets":[{"key":"web-01","doc_count":2},{"key":"db-01","doc_count":1},{"key":"web-02","doc_count":1}]}`)
+	require.Equal(t, terms(`{"terms": {"field": "host", "size": 1}}`),
+		`{"doc_count_error_upper_bound":0,"sum_other_doc_count":2,"buckets":[{"key":"web-01","doc_count":2}]}`)
+	require.Equal(t, terms(`{"terms": {"field": "host", "order": {"_key": "desc"}}}`),
+		`{"doc_count_error_upper_bound":0,"sum_other_doc_count":0,"buckets":[{"key":"web-02","doc_count":1},{"key":"web-01","doc_count":2},{"key":"db-01","doc_count":1}]}`)
+	require.Equal(t, terms(`{"terms": {"field": "host", "min_doc_count": "2"}}`),
+		`{"doc_count_error_upper_bound":0,"sum_other_doc_count":0,"buckets":[{"key":"web-01","doc_count":2}]}`)
+	require.Equal(t, terms(`{"terms": {"field": "host", "missing": "none", "order": {"_key": "asc"}}}`),
+		`{"doc_count_error_upper_bound":0,"sum_other_doc_count":0,"buckets":[{"key":"db-01","doc_count":1},{"key":"none","doc_count":1},{"key":"web-01","doc_count":2},{"key":"web-02","doc_count":1}]}`)
+
+	// Each document counts once in the bucket of each of its values
+	require.Equal(t, terms(`{"terms": {"field": "tags"}}`),
+		`{"doc_count_error_upper_bound":0,"sum_other_doc_count":0,"buckets":[{"key":"b","doc_count":2},{"key":"a","doc_count":1},{"key":"c","doc_count":1}]}`)
+
+	// Keys as ES shows them for each type of field
+	require.Equal(t, terms(`{"terms": {"field": "status"}}`),
+		`{"doc_count_error_upper_bound":0,"sum_other_doc_count":0,"buckets":[{"key":200,"doc_count":2},{"key":404,"doc_count":1},{"key":500,"doc_count":1}]}`)
+	require.Equal(t, terms(`{"terms": {"field": "ts"}}`),
+		`{"doc_count_error_upper_bound":0,"sum_other_doc_count":0,"buckets":[{"key_as_string":"2022-11-11T00:00:00.000Z","key":1668124800000,"doc_count":2},{"key_as_string":"2022-11-12T00:00:00.000Z","key":1668211200000,"doc_count":1}]}`)
+	require.Equal(t, terms(`{"terms": {"field": "up"}}`),
+		`{"doc_count_error_upper_bound":0,"sum_other_doc_count":0,"buckets":[{"key_as_string":"true","key":1,"doc_count":2},{"key_as_string":"false","key":0,"doc_count":1}]}`)
+
+	// Include and exclude
+	require.Equal(t, terms(`{"terms": {"field": "host", "include": "web-.*", "exclude": ["web-02"]}}`),
+		`{"doc_count_error_upper_bound":0,"sum_other_doc_count":0,"buckets":[{"key":"web-01","doc_count":2}]}`)
+	require.Equal(t, terms(`{"terms": {"field": "host", "exclude": "web-.*"}}`),
+		`{"doc_count_error_upper_bound":0,"sum_other_doc_count":0,"buckets":[{"key":"db-01","doc_count":1}]}`)
+	require.Equal(t, terms(`{"terms": {"field": "status", "include": [404, 500]}}`),
+		`{"doc_count_error_upper_bound":0,"sum_other_doc_count":0,"buckets":[{"key":404,"doc_count":1},{"key":500,"doc_count":1}]}`)
+	// Each term is in exactly one partition
+	partitions := make(map[string]int)
+	for _, p := range []string{"0", "1", "2"} {
+		var resp struct {
+			Buckets []struct {
+				Key string `json:"key"`
+			} `json:"buckets"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(terms(`{"terms": {"field": "host", "include": {"partition": `+p+`, "num_partitions": 3}}}`)), &resp))
+		for _, b := range resp.Buckets {
+			partitions[b.Key]++
+		}
+	}
+	require.Equal(t, partitions, map[string]int{"web-01": 1, "web-02": 1, "db-01": 1})
+
+	// Ordered by sub-aggregations
+	require.Equal(t, terms(`{"terms": {"field": "host", "order": {"lat": "desc"}}, "aggregations": {"lat": {"avg": {"field": "lat"}}}}`),
+		`{"doc_count_error_upper_bound":0,"sum_other_doc_count":0,"buckets":[{"key":"web-02","doc_count":1,"lat":{"value":30}},{"key":"web-01","doc_count":2,"lat":{"value":15}},{"key":"db-01","doc_count":1,"lat":{"value":5}}]}`)
+	require.Equal(t, terms(`{"terms": {"field": "host", "size": 2, "order": {"lat.max": "asc"}}, "aggregations": {"lat": {"stats": {"field": "lat"}}}}`),
+		`{"doc_count_error_upper_bound":0,"sum_other_doc_count":1,"buckets":[{"key":"db-01","doc_count":1,"lat":{"count":1,"min":5,"max":5,"avg":5,"sum":5}},{"key":"web-01","doc_count":2,"lat":{"count":2,"min":10,"max":20,"avg":15,"sum":30}}]}`)
+	require.Equal(t, terms(`{"terms": {"field": "host", "order": [{"_count": "desc"}, {"lat": "desc"}]}, "aggregations": {"lat": {"max": {"field": "lat"}}}}`),
+		`{"doc_count_error_upper_bound":0,"sum_other_doc_count":0,"buckets":[{"key":"web-01","doc_count":2,"lat":{"value":20}},{"key":"web-02","doc_count":1,"lat":{"value":30}},{"key":"db-01","doc_count":1,"lat":{"value":5}}]}`)
+
+	for _, agg := range []string{
+		`{"terms": {"field": "host", "size": 0}}`,
+		`{"terms": {"field": "host", "order": {"_count": "up"}}}`,
+		`{"terms": {"field": "host", "order": {"nothing": "desc"}}}`,
+		`{"terms": {"field": "host", "order": {"lat": "desc"}}, "aggregations": {"lat": {"stats": {"field": "lat"}}}}`,
+		`{"terms": {"field": "host", "include": {"partition": 3, "num_partitions": 3}}}`,
+		`{"terms": {"field": "host", "exclude": {"partition": 0, "num_partitions": 3}}}`,
+	} {
+		rec := doRequest(http.MethodPost, "/termsagg-000001/_search", `{"size": 0, "aggs": {"a": `+agg+`}}`)
+		require.Equal(t, rec.Code, http.StatusBadRequest, agg)
+	}
+}
+
+func TestMurmur3(t *testing.T) {
+	require.Equal(t, murmur3([]byte(""), 0), 0)
+	require.Equal(t, murmur3([]byte(""), 1), 0x514e28b7)
+	require.Equal(t, murmur3([]byte("hello"), 0), 0x248bfa47)
+	require.Equal(t, murmur3([]byte("The quick brown fox jumps over the lazy dog"), 0), 0x2e4ff723)
+}
@@ -0,0 +1,313 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/atomic77/gopensearch/pkg/dsl"
+	"github.com/jmoiron/sqlx"
+)
+
+/*
+
+Top hits aggregations show the top documents of a bucket, sorted as the hits of a
+search are, and top metrics the values of fields of them. Neither can be computed
+alongside the buckets, so both are run for each of them as bucket sub-aggregations
+are, as a query of the documents in the bucket
+
+https://www.elastic.co/guide/en/elasticsearch/reference/7.17/search-aggregations-metrics-top-hits-aggregation.html
+https://www.elastic.co/guide/en/elasticsearch/reference/7.17/search-aggregations-metrics-top-metrics.html
+
+*/
+
+type TopHitsAggregation struct {
+	Hits Hits `json:"hits"`
+	top  *topHits
+}
+
+func (m TopHitsAggregation) GetAggregateCategory() dsl.AggregationCategory {
+	return dsl.Hits
+}
+
+type TopMetricsAggregation struct {
+	Top []TopMetric `json:"top"`
+	top *topHits
+}
+
+func (m TopMetricsAggregation) GetAggregateCategory() dsl.AggregationCategory {
+	return dsl.Hits
+}
+
+type TopMetric struct {
+	Sort    []interface{}          `json:"sort"`
+	Metrics map[string]interface{} `json:"metrics"`
+}
+
+// The query of the top documents, as planned
+type topHits struct {
+	from, size int
+	sorts      []topSort
+	// Scores are only shown when sorting by them, unless they are tracked
+	scores  bool
+	metrics []string
+	source  *dsl.SourceFilter
+}
+
+type topSort struct {
+	alias string
+	desc  bool
+}
+
+// The number of documents in the bucket, whichever of them are shown
+const topHitsTotalAlias = "hits_total"
+
+// As index.max_inner_result_window is by default
+const maxTopHitsWindow = 100
+
+func (dbq *dbSubQuery) genTopHitsSelectExprs(agg *dsl.Aggregate) error {
+	label := *dbq.label
+	var (
+		th    *topHits
+		sorts dsl.SortFields
+		typ   string
+	)
+	if t := agg.TopHits; t != nil {
+		typ = "top_hits"
+		th = &topHits{from: t.From, size: 3, source: t.Source}
+		if t.Size != nil {
+			th.size = *t.Size
+		}
+		if th.from < 0 {
+			return &QueryError{Reason: fmt.Sprintf("[from] must be greater than or equal to 0. Found [%d] in [%s]", th.from, label)}
+		}
+		if th.size < 0 {
+			return &QueryError{Reason: fmt.Sprintf("[size] must be greater than or equal to 0. Found [%d] in [%s]", th.size, label)}
+		}
+		if th.from+th.size > maxTopHitsWindow {
+			return &QueryError{Reason: fmt.Sprintf("Top hits result window is too large, the top hits aggregator [%s]'s from + size must be less than or equal to: [%d] but was [%d]. This limit can be set by changing the [index.max_inner_result_window] index level setting.",
+				label, maxTopHitsWindow, th.from+th.size)}
+		}
+		sorts = t.Sort
+		th.scores = len(sorts) == 0 || t.TrackScores
+		dbq.aggregation = &TopHitsAggregation{top: th}
+	} else {
+		t := agg.TopMetrics
+		typ = "top_metrics"
+		th = &topHits{size: 1}
+		if t.Size != nil {
+			th.size = *t.Size
+		}
+		if th.size < 1 {
+			return &QueryError{Reason: fmt.Sprintf("[size] must be more than 0 but was [%d]", th.size)}
+		}
+		if th.size > 10 {
+			return &QueryError{Reason: fmt.Sprintf("[top_metrics.size] must not be more than [10] but was [%d]", th.size)}
+		}
+		if len(t.Metrics) == 0 {
+			return &QueryError{Reason: "[metrics] must not be empty"}
+		}
+		if len(t.Sort) != 1 {
+			return &QueryError{Reason: "only supports sorting on a single field"}
+		}
+		sorts = t.Sort
+		dbq.aggregation = &TopMetricsAggregation{top: th}
+	}
+	if len(agg.Aggs) > 0 {
+		return &QueryError{Reason: fmt.Sprintf("Aggregator [%s] of type [%s] cannot accept sub-aggregations", label, typ)}
+	}
+
+	exprs := make([]string, 0, len(sorts))
+	for i, c := range sorts {
+		th.scores = th.scores || c.Key == "_score"
+		s := topSort{alias: fmt.Sprintf("hit_sort_%d", i), desc: c.Key == "_score"}
+		switch strings.ToUpper(c.Direction) {
+		case "":
+		case "ASC":
+			s.desc = false
+		case "DESC":
+			s.desc = true
+		default:
+			return &QueryError{Reason: fmt.Sprintf("Unknown SortOrder [%s]", c.Direction)}
+		}
+		value, err := dbq.topSortValue(c.Key)
+		if err != nil {
+			return err
+		}
+		th.sorts = append(th.sorts, s)
+		exprs = append(exprs, dbq.sb.As(value, s.alias))
+	}
+	if agg.TopMetrics != nil {
+		for i, m := range agg.TopMetrics.Metrics {
+			field := cleanseKeyField(m.Field)
+			value, err := dbq.fieldExpr(field, `JSON_EXTRACT(content, %s)`)
+			if err != nil {
+				return err
+			}
+			th.metrics = append(th.metrics, field)
+			exprs = append(exprs, dbq.sb.As(value, fmt.Sprintf("hit_metric_%d", i)))
+		}
+	}
+
+	score := "NULL"
+	if th.scores {
+		score = "_score"
+	}
+	dbq.selectExprs = append([]string{
+		"_index",
+		"_id",
+		dbq.sb.As("JSON(content)", "_source"),
+		dbq.sb.As(score, "_score"),
+		dbq.sb.As("COUNT(*) OVER ()", topHitsTotalAlias),
+	}, exprs...)
+	return nil
+}
+
+// Dates are sorted by, and shown as, epoch millis
+func (dbq *dbSubQuery) topSortValue(key string) (string, error) {
+	if key == "_score" {
+		return "_score", nil
+	}
+	field := cleanseKeyField(key)
+	switch prop, _ := dbq.mapping.fieldType(field); prop.Type {
+	case "date", "date_nanos":
+		return dbq.dateMillis(field)
+	}
+	return dbq.fieldExpr(field, `JSON_EXTRACT(content, %s)`)
+}
+
+// The documents up to the last of the page, as a search sorts them. There is
+// always at least one row if there are any documents, for the total
+func (dbq *dbSubQuery) genTopHitsOrder(th *topHits) {
+	for _, s := range th.sorts {
+		if s.desc {
+			dbq.sb.OrderBy(s.alias + " DESC")
+		} else {
+			dbq.sb.OrderBy(s.alias + " ASC")
+		}
+	}
+	if len(th.sorts) == 0 {
+		dbq.sb.OrderBy("_score DESC")
+	}
+	dbq.sb.OrderBy("_index", "_rowid")
+	limit := th.from + th.size
+	if limit == 0 {
+		limit = 1
+	}
+	dbq.sb.Limit(limit)
+}
+
+// Each row of the page, with the total of any of them
+func (th *topHits) scanPage(rows *sqlx.Rows, fn func(dest map[string]interface{}) error) (int, error) {
+	total, n := 0, 0
+	for rows.Next() {
+		dest := make(map[string]interface{})
+		if err := rows.MapScan(dest); err != nil {
+			return 0, err
+		}
+		if t, ok := dest[topHitsTotalAlias].(int64); ok {
+			total = int(t)
+		}
+		n++
+		if n <= th.from || n > th.from+th.size {
+			continue
+		}
+		if err := fn(dest); err != nil {
+			return 0, err
+		}
+	}
+	return total, rows.Err()
+}
+
+func (th *topHits) sortValues(dest map[string]interface{}) []interface{} {
+	values := make([]interface{}, len(th.sorts))
+	for i, s := range th.sorts {
+		values[i] = dest[s.alias]
+	}
+	return values
+}
+
+func (m *TopHitsAggregation) SerializeResultset(rows *sqlx.Rows, dbq *dbSubQuery) error {
+	th := m.top
+	docs := make([]Document, 0, th.size)
+	total, err := th.scanPage(rows, func(dest map[string]interface{}) error {
+		doc := Document{}
+		doc.Index, _ = dest["_index"].(string)
+		doc.Id, _ = dest["_id"].(string)
+		if score, ok := termsKeyNumber(dest["_score"]); ok {
+			doc.Score = &score
+		}
+		if th.source == nil || !th.source.Disabled {
+			src, _ := dest["_source"].(string)
+			content, err := unMarshalDoc(src, dbq.source.mappings[doc.Index])
+			if err != nil {
+				return err
+			}
+			if th.source != nil {
+				content = filterSource(content, "", th.source.Includes, th.source.Excludes)
+			}
+			doc.Content = content
+		}
+		if len(th.sorts) > 0 {
+			doc.Sort = th.sortValues(dest)
+		}
+		docs = append(docs, doc)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	m.Hits = Hits{Total: total, MaxScore: maxScore(docs), Hits: docs}
+	return nil
+}
+
+func (m *TopMetricsAggregation) SerializeResultset(rows *sqlx.Rows, dbq *dbSubQuery) error {
+	th := m.top
+	m.Top = make([]TopMetric, 0, th.size)
+	_, err := th.scanPage(rows, func(dest map[string]interface{}) error {
+		top := TopMetric{Sort: th.sortValues(dest), Metrics: make(map[string]interface{}, len(th.metrics))}
+		for i, field := range th.metrics {
+			top.Metrics[field] = dest[fmt.Sprintf("hit_metric_%d", i)]
+		}
+		m.Top = append(m.Top, top)
+		return nil
+	})
+	return err
+}
+
+// The fields of a document matching any of the includes, if there are some, and
+// none of the excludes, by their paths
+func filterSource(doc map[string]interface{}, prefix string, includes, excludes []string) map[string]interface{} {
+	matches := func(patterns []string, path string) bool {
+		for _, p := range patterns {
+			if indexPatternMatch(p, path) {
+				return true
+			}
+		}
+		return false
+	}
+	filtered := make(map[string]interface{})
+	for k, v := range doc {
+		path := k
+		if prefix != "" {
+			path = prefix + "." + k
+		}
+		if matches(excludes, path) {
+			continue
+		}
+		obj, isObj := v.(map[string]interface{})
+		if len(includes) == 0 || matches(includes, path) {
+			if isObj && len(excludes) > 0 {
+				v = filterSource(obj, path, nil, excludes)
+			}
+			filtered[k] = v
+			continue
+		}
+		// What is included may be within it
+		if isObj {
+			if sub := filterSource(obj, path, includes, excludes); len(sub) > 0 {
+				filtered[k] = sub
+			}
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	require "github.com/alecthomas/assert/v2"
+)
+
+func TestTopHitsAggregations(t *testing.T) {
+	bulkRequest(t, "/tophitsaggs/_bulk", `
+{"index": {}}
+{"service": "api", "status": 500, "ts": "2022-11-01T10:00:00Z", "msg": "timeout", "user": {"name": "a", "ip": "10.0.0.1"}}
+{"index": {}}
+{"service": "api", "status": 200, "ts": "2022-11-01T11:00:00Z", "msg": "ok", "user": {"name": "b", "ip": "10.0.0.2"}}
+{"index": {}}
+{"service": "api", "status": 503, "ts": "2022-11-01T12:00:00Z", "msg": "unavailable", "user": {"name": "c", "ip": "10.0.0.3"}}
+{"index": {}}
+{"service": "web", "status": 500, "ts": "2022-11-01T09:00:00Z", "msg": "crash", "user": {"name": "d", "ip": "10.0.0.4"}}
+`)
+	search := func(body string) map[string]json.RawMessage {
+		t.Helper()
+		rec := doRequest(http.MethodPost, "/tophitsaggs/_search", body)
+		require.Equal(t, rec.Code, http.StatusOK, rec.Body.String())
+		var resp struct {
+			Aggregations map[string]json.RawMessage `json:"aggregations"`
+		}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		return resp.Aggregations
+	}
+	type topHitsResult struct {
+		Hits Hits `json:"hits"`
+	}
+
+	// The last error of each service
+	var services struct {
+		Buckets []struct {
+			Key  string        `json:"key"`
+			Last topHitsResult `json:"last"`
+		} `json:"buckets"`
+	}
+	aggs := search(`{"size": 0, "query": {"range": {"status": {"gte": 500}}}, "aggs": {"a": {"terms": {"field": "service"}, "aggs": {
+		"last": {"top_hits": {"size": 1, "sort": [{"ts": {"order": "desc"}}], "_source": {"includes": ["msg", "user.*"], "excludes": ["user.ip"]}}}}}}}`)
+	require.NoError(t, json.Unmarshal(aggs["a"], &services))
+	require.Equal(t, len(services.Buckets), 2)
+	api, web := services.Buckets[0].Last.Hits, services.Buckets[1].Last.Hits
+	require.Equal(t, api.Total, 2)
+	require.Equal(t, len(api.Hits), 1)
+	require.Equal(t, api.Hits[0].Index, "tophitsaggs")
+	require.Equal(t, api.Hits[0].Score, nil)
+	require.Equal(t, api.Hits[0].Content, map[string]interface{}{"msg": "unavailable", "user": map[string]interface{}{"name": "c"}})
+	require.Equal(t, api.Hits[0].Sort, []interface{}{"2022-11-01T12:00:00Z"})
+	require.Equal(t, web.Total, 1)
+	require.Equal(t, web.Hits[0].Content, map[string]interface{}{"msg": "crash", "user": map[string]interface{}{"name": "d"}})
+
+	// Pages of the top hits, by score, and without their source
+	var page topHitsResult
+	aggs = search(`{"size": 0, "aggs": {"a": {"top_hits": {"from": 1, "size": 2, "_source": false}}}}`)
+	require.NoError(t, json.Unmarshal(aggs["a"], &page))
+	require.Equal(t, page.Hits.Total, 4)
+	require.Equal(t, len(page.Hits.Hits), 2)
+	require.True(t, page.Hits.Hits[0].Score != nil)
+	require.Equal(t, page.Hits.Hits[0].Content, nil)
+	aggs = search(`{"size": 0, "aggs": {"a": {"top_hits": {"from": 10, "size": 2}}}}`)
+	require.NoError(t, json.Unmarshal(aggs["a"], &page))
+	require.Equal(t, page.Hits.Total, 4)
+	require.Equal(t, len(page.Hits.Hits), 0)
+
+	// The status of the latest request, and a pipeline over it
+	require.Equal(t, aggregationResult(t, "tophitsaggs", `{"a": {"terms": {"field": "service"}, "aggs": {
+		"tm": {"top_metrics": {"metrics": {"field": "status"}, "sort": {"ts": "desc"}}},
+		"class": {"bucket_script": {"buckets_path": {"s": "tm.status"}, "script": "params.s / 100"}}}}}`),
+		`{"doc_count_error_upper_bound":0,"sum_other_doc_count":0,"buckets":[`+
+			`{"key":"api","doc_count":3,"class":{"value":5.03},"tm":{"top":[{"sort":["2022-11-01T12:00:00Z"],"metrics":{"status":503}}]}},`+
+			`{"key":"web","doc_count":1,"class":{"value":5},"tm":{"top":[{"sort":["2022-11-01T09:00:00Z"],"metrics":{"status":500}}]}}]}`)
+	require.Equal(t, aggregationResult(t, "tophitsaggs", `{"a": {"top_metrics": {"metrics": [{"field": "status"}, {"field": "msg"}],
+		"sort": [{"status": "asc"}], "size": 2}}}`),
+		`{"top":[{"sort":[200],"metrics":{"msg":"ok","status":200}},{"sort":[500],"metrics":{"msg":"timeout","status":500}}]}`)
+
+	for _, aggs := range []string{
+		`{"a": {"top_hits": {"size": 101}}}`,
+		`{"a": {"top_hits": {"sort": [{"ts": "up"}]}}}`,
+		`{"a": {"top_hits": {}, "aggs": {"b": {"max": {"field": "status"}}}}}`,
+		`{"a": {"top_metrics": {"metrics": {"field": "status"}, "sort": ["ts", "status"]}}}`,
+		`{"a": {"top_metrics": {"metrics": {"field": "status"}, "sort": "ts", "size": 11}}}`,
+	} {
+		rec := doRequest(http.MethodPost, "/tophitsaggs/_search", `{"size": 0, "aggs": `+aggs+`}`)
+		require.Equal(t, rec.Code, http.StatusBadRequest, aggs)
+	}
+}
+
+func TestFilterSource(t *testing.T) {
+	doc := map[string]interface{}{
+		"msg":  "ok",
+		"user": map[string]interface{}{"name": "a", "ip": "10.0.0.1"},
+	}
+	require.Equal(t, filterSource(doc, "", []string{"user.name"}, nil),
+		map[string]interface{}{"user": map[string]interface{}{"name": "a"}})
+	require.Equal(t, filterSource(doc, "", nil, []string{"user"}),
+		map[string]interface{}{"msg": "ok"})
+	require.Equal(t, filterSource(doc, "", []string{"*"}, []string{"*.ip"}),
+		map[string]interface{}{"msg": "ok", "user": map[string]interface{}{"name": "a"}})
+}
@@ -1,7 +1,9 @@
 package server
 
 import (
+	"encoding/json"
 	"net/http"
+	"sync"
 
 	"github.com/atomic77/gopensearch/pkg/dsl"
 	"github.com/jmoiron/sqlx"
@@ -12,6 +14,10 @@ type Config struct {
 	ListenAddr string
 	Port       int
 	Debug      bool
+	// Number of bulk operations to write per transaction
+	BulkBatchSize int
+	// Largest request body accepted, in bytes
+	MaxContentLength int64
 }
 
 type Server struct {
@@ -19,16 +25,31 @@ type Server struct {
 	Router           http.Handler
 	Cfg              Config
 	TemplateMappings map[string]TemplateMapping
+	// Replaced as a whole by updates, and read through aliases()
+	Aliases aliasMap
+	aliasMu sync.RWMutex
 }
 
 type Document struct {
-	Id      int                    `json:"id"`
+	Index   string                 `json:"_index"`
+	Id      string                 `json:"_id"`
+	Score   *float64               `json:"_score"`
 	Content map[string]interface{} `json:"_source"`
+	// The values a hit was sorted by, for top hits
+	Sort []interface{} `json:"sort,omitempty"`
 }
 type Bucket struct {
-	KeyAsString   string `json:"key_as_string,omitempty"`
-	Key           string `json:"key"`
-	DocCount      int64  `json:"doc_count"`
+	KeyAsString string      `json:"key_as_string,omitempty"`
+	Key         interface{} `json:"key"`
+	// The bounds of range buckets
+	From         interface{} `json:"from,omitempty"`
+	FromAsString string      `json:"from_as_string,omitempty"`
+	To           interface{} `json:"to,omitempty"`
+	ToAsString   string      `json:"to_as_string,omitempty"`
+	DocCount     int64       `json:"doc_count"`
+	// Of significant terms
+	Score         *float64 `json:"score,omitempty"`
+	BgCount       *int64   `json:"bg_count,omitempty"`
 	subaggregates map[string]interface{}
 }
 
@@ -38,22 +59,36 @@ func makeBucket() Bucket {
 	return b
 }
 
-type BucketAggregation struct {
-	DocCountErrorUpperBound int      `json:"doc_count_error_upper_bound"`
-	Buckets                 []Bucket `json:"buckets"`
-}
-type MetricMultipleAggregation struct {
-	Values []float64 `json:"values"`
-}
-
 type IndexDocumentResponse struct {
 	// TODO Add shards:
 	// https://www.elastic.co/guide/en/elasticsearch/reference/current/docs-index_.html#create-document-ids-automatically
-	Index   string `json:"_index"`
-	Id      int    `json:"_id"`
-	Version int    `json:"_version"`
-	Result  string `json:"result"`
+	Index       string     `json:"_index"`
+	Type        string     `json:"_type"`
+	Id          string     `json:"_id"`
+	Version     int        `json:"_version"`
+	Result      string     `json:"result"`
+	Shards      ShardsInfo `json:"_shards"`
+	SeqNo       int64      `json:"_seq_no"`
+	PrimaryTerm int        `json:"_primary_term"`
+}
+
+// https://www.elastic.co/guide/en/elasticsearch/reference/7.17/docs-get.html
+type GetDocumentResponse struct {
+	Index       string                 `json:"_index"`
+	Type        string                 `json:"_type"`
+	Id          string                 `json:"_id"`
+	Version     int                    `json:"_version,omitempty"`
+	SeqNo       *int64                 `json:"_seq_no,omitempty"`
+	PrimaryTerm int                    `json:"_primary_term,omitempty"`
+	Found       bool                   `json:"found"`
+	Source      map[string]interface{} `json:"_source,omitempty"`
+}
+
+// Only aliases are interpreted from the create index body for now
+type CreateIndexRequest struct {
+	Aliases map[string]AliasProperties `json:"aliases"`
 }
+
 type CreateIndexResponse struct {
 	Acknowledged       bool   `json:"acknowledged"`
 	ShardsAcknowledged bool   `json:"shards_acknowledged"`
@@ -69,15 +104,19 @@ type SearchResponse struct {
 
 type Aggregation interface {
 	GetAggregateCategory() dsl.AggregationCategory
-	SerializeResultset(rows *sqlx.Rows, dbq *dbSubQuery)
+	SerializeResultset(rows *sqlx.Rows, dbq *dbSubQuery) error
 }
 
 type Hits struct {
-	Total int        `json:"total"`
-	Hits  []Document `json:"hits"`
+	Total    int        `json:"total"`
+	MaxScore *float64   `json:"max_score"`
+	Hits     []Document `json:"hits"`
 }
 type MetricSingleAggregation struct {
-	Value float64 `json:"value"`
+	// null when no document has a value for the field, as with ES
+	Value         *float64 `json:"value"`
+	ValueAsString string   `json:"value_as_string,omitempty"`
+	metric        *metric
 }
 type ShardsInfo struct {
 	Total      int `json:"total"`
@@ -96,23 +135,28 @@ type BulkResponse struct {
 	Items  []map[string]BulkResponseItem `json:"items"`
 }
 
-// Not fully implemented
 type BulkResponseItem struct {
-	Index       string     `json:"_index"`
-	Id          string     `json:"_id"`
-	Type        string     `json:"_type"`
-	Version     int        `json:"_version"`
-	Result      string     `json:"result"`
-	SeqNo       int        `json:"_seq_no"`
-	Status      int        `json:"status"`
-	PrimaryTerm int        `json:"_primary_term"`
-	Shards      ShardsInfo `json:"_shards"`
-	// Error       map[string]string `json:"error"`
+	Index       string         `json:"_index"`
+	Id          string         `json:"_id"`
+	Type        string         `json:"_type"`
+	Version     int            `json:"_version,omitempty"`
+	Result      string         `json:"result,omitempty"`
+	SeqNo       *int64         `json:"_seq_no,omitempty"`
+	Status      int            `json:"status"`
+	PrimaryTerm int            `json:"_primary_term,omitempty"`
+	Shards      *ShardsInfo    `json:"_shards,omitempty"`
+	Error       *BulkItemError `json:"error,omitempty"`
+}
+
+type BulkItemError struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+	Index  string `json:"index,omitempty"`
 }
 
 type MSearchHeader struct {
-	IgnoreUnavailable *bool   `json:"ignore_unavailable"`
-	Index             *string `json:"index"`
+	IgnoreUnavailable *bool      `json:"ignore_unavailable"`
+	Index             indexNames `json:"index"`
 
 	// Can't find any documentation about this, but appears to be supported by ES
 	// in use in the wild
@@ -127,3 +171,21 @@ type MSearchResponse struct {
 	Responses []*SearchResponse `json:"responses"`
 	// TODO More options to implement
 }
+
+// Index names can be given either as a single (possibly comma-separated) string
+// or as an array of strings
+type indexNames []string
+
+func (n *indexNames) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*n = indexNames{single}
+		return nil
+	}
+	var multi []string
+	if err := json.Unmarshal(b, &multi); err != nil {
+		return err
+	}
+	*n = multi
+	return nil
+}
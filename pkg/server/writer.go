@@ -0,0 +1,485 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Outcome of a write against a single document, as reported back to clients
+type IndexResult struct {
+	Id      string
+	Version int
+	SeqNo   int64
+	Result  string
+}
+
+// A document as retrieved by its id
+type StoredDocument struct {
+	Index   string
+	Id      string
+	Version int
+	SeqNo   int64
+	Content map[string]interface{}
+}
+
+const defaultBulkBatchSize = 1000
+
+// All document writes go through a docWriter, which runs them in a transaction
+// until it is flushed. Bulk requests apply batchSize operations per transaction.
+// Statements are prepared once per index and transaction, and template lookups
+// are cached for the lifetime of the writer, so that bulk ingestion doesn't pay
+// for either on every document. Single document apis just use a writer with a
+// batch size of 1.
+type docWriter struct {
+	s         *Server
+	tx        *sqlx.Tx
+	batchSize int
+	stmts     map[string]*indexStmts
+	templates map[string]*TemplateMapping
+	tables    map[string]interface{}
+	// Tables created in the current transaction
+	created []string
+}
+
+// Prepared statements for a single index within the current transaction
+type indexStmts struct {
+	lookup    *sqlx.Stmt
+	get       *sqlx.Stmt
+	insertDoc *sqlx.Stmt
+	deleteDoc *sqlx.Stmt
+	upsertId  *sqlx.Stmt
+	deleteId  *sqlx.Stmt
+}
+
+func (s *Server) newDocWriter(batchSize int) (*docWriter, error) {
+	if batchSize < 1 {
+		batchSize = defaultBulkBatchSize
+	}
+	tables, err := s.ListTables()
+	if err != nil {
+		return nil, err
+	}
+	return &docWriter{
+		s:         s,
+		batchSize: batchSize,
+		stmts:     make(map[string]*indexStmts),
+		templates: make(map[string]*TemplateMapping),
+		tables:    tables,
+	}, nil
+}
+
+func (dw *docWriter) begin() error {
+	if dw.tx != nil {
+		return nil
+	}
+	tx, err := dw.s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	dw.tx = tx
+	return nil
+}
+
+// Commit whatever is pending; the next operation will start a new transaction
+func (dw *docWriter) flush() error {
+	if dw.tx == nil {
+		return nil
+	}
+	dw.closeStmts()
+	err := dw.tx.Commit()
+	dw.tx = nil
+	if err != nil {
+		dw.forgetCreated()
+	}
+	dw.created = nil
+	return err
+}
+
+// Discard anything that hasn't been flushed yet
+func (dw *docWriter) rollback() {
+	if dw.tx == nil {
+		return
+	}
+	dw.closeStmts()
+	dw.tx.Rollback()
+	dw.tx = nil
+	dw.forgetCreated()
+	dw.created = nil
+}
+
+// Tables created in a transaction that wasn't committed no longer exist
+func (dw *docWriter) forgetCreated() {
+	for _, index := range dw.created {
+		delete(dw.tables, index)
+	}
+}
+
+func (dw *docWriter) closeStmts() {
+	for _, st := range dw.stmts {
+		for _, stmt := range []*sqlx.Stmt{st.lookup, st.get, st.insertDoc, st.deleteDoc, st.upsertId, st.deleteId} {
+			stmt.Close()
+		}
+	}
+	dw.stmts = make(map[string]*indexStmts)
+}
+
+// Run a single operation within the current batch. Each operation gets its own
+// savepoint so that a failure part way through doesn't leave a half-written
+// document behind in an otherwise successful batch
+func (dw *docWriter) run(op func() (*IndexResult, error)) (*IndexResult, error) {
+	if err := dw.begin(); err != nil {
+		return nil, err
+	}
+	if _, err := dw.tx.Exec("SAVEPOINT doc_op"); err != nil {
+		return nil, err
+	}
+	res, err := op()
+	if err != nil {
+		dw.tx.Exec("ROLLBACK TO doc_op")
+		dw.tx.Exec("RELEASE doc_op")
+		return nil, err
+	}
+	if _, err = dw.tx.Exec("RELEASE doc_op"); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (dw *docWriter) prepare(index string) (*indexStmts, error) {
+	if st, ok := dw.stmts[index]; ok {
+		return st, nil
+	}
+	if err := dw.begin(); err != nil {
+		return nil, err
+	}
+	queries := []string{
+		fmt.Sprintf(`SELECT doc_rowid, version FROM %s WHERE _id = ?`, quoteIdent(docIdTable(index))),
+		fmt.Sprintf(`SELECT i.doc_rowid, i.version, JSON(d.content) AS content FROM %s i JOIN %s d ON d.rowid = i.doc_rowid WHERE i._id = ?`,
+			quoteIdent(docIdTable(index)), quoteIdent(index)),
+		// Insert into fts5 index; rowid will be created automatically
+		fmt.Sprintf(`INSERT INTO %s (content, _id) VALUES (json(?), ?)`, quoteIdent(index)),
+		fmt.Sprintf(`DELETE FROM %s WHERE rowid = ?`, quoteIdent(index)),
+		fmt.Sprintf(`INSERT OR REPLACE INTO %s (_id, doc_rowid, version) VALUES (?, ?, ?)`, quoteIdent(docIdTable(index))),
+		fmt.Sprintf(`DELETE FROM %s WHERE _id = ?`, quoteIdent(docIdTable(index))),
+	}
+	prepared := make([]*sqlx.Stmt, 0, len(queries))
+	for _, q := range queries {
+		stmt, err := dw.tx.Preparex(q)
+		if err != nil {
+			for _, p := range prepared {
+				p.Close()
+			}
+			return nil, err
+		}
+		prepared = append(prepared, stmt)
+	}
+	st := &indexStmts{
+		lookup:    prepared[0],
+		get:       prepared[1],
+		insertDoc: prepared[2],
+		deleteDoc: prepared[3],
+		upsertId:  prepared[4],
+		deleteId:  prepared[5],
+	}
+	dw.stmts[index] = st
+	return st, nil
+}
+
+func (dw *docWriter) template(index string) *TemplateMapping {
+	tm, ok := dw.templates[index]
+	if !ok {
+		tm = dw.s.findMatchingTemplate(index)
+		dw.templates[index] = tm
+	}
+	return tm
+}
+
+// Create the index if we haven't seen it before
+func (dw *docWriter) ensureTable(index string) error {
+	if _, ok := dw.tables[index]; ok {
+		return nil
+	}
+	if err := dw.begin(); err != nil {
+		return err
+	}
+	if err := createTable(dw.tx, index); err != nil {
+		return err
+	}
+	dw.tables[index] = 42
+	dw.created = append(dw.created, index)
+	return nil
+}
+
+func (dw *docWriter) hasTable(index string) bool {
+	_, ok := dw.tables[index]
+	return ok
+}
+
+// Sources are json objects, as nothing else could be searched or returned as a
+// document
+func checkSource(doc string) error {
+	if !json.Valid([]byte(doc)) {
+		return &MapperParsingError{Err: errors.New("document source is not valid json")}
+	}
+	if !strings.HasPrefix(strings.TrimSpace(doc), "{") {
+		return &MapperParsingError{Err: errors.New("malformed content, must start with an object")}
+	}
+	return nil
+}
+
+// Index a document under the given id, replacing any existing document with the
+// same id unless onlyCreate is set, in which case a VersionConflictError is returned.
+// An empty id will have an ES-style one generated for it.
+func (dw *docWriter) index(doc string, index string, id string, onlyCreate bool) (*IndexResult, error) {
+	// Tables are created outside of the per-operation savepoint, so that they
+	// always exist once we've recorded them as existing
+	if err := dw.ensureTable(index); err != nil {
+		return nil, err
+	}
+	return dw.run(func() (*IndexResult, error) {
+		return dw.indexOp(doc, index, id, onlyCreate)
+	})
+}
+
+func (dw *docWriter) indexOp(doc string, index string, id string, onlyCreate bool) (*IndexResult, error) {
+	if err := checkSource(doc); err != nil {
+		return nil, err
+	}
+	var err error
+	d := &doc
+	if tm := dw.template(index); tm != nil {
+		d, err = templateMapDoc(doc, tm)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// How to index specific json columns in sqlite:
+	// https://dgl.cx/2020/06/sqlite-json-support
+	// https://www.sqlite.org/gencol.html  <- as of 3.31
+	// Need to figure out best way to provide mapping between indexing features of ES and how we'd add
+	// columns on the fly to ensure fast performance without bloating the size of the resulting file
+
+	st, err := dw.prepare(index)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &IndexResult{Id: id, Version: 1, Result: "created"}
+	if id == "" {
+		res.Id = generateDocId()
+	} else {
+		var prev docIdRow
+		err = st.lookup.Get(&prev, id)
+		if err == nil {
+			if onlyCreate {
+				return nil, &VersionConflictError{Index: index, Id: id}
+			}
+			// fts5 tables can't be updated in place in any useful way, so the previous
+			// version is removed and a new row inserted in its place
+			if _, err = st.deleteDoc.Exec(prev.Rowid); err != nil {
+				return nil, err
+			}
+			res.Version = prev.Version + 1
+			res.Result = "updated"
+		} else if err != sql.ErrNoRows {
+			return nil, err
+		}
+	}
+
+	r, err := st.insertDoc.Exec(*d, res.Id)
+	if err != nil {
+		return nil, err
+	}
+	if res.SeqNo, err = r.LastInsertId(); err != nil {
+		return nil, err
+	}
+	if _, err = st.upsertId.Exec(res.Id, res.SeqNo, res.Version); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Fetch a single document by id, returning nil if it (or its index) doesn't exist
+func (dw *docWriter) get(index string, id string) (*StoredDocument, error) {
+	if !dw.hasTable(index) {
+		return nil, nil
+	}
+	st, err := dw.prepare(index)
+	if err != nil {
+		return nil, err
+	}
+	var row struct {
+		docIdRow
+		Content string `db:"content"`
+	}
+	err = st.get.Get(&row, id)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := unMarshalDoc(row.Content, dw.template(index))
+	if err != nil {
+		return nil, err
+	}
+	return &StoredDocument{
+		Index:   index,
+		Id:      id,
+		Version: row.Version,
+		SeqNo:   row.Rowid,
+		Content: content,
+	}, nil
+}
+
+// Delete a single document by id; the result will be "not_found" if there was
+// nothing to delete
+func (dw *docWriter) delete(index string, id string) (*IndexResult, error) {
+	return dw.run(func() (*IndexResult, error) {
+		if !dw.hasTable(index) {
+			return &IndexResult{Id: id, Version: 1, Result: "not_found"}, nil
+		}
+		st, err := dw.prepare(index)
+		if err != nil {
+			return nil, err
+		}
+		var prev docIdRow
+		err = st.lookup.Get(&prev, id)
+		if err == sql.ErrNoRows {
+			return &IndexResult{Id: id, Version: 1, Result: "not_found"}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if _, err = st.deleteDoc.Exec(prev.Rowid); err != nil {
+			return nil, err
+		}
+		if _, err = st.deleteId.Exec(id); err != nil {
+			return nil, err
+		}
+		return &IndexResult{Id: id, Version: prev.Version + 1, SeqNo: prev.Rowid, Result: "deleted"}, nil
+	})
+}
+
+// Apply a partial document to an existing one, recursively merging objects in
+// the same way as ES. If the document doesn't exist, it is created from the upsert
+// document if one is provided (or the partial document itself with docAsUpsert),
+// otherwise a DocumentMissingError is returned
+func (dw *docWriter) update(index string, id string, partial map[string]interface{}, upsert map[string]interface{}, docAsUpsert bool) (*IndexResult, error) {
+	if err := dw.ensureTable(index); err != nil {
+		return nil, err
+	}
+	return dw.run(func() (*IndexResult, error) {
+		existing, err := dw.get(index, id)
+		if err != nil {
+			return nil, err
+		}
+
+		var newDoc map[string]interface{}
+		if existing == nil {
+			switch {
+			case upsert != nil:
+				newDoc = upsert
+			case docAsUpsert:
+				newDoc = partial
+			default:
+				return nil, &DocumentMissingError{Index: index, Id: id}
+			}
+		} else {
+			newDoc = existing.Content
+			if !mergeDocs(newDoc, partial) {
+				return &IndexResult{Id: id, Version: existing.Version, SeqNo: existing.SeqNo, Result: "noop"}, nil
+			}
+		}
+
+		b, err := json.Marshal(newDoc)
+		if err != nil {
+			return nil, err
+		}
+		return dw.indexOp(string(b), index, id, false)
+	})
+}
+
+// Recursively merge src into dst, returning whether anything changed
+func mergeDocs(dst, src map[string]interface{}) bool {
+	changed := false
+	for k, v := range src {
+		srcObj, srcIsObj := v.(map[string]interface{})
+		dstObj, dstIsObj := dst[k].(map[string]interface{})
+		if srcIsObj && dstIsObj {
+			if mergeDocs(dstObj, srcObj) {
+				changed = true
+			}
+			continue
+		}
+		if cur, ok := dst[k]; !ok || !reflect.DeepEqual(normalizeJson(cur), normalizeJson(v)) {
+			dst[k] = v
+			changed = true
+		}
+	}
+	return changed
+}
+
+// Values that came from different sources (eg. date conversion vs. json decoding)
+// may have different go types for the same json, so compare them via their encoding
+func normalizeJson(v interface{}) interface{} {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	var n interface{}
+	if err = json.Unmarshal(b, &n); err != nil {
+		return v
+	}
+	return n
+}
+
+// Single document operations, each in their own transaction
+
+func (s *Server) IndexDocument(doc string, index string, id string, onlyCreate bool) (*IndexResult, error) {
+	return s.withDocWriter(func(dw *docWriter) (*IndexResult, error) {
+		return dw.index(doc, index, id, onlyCreate)
+	})
+}
+
+func (s *Server) DeleteDocument(index string, id string) (*IndexResult, error) {
+	return s.withDocWriter(func(dw *docWriter) (*IndexResult, error) {
+		return dw.delete(index, id)
+	})
+}
+
+func (s *Server) UpdateDocument(index string, id string, partial map[string]interface{}, upsert map[string]interface{}, docAsUpsert bool) (*IndexResult, error) {
+	return s.withDocWriter(func(dw *docWriter) (*IndexResult, error) {
+		return dw.update(index, id, partial, upsert, docAsUpsert)
+	})
+}
+
+func (s *Server) GetDocument(index string, id string) (*StoredDocument, error) {
+	dw, err := s.newDocWriter(1)
+	if err != nil {
+		return nil, err
+	}
+	defer dw.rollback()
+	return dw.get(index, id)
+}
+
+func (s *Server) withDocWriter(op func(dw *docWriter) (*IndexResult, error)) (*IndexResult, error) {
+	dw, err := s.newDocWriter(1)
+	if err != nil {
+		return nil, err
+	}
+	res, err := op(dw)
+	if err != nil {
+		dw.rollback()
+		return nil, err
+	}
+	return res, dw.flush()
+}